@@ -0,0 +1,130 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+)
+
+const (
+	ApiUrlAdminExpiringCerts = "/api/admin/v1/certificates/expiring"
+	ApiUrlAdminCASign        = "/api/admin/v1/ca/sign"
+	ApiUrlAdminCACerts       = "/api/admin/v1/ca/certificates"
+	ApiUrlAdminCARevoke      = "/api/admin/v1/ca/certificates/:serial/revoke"
+	ApiUrlMetrics            = "/metrics"
+
+	ContentTypePEM = "application/x-pem-file"
+)
+
+var (
+	ErrAdminTokenRequired = errors.New("the admin API's CA endpoints need a token")
+)
+
+// AdminConfig configures the operator facing admin API
+type AdminConfig struct {
+	// Token, if set, is required as a bearer token on every request;
+	// it must be set with the CA endpoints
+	Token string
+
+	// CertExpiryWarning is the default 'within' of the expiring certs listing
+	CertExpiryWarning time.Duration
+
+	// Issuer, if set, enables the cert issuance endpoint
+	Issuer issuer.Issuer
+
+	// CAStore, if set, enables listing and revoking the internal CA's certs
+	CAStore *ca.Store
+}
+
+// AdminController serves the client cert tracking state to operators
+type AdminController struct {
+	tracker *app.CertTracker
+	warning time.Duration
+}
+
+func NewAdminController(tracker *app.CertTracker, warning time.Duration) *AdminController {
+	return &AdminController{
+		tracker: tracker,
+		warning: warning,
+	}
+}
+
+// GetExpiringCerts lists the client certs seen recently which expire
+// within the 'within' query param (a Go duration, e.g. 168h)
+func (ac *AdminController) GetExpiringCerts(c *gin.Context) {
+	within := ac.warning
+	if w := c.Query("within"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid 'within' duration",
+			})
+			return
+		}
+		within = d
+	}
+
+	c.JSON(http.StatusOK, ac.tracker.Expiring(within, time.Now()))
+}
+
+// NewAdminRouter creates the admin API router, to be served on
+// a separate, operator-only listener
+func NewAdminRouter(tracker *app.CertTracker, config AdminConfig) (*gin.Engine, error) {
+	if config.Token == "" && (config.Issuer != nil || config.CAStore != nil) {
+		return nil, ErrAdminTokenRequired
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	gin.DisableConsoleColor()
+
+	l := log.NewEmpty()
+
+	router := gin.New()
+
+	router.Use(routerLogger(l))
+	router.Use(gin.Recovery())
+	if config.Token != "" {
+		router.Use(bearerAuth(config.Token))
+	}
+
+	admin := NewAdminController(tracker, config.CertExpiryWarning)
+	router.GET(ApiUrlAdminExpiringCerts, admin.GetExpiringCerts)
+	router.GET(ApiUrlMetrics, gin.WrapH(promhttp.Handler()))
+
+	cac := NewCAController(config.Issuer, config.CAStore)
+	if config.Issuer != nil {
+		router.POST(ApiUrlAdminCASign, cac.Sign)
+	}
+	if config.CAStore != nil {
+		router.GET(ApiUrlAdminCACerts, cac.ListCerts)
+		router.POST(ApiUrlAdminCARevoke, cac.Revoke)
+	}
+
+	return router, nil
+}
+
+func bearerAuth(token string) gin.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		got := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
+)
+
+func TestAdminExpiringCerts(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tracker := app.NewCertTracker(10)
+	for i, d := range []time.Duration{time.Hour, 24 * time.Hour, 1000 * time.Hour} {
+		tracker.Observe(&x509.Certificate{
+			Raw:          []byte{byte(i)},
+			SerialNumber: big.NewInt(int64(i)),
+			NotAfter:     now.Add(d),
+		}, "10.0.0.1:1000", now)
+	}
+
+	router, err := NewAdminRouter(tracker, AdminConfig{
+		Token:             "secret",
+		CertExpiryWarning: 48 * time.Hour,
+	})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+
+		url   string
+		token string
+
+		outStatus int
+		outCerts  int
+	}{
+		{
+			name:      "ok, default warning",
+			url:       ApiUrlAdminExpiringCerts,
+			token:     "secret",
+			outStatus: http.StatusOK,
+			outCerts:  2,
+		},
+		{
+			name:      "ok, within",
+			url:       ApiUrlAdminExpiringCerts + "?within=2h",
+			token:     "secret",
+			outStatus: http.StatusOK,
+			outCerts:  1,
+		},
+		{
+			name:      "error, bad within",
+			url:       ApiUrlAdminExpiringCerts + "?within=2days",
+			token:     "secret",
+			outStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "error, bad token",
+			url:       ApiUrlAdminExpiringCerts,
+			token:     "guess",
+			outStatus: http.StatusUnauthorized,
+		},
+		{
+			name:      "ok, metrics",
+			url:       ApiUrlMetrics,
+			token:     "secret",
+			outStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.outStatus, w.Code)
+			if tc.outStatus != http.StatusOK {
+				return
+			}
+
+			if tc.url == ApiUrlMetrics {
+				assert.True(t, strings.Contains(w.Body.String(),
+					"mtls_client_cert_remaining_lifetime_seconds_count"))
+				return
+			}
+
+			var certs []app.TrackedCert
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &certs))
+			assert.Len(t, certs, tc.outCerts)
+		})
+	}
+}
+
+func TestCertExpiryHeader(t *testing.T) {
+	t.Parallel()
+
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	cases := []struct {
+		name string
+
+		config *RouterConfig
+
+		outHeader string
+	}{
+		{
+			name:   "disabled",
+			config: nil,
+		},
+		{
+			name: "not expiring yet",
+			config: &RouterConfig{
+				CertExpiryHeader:  true,
+				CertExpiryWarning: time.Hour,
+			},
+		},
+		{
+			name: "expiring",
+			config: &RouterConfig{
+				CertExpiryHeader:  true,
+				CertExpiryWarning: 48 * time.Hour,
+			},
+			outHeader: notAfter.Format(time.RFC3339),
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := &mockProxy{
+				url:    "/api/devices/v1/inventory/device/attributes",
+				body:   []byte{},
+				status: http.StatusOK,
+				t:      t,
+			}
+			router, err := NewRouter(nil, proxy, tc.config)
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, proxy.url, nil)
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{NotAfter: notAfter}},
+			}
+			router.ServeHTTP(w, req)
+
+			assert.True(t, proxy.called)
+			assert.Equal(t, tc.outHeader, w.Header().Get(HdrClientCertExpires))
+		})
+	}
+}
+
+func TestAdminRouterNeedsTokenForCA(t *testing.T) {
+	t.Parallel()
+
+	caCert, caKey := newTestCA(t, "Issuing CA")
+	issuer, err := ca.New(caCert, caKey)
+	assert.NoError(t, err)
+
+	_, err = NewAdminRouter(app.NewCertTracker(10), AdminConfig{})
+	assert.NoError(t, err)
+
+	_, err = NewAdminRouter(app.NewCertTracker(10), AdminConfig{Issuer: issuer})
+	assert.Equal(t, ErrAdminTokenRequired, err)
+
+	_, err = NewAdminRouter(app.NewCertTracker(10), AdminConfig{Token: "secret", Issuer: issuer})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mtls-ambassador/artifacts"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
+)
+
+const (
+	// UrlDeploymentsNext tells a device its next deployment, with the artifact's download
+	// link; v2 is the same, POSTed with the device's details
+	UrlDeploymentsNext   = "/api/devices/v1/deployments/device/deployments/next"
+	UrlDeploymentsNextV2 = "/api/devices/v2/deployments/device/deployments/next"
+
+	// maxNextSize bounds the next responses inspected for download links
+	maxNextSize = 1024 * 1024
+	// maxArtifactLinks bounds the download links remembered
+	maxArtifactLinks = 100000
+	// artifactLinkTTL is the lifetime of links without an expiry
+	artifactLinkTTL = 24 * time.Hour
+)
+
+// deploymentNext is the part of a next response naming the artifact
+type deploymentNext struct {
+	Artifact struct {
+		ID     string `json:"id"`
+		Source struct {
+			URI    string    `json:"uri"`
+			Expire time.Time `json:"expire"`
+		} `json:"source"`
+	} `json:"artifact"`
+}
+
+// parseDeploymentNext parses a successful next response, keeping its
+// body; the body, decompressed if needed, is returned too
+func parseDeploymentNext(rsp *http.Response) ([]byte, *deploymentNext, bool) {
+	path := rsp.Request.URL.Path
+	if path != UrlDeploymentsNext && path != UrlDeploymentsNextV2 || rsp.StatusCode != http.StatusOK {
+		return nil, nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxNextSize+1))
+	rsp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rsp.Body), rsp.Body}
+	if err != nil || len(body) > maxNextSize {
+		return nil, nil, false
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	if rsp.Header.Get("Content-Encoding") == "gzip" {
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, nil, false
+		}
+	}
+
+	if body, err = ioutil.ReadAll(r); err != nil {
+		return nil, nil, false
+	}
+
+	var next deploymentNext
+	if err := json.Unmarshal(body, &next); err != nil ||
+		next.Artifact.ID == "" || next.Artifact.Source.URI == "" {
+		return nil, nil, false
+	}
+	return body, &next, true
+}
+
+// artifactLinks are the download links of the artifacts in next responses,
+// by their path and query - the host is whatever routes them to the Ambassador
+type artifactLinks struct {
+	mu    sync.Mutex
+	links map[string]artifactLink
+}
+
+type artifactLink struct {
+	id     string
+	expire time.Time
+}
+
+func newArtifactLinks() *artifactLinks {
+	return &artifactLinks{links: map[string]artifactLink{}}
+}
+
+func (a *artifactLinks) add(uri, id string, expire time.Time) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if expire.IsZero() {
+		expire = now.Add(artifactLinkTTL)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.links) >= maxArtifactLinks {
+		for k, link := range a.links {
+			if now.After(link.expire) {
+				delete(a.links, k)
+			}
+		}
+	}
+	if len(a.links) >= maxArtifactLinks {
+		l.Warnf("too many artifact links, not caching %s", id)
+		return
+	}
+	a.links[u.RequestURI()] = artifactLink{id: id, expire: expire}
+}
+
+// lookup returns the ID of the artifact the request downloads, if any
+func (a *artifactLinks) lookup(u *url.URL) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	link, ok := a.links[u.RequestURI()]
+	if !ok || time.Now().After(link.expire) {
+		return "", false
+	}
+	return link.id, true
+}
+
+// SetArtifactCache caches the artifacts downloaded through the proxy, i.e. those
+// whose download links (of next responses) point at the Ambassador; call it before serving
+func (p *proxy) SetArtifactCache(cache *artifacts.Cache) {
+	p.artifacts = cache
+	p.links = newArtifactLinks()
+	p.proxy.ModifyResponse = p.modifyResponse
+}
+
+// SetArtifactDownloads rewrites the download links of next responses to
+// the Ambassador, for devices with a client cert; call it before serving
+func (p *proxy) SetArtifactDownloads(d *ArtifactDownloads) {
+	p.downloads = d
+	p.proxy.ModifyResponse = p.modifyResponse
+}
+
+// modifyResponse rewrites or records the download links of next responses
+func (p *proxy) modifyResponse(rsp *http.Response) error {
+	body, next, ok := parseDeploymentNext(rsp)
+	if !ok {
+		return nil
+	}
+
+	if tls := rsp.Request.TLS; p.downloads != nil && tls != nil && len(tls.PeerCertificates) > 0 {
+		p.downloads.rewrite(rsp, body, next, tls.PeerCertificates[0])
+		return nil
+	}
+	if p.links != nil {
+		p.links.add(next.Artifact.Source.URI, next.Artifact.ID, next.Artifact.Source.Expire)
+	}
+	return nil
+}
+
+// ServesArtifact tells if the request downloads a cached artifact, whose
+// link needn't be in the device API
+func (p *proxy) ServesArtifact(r *http.Request) bool {
+	_, ok := p.artifactID(r)
+	return ok
+}
+
+// artifactID returns the ID of the cached artifact the request downloads, if any
+func (p *proxy) artifactID(r *http.Request) (string, bool) {
+	if p.artifacts == nil || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	return p.links.lookup(r.URL)
+}
+
+// serveArtifact serves a download from the cache, filled from Mender
+func (p *proxy) serveArtifact(w http.ResponseWriter, r *http.Request, id string) {
+	target := *p.backend
+	target.Path = r.URL.Path
+	target.RawPath = r.URL.RawPath
+	target.RawQuery = r.URL.RawQuery
+
+	// the fill outlives the request which started it
+	ctx := upstream.WithKey(context.Background(), upstream.KeyFromContext(r.Context()))
+	host := r.Host
+
+	p.artifacts.Serve(w, r, id, func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Host = host
+		return p.proxy.Transport.RoundTrip(req)
+	})
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/artifacts"
+)
+
+func TestProxyArtifactCache(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("artifact"), 1000)
+	var downloads int32
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case UrlDeploymentsNext, UrlDeploymentsNextV2:
+			next := fmt.Sprintf(`{"id":"d1","artifact":{"id":"a1","artifact_name":"release-1",`+
+				`"source":{"uri":"https://s3.example.com/download/a1?sig=%s","expire":"%s"}}}`,
+				r.URL.Query().Get("sig"), time.Now().Add(time.Hour).Format(time.RFC3339))
+			if r.Header.Get("Accept-Encoding") == "gzip" {
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				_, _ = gz.Write([]byte(next))
+				gz.Close()
+				return
+			}
+			_, _ = w.Write([]byte(next))
+		case "/download/a1":
+			atomic.AddInt32(&downloads, 1)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cache, err := artifacts.NewCache(dir, 1024*1024, 0)
+	assert.NoError(t, err)
+
+	p, err := NewProxy(backend.URL, false)
+	assert.NoError(t, err)
+	p.SetArtifactCache(cache)
+
+	router, err := NewRouter(nil, p, nil)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	do := func(method, path string, hdr http.Header) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, srv.URL+path, nil)
+		assert.NoError(t, err)
+		for k, v := range hdr {
+			r.Header[k] = v
+		}
+		rsp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		defer rsp.Body.Close()
+
+		w := httptest.NewRecorder()
+		for k, v := range rsp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(w, rsp.Body)
+		return w
+	}
+
+	// not announced by a next response, nor in the device API: not found
+	w := do(http.MethodGet, "/download/a1?sig=1", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&downloads))
+
+	// plain and gzipped next responses reach the device intact
+	w = do(http.MethodGet, UrlDeploymentsNext+"?sig=1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"a1"`)
+	w = do(http.MethodPost, UrlDeploymentsNextV2+"?sig=2",
+		http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	next, _ := ioutil.ReadAll(gz)
+	assert.Contains(t, string(next), `"id":"a1"`)
+
+	// both links lead to the one cached artifact
+	for _, sig := range []string{"1", "2", "1"} {
+		w = do(http.MethodGet, "/download/a1?sig="+sig, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, data, w.Body.Bytes())
+		assert.NotEmpty(t, w.Header().Get("ETag"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+
+	w = do(http.MethodGet, "/download/a1?sig=2",
+		http.Header{"Range": {"bytes=8-15"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "artifact", w.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+
+	w = do(http.MethodHead, "/download/a1?sig=1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+}
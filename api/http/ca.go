@@ -0,0 +1,101 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+)
+
+// CAController exposes cert issuance, and the internal CA's records, to operators
+type CAController struct {
+	issuer issuer.Issuer
+	store  *ca.Store
+}
+
+// NewCAController creates the controller; store is optional and
+// only needed for listing and revocation
+func NewCAController(iss issuer.Issuer, store *ca.Store) *CAController {
+	return &CAController{
+		issuer: iss,
+		store:  store,
+	}
+}
+
+// Sign issues a cert for a PEM encoded CSR, returned as PEM
+func (cc *CAController) Sign(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request"})
+		return
+	}
+
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expected a PEM encoded CERTIFICATE REQUEST"})
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to parse CSR: " + err.Error()})
+		return
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidCSR.Error()})
+		return
+	}
+
+	cert, err := cc.issuer.Issue(c.Request.Context(), csr)
+	if err != nil {
+		l.Errorf("CA: issuing certificate failed: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	l.Infof("CA: issued certificate %s for %q, valid until %s",
+		cert.SerialNumber, cert.Subject, cert.NotAfter.UTC())
+
+	c.Data(http.StatusOK, ContentTypePEM,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// ListCerts lists the issued certs, oldest first
+func (cc *CAController) ListCerts(c *gin.Context) {
+	certs, err := cc.store.List()
+	if err != nil {
+		l.Errorf("CA: listing certificates failed: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, certs)
+}
+
+// Revoke revokes an issued cert by its decimal serial number
+func (cc *CAController) Revoke(c *gin.Context) {
+	serial := c.Param("serial")
+
+	err := cc.store.Revoke(serial, time.Now())
+	switch err {
+	case nil:
+		l.Infof("CA: revoked certificate %s", serial)
+		c.Status(http.StatusNoContent)
+	case ca.ErrCertNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case ca.ErrAlreadyRevoked:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		l.Errorf("CA: revoking certificate %s failed: %s", serial, err)
+		c.Status(http.StatusInternalServerError)
+	}
+}
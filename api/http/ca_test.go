@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
+)
+
+func TestAdminCA(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ca")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caCert, caKey := newTestCA(t, "Issuing CA")
+	issuer, err := ca.New(caCert, caKey)
+	assert.NoError(t, err)
+	issuer.Profile = &ca.Profile{
+		Validity: time.Hour,
+		URIs:     []string{"urn:dev:{{.CommonName}}"},
+	}
+	issuer.Store, err = ca.OpenStore(filepath.Join(dir, "issued.json"))
+	assert.NoError(t, err)
+
+	router, err := NewAdminRouter(app.NewCertTracker(10), AdminConfig{
+		Token:   "secret",
+		Issuer:  issuer,
+		CAStore: issuer.Store,
+	})
+	assert.NoError(t, err)
+
+	do := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	devKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	csr := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: newTestCSR(t, devKey, "device-1"),
+	})
+
+	// sign
+	w := do(http.MethodPost, ApiUrlAdminCASign, []byte("garbage"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(http.MethodPost, ApiUrlAdminCASign, csr)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ContentTypePEM, w.Header().Get("Content-Type"))
+
+	block, _ := pem.Decode(w.Body.Bytes())
+	assert.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, "device-1", cert.Subject.CommonName)
+	assert.Equal(t, "urn:dev:device-1", cert.URIs[0].String())
+
+	// list
+	w = do(http.MethodGet, ApiUrlAdminCACerts, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var issued []ca.IssuedCert
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &issued))
+	assert.Len(t, issued, 1)
+	assert.Equal(t, cert.SerialNumber.String(), issued[0].Serial)
+	assert.Nil(t, issued[0].RevokedAt)
+
+	// revoke
+	revoke := ApiUrlAdminCACerts + "/" + cert.SerialNumber.String() + "/revoke"
+	w = do(http.MethodPost, revoke, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.True(t, issuer.IsRevoked(cert))
+
+	w = do(http.MethodPost, revoke, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = do(http.MethodPost, ApiUrlAdminCACerts+"/1/revoke", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// HdrClientCertExpires tells the device when its client cert expires (RFC 3339),
+	// so that it can renew it in time
+	HdrClientCertExpires = "X-MEN-Client-Cert-Expires"
+)
+
+// certExpiryHeader sets HdrClientCertExpires if the client's leaf cert
+// expires within the warning period
+func certExpiryHeader(warning time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+			notAfter := c.Request.TLS.PeerCertificates[0].NotAfter
+			if time.Until(notAfter) < warning {
+				c.Header(HdrClientCertExpires, notAfter.UTC().Format(time.RFC3339))
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+)
+
+// CertHeaders name the headers passing the client cert's identity to Mender
+// on proxied requests; empty names aren't sent
+type CertHeaders struct {
+	// Fingerprint is the hex SHA-256 of the cert
+	Fingerprint string
+	// Subject and Issuer are the RFC 2253 distinguished names
+	Subject string
+	Issuer  string
+	// Serial is the decimal serial number
+	Serial string
+	// SANURIs has a value per URI SAN
+	SANURIs string
+	// XFCC is an Envoy style X-Forwarded-Client-Cert summary, with the
+	// fingerprint (Hash), subject and URI SANs
+	XFCC string
+}
+
+func (h CertHeaders) names() []string {
+	names := []string{}
+	for _, n := range []string{h.Fingerprint, h.Subject, h.Issuer, h.Serial, h.SANURIs, h.XFCC} {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// Enabled tells if any header is named
+func (h CertHeaders) Enabled() bool {
+	return len(h.names()) > 0
+}
+
+// Validate checks that the names are valid header names, used once each
+func (h CertHeaders) Validate() error {
+	seen := map[string]bool{}
+	for _, n := range h.names() {
+		if !validHeaderName(n) {
+			return errors.Errorf("invalid header name %q", n)
+		}
+		n = http.CanonicalHeaderKey(n)
+		if seen[n] {
+			return errors.Errorf("header %s named more than once", n)
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
+// validHeaderName tells if the name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// certIdentityHeaders replaces the named headers sent by the device
+// with the identity of its verified client cert
+func certIdentityHeaders(h CertHeaders) gin.HandlerFunc {
+	names := h.names()
+	return func(c *gin.Context) {
+		hdr := c.Request.Header
+		for _, n := range names {
+			hdr.Del(n)
+		}
+
+		if c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) > 0 {
+			cert := c.Request.TLS.PeerCertificates[0]
+			setCertHeader(c, h.Fingerprint, app.CertFingerprint(cert))
+			setCertHeader(c, h.Subject, cert.Subject.String())
+			setCertHeader(c, h.Issuer, cert.Issuer.String())
+			setCertHeader(c, h.Serial, cert.SerialNumber.String())
+			if h.SANURIs != "" {
+				for _, u := range cert.URIs {
+					setCertHeader(c, h.SANURIs, u.String())
+				}
+			}
+			setCertHeader(c, h.XFCC, xfcc(cert))
+		}
+		c.Next()
+	}
+}
+
+// setCertHeader adds the header, unless unnamed or its value would be
+// invalid (control characters in a cert's fields)
+func setCertHeader(c *gin.Context, name, value string) {
+	if name == "" {
+		return
+	}
+	for i := 0; i < len(value); i++ {
+		if b := value[i]; b < ' ' && b != '\t' || b == 0x7f {
+			log.FromContext(c.Request.Context()).Warnf("not sending %s: invalid value", name)
+			return
+		}
+	}
+	c.Request.Header.Add(name, value)
+}
+
+// xfcc summarizes the cert as an Envoy X-Forwarded-Client-Cert element
+func xfcc(cert *x509.Certificate) string {
+	parts := []string{
+		"Hash=" + app.CertFingerprint(cert),
+		"Subject=" + xfccQuote(cert.Subject.String()),
+	}
+	for _, u := range cert.URIs {
+		parts = append(parts, "URI="+xfccValue(u.String()))
+	}
+	return strings.Join(parts, ";")
+}
+
+// xfccValue quotes values with XFCC's separators
+func xfccValue(v string) string {
+	if strings.ContainsAny(v, `,;="`) {
+		return xfccQuote(v)
+	}
+	return v
+}
+
+func xfccQuote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+)
+
+func TestCertIdentityHeaders(t *testing.T) {
+	t.Parallel()
+
+	cert := &x509.Certificate{
+		Raw:          []byte("device cert"),
+		Subject:      pkix.Name{CommonName: "device-1", Organization: []string{"Acme, Inc."}},
+		Issuer:       pkix.Name{CommonName: "Acme CA"},
+		SerialNumber: big.NewInt(4242),
+		URIs:         []*url.URL{{Scheme: "urn", Opaque: "device:1"}},
+	}
+	fp := app.CertFingerprint(cert)
+
+	headers := CertHeaders{
+		Fingerprint: "X-Client-Cert-Fingerprint",
+		Subject:     "X-Client-Cert-Subject",
+		Issuer:      "X-Client-Cert-Issuer",
+		Serial:      "X-Client-Cert-Serial",
+		SANURIs:     "X-Client-Cert-Uri",
+		XFCC:        "X-Forwarded-Client-Cert",
+	}
+
+	cases := []struct {
+		name string
+
+		headers CertHeaders
+		cert    *x509.Certificate
+		inHdr   map[string]string
+
+		outHdr map[string]string
+	}{
+		{
+			name: "disabled: device's headers kept",
+
+			cert:  cert,
+			inHdr: map[string]string{"X-Client-Cert-Fingerprint": "forged"},
+
+			outHdr: map[string]string{"X-Client-Cert-Fingerprint": "forged"},
+		},
+		{
+			name: "ok",
+
+			headers: headers,
+			cert:    cert,
+			inHdr: map[string]string{
+				"X-Client-Cert-Fingerprint": "forged",
+				"X-Forwarded-Client-Cert":   "Hash=forged",
+			},
+
+			outHdr: map[string]string{
+				"X-Client-Cert-Fingerprint": fp,
+				"X-Client-Cert-Subject":     `CN=device-1,O=Acme\, Inc.`,
+				"X-Client-Cert-Issuer":      "CN=Acme CA",
+				"X-Client-Cert-Serial":      "4242",
+				"X-Client-Cert-Uri":         "urn:device:1",
+				"X-Forwarded-Client-Cert":   `Hash=` + fp + `;Subject="CN=device-1,O=Acme\\, Inc.";URI=urn:device:1`,
+			},
+		},
+		{
+			name: "ok, some headers",
+
+			headers: CertHeaders{Serial: "X-Client-Cert-Serial"},
+			cert:    cert,
+			inHdr:   map[string]string{"X-Client-Cert-Fingerprint": "other"},
+
+			outHdr: map[string]string{
+				"X-Client-Cert-Fingerprint": "other",
+				"X-Client-Cert-Serial":      "4242",
+			},
+		},
+		{
+			name: "no cert: device's headers dropped",
+
+			headers: headers,
+			inHdr: map[string]string{
+				"X-Client-Cert-Fingerprint": "forged",
+				"X-Client-Cert-Subject":     "CN=forged",
+			},
+
+			outHdr: map[string]string{
+				"X-Client-Cert-Fingerprint": "",
+				"X-Client-Cert-Subject":     "",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := &mockProxy{
+				url:    "/api/devices/v1/inventory/device/attributes",
+				body:   []byte{},
+				hdr:    tc.outHdr,
+				status: http.StatusOK,
+				t:      t,
+			}
+			router, err := NewRouter(nil, proxy, &RouterConfig{CertHeaders: tc.headers})
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, proxy.url, nil)
+			for k, v := range tc.inHdr {
+				req.Header.Set(k, v)
+			}
+			if tc.cert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}}
+			}
+			router.ServeHTTP(w, req)
+
+			assert.True(t, proxy.called)
+		})
+	}
+}
+
+type mockArtifactProxy struct {
+	*mockProxy
+}
+
+func (mp *mockArtifactProxy) ServesArtifact(r *http.Request) bool {
+	return r.URL.Path == mp.url
+}
+
+func TestCertIdentityHeadersArtifactLinks(t *testing.T) {
+	t.Parallel()
+
+	cert := &x509.Certificate{
+		Raw:          []byte("device cert"),
+		Subject:      pkix.Name{CommonName: "device-1"},
+		SerialNumber: big.NewInt(4242),
+	}
+
+	// cached artifacts' download links are outside the device API
+	proxy := &mockArtifactProxy{&mockProxy{
+		url:  "/artifacts/0123/release-1.mender",
+		body: []byte{},
+		hdr: map[string]string{
+			"X-Client-Cert-Fingerprint": app.CertFingerprint(cert),
+			"X-Client-Cert-Serial":      "4242",
+		},
+		status: http.StatusOK,
+		t:      t,
+	}}
+	router, err := NewRouter(nil, proxy, &RouterConfig{CertHeaders: CertHeaders{
+		Fingerprint: "X-Client-Cert-Fingerprint",
+		Serial:      "X-Client-Cert-Serial",
+	}})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, proxy.url, nil)
+	req.Header.Set("X-Client-Cert-Fingerprint", "forged")
+	req.Header.Set("X-Client-Cert-Serial", "1")
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	router.ServeHTTP(w, req)
+
+	assert.True(t, proxy.called)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// other paths are still not found
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/artifacts/other", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestXFCC(t *testing.T) {
+	t.Parallel()
+
+	cert := &x509.Certificate{
+		Raw:     []byte("device cert"),
+		Subject: pkix.Name{CommonName: `device "1"`},
+		URIs: []*url.URL{
+			{Scheme: "spiffe", Host: "acme.io", Path: "/device/1"},
+			{Scheme: "https", Host: "acme.io", Path: "/d", RawQuery: "id=1;x"},
+		},
+	}
+	assert.Equal(t, "Hash="+app.CertFingerprint(cert)+`;Subject="CN=device \\\"1\\\""`+
+		`;URI=spiffe://acme.io/device/1;URI="https://acme.io/d?id=1;x"`, xfcc(cert))
+}
+
+func TestCertHeadersValidate(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, CertHeaders{}.Validate())
+	assert.NoError(t, CertHeaders{Fingerprint: "X-Fp", XFCC: "X-Forwarded-Client-Cert"}.Validate())
+	assert.EqualError(t, CertHeaders{Subject: "X Subject"}.Validate(), `invalid header name "X Subject"`)
+	assert.EqualError(t, CertHeaders{Subject: "x-cert", Issuer: "X-Cert"}.Validate(),
+		"header X-Cert named more than once")
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/artifacts"
+)
+
+const (
+	// ApiUrlArtifactDownload serves the artifacts of rewritten download links
+	ApiUrlArtifactDownload = "/api/ambassador/v1/artifacts/:token"
+
+	// reasons for rejecting downloads
+	DownloadNoCert       = "no_cert"
+	DownloadInvalid      = "invalid"
+	DownloadExpired      = "expired"
+	DownloadCertMismatch = "cert_mismatch"
+)
+
+var (
+	downloadLinksRewritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mtls_artifact_download_links_rewritten_total",
+		Help: "Artifact download links of next responses rewritten to the Ambassador.",
+	})
+	downloadsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_artifact_downloads_rejected_total",
+		Help: "Downloads of rewritten artifact links rejected, by reason.",
+	}, []string{"reason"})
+
+	errDownloadExpired = errors.New("download link expired")
+)
+
+// ArtifactDownloadConfig are the settings of rewritten download links
+type ArtifactDownloadConfig struct {
+	// Secret signs the links; Ambassadors sharing devices need the same
+	Secret []byte
+	// TTL bounds the links' lifetime, on top of the original's expiry
+	TTL time.Duration
+	// Client fetches the artifacts from their original links
+	Client *http.Client
+	// Cache is optional
+	Cache *artifacts.Cache
+}
+
+// ArtifactDownloads rewrites the artifact links of next responses to
+// the Ambassador's download path, so that devices needn't reach the
+// storage; a link is signed, time-limited and tied to the device's cert
+type ArtifactDownloads struct {
+	cfg ArtifactDownloadConfig
+}
+
+func NewArtifactDownloads(cfg ArtifactDownloadConfig) (*ArtifactDownloads, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, errors.New("download link secret must not be empty")
+	}
+	if cfg.TTL <= 0 {
+		return nil, errors.New("download link TTL must be positive")
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	return &ArtifactDownloads{cfg: cfg}, nil
+}
+
+// downloadToken is a rewritten link's path parameter
+type downloadToken struct {
+	URI        string `json:"u"`
+	ArtifactID string `json:"a"`
+	// Cert is the fingerprint of the device's client cert
+	Cert   string `json:"c"`
+	Expire int64  `json:"e"`
+}
+
+// sign encodes the token as "<payload>.<hmac>", base64url each
+func (d *ArtifactDownloads) sign(t *downloadToken) string {
+	payload, _ := json.Marshal(t)
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	return enc + "." + base64.RawURLEncoding.EncodeToString(d.mac(enc))
+}
+
+func (d *ArtifactDownloads) mac(payload string) []byte {
+	m := hmac.New(sha256.New, d.cfg.Secret)
+	_, _ = m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+func (d *ArtifactDownloads) verify(s string, now time.Time) (*downloadToken, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed download link")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, d.mac(parts[0])) {
+		return nil, errors.New("invalid download link signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed download link")
+	}
+
+	var t downloadToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, errors.Wrap(err, "malformed download link")
+	}
+	if now.Unix() >= t.Expire {
+		return nil, errDownloadExpired
+	}
+	return &t, nil
+}
+
+// rewrite points the next response's artifact link at the Ambassador,
+// for the device with the cert; on failure, the response is kept as is
+func (d *ArtifactDownloads) rewrite(rsp *http.Response, body []byte, next *deploymentNext, cert *x509.Certificate) {
+	now := time.Now()
+	expire := now.Add(d.cfg.TTL)
+	if src := next.Artifact.Source.Expire; !src.IsZero() && src.Before(expire) {
+		expire = src
+	}
+
+	host := rsp.Request.Host
+	if host == "" && rsp.Request.TLS != nil {
+		host = rsp.Request.TLS.ServerName
+	}
+	link := "https://" + host + strings.Replace(ApiUrlArtifactDownload, ":token", d.sign(&downloadToken{
+		URI:        next.Artifact.Source.URI,
+		ArtifactID: next.Artifact.ID,
+		Cert:       app.CertFingerprint(cert),
+		Expire:     expire.Unix(),
+	}), 1)
+
+	out, err := setArtifactSource(body, link, time.Unix(expire.Unix(), 0).UTC())
+	if err != nil {
+		log.FromContext(rsp.Request.Context()).Errorf("rewriting artifact link failed: %s", err)
+		return
+	}
+
+	rsp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(out), rsp.Body}
+	rsp.ContentLength = int64(len(out))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	rsp.Header.Del("Content-Encoding")
+	rsp.Header.Del("ETag")
+	downloadLinksRewritten.Inc()
+}
+
+// setArtifactSource sets artifact.source's uri and expire, keeping the rest
+func setArtifactSource(body []byte, uri string, expire time.Time) ([]byte, error) {
+	var next, artifact, source map[string]json.RawMessage
+	if err := json.Unmarshal(body, &next); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(next["artifact"], &artifact); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(artifact["source"], &source); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if source["uri"], err = json.Marshal(uri); err != nil {
+		return nil, err
+	}
+	if source["expire"], err = json.Marshal(expire); err != nil {
+		return nil, err
+	}
+	if artifact["source"], err = json.Marshal(source); err != nil {
+		return nil, err
+	}
+	if next["artifact"], err = json.Marshal(artifact); err != nil {
+		return nil, err
+	}
+	return json.Marshal(next)
+}
+
+// Download serves the artifact of a rewritten link to the device it was
+// made for, streamed from the original link, or from the cache if enabled
+func (d *ArtifactDownloads) Download(c *gin.Context) {
+	r := c.Request
+	lg := log.FromContext(r.Context())
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		downloadsRejected.WithLabelValues(DownloadNoCert).Inc()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": app.ErrCertNum.Error()})
+		return
+	}
+
+	t, err := d.verify(c.Param("token"), time.Now())
+	if err != nil {
+		reason := DownloadInvalid
+		if err == errDownloadExpired {
+			reason = DownloadExpired
+		}
+		downloadsRejected.WithLabelValues(reason).Inc()
+		lg.Warnf("rejecting artifact download: %s", err)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if !hmac.Equal([]byte(t.Cert), []byte(app.CertFingerprint(r.TLS.PeerCertificates[0]))) {
+		downloadsRejected.WithLabelValues(DownloadCertMismatch).Inc()
+		lg.Warnf("rejecting artifact download of %s: link of another device", t.ArtifactID)
+		c.JSON(http.StatusForbidden, gin.H{"error": "download link of another device"})
+		return
+	}
+
+	lg.Debugf("serving artifact %s", t.ArtifactID)
+	if d.cfg.Cache != nil {
+		// the fill outlives the request which started it
+		d.cfg.Cache.Serve(c.Writer, r, t.ArtifactID, func() (*http.Response, error) {
+			return d.fetch(context.Background(), http.MethodGet, t.URI, nil)
+		})
+		return
+	}
+	d.stream(c.Writer, r, t.URI)
+}
+
+// fetch requests the original link, with the given headers
+func (d *ArtifactDownloads) fetch(ctx context.Context, method, uri string, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	return d.cfg.Client.Do(req)
+}
+
+// stream proxies the original link's response, with Range requests
+func (d *ArtifactDownloads) stream(w http.ResponseWriter, r *http.Request, uri string) {
+	hdr := http.Header{}
+	for _, h := range []string{"Range", "If-Range"} {
+		if v := r.Header.Get(h); v != "" {
+			hdr.Set(h, v)
+		}
+	}
+
+	rsp, err := d.fetch(r.Context(), r.Method, uri, hdr)
+	if err != nil {
+		log.FromContext(r.Context()).Errorf("fetching artifact failed: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer rsp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Content-Length", "Content-Range",
+		"Accept-Ranges", "ETag", "Last-Modified"} {
+		if v := rsp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(rsp.StatusCode)
+	_, _ = io.Copy(w, rsp.Body)
+}
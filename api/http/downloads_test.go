@@ -0,0 +1,230 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/artifacts"
+)
+
+func TestDownloadToken(t *testing.T) {
+	t.Parallel()
+
+	d, err := NewArtifactDownloads(ArtifactDownloadConfig{Secret: []byte("secret"), TTL: time.Hour})
+	assert.NoError(t, err)
+	other, err := NewArtifactDownloads(ArtifactDownloadConfig{Secret: []byte("other"), TTL: time.Hour})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	tok := &downloadToken{
+		URI:        "https://s3.example.com/artifacts/a1?X-Amz-Signature=abc",
+		ArtifactID: "a1",
+		Cert:       "f00d",
+		Expire:     now.Add(time.Minute).Unix(),
+	}
+	s := d.sign(tok)
+	assert.NotContains(t, s, "/")
+
+	got, err := d.verify(s, now)
+	assert.NoError(t, err)
+	assert.Equal(t, tok, got)
+
+	_, err = d.verify(s, now.Add(time.Minute))
+	assert.Equal(t, errDownloadExpired, err)
+
+	_, err = other.verify(s, now)
+	assert.EqualError(t, err, "invalid download link signature")
+
+	forged := *tok
+	forged.Cert = "beef"
+	parts := strings.Split(d.sign(&forged), ".")
+	_, err = d.verify(parts[0]+"."+strings.Split(s, ".")[1], now)
+	assert.EqualError(t, err, "invalid download link signature")
+
+	_, err = d.verify("garbage", now)
+	assert.EqualError(t, err, "malformed download link")
+
+	_, err = NewArtifactDownloads(ArtifactDownloadConfig{TTL: time.Hour})
+	assert.EqualError(t, err, "download link secret must not be empty")
+}
+
+func TestSetArtifactSource(t *testing.T) {
+	t.Parallel()
+
+	expire := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	out, err := setArtifactSource([]byte(`{"id":"d1","artifact":{"id":"a1","artifact_name":"r1",`+
+		`"device_types_compatible":["qemu"],"source":{"uri":"https://s3/a1","expire":"2020-06-02T00:00:00Z"}}}`),
+		"https://ambassador.local/x", expire)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"d1","artifact":{"id":"a1","artifact_name":"r1",`+
+		`"device_types_compatible":["qemu"],"source":{"uri":"https://ambassador.local/x","expire":"2020-06-01T12:00:00Z"}}}`,
+		string(out))
+
+	_, err = setArtifactSource([]byte(`{"id":"d1"}`), "https://ambassador.local/x", expire)
+	assert.Error(t, err)
+}
+
+func TestArtifactDownloads(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	var fetches int32
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "ok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/vnd.mender-artifact")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer storage.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id":"d1","artifact":{"id":"a1","artifact_name":"r1",`+
+			`"source":{"uri":"%s/a1?sig=%s","expire":"%s"}}}`,
+			storage.URL, r.URL.Query().Get("sig"), time.Now().Add(time.Hour).Format(time.RFC3339))
+	}))
+	defer backend.Close()
+
+	cert := &x509.Certificate{Raw: []byte("device cert")}
+	otherCert := &x509.Certificate{Raw: []byte("other cert")}
+
+	newDownloads := func(cache *artifacts.Cache) (*proxy, *gin.Engine) {
+		d, err := NewArtifactDownloads(ArtifactDownloadConfig{
+			Secret: []byte("secret"),
+			TTL:    10 * time.Minute,
+			Cache:  cache,
+		})
+		assert.NoError(t, err)
+
+		p, err := NewProxy(backend.URL, false)
+		assert.NoError(t, err)
+		p.SetArtifactDownloads(d)
+
+		gin.SetMode(gin.ReleaseMode)
+		router := gin.New()
+		router.GET(ApiUrlArtifactDownload, d.Download)
+		return p, router
+	}
+
+	// next gets a device a link to the Ambassador, valid for the TTL at most
+	next := func(p *proxy, cert *x509.Certificate, sig string) string {
+		r := httptest.NewRequest(http.MethodGet, "https://ambassador.local"+UrlDeploymentsNext+"?sig="+sig, nil)
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		w := httptest.NewRecorder()
+		p.Redirect(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, fmt.Sprint(w.Body.Len()), w.Header().Get("Content-Length"))
+
+		var rsp deploymentNext
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+		assert.Equal(t, "a1", rsp.Artifact.ID)
+		if cert != nil {
+			assert.WithinDuration(t, time.Now().Add(10*time.Minute), rsp.Artifact.Source.Expire, 2*time.Second)
+		}
+		return rsp.Artifact.Source.URI
+	}
+
+	download := func(router *gin.Engine, link string, cert *x509.Certificate, hdr http.Header) *httptest.ResponseRecorder {
+		u, err := url.Parse(link)
+		assert.NoError(t, err)
+		r := httptest.NewRequest(http.MethodGet, u.RequestURI(), nil)
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		for k, v := range hdr {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("ok, streamed", func(t *testing.T) {
+		p, router := newDownloads(nil)
+
+		link := next(p, cert, "ok")
+		assert.True(t, strings.HasPrefix(link, "https://ambassador.local/api/ambassador/v1/artifacts/"))
+
+		w := download(router, link, cert, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, data, w.Body.Bytes())
+		assert.Equal(t, "application/vnd.mender-artifact", w.Header().Get("Content-Type"))
+
+		w = download(router, link, cert, http.Header{"Range": {"bytes=10-19"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "0123456789", w.Body.String())
+		assert.Equal(t, "bytes 10-19/10000", w.Header().Get("Content-Range"))
+	})
+
+	t.Run("ok, no cert: link kept", func(t *testing.T) {
+		p, _ := newDownloads(nil)
+		assert.True(t, strings.HasPrefix(next(p, nil, "ok"), storage.URL))
+	})
+
+	t.Run("ok, storage error passed on", func(t *testing.T) {
+		p, router := newDownloads(nil)
+		w := download(router, next(p, cert, "expired"), cert, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("error, other device", func(t *testing.T) {
+		p, router := newDownloads(nil)
+		link := next(p, cert, "ok")
+
+		w := download(router, link, otherCert, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "download link of another device")
+
+		w = download(router, link, nil, nil)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("error, tampered", func(t *testing.T) {
+		p, router := newDownloads(nil)
+		link := next(p, cert, "ok")
+
+		w := download(router, strings.Replace(link, "/artifacts/", "/artifacts/x", 1), cert, nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("ok, cached", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "artifacts")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		cache, err := artifacts.NewCache(dir, 1024*1024, 0)
+		assert.NoError(t, err)
+
+		p, router := newDownloads(cache)
+		before := atomic.LoadInt32(&fetches)
+		for _, c := range []*x509.Certificate{cert, otherCert, cert} {
+			w := download(router, next(p, c, "ok"), c, nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, data, w.Body.Bytes())
+		}
+		assert.Equal(t, before+1, atomic.LoadInt32(&fetches))
+	})
+}
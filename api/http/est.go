@@ -0,0 +1,242 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/est"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+)
+
+var (
+	ErrNoClientCert      = errors.New("no client certificate")
+	ErrIdentityMismatch  = errors.New("CSR subject or SANs differ from the current certificate")
+	ErrCertRevoked       = errors.New("client certificate revoked")
+	errUnsupportedCSRKey = errors.New("unsupported CSR public key")
+	errInvalidCSR        = errors.New("invalid CSR signature")
+	errCSRTooLarge       = errors.New("CSR too large")
+)
+
+const (
+	// MaxCSRSize bounds EST request bodies; real CSRs are a few KiB
+	MaxCSRSize = 64 * 1024
+)
+
+// ESTController serves EST (RFC 7030) enrollment:
+// devices enroll with a factory (bootstrap) cert and re-enroll with
+// the cert issued to them
+type ESTController struct {
+	issuer    issuer.Issuer
+	bootstrap *x509.CertPool
+
+	// revocation, if set, rejects re-enrollment with revoked certs
+	revocation RevocationChecker
+}
+
+// RevocationChecker tells whether a client cert was revoked
+type RevocationChecker interface {
+	IsRevoked(cert *x509.Certificate) bool
+}
+
+func NewESTController(iss issuer.Issuer, bootstrap *x509.CertPool) *ESTController {
+	return &ESTController{
+		issuer:    iss,
+		bootstrap: bootstrap,
+	}
+}
+
+// CheckRevocation rejects re-enrollment with certs the checker reports
+// as revoked; call it before serving
+func (ec *ESTController) CheckRevocation(rc RevocationChecker) {
+	ec.revocation = rc
+}
+
+// NewESTRouter creates the router of the EST listener
+func NewESTRouter(ec *ESTController) (*gin.Engine, error) {
+	gin.SetMode(gin.ReleaseMode)
+	gin.DisableConsoleColor()
+
+	l := log.NewEmpty()
+
+	router := gin.New()
+
+	router.Use(routerLogger(l))
+	router.Use(gin.Recovery())
+
+	router.GET(est.UrlCACerts, ec.GetCACerts)
+	router.POST(est.UrlSimpleEnroll, ec.SimpleEnroll)
+	router.POST(est.UrlSimpleReenroll, ec.SimpleReenroll)
+
+	return router, nil
+}
+
+func (ec *ESTController) GetCACerts(c *gin.Context) {
+	cas, err := ec.issuer.CACerts(c.Request.Context())
+	if err != nil {
+		l.Errorf("EST: getting CA certificates failed: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	ec.writeCerts(c, cas...)
+}
+
+func (ec *ESTController) SimpleEnroll(c *gin.Context) {
+	leaf, err := verifiedClientCert(c.Request, ec.bootstrap)
+	if err != nil {
+		l.Warnf("EST enroll: rejecting client: %s", err)
+		c.String(statusForCertError(err), err.Error())
+		return
+	}
+
+	csr, err := parseCSR(c.Request)
+	if err != nil {
+		l.Warnf("EST enroll: %s", err)
+		c.String(statusForCSRError(err), err.Error())
+		return
+	}
+
+	l.Infof("EST enroll: %q (bootstrap cert %q)", csr.Subject, leaf.Subject)
+	ec.issue(c, csr)
+}
+
+func (ec *ESTController) SimpleReenroll(c *gin.Context) {
+	cas, err := ec.issuer.CACerts(c.Request.Context())
+	if err != nil {
+		l.Errorf("EST re-enroll: getting CA certificates failed: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	issued := x509.NewCertPool()
+	for _, cert := range cas {
+		issued.AddCert(cert)
+	}
+
+	leaf, err := verifiedClientCert(c.Request, issued)
+	if err != nil {
+		l.Warnf("EST re-enroll: rejecting client: %s", err)
+		c.String(statusForCertError(err), err.Error())
+		return
+	}
+	if ec.revocation != nil && ec.revocation.IsRevoked(leaf) {
+		l.Warnf("EST re-enroll: rejecting revoked certificate %s of %q", leaf.SerialNumber, leaf.Subject)
+		c.String(http.StatusForbidden, ErrCertRevoked.Error())
+		return
+	}
+
+	csr, err := parseCSR(c.Request)
+	if err != nil {
+		l.Warnf("EST re-enroll: %s", err)
+		c.String(statusForCSRError(err), err.Error())
+		return
+	}
+
+	if !app.SameIdentity(csr, leaf) {
+		l.Warnf("EST re-enroll: %q: %s", leaf.Subject, ErrIdentityMismatch)
+		c.String(http.StatusForbidden, ErrIdentityMismatch.Error())
+		return
+	}
+
+	l.Infof("EST re-enroll: %q", csr.Subject)
+	ec.issue(c, csr)
+}
+
+func (ec *ESTController) issue(c *gin.Context, csr *x509.CertificateRequest) {
+	cert, err := ec.issuer.Issue(c.Request.Context(), csr)
+	if err != nil {
+		l.Errorf("EST: issuing certificate failed: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	l.Infof("EST: issued certificate %s for %q, valid until %s",
+		cert.SerialNumber, cert.Subject, cert.NotAfter.UTC())
+	ec.writeCerts(c, cert)
+}
+
+func (ec *ESTController) writeCerts(c *gin.Context, certs ...*x509.Certificate) {
+	der, err := est.EncodeCertsOnly(certs)
+	if err != nil {
+		l.Errorf("EST: encoding certificates failed: %s", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header(est.HdrContentTransferEncoding, "base64")
+	c.Data(http.StatusOK, est.ContentTypeCertsOnly, est.EncodeBody(der))
+}
+
+// verifiedClientCert returns the client's leaf cert if it chains to roots
+func verifiedClientCert(r *http.Request, roots *x509.CertPool) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoClientCert
+	}
+
+	certs := r.TLS.PeerCertificates
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func statusForCertError(err error) int {
+	if err == ErrNoClientCert {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+func statusForCSRError(err error) int {
+	if err == errCSRTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func parseCSR(r *http.Request) (*x509.CertificateRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxCSRSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CSR")
+	}
+	if len(body) > MaxCSRSize {
+		return nil, errCSRTooLarge
+	}
+
+	der, err := est.DecodeBody(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode CSR")
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CSR")
+	}
+	if csr.PublicKey == nil {
+		return nil, errUnsupportedCSRKey
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, errInvalidCSR
+	}
+
+	return csr, nil
+}
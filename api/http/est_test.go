@@ -0,0 +1,170 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/est"
+)
+
+func newTestCert(t *testing.T, tmpl, parent *x509.Certificate, pub interface{}, signer crypto.Signer) *x509.Certificate {
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	cert := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, &key.PublicKey, key)
+
+	return cert, key
+}
+
+func newTestCSR(t *testing.T, key crypto.Signer, cn string) []byte {
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	assert.NoError(t, err)
+	return csr
+}
+
+func estClient(url string, cert *x509.Certificate, key crypto.Signer) *est.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{{
+			Certificate: [][]byte{cert.Raw},
+			PrivateKey:  key,
+		}}
+	}
+	return est.NewClient(url, &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	})
+}
+
+func TestEST(t *testing.T) {
+	t.Parallel()
+
+	issuerCert, issuerKey := newTestCA(t, "Issuing CA")
+	issuer, err := ca.New(issuerCert, issuerKey)
+	assert.NoError(t, err)
+	issuer.Profile = &ca.Profile{Validity: time.Hour}
+	dir, err := ioutil.TempDir("", "est")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	issuer.Store, err = ca.OpenStore(filepath.Join(dir, "issued.json"))
+	assert.NoError(t, err)
+
+	factoryCert, factoryKey := newTestCA(t, "Factory CA")
+	bootstrap := x509.NewCertPool()
+	bootstrap.AddCert(factoryCert)
+
+	controller := NewESTController(issuer, bootstrap)
+	controller.CheckRevocation(issuer)
+	router, err := NewESTRouter(controller)
+	assert.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	devKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	factoryDevCert := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "factory device-1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, factoryCert, &devKey.PublicKey, factoryKey)
+
+	// cacerts - no auth needed
+	cas, err := estClient(srv.URL, nil, nil).CACerts(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, cas, 1)
+	assert.Equal(t, issuerCert.Raw, cas[0].Raw)
+
+	// enroll - needs a factory cert
+	_, err = estClient(srv.URL, nil, nil).SimpleEnroll(ctx, newTestCSR(t, devKey, "device-1"))
+	assert.EqualError(t, err, "EST request failed with status 401: no client certificate")
+
+	cert, err := estClient(srv.URL, factoryDevCert, devKey).
+		SimpleEnroll(ctx, newTestCSR(t, devKey, "device-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "device-1", cert.Subject.CommonName)
+	assert.NoError(t, cert.CheckSignatureFrom(issuerCert))
+
+	// enroll - CSRs are bounded
+	rsp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{factoryDevCert.Raw}, PrivateKey: devKey}},
+	}}}).Post(srv.URL+est.UrlSimpleEnroll, "application/pkcs10",
+		bytes.NewReader(bytes.Repeat([]byte("A"), MaxCSRSize+1)))
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+
+	// re-enroll - not with a factory cert, and only for the same subject
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	_, err = estClient(srv.URL, factoryDevCert, devKey).
+		SimpleReenroll(ctx, newTestCSR(t, newKey, "device-1"))
+	assert.Error(t, err)
+
+	_, err = estClient(srv.URL, cert, devKey).
+		SimpleReenroll(ctx, newTestCSR(t, newKey, "device-2"))
+	assert.EqualError(t, err, "EST request failed with status 403: "+ErrIdentityMismatch.Error())
+
+	renewed, err := estClient(srv.URL, cert, devKey).
+		SimpleReenroll(ctx, newTestCSR(t, newKey, "device-1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "device-1", renewed.Subject.CommonName)
+	assert.NotEqual(t, cert.SerialNumber, renewed.SerialNumber)
+	assert.Equal(t, &newKey.PublicKey, renewed.PublicKey)
+
+	// re-enroll - not with a revoked cert
+	assert.NoError(t, issuer.Store.Revoke(renewed.SerialNumber.String(), time.Now()))
+	_, err = estClient(srv.URL, renewed, newKey).
+		SimpleReenroll(ctx, newTestCSR(t, newKey, "device-1"))
+	assert.EqualError(t, err, "EST request failed with status 403: "+ErrCertRevoked.Error())
+}
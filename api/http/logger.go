@@ -10,13 +10,23 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/mendersoftware/go-lib-micro/log"
 	"github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mtls-ambassador/requestid"
 )
 
 const typeHTTP = "http"
 
+// routerLogger logs every request, with the request's context logger
+// if the server set one, the given one otherwise
 func routerLogger(logger logrus.FieldLogger) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		reqLogger := logger
+		if requestid.FromContext(c.Request.Context()) != "" {
+			reqLogger = log.FromContext(c.Request.Context())
+		}
+
 		// other handler can change c.Path so:
 		path := c.Request.URL.Path
 		start := time.Now()
@@ -32,7 +42,7 @@ func routerLogger(logger logrus.FieldLogger) gin.HandlerFunc {
 			dataLength = 0
 		}
 
-		entry := logger.WithFields(logrus.Fields{
+		entry := reqLogger.WithFields(logrus.Fields{
 			"clientip":     clientIP,
 			"type":         typeHTTP,
 			"ts":           start.Round(0),
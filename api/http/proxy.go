@@ -7,6 +7,7 @@ package http
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -16,9 +17,12 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/mendersoftware/go-lib-micro/log"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 
 	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/artifacts"
 	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
 )
 
 const (
@@ -40,8 +44,21 @@ type Proxy interface {
 	Redirect(w http.ResponseWriter, r *http.Request)
 }
 
+// ArtifactProxy is a Proxy which also serves artifact downloads
+// from links outside the device API
+type ArtifactProxy interface {
+	Proxy
+	ServesArtifact(r *http.Request) bool
+}
+
 type proxy struct {
-	proxy *httputil.ReverseProxy
+	proxy   *httputil.ReverseProxy
+	backend *url.URL
+	tunnels TunnelConfig
+
+	artifacts *artifacts.Cache
+	links     *artifactLinks
+	downloads *ArtifactDownloads
 }
 
 func NewProxy(menderUrl string, insecureSkipVerify bool) (*proxy, error) {
@@ -68,23 +85,45 @@ func NewProxy(menderUrl string, insecureSkipVerify bool) (*proxy, error) {
 		TLSClientConfig: tlsConfig,
 	}
 
+	// upgrades aren't traced: otelhttp wraps the response body,
+	// hiding the upgraded connection ReverseProxy writes to
+	traced := otelhttp.NewTransport(tr, otelhttp.WithFilter(func(r *http.Request) bool {
+		return upgradeType(r) == ""
+	}))
+
 	ret := &proxy{
 		proxy: &httputil.ReverseProxy{
 			Director:  director,
-			Transport: tr,
+			Transport: traced,
 		},
+		backend: u,
 	}
 	l.Info("creating proxy: ok")
 
-	if insecureSkipVerify {
-		ret.proxy.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
-	}
-
 	return ret, nil
 }
 
+// SetTunnels applies the limits of connections proxied after an HTTP upgrade
+// (e.g. deviceconnect's WebSocket); call it before serving
+func (p *proxy) SetTunnels(cfg TunnelConfig) {
+	p.tunnels = cfg
+}
+
+// SetUpstreams balances the proxied requests over the pool's backends
+func (p *proxy) SetUpstreams(pool *upstream.Pool) {
+	p.proxy.Transport = upstream.NewTransport(pool, p.proxy.Transport)
+}
+
 func (p *proxy) Redirect(w http.ResponseWriter, r *http.Request) {
-	l.Debug("proxy redirection called")
+	log.FromContext(r.Context()).Debug("proxy redirection called")
+	if protocol := upgradeType(r); protocol != "" {
+		p.tunnel(w, r, protocol)
+		return
+	}
+	if id, ok := p.artifactID(r); ok {
+		p.serveArtifact(w, r, id)
+		return
+	}
 	p.proxy.ServeHTTP(w, r)
 }
 
@@ -97,6 +136,10 @@ func NewProxyController(app app.App, proxy Proxy) *ProxyController {
 }
 
 func (pc *ProxyController) Any(c *gin.Context) {
+	// the request's context, gin's doesn't carry the trace nor the logger
+	ctx := c.Request.Context()
+	l := log.FromContext(ctx)
+
 	if c.Request.URL.Path == UrlDevauthAuthReq {
 		l.Debug("auth request intercepted")
 
@@ -109,13 +152,24 @@ func (pc *ProxyController) Any(c *gin.Context) {
 		}
 		l.Debug("parsing auth request: ok")
 
+		// no TLS (e.g. behind a TLS terminating proxy) means no client certs
+		var certs []*x509.Certificate
+		if c.Request.TLS != nil {
+			certs = c.Request.TLS.PeerCertificates
+		}
+
 		l.Debug("verifying client cert")
-		err = pc.app.VerifyClientCert(c,
-			c.Request.TLS.PeerCertificates,
+		err = pc.app.VerifyClientCert(ctx,
+			certs,
 			authreq,
 			raw,
 			c.Request.Header.Get("X-MEN-Signature"))
-		if err != nil {
+		if e, ok := err.(*app.ReplayError); ok && e.Reason == app.ReplayReasonFull {
+			// not the device's fault - it may retry later
+			l.Errorf("verifying client cert failed: %s", err.Error())
+			c.Writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
 			l.Errorf("verifying client cert failed: %s", err.Error())
 			c.Writer.WriteHeader(http.StatusBadRequest)
 			return
@@ -123,7 +177,7 @@ func (pc *ProxyController) Any(c *gin.Context) {
 		l.Debug("verifying client cert: ok")
 
 		l.Debug("preauthorizing")
-		err = pc.app.Preauth(c, authreq)
+		err = pc.app.Preauth(ctx, authreq)
 		if err != nil && err != app.ErrPreauthConflict {
 			l.Errorf("preauthorization failed: %s", err.Error())
 			c.Writer.WriteHeader(http.StatusInternalServerError)
@@ -142,10 +196,14 @@ func (pc *ProxyController) Any(c *gin.Context) {
 }
 
 // parseAuthReq parses the auth request and for convenience
-// returns also the raw body for further verification
+// returns also the raw body for further verification;
+// its size is bounded by the listener's body_limit_auth_requests
 func parseAuthReq(r *http.Request) (*mender.AuthReq, []byte, error) {
 	data, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
+	r.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	authreq := mender.AuthReq{}
 	err = json.Unmarshal(data, &authreq)
@@ -0,0 +1,93 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// +build go1.18
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
+)
+
+type fuzzClient struct{}
+
+func (fuzzClient) Login(ctx context.Context, user, pwd string) (string, error) {
+	return "token", nil
+}
+
+func (fuzzClient) Preauth(ctx context.Context, idData, pubKey, userToken string) error {
+	return nil
+}
+
+type fuzzAuthProvider struct{}
+
+func (fuzzAuthProvider) GetToken() (string, error) {
+	return "token", nil
+}
+
+type fuzzProxy struct{}
+
+func (fuzzProxy) Redirect(w http.ResponseWriter, r *http.Request) {
+	_, _ = ioutil.ReadAll(r.Body)
+	w.WriteHeader(http.StatusOK)
+}
+
+// FuzzAuthRequest feeds attacker controlled auth request bodies and
+// signature headers through the router and the real app, with and without
+// a (verified) client cert; the seed corpus in testdata/fuzz holds
+// Mender client requests by the certs/tenant-foo.client.1 device
+func FuzzAuthRequest(f *testing.F) {
+	f.Add([]byte(nil), "", false)
+	f.Add([]byte(`{"id_data":"{}","pubkey":"","tenant_token":""}`), "AAAA", true)
+
+	data, err := ioutil.ReadFile("../../certs/tenant-foo.client.1.crt")
+	if err != nil {
+		f.Fatal(err)
+	}
+	cert, err := ca.ParseCertificate(data)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	router, err := NewRouter(
+		app.NewApp(fuzzClient{}, fuzzAuthProvider{}, nil, nil, nil),
+		fuzzProxy{},
+		nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte, signature string, withCert bool) {
+		req := httptest.NewRequest(http.MethodPost, UrlDevauthAuthReq, bytes.NewReader(body))
+		req.Header.Set("X-MEN-Signature", signature)
+		if withCert {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			}
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		switch w.Code {
+		case http.StatusOK:
+			if !withCert {
+				t.Fatal("proxied an auth request without a client cert")
+			}
+		case http.StatusBadRequest:
+		default:
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+	})
+}
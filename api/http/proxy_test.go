@@ -6,6 +6,7 @@ package http
 
 import (
 	"bytes"
+	"crypto/x509"
 	"errors"
 	"io/ioutil"
 	"net/http"
@@ -134,6 +135,26 @@ func TestProxyController(t *testing.T) {
 
 			outStatus: 400,
 		},
+		{
+			name:   "error, auth request, nonce store full",
+			inUrl:  "/api/devices/v1/authentication/auth_requests",
+			inBody: []byte(`{"id_data": "{\"sn\": \"0001\"}", "pubkey": "foo", "tenant_token": "token"}`),
+			inHdr: map[string]string{
+				"X-MEN-Signature": "signature",
+				"X-MEN-RequestID": "reqid",
+			},
+			authReq: &mender.AuthReq{
+				IdData:      `{"sn": "0001"}`,
+				PubKey:      "foo",
+				TenantToken: "token",
+			},
+
+			appVerifyErr: &app.ReplayError{Reason: app.ReplayReasonFull, Detail: "full"},
+
+			willProxy: false,
+
+			outStatus: 503,
+		},
 		{
 			name:   "ok, other device api",
 			inUrl:  "/api/devices/not/an/auth/req",
@@ -171,7 +192,7 @@ func TestProxyController(t *testing.T) {
 
 			if tc.authReq != nil {
 				app.On("VerifyClientCert",
-					mock.AnythingOfType("*gin.Context"),
+					mock.Anything,
 					mock.AnythingOfType("[]*x509.Certificate"),
 					tc.authReq,
 					tc.inBody,
@@ -179,7 +200,7 @@ func TestProxyController(t *testing.T) {
 					Return(tc.appVerifyErr)
 				if tc.appVerifyErr == nil {
 					app.On("Preauth",
-						mock.AnythingOfType("*gin.Context"),
+						mock.Anything,
 						tc.authReq).
 						Return(tc.appPreauthErr)
 				}
@@ -193,7 +214,7 @@ func TestProxyController(t *testing.T) {
 				t:      t,
 			}
 
-			r, err := NewRouter(app, proxy)
+			r, err := NewRouter(app, proxy, nil)
 			assert.NoError(t, err)
 			server := mockServer(tc.inUrl, r.ServeHTTP)
 
@@ -222,6 +243,66 @@ func TestProxyController(t *testing.T) {
 	}
 }
 
+func TestProxyControllerAuthRequestChecks(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`{"id_data": "{\"sn\": \"0001\"}", "pubkey": "foo", "tenant_token": "token"}`)
+
+	cases := []struct {
+		name string
+		body []byte
+
+		// the app's verdict on the (missing) client certs
+		verify bool
+		certs  []*x509.Certificate
+
+		outStatus int
+	}{
+		{
+			name:   "no TLS",
+			body:   body,
+			verify: true,
+
+			outStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "large: bounded by the listener only",
+			body:   append(body, bytes.Repeat([]byte(" "), 128*1024)...),
+			verify: true,
+
+			outStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			a := &mapp.App{}
+			if tc.verify {
+				a.On("VerifyClientCert",
+					mock.Anything,
+					tc.certs,
+					mock.AnythingOfType("*mender.AuthReq"),
+					tc.body,
+					"").
+					Return(app.ErrCertNum)
+			}
+
+			r, err := NewRouter(a, &mockProxy{t: t}, nil)
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, UrlDevauthAuthReq, bytes.NewReader(tc.body))
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.outStatus, w.Code)
+			a.AssertExpectations(t)
+		})
+	}
+}
+
 func mockServer(url string, handleFun func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
 	handler := http.NewServeMux()
 	handler.HandleFunc(url, handleFun)
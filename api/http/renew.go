@@ -0,0 +1,91 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mendersoftware/go-lib-micro/log"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+)
+
+// RenewReq is the body of a device's cert renewal request
+type RenewReq struct {
+	// IdData is the device's identity data, as in its auth requests
+	IdData string `json:"id_data"`
+	// CSR is the PEM encoded CSR for the new key
+	CSR string `json:"csr"`
+}
+
+// RenewController lets enrolled devices rotate their cert and key
+type RenewController struct {
+	app app.App
+}
+
+func NewRenewController(app app.App) *RenewController {
+	return &RenewController{
+		app: app,
+	}
+}
+
+// Renew issues a new cert for the CSR, authenticated by the current
+// client cert; the response is the PEM encoded cert
+func (rc *RenewController) Renew(c *gin.Context) {
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": app.ErrCertNum.Error()})
+		return
+	}
+
+	var req RenewReq
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to parse request: " + err.Error()})
+		return
+	}
+	if req.IdData == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id_data is required"})
+		return
+	}
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "csr must be a PEM encoded CERTIFICATE REQUEST"})
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to parse CSR: " + err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	cert, err := rc.app.RenewCert(ctx, c.Request.TLS.PeerCertificates, req.IdData, csr)
+	if err != nil {
+		log.FromContext(ctx).Errorf("renewing client cert failed: %s", err.Error())
+
+		switch err.(type) {
+		case *app.CertPolicyError:
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		switch err {
+		case app.ErrRenewalDisabled:
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		case app.ErrInvalidCSR, app.ErrRenewIdentity, app.ErrRenewSameKey:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Data(http.StatusOK, ContentTypePEM,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	mapp "github.com/mendersoftware/mtls-ambassador/app/mocks"
+)
+
+func TestRenew(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	csrPEM := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: newTestCSR(t, key, "device-1"),
+	}))
+
+	current := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	renewed := &x509.Certificate{Raw: []byte("renewed")}
+
+	cases := []struct {
+		name string
+
+		noCert bool
+		body   interface{}
+
+		appCalled bool
+		appCert   *x509.Certificate
+		appErr    error
+
+		outStatus int
+	}{
+		{
+			name:      "ok",
+			body:      RenewReq{IdData: `{"sn": "0001"}`, CSR: csrPEM},
+			appCalled: true,
+			appCert:   renewed,
+			outStatus: http.StatusOK,
+		},
+		{
+			name:      "error, no client cert",
+			noCert:    true,
+			body:      RenewReq{IdData: `{"sn": "0001"}`, CSR: csrPEM},
+			outStatus: http.StatusUnauthorized,
+		},
+		{
+			name:      "error, no id data",
+			body:      RenewReq{CSR: csrPEM},
+			outStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "error, bad csr",
+			body:      RenewReq{IdData: `{"sn": "0001"}`, CSR: "csr"},
+			outStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "error, renewal disabled",
+			body:      RenewReq{IdData: `{"sn": "0001"}`, CSR: csrPEM},
+			appCalled: true,
+			appErr:    app.ErrRenewalDisabled,
+			outStatus: http.StatusNotImplemented,
+		},
+		{
+			name:      "error, subject",
+			body:      RenewReq{IdData: `{"sn": "0001"}`, CSR: csrPEM},
+			appCalled: true,
+			appErr:    app.ErrRenewIdentity,
+			outStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "error, cert policy",
+			body:      RenewReq{IdData: `{"sn": "0001"}`, CSR: csrPEM},
+			appCalled: true,
+			appErr:    &app.CertPolicyError{Rule: app.RuleExpired},
+			outStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			a := &mapp.App{}
+			if tc.appCalled {
+				a.On("RenewCert",
+					mock.Anything,
+					[]*x509.Certificate{current},
+					`{"sn": "0001"}`,
+					mock.AnythingOfType("*x509.CertificateRequest")).
+					Return(tc.appCert, tc.appErr)
+			}
+
+			router, err := NewRouter(a, nil, nil)
+			assert.NoError(t, err)
+
+			body, err := json.Marshal(tc.body)
+			assert.NoError(t, err)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, ApiUrlRenew, bytes.NewReader(body))
+			if !tc.noCert {
+				req.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{current},
+				}
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.outStatus, w.Code)
+			if tc.outStatus == http.StatusOK {
+				block, _ := pem.Decode(w.Body.Bytes())
+				assert.NotNil(t, block)
+				assert.Equal(t, renewed.Raw, block.Bytes)
+			}
+			a.AssertExpectations(t)
+		})
+	}
+}
@@ -5,6 +5,8 @@
 package http
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/mendersoftware/go-lib-micro/log"
@@ -15,12 +17,32 @@ import (
 const (
 	ApiUrlStatus = "/status"
 	ApiUrlProxy  = "/api/devices/*path"
+	ApiUrlRenew  = "/api/ambassador/v1/certificate/renew"
 )
 
-func NewRouter(app app.App, proxy Proxy) (*gin.Engine, error) {
+// RouterConfig are the optional features of the device API router
+type RouterConfig struct {
+	// CertExpiryHeader enables HdrClientCertExpires on proxied requests
+	// whose client cert expires within CertExpiryWarning
+	CertExpiryHeader  bool
+	CertExpiryWarning time.Duration
+
+	// CertHeaders pass the client cert's identity to Mender
+	CertHeaders CertHeaders
+
+	// ArtifactDownloads serves the artifacts of rewritten download links
+	ArtifactDownloads *ArtifactDownloads
+}
+
+// NewRouter creates the device API router; a nil config means defaults
+func NewRouter(app app.App, proxy Proxy, config *RouterConfig) (*gin.Engine, error) {
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
 
+	if config == nil {
+		config = &RouterConfig{}
+	}
+
 	l := log.NewEmpty()
 
 	router := gin.New()
@@ -28,12 +50,42 @@ func NewRouter(app app.App, proxy Proxy) (*gin.Engine, error) {
 	//TODO use custom Mender-compliant logger
 	router.Use(routerLogger(l))
 	router.Use(gin.Recovery())
+	router.Use(routerTracing())
 
 	status := NewStatusController()
 	router.GET(ApiUrlStatus, status.GetStatus)
 
+	renew := NewRenewController(app)
+	router.POST(ApiUrlRenew, renew.Renew)
+
+	if config.ArtifactDownloads != nil {
+		router.GET(ApiUrlArtifactDownload, config.ArtifactDownloads.Download)
+		router.HEAD(ApiUrlArtifactDownload, config.ArtifactDownloads.Download)
+	}
+
+	// the middleware of everything proxied to Mender
+	proxyHandlers := func(h gin.HandlerFunc) []gin.HandlerFunc {
+		handlers := []gin.HandlerFunc{}
+		if config.CertHeaders.Enabled() {
+			handlers = append(handlers, certIdentityHeaders(config.CertHeaders))
+		}
+		if config.CertExpiryHeader {
+			handlers = append(handlers, certExpiryHeader(config.CertExpiryWarning))
+		}
+		return append(handlers, h)
+	}
+
 	proxyController := NewProxyController(app, proxy)
-	router.Any(ApiUrlProxy, proxyController.Any)
+	router.Any(ApiUrlProxy, proxyHandlers(proxyController.Any)...)
+
+	// cached artifacts' download links may have any path
+	if ap, ok := proxy.(ArtifactProxy); ok {
+		router.NoRoute(proxyHandlers(func(c *gin.Context) {
+			if ap.ServesArtifact(c.Request) {
+				ap.Redirect(c.Writer, c.Request)
+			}
+		})...)
+	}
 
 	return router, nil
 }
@@ -15,7 +15,7 @@ import (
 )
 
 func TestStatus(t *testing.T) {
-	router, _ := NewRouter(nil, nil)
+	router, _ := NewRouter(nil, nil, nil)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/status", nil)
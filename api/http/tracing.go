@@ -0,0 +1,57 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracerName is the instrumentation name of the router's spans
+	tracerName = "github.com/mendersoftware/mtls-ambassador/api/http"
+)
+
+// routerTracing names the request's span after its route; if the
+// server didn't start one, it does so itself, recording the status too
+func routerTracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		span := trace.SpanFromContext(c.Request.Context())
+		own := !span.SpanContext().IsValid()
+		if own {
+			ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(),
+				propagation.HeaderCarrier(c.Request.Header))
+			ctx, span = otel.Tracer(tracerName).Start(ctx, "HTTP "+c.Request.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPMethodKey.String(c.Request.Method),
+					semconv.HTTPTargetKey.String(c.Request.URL.Path)))
+			c.Request = c.Request.WithContext(ctx)
+		}
+
+		if route := c.FullPath(); route != "" {
+			span.SetName(c.Request.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRouteKey.String(route))
+		}
+
+		c.Next()
+
+		if own {
+			status := c.Writer.Status()
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+			}
+			span.End()
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// UrlDeviceConnect is Mender's deviceconnect WebSocket, for remote
+	// terminal, file transfer and port forwarding
+	UrlDeviceConnect = "/api/devices/v1/deviceconnect/connect"
+
+	// reasons for closing tunnels
+	TunnelClosed      = "closed"
+	TunnelIdleTimeout = "idle_timeout"
+)
+
+var (
+	tunnelsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mtls_websocket_tunnels_active",
+		Help: "Proxied WebSocket (HTTP upgrade) connections open.",
+	})
+	tunnelsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_websocket_tunnels_closed_total",
+		Help: "Proxied WebSocket (HTTP upgrade) connections closed, by reason.",
+	}, []string{"reason"})
+
+	// pingFrame is an unmasked, empty WebSocket ping, as sent by servers
+	pingFrame = []byte{0x89, 0x00}
+)
+
+// TunnelConfig bounds the connections proxied after an HTTP upgrade
+type TunnelConfig struct {
+	// IdleTimeout closes tunnels without data from the device
+	// for this long; 0 means no timeout
+	IdleTimeout time.Duration
+	// PingInterval is how long a WebSocket device may be quiet
+	// before it's pinged, so that a live one always answers within
+	// the idle timeout; 0 disables pings
+	PingInterval time.Duration
+}
+
+// upgradeType is the protocol the request asks to switch to, if any
+func upgradeType(r *http.Request) string {
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return strings.ToLower(r.Header.Get("Upgrade"))
+			}
+		}
+	}
+	return ""
+}
+
+// tunnel proxies an upgrade request; only devices with a client cert may open one
+func (p *proxy) tunnel(w http.ResponseWriter, r *http.Request, protocol string) {
+	l := log.FromContext(r.Context())
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		l.Warnf("rejecting %s upgrade of %s without client certificate", protocol, r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	l.Debugf("proxying %s upgrade of %s", protocol, r.URL.Path)
+	p.proxy.ServeHTTP(&tunnelWriter{
+		ResponseWriter: w,
+		cfg:            p.tunnels,
+		websocket:      protocol == "websocket",
+		l:              l,
+	}, r)
+}
+
+// tunnelWriter hands the reverse proxy the device's connection
+// wrapped in a tunnelConn, once it's hijacked for the upgrade
+type tunnelWriter struct {
+	http.ResponseWriter
+	cfg       TunnelConfig
+	websocket bool
+	l         *log.Logger
+}
+
+func (w *tunnelWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newTunnelConn(conn, w.cfg, w.websocket, w.l), brw, nil
+}
+
+// CloseNotify is passed through for gin, whose writer asserts it unchecked
+func (w *tunnelWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *tunnelWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// tunnelConn is the device's side of a tunnel: it enforces the idle
+// timeout on reads and, for WebSockets, pings the device when it's quiet
+type tunnelConn struct {
+	net.Conn
+	cfg TunnelConfig
+	l   *log.Logger
+
+	// lastRead is the time (unix nanos) data last came from the device
+	lastRead int64
+	idle     int32
+
+	// mu serializes writes to the device, the proxied frames and pings
+	mu     sync.Mutex
+	frames *frameTracker
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTunnelConn(conn net.Conn, cfg TunnelConfig, websocket bool, l *log.Logger) *tunnelConn {
+	c := &tunnelConn{
+		Conn:     conn,
+		cfg:      cfg,
+		l:        l,
+		lastRead: time.Now().UnixNano(),
+		done:     make(chan struct{}),
+	}
+	tunnelsActive.Inc()
+
+	if websocket && cfg.PingInterval > 0 {
+		c.frames = &frameTracker{}
+		go c.ping()
+	}
+	return c
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	if c.cfg.IdleTimeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.cfg.IdleTimeout))
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if atomic.CompareAndSwapInt32(&c.idle, 0, 1) {
+			c.l.Infof("closing tunnel from %s: idle for %s", c.RemoteAddr(), c.cfg.IdleTimeout)
+		}
+	}
+	return n, err
+}
+
+// Write passes the upstream's data on, injecting
+// pending pings between its WebSocket frames
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.frames == nil {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if err := c.flushPing(); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(p[:c.frames.advance(p)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, c.flushPing()
+}
+
+// flushPing sends a pending ping if between frames; called with mu held
+func (c *tunnelConn) flushPing() error {
+	if !c.frames.pendingPing || !c.frames.atBoundary() {
+		return nil
+	}
+	c.frames.pendingPing = false
+	_, err := c.Conn.Write(pingFrame)
+	return err
+}
+
+// ping pings the device whenever it's been quiet for the ping interval
+func (c *tunnelConn) ping() {
+	ticker := time.NewTicker(c.cfg.PingInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastRead))
+			if now.Sub(last) < c.cfg.PingInterval {
+				continue
+			}
+			c.mu.Lock()
+			c.frames.pendingPing = true
+			err := c.flushPing()
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		tunnelsActive.Dec()
+		reason := TunnelClosed
+		if atomic.LoadInt32(&c.idle) == 1 {
+			reason = TunnelIdleTimeout
+		}
+		tunnelsClosed.WithLabelValues(reason).Inc()
+	})
+	return err
+}
+
+// frameTracker follows the frame boundaries of a WebSocket stream
+// written piecewise, so that control frames can be injected between frames
+type frameTracker struct {
+	// hdr collects the current frame's header, until complete
+	hdr []byte
+	// remaining is the current frame's payload still to be written
+	remaining uint64
+
+	pendingPing bool
+}
+
+func (f *frameTracker) atBoundary() bool {
+	return len(f.hdr) == 0 && f.remaining == 0
+}
+
+// advance consumes the start of p up to the end of the current
+// frame's header or payload, and returns its length
+func (f *frameTracker) advance(p []byte) int {
+	if f.remaining > 0 {
+		n := uint64(len(p))
+		if n > f.remaining {
+			n = f.remaining
+		}
+		f.remaining -= n
+		return int(n)
+	}
+
+	n := 0
+	for n < len(p) {
+		f.hdr = append(f.hdr, p[n])
+		n++
+		if size, ok := f.headerSize(); ok && len(f.hdr) == size {
+			f.remaining = f.payloadLen()
+			f.hdr = f.hdr[:0]
+			break
+		}
+	}
+	return n
+}
+
+// headerSize is the complete header's size, once known
+func (f *frameTracker) headerSize() (int, bool) {
+	if len(f.hdr) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch f.hdr[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if f.hdr[1]&0x80 != 0 {
+		size += 4
+	}
+	return size, true
+}
+
+func (f *frameTracker) payloadLen() uint64 {
+	switch n := f.hdr[1] & 0x7f; n {
+	case 126:
+		return uint64(f.hdr[2])<<8 | uint64(f.hdr[3])
+	case 127:
+		var l uint64
+		for _, b := range f.hdr[2:10] {
+			l = l<<8 | uint64(b)
+		}
+		return l
+	default:
+		return uint64(n)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	wsOpText   = 0x1
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+)
+
+// readFrame reads a WebSocket frame, unmasking it if needed
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var mask [4]byte
+	masked := hdr[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return hdr[0] & 0x0f, payload, nil
+}
+
+// frame encodes a final WebSocket frame; clients mask theirs
+func frame(op byte, payload []byte, masked bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | op)
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf.WriteByte(maskBit | byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(maskBit | 126)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(maskBit | 127)
+		_ = binary.Write(&buf, binary.BigEndian, uint64(n))
+	}
+
+	if !masked {
+		buf.Write(payload)
+		return buf.Bytes()
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	buf.Write(mask[:])
+	for i, b := range payload {
+		buf.WriteByte(b ^ mask[i%4])
+	}
+	return buf.Bytes()
+}
+
+// wsEcho is a minimal WebSocket backend, echoing data frames
+type wsEcho struct {
+	*httptest.Server
+	upgrades int32
+	pongs    int32
+}
+
+func newWSEcho() *wsEcho {
+	e := &wsEcho{}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r) != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&e.upgrades, 1)
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			base64.StdEncoding.EncodeToString(accept[:]))
+		brw.Flush()
+
+		for {
+			op, payload, err := readFrame(brw)
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpClose:
+				_, _ = conn.Write(frame(wsOpClose, nil, false))
+				return
+			case wsOpPong:
+				atomic.AddInt32(&e.pongs, 1)
+			default:
+				_, _ = conn.Write(frame(op, payload, false))
+			}
+		}
+	}))
+	return e
+}
+
+// newTunnelProxy proxies to the backend; requests with X-Test-Client-Cert
+// pass for ones with a verified client cert
+func newTunnelProxy(t *testing.T, backend string, cfg TunnelConfig) *httptest.Server {
+	p, err := NewProxy(backend, false)
+	assert.NoError(t, err)
+	p.SetTunnels(cfg)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test-Client-Cert") != "" {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{}}}
+		}
+		p.Redirect(w, r)
+	}))
+}
+
+// dialTunnel opens deviceconnect's WebSocket through the proxy
+func dialTunnel(t *testing.T, url string, cert bool) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, url+UrlDeviceConnect, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if cert {
+		req.Header.Set("X-Test-Client-Cert", "1")
+	}
+	assert.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(br, req)
+	assert.NoError(t, err)
+	return conn, br, rsp
+}
+
+func TestTunnel(t *testing.T) {
+	// not parallel, the tunnel metrics are global
+	backend := newWSEcho()
+	defer backend.Close()
+
+	t.Run("ok, echo", func(t *testing.T) {
+		front := newTunnelProxy(t, backend.URL, TunnelConfig{IdleTimeout: 5 * time.Second})
+		defer front.Close()
+
+		active := testutil.ToFloat64(tunnelsActive)
+		closed := testutil.ToFloat64(tunnelsClosed.WithLabelValues(TunnelClosed))
+
+		conn, br, rsp := dialTunnel(t, front.URL, true)
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, rsp.StatusCode)
+		assert.Equal(t, active+1, testutil.ToFloat64(tunnelsActive))
+
+		for _, msg := range []string{"hello", strings.Repeat("x", 1000)} {
+			_, err := conn.Write(frame(wsOpText, []byte(msg), true))
+			assert.NoError(t, err)
+			op, payload, err := readFrame(br)
+			assert.NoError(t, err)
+			assert.Equal(t, byte(wsOpText), op)
+			assert.Equal(t, msg, string(payload))
+		}
+
+		_, err := conn.Write(frame(wsOpClose, nil, true))
+		assert.NoError(t, err)
+		op, _, err := readFrame(br)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(wsOpClose), op)
+
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(tunnelsActive) == active &&
+				testutil.ToFloat64(tunnelsClosed.WithLabelValues(TunnelClosed)) == closed+1
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("error, no client cert", func(t *testing.T) {
+		front := newTunnelProxy(t, backend.URL, TunnelConfig{})
+		defer front.Close()
+
+		upgrades := atomic.LoadInt32(&backend.upgrades)
+
+		conn, _, rsp := dialTunnel(t, front.URL, false)
+		defer conn.Close()
+		assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+		assert.Equal(t, upgrades, atomic.LoadInt32(&backend.upgrades))
+	})
+
+	t.Run("ok, quiet device pinged", func(t *testing.T) {
+		front := newTunnelProxy(t, backend.URL, TunnelConfig{
+			IdleTimeout:  time.Second,
+			PingInterval: 100 * time.Millisecond,
+		})
+		defer front.Close()
+
+		pongs := atomic.LoadInt32(&backend.pongs)
+
+		conn, br, rsp := dialTunnel(t, front.URL, true)
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, rsp.StatusCode)
+
+		// answering pings keeps the tunnel open past the idle timeout
+		deadline := time.Now().Add(1500 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			op, _, err := readFrame(br)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, byte(wsOpPing), op)
+			_, err = conn.Write(frame(wsOpPong, nil, true))
+			assert.NoError(t, err)
+		}
+
+		_, err := conn.Write(frame(wsOpBinary, []byte{1, 2, 3}, true))
+		assert.NoError(t, err)
+		for {
+			op, payload, err := readFrame(br)
+			if !assert.NoError(t, err) || op != wsOpPing {
+				assert.Equal(t, byte(wsOpBinary), op)
+				assert.Equal(t, []byte{1, 2, 3}, payload)
+				break
+			}
+		}
+
+		// the pongs went on to the backend, which ignores them
+		assert.True(t, atomic.LoadInt32(&backend.pongs) > pongs)
+	})
+
+	t.Run("error, idle timeout", func(t *testing.T) {
+		front := newTunnelProxy(t, backend.URL, TunnelConfig{IdleTimeout: 200 * time.Millisecond})
+		defer front.Close()
+
+		idle := testutil.ToFloat64(tunnelsClosed.WithLabelValues(TunnelIdleTimeout))
+
+		conn, br, rsp := dialTunnel(t, front.URL, true)
+		defer conn.Close()
+		assert.Equal(t, http.StatusSwitchingProtocols, rsp.StatusCode)
+
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _, err := readFrame(br)
+		assert.Equal(t, io.EOF, err)
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(tunnelsClosed.WithLabelValues(TunnelIdleTimeout)) == idle+1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+// captureConn records what's written to it
+type captureConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func TestTunnelPingBetweenFrames(t *testing.T) {
+	t.Parallel()
+
+	frames := [][]byte{
+		frame(wsOpText, []byte("abc"), false),
+		frame(wsOpBinary, bytes.Repeat([]byte{0x89}, 300), false),
+		frame(wsOpText, nil, false),
+		frame(wsOpBinary, bytes.Repeat([]byte{0}, 70000), false),
+		frame(wsOpText, []byte("masked"), true),
+	}
+	stream := bytes.Join(frames, nil)
+
+	for _, chunk := range []int{1, 3, 7, 1000, len(stream)} {
+		t.Run(fmt.Sprintf("chunks of %d", chunk), func(t *testing.T) {
+			out := &captureConn{}
+			c := &tunnelConn{Conn: out, frames: &frameTracker{}}
+
+			for p := stream; len(p) > 0; {
+				n := chunk
+				if n > len(p) {
+					n = len(p)
+				}
+				// a ping is always pending, written as soon as between frames
+				c.frames.pendingPing = true
+				written, err := c.Write(p[:n])
+				assert.NoError(t, err)
+				assert.Equal(t, n, written)
+				p = p[n:]
+			}
+
+			// the frames are intact, with pings only between them
+			pings := 0
+			var got [][]byte
+			for out.buf.Len() > 0 {
+				raw := out.buf.Bytes()
+				op, payload, err := readFrame(&out.buf)
+				if !assert.NoError(t, err) {
+					return
+				}
+				if op == wsOpPing {
+					assert.Empty(t, payload)
+					pings++
+					continue
+				}
+				got = append(got, raw[:len(raw)-out.buf.Len()])
+			}
+			assert.Equal(t, frames, got)
+			assert.True(t, pings >= 1)
+		})
+	}
+}
@@ -6,16 +6,25 @@ package app
 
 import (
 	"context"
-	"crypto/rsa"
 	"crypto/x509"
 	"errors"
+	"time"
 
 	"github.com/mendersoftware/go-lib-micro/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
 	"github.com/mendersoftware/mtls-ambassador/utils"
 )
 
+const (
+	// tracerName is the instrumentation name of the app's spans
+	tracerName = "github.com/mendersoftware/mtls-ambassador/app"
+)
+
 var (
 	ErrKeyMismatch     = errors.New("certificate key and auth request key don't match")
 	ErrCertNum         = errors.New("need at least one client certificate")
@@ -32,30 +41,54 @@ type App interface {
 		req *mender.AuthReq,
 		bodyRaw []byte,
 		bodySignature string) error
+	RenewCert(ctx context.Context,
+		certs []*x509.Certificate,
+		idData string,
+		csr *x509.CertificateRequest) (*x509.Certificate, error)
 }
 
 type app struct {
 	apiClient    mender.Client
 	authProvider AuthProvider
+	certPolicy   *CertPolicy
+	issuer       issuer.Issuer
+	replay       *ReplayGuard
 }
 
-func NewApp(apiClient mender.Client, auth AuthProvider) *app {
+// NewApp creates the app; certPolicy, iss and replay are optional,
+// nil skips the policy checks, disables cert renewal and skips
+// the replay protection respectively
+func NewApp(apiClient mender.Client, auth AuthProvider, certPolicy *CertPolicy,
+	iss issuer.Issuer, replay *ReplayGuard) *app {
 	return &app{
 		apiClient:    apiClient,
 		authProvider: auth,
+		certPolicy:   certPolicy,
+		issuer:       iss,
+		replay:       replay,
 	}
 }
 
 func (app *app) VerifyClientCert(ctx context.Context, certs []*x509.Certificate,
 	req *mender.AuthReq,
 	bodyRaw []byte,
-	bodySignature string) error {
+	bodySignature string) (err error) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "app.VerifyClientCert")
+	defer func() {
+		endSpan(span, err)
+	}()
 
 	if len(certs) == 0 {
 		return ErrCertNum
 	}
 
-	certKey := certs[0].PublicKey.(*rsa.PublicKey)
+	if app.certPolicy != nil {
+		if err := app.certPolicy.Check(certs[0], time.Now()); err != nil {
+			return err
+		}
+	}
+
+	certKey := certs[0].PublicKey
 
 	certKeyStr, err := utils.SerializePubKey(certKey)
 	if err != nil {
@@ -66,10 +99,26 @@ func (app *app) VerifyClientCert(ctx context.Context, certs []*x509.Certificate,
 		return ErrKeyMismatch
 	}
 
-	return utils.VerifyAuthReqSign(bodySignature, certKey, bodyRaw)
+	if err := utils.VerifyAuthReqSign(bodySignature, certKey, bodyRaw); err != nil {
+		return err
+	}
+
+	if app.replay != nil {
+		return app.replay.Check(req, time.Now())
+	}
+	return nil
 }
 
-func (app *app) Preauth(ctx context.Context, req *mender.AuthReq) error {
+func (app *app) Preauth(ctx context.Context, req *mender.AuthReq) (err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "app.Preauth")
+	defer func() {
+		// a conflict means the device is already known, it's not a failure
+		if err == ErrPreauthConflict {
+			endSpan(span, nil)
+		} else {
+			endSpan(span, err)
+		}
+	}()
 
 	token, err := app.authProvider.GetToken()
 	if err != nil {
@@ -88,3 +137,12 @@ func (app *app) Preauth(ctx context.Context, req *mender.AuthReq) error {
 
 	return err
 }
+
+// endSpan ends the span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
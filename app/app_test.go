@@ -8,21 +8,29 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"math/big"
 	"testing"
+	"time"
 
 	mapp "github.com/mendersoftware/mtls-ambassador/app/mocks"
 	"github.com/mendersoftware/mtls-ambassador/client/mender"
 	mmender "github.com/mendersoftware/mtls-ambassador/client/mender/mocks"
+	"github.com/mendersoftware/mtls-ambassador/utils"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func TestAppPreauth(t *testing.T) {
@@ -102,15 +110,16 @@ func TestAppPreauth(t *testing.T) {
 
 			client := &mmender.Client{}
 			if tc.authErr == nil {
+				// the context carries app.Preauth's span
 				client.On("Preauth",
-					ctx,
+					mock.Anything,
 					tc.authReq.IdData,
 					tc.authReq.PubKey,
 					tc.authToken).
 					Return(tc.clientErr)
 			}
 
-			app := NewApp(client, authProvider)
+			app := NewApp(client, authProvider, nil, nil, nil)
 
 			err := app.Preauth(ctx, tc.authReq)
 
@@ -257,7 +266,7 @@ c+LLPXwUqRuVoW5DaioEOflB86pL8ezacB1gI/TyQCa5T1VqZd84
 		t.Run(tc.name, func(*testing.T) {
 			ctx := context.TODO()
 			client := &mmender.Client{}
-			app := NewApp(client, nil)
+			app := NewApp(client, nil, nil, nil, nil)
 
 			certs := []*x509.Certificate{}
 			if tc.cert != "" {
@@ -294,6 +303,77 @@ c+LLPXwUqRuVoW5DaioEOflB86pL8ezacB1gI/TyQCa5T1VqZd84
 	}
 }
 
+func TestAppVerifyKeyTypes(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+		key  crypto.Signer
+		err  error
+	}{
+		{name: "ok, ecdsa", key: ecKey},
+		{name: "error, ed25519", key: edKey, err: errors.New("unrecognizable public key type")},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "device"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, tc.key.Public(), tc.key)
+			assert.NoError(t, err)
+			cert, err := x509.ParseCertificate(der)
+			assert.NoError(t, err)
+
+			pubKey := "key"
+			if tc.err == nil {
+				pubKey, err = utils.SerializePubKey(tc.key.Public())
+				assert.NoError(t, err)
+			}
+			req := &mender.AuthReq{
+				IdData: `{"sn": "0001"}`,
+				PubKey: pubKey,
+			}
+			raw, err := json.Marshal(req)
+			assert.NoError(t, err)
+
+			sum := sha256.Sum256(raw)
+			sig, err := tc.key.Sign(rand.Reader, sum[:], crypto.SHA256)
+			if tc.err != nil {
+				sig, err = tc.key.Sign(rand.Reader, raw, crypto.Hash(0))
+			}
+			assert.NoError(t, err)
+
+			app := NewApp(&mmender.Client{}, nil, nil, nil, nil)
+			err = app.VerifyClientCert(context.TODO(),
+				[]*x509.Certificate{cert}, req, raw,
+				base64.StdEncoding.EncodeToString(sig))
+			if tc.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err.Error())
+			}
+
+			// a signature over another body
+			err = app.VerifyClientCert(context.TODO(),
+				[]*x509.Certificate{cert}, req, []byte("{}"),
+				base64.StdEncoding.EncodeToString(sig))
+			assert.Error(t, err)
+		})
+	}
+}
+
 func sign(t *testing.T, data []byte, key crypto.PrivateKey) string {
 	hash := sha256.New()
 	if _, err := bytes.NewReader(data).WriteTo(hash); err != nil {
@@ -0,0 +1,252 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client cert policy rules, as reported in CertPolicyError
+const (
+	RuleMaxValidity        = "max_validity"
+	RuleNotYetValid        = "not_yet_valid"
+	RuleExpired            = "expired"
+	RuleKeySize            = "key_size"
+	RuleSignatureAlgorithm = "signature_algorithm"
+	RuleKeyUsage           = "key_usage"
+	RuleExtKeyUsage        = "ext_key_usage"
+	RulePolicy             = "policy"
+)
+
+var (
+	keyUsages = map[string]x509.KeyUsage{
+		"digital_signature":  x509.KeyUsageDigitalSignature,
+		"content_commitment": x509.KeyUsageContentCommitment,
+		"key_encipherment":   x509.KeyUsageKeyEncipherment,
+		"data_encipherment":  x509.KeyUsageDataEncipherment,
+		"key_agreement":      x509.KeyUsageKeyAgreement,
+		"cert_sign":          x509.KeyUsageCertSign,
+		"crl_sign":           x509.KeyUsageCRLSign,
+		"encipher_only":      x509.KeyUsageEncipherOnly,
+		"decipher_only":      x509.KeyUsageDecipherOnly,
+	}
+
+	extKeyUsages = map[string]x509.ExtKeyUsage{
+		"any":              x509.ExtKeyUsageAny,
+		"server_auth":      x509.ExtKeyUsageServerAuth,
+		"client_auth":      x509.ExtKeyUsageClientAuth,
+		"code_signing":     x509.ExtKeyUsageCodeSigning,
+		"email_protection": x509.ExtKeyUsageEmailProtection,
+		"time_stamping":    x509.ExtKeyUsageTimeStamping,
+		"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+	}
+)
+
+// CertPolicyError is returned by VerifyClientCert when the client's
+// leaf cert chains to the tenant CA, but violates the cert policy
+type CertPolicyError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *CertPolicyError) Error() string {
+	return fmt.Sprintf("client certificate policy violation: %s: %s", e.Rule, e.Reason)
+}
+
+// CertPolicy are the rules checked on the client's leaf cert,
+// on top of the chain verification done in the TLS handshake.
+// Zero values disable the respective rule.
+type CertPolicy struct {
+	// MaxValidity is the longest remaining validity accepted
+	MaxValidity time.Duration
+
+	// NotBeforeGrace tolerates certs which are not yet valid by up
+	// to this much, for devices with bad clocks
+	NotBeforeGrace time.Duration
+
+	MinRSAKeyBits int
+	MinECKeyBits  int
+
+	SignatureAlgorithms []x509.SignatureAlgorithm
+
+	// KeyUsage and ExtKeyUsage must all be present in the cert
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// Policies must all be present among the cert's policy identifiers
+	Policies []asn1.ObjectIdentifier
+}
+
+// Check verifies the cert against the policy, at the given time
+func (p *CertPolicy) Check(cert *x509.Certificate, now time.Time) error {
+	if now.Add(p.NotBeforeGrace).Before(cert.NotBefore) {
+		return &CertPolicyError{RuleNotYetValid,
+			fmt.Sprintf("valid from %s", cert.NotBefore.UTC())}
+	}
+
+	if now.After(cert.NotAfter) {
+		return &CertPolicyError{RuleExpired,
+			fmt.Sprintf("expired at %s", cert.NotAfter.UTC())}
+	}
+
+	if p.MaxValidity > 0 && cert.NotAfter.Sub(now) > p.MaxValidity {
+		return &CertPolicyError{RuleMaxValidity,
+			fmt.Sprintf("valid until %s, more than %s from now", cert.NotAfter.UTC(), p.MaxValidity)}
+	}
+
+	if err := p.checkKeySize(cert); err != nil {
+		return err
+	}
+
+	if len(p.SignatureAlgorithms) > 0 && !containsSignatureAlgorithm(p.SignatureAlgorithms, cert.SignatureAlgorithm) {
+		return &CertPolicyError{RuleSignatureAlgorithm,
+			fmt.Sprintf("%s not allowed", cert.SignatureAlgorithm)}
+	}
+
+	if cert.KeyUsage&p.KeyUsage != p.KeyUsage {
+		return &CertPolicyError{RuleKeyUsage,
+			fmt.Sprintf("has 0x%x, need 0x%x", cert.KeyUsage, p.KeyUsage)}
+	}
+
+	for _, eku := range p.ExtKeyUsage {
+		if !containsExtKeyUsage(cert.ExtKeyUsage, eku) {
+			return &CertPolicyError{RuleExtKeyUsage,
+				fmt.Sprintf("missing extended key usage %s", extKeyUsageName(eku))}
+		}
+	}
+
+	for _, oid := range p.Policies {
+		if !containsOID(cert.PolicyIdentifiers, oid) {
+			return &CertPolicyError{RulePolicy,
+				fmt.Sprintf("missing policy %s", oid)}
+		}
+	}
+
+	return nil
+}
+
+func (p *CertPolicy) checkKeySize(cert *x509.Certificate) error {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if bits := key.N.BitLen(); bits < p.MinRSAKeyBits {
+			return &CertPolicyError{RuleKeySize,
+				fmt.Sprintf("RSA key has %d bits, need %d", bits, p.MinRSAKeyBits)}
+		}
+	case *ecdsa.PublicKey:
+		if bits := key.Curve.Params().BitSize; bits < p.MinECKeyBits {
+			return &CertPolicyError{RuleKeySize,
+				fmt.Sprintf("EC key has %d bits, need %d", bits, p.MinECKeyBits)}
+		}
+	}
+	return nil
+}
+
+func containsSignatureAlgorithm(algs []x509.SignatureAlgorithm, alg x509.SignatureAlgorithm) bool {
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func containsExtKeyUsage(ekus []x509.ExtKeyUsage, eku x509.ExtKeyUsage) bool {
+	for _, e := range ekus {
+		if e == eku || e == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOID(oids []asn1.ObjectIdentifier, oid asn1.ObjectIdentifier) bool {
+	for _, o := range oids {
+		if o.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseKeyUsage parses key usage names (e.g. "digital_signature") into a bit mask
+func ParseKeyUsage(names []string) (x509.KeyUsage, error) {
+	var ku x509.KeyUsage
+	for _, name := range names {
+		u, ok := keyUsages[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown key usage %q", name)
+		}
+		ku |= u
+	}
+	return ku, nil
+}
+
+// ParseExtKeyUsage parses extended key usage names (e.g. "client_auth")
+func ParseExtKeyUsage(names []string) ([]x509.ExtKeyUsage, error) {
+	var ekus []x509.ExtKeyUsage
+	for _, name := range names {
+		eku, ok := extKeyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown extended key usage %q", name)
+		}
+		ekus = append(ekus, eku)
+	}
+	return ekus, nil
+}
+
+func extKeyUsageName(eku x509.ExtKeyUsage) string {
+	for name, e := range extKeyUsages {
+		if e == eku {
+			return name
+		}
+	}
+	return strconv.Itoa(int(eku))
+}
+
+// ParseSignatureAlgorithms parses signature algorithm names as printed by Go
+// (e.g. "SHA256-RSA", "ECDSA-SHA384", "Ed25519")
+func ParseSignatureAlgorithms(names []string) ([]x509.SignatureAlgorithm, error) {
+	known := map[string]x509.SignatureAlgorithm{}
+	for a := x509.MD2WithRSA; a <= x509.PureEd25519; a++ {
+		known[a.String()] = a
+	}
+
+	var algs []x509.SignatureAlgorithm
+	for _, name := range names {
+		a, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown signature algorithm %q", name)
+		}
+		algs = append(algs, a)
+	}
+	return algs, nil
+}
+
+// ParsePolicies parses certificate policy OIDs in dotted form (e.g. "1.3.6.1.4.1.311.21.8")
+func ParsePolicies(oids []string) ([]asn1.ObjectIdentifier, error) {
+	var policies []asn1.ObjectIdentifier
+	for _, s := range oids {
+		var oid asn1.ObjectIdentifier
+		for _, arc := range strings.Split(s, ".") {
+			n, err := strconv.Atoi(arc)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid policy OID %q", s)
+			}
+			oid = append(oid, n)
+		}
+		if len(oid) < 2 {
+			return nil, fmt.Errorf("invalid policy OID %q", s)
+		}
+		policies = append(policies, oid)
+	}
+	return policies, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+)
+
+func TestCertPolicyCheck(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+	policyOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := func() *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:      big.NewInt(1),
+			Subject:           pkix.Name{CommonName: "device"},
+			NotBefore:         now.Add(-time.Hour),
+			NotAfter:          now.Add(30 * 24 * time.Hour),
+			KeyUsage:          x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:       []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			PolicyIdentifiers: []asn1.ObjectIdentifier{policyOID},
+		}
+	}
+
+	strict := &CertPolicy{
+		MaxValidity:         90 * 24 * time.Hour,
+		NotBeforeGrace:      10 * time.Minute,
+		MinRSAKeyBits:       1024,
+		MinECKeyBits:        256,
+		SignatureAlgorithms: []x509.SignatureAlgorithm{x509.SHA256WithRSA, x509.ECDSAWithSHA256},
+		KeyUsage:            x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:         []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Policies:            []asn1.ObjectIdentifier{policyOID},
+	}
+
+	cases := []struct {
+		name string
+
+		policy *CertPolicy
+		cert   func(*x509.Certificate)
+		key    interface{}
+
+		outRule string
+	}{
+		{
+			name:   "ok, empty policy",
+			policy: &CertPolicy{},
+		},
+		{
+			name:   "ok, strict policy",
+			policy: strict,
+		},
+		{
+			name:   "ok, ec key",
+			policy: strict,
+			key:    ecKey,
+		},
+		{
+			name:   "ok, not yet valid, within grace",
+			policy: strict,
+			cert: func(c *x509.Certificate) {
+				c.NotBefore = now.Add(5 * time.Minute)
+			},
+		},
+		{
+			name:   "error, not yet valid",
+			policy: strict,
+			cert: func(c *x509.Certificate) {
+				c.NotBefore = now.Add(time.Hour)
+			},
+			outRule: RuleNotYetValid,
+		},
+		{
+			name:   "error, expired",
+			policy: &CertPolicy{},
+			cert: func(c *x509.Certificate) {
+				c.NotAfter = now.Add(-time.Minute)
+			},
+			outRule: RuleExpired,
+		},
+		{
+			name:   "error, max validity",
+			policy: strict,
+			cert: func(c *x509.Certificate) {
+				c.NotAfter = now.Add(365 * 24 * time.Hour)
+			},
+			outRule: RuleMaxValidity,
+		},
+		{
+			name: "error, rsa key size",
+			policy: &CertPolicy{
+				MinRSAKeyBits: 2048,
+			},
+			outRule: RuleKeySize,
+		},
+		{
+			name: "error, ec key size",
+			policy: &CertPolicy{
+				MinECKeyBits: 384,
+			},
+			key:     ecKey,
+			outRule: RuleKeySize,
+		},
+		{
+			name: "error, signature algorithm",
+			policy: &CertPolicy{
+				SignatureAlgorithms: []x509.SignatureAlgorithm{x509.SHA384WithRSA},
+			},
+			outRule: RuleSignatureAlgorithm,
+		},
+		{
+			name:   "error, key usage",
+			policy: strict,
+			cert: func(c *x509.Certificate) {
+				c.KeyUsage = x509.KeyUsageKeyEncipherment
+			},
+			outRule: RuleKeyUsage,
+		},
+		{
+			name:   "error, ext key usage",
+			policy: strict,
+			cert: func(c *x509.Certificate) {
+				c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			},
+			outRule: RuleExtKeyUsage,
+		},
+		{
+			name:   "error, policy",
+			policy: strict,
+			cert: func(c *x509.Certificate) {
+				c.PolicyIdentifiers = nil
+			},
+			outRule: RulePolicy,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl := template()
+			if tc.cert != nil {
+				tc.cert(tmpl)
+			}
+
+			var signer interface{} = rsaKey
+			var pub interface{} = &rsaKey.PublicKey
+			if tc.key != nil {
+				signer = tc.key
+				pub = &tc.key.(*ecdsa.PrivateKey).PublicKey
+			}
+
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, signer)
+			assert.NoError(t, err)
+			cert, err := x509.ParseCertificate(der)
+			assert.NoError(t, err)
+
+			err = tc.policy.Check(cert, now)
+			if tc.outRule == "" {
+				assert.NoError(t, err)
+			} else {
+				perr, ok := err.(*CertPolicyError)
+				assert.True(t, ok)
+				if ok {
+					assert.Equal(t, tc.outRule, perr.Rule)
+				}
+			}
+		})
+	}
+}
+
+func TestAppVerifyCertPolicy(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	app := NewApp(nil, nil, &CertPolicy{MinRSAKeyBits: 2048}, nil, nil)
+	err = app.VerifyClientCert(context.TODO(),
+		[]*x509.Certificate{cert},
+		&mender.AuthReq{},
+		[]byte("{}"),
+		"")
+
+	assert.IsType(t, &CertPolicyError{}, err)
+	assert.EqualError(t, err,
+		"client certificate policy violation: key_size: RSA key has 1024 bits, need 2048")
+}
+
+func TestParseCertPolicySettings(t *testing.T) {
+	t.Parallel()
+
+	ku, err := ParseKeyUsage([]string{"digital_signature", "key_encipherment"})
+	assert.NoError(t, err)
+	assert.Equal(t, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment, ku)
+	_, err = ParseKeyUsage([]string{"signing"})
+	assert.EqualError(t, err, `unknown key usage "signing"`)
+
+	ekus, err := ParseExtKeyUsage([]string{"client_auth"})
+	assert.NoError(t, err)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, ekus)
+	_, err = ParseExtKeyUsage([]string{"device_auth"})
+	assert.EqualError(t, err, `unknown extended key usage "device_auth"`)
+
+	algs, err := ParseSignatureAlgorithms([]string{"SHA256-RSA", "ECDSA-SHA384", "Ed25519"})
+	assert.NoError(t, err)
+	assert.Equal(t, []x509.SignatureAlgorithm{x509.SHA256WithRSA, x509.ECDSAWithSHA384, x509.PureEd25519}, algs)
+	_, err = ParseSignatureAlgorithms([]string{"SHA256"})
+	assert.EqualError(t, err, `unknown signature algorithm "SHA256"`)
+
+	oids, err := ParsePolicies([]string{"2.23.140.1.2.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}}, oids)
+	_, err = ParsePolicies([]string{"2.x.1"})
+	assert.EqualError(t, err, `invalid policy OID "2.x.1"`)
+}
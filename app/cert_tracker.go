@@ -0,0 +1,136 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	day = 24 * time.Hour
+)
+
+var (
+	certRemainingLifetime = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "mtls_client_cert_remaining_lifetime_seconds",
+		Help: "Remaining lifetime of client certs, observed once per connection.",
+		Buckets: []float64{
+			(1 * day).Seconds(),
+			(7 * day).Seconds(),
+			(14 * day).Seconds(),
+			(30 * day).Seconds(),
+			(60 * day).Seconds(),
+			(90 * day).Seconds(),
+			(180 * day).Seconds(),
+			(365 * day).Seconds(),
+		},
+	})
+)
+
+// TrackedCert is the last seen state of a client cert
+type TrackedCert struct {
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotAfter    time.Time `json:"not_after"`
+	LastSeen    time.Time `json:"last_seen"`
+	RemoteAddr  string    `json:"remote_addr"`
+}
+
+// CertTracker keeps the client certs seen on authenticated connections,
+// to find the devices about to lock themselves out
+type CertTracker struct {
+	mu         sync.Mutex
+	certs      map[string]*TrackedCert
+	maxEntries int
+}
+
+// NewCertTracker creates a tracker of at most maxEntries certs;
+// beyond that, the least recently seen ones are dropped
+func NewCertTracker(maxEntries int) *CertTracker {
+	return &CertTracker{
+		certs:      map[string]*TrackedCert{},
+		maxEntries: maxEntries,
+	}
+}
+
+// CertFingerprint is the hex SHA-256 of the cert's DER encoding
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Observe records a client cert seen on a new connection
+func (t *CertTracker) Observe(cert *x509.Certificate, remoteAddr string, now time.Time) {
+	certRemainingLifetime.Observe(cert.NotAfter.Sub(now).Seconds())
+
+	fp := CertFingerprint(cert)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tc, ok := t.certs[fp]; ok {
+		tc.LastSeen = now
+		tc.RemoteAddr = remoteAddr
+		return
+	}
+
+	if len(t.certs) >= t.maxEntries {
+		t.evict()
+	}
+
+	t.certs[fp] = &TrackedCert{
+		Fingerprint: fp,
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Serial:      cert.SerialNumber.String(),
+		NotAfter:    cert.NotAfter,
+		LastSeen:    now,
+		RemoteAddr:  remoteAddr,
+	}
+}
+
+// evict drops the least recently seen cert
+func (t *CertTracker) evict() {
+	var oldest *TrackedCert
+	for _, tc := range t.certs {
+		if oldest == nil || tc.LastSeen.Before(oldest.LastSeen) {
+			oldest = tc
+		}
+	}
+	if oldest != nil {
+		delete(t.certs, oldest.Fingerprint)
+	}
+}
+
+// Expiring returns the certs which expire within the given time from now
+// (including the already expired ones), soonest first
+func (t *CertTracker) Expiring(within time.Duration, now time.Time) []TrackedCert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deadline := now.Add(within)
+	ret := []TrackedCert{}
+	for _, tc := range t.certs {
+		if tc.NotAfter.Before(deadline) {
+			ret = append(ret, *tc)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].NotAfter.Before(ret[j].NotAfter)
+	})
+
+	return ret
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertTracker(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	cert := func(serial int64, notAfter time.Time) *x509.Certificate {
+		return &x509.Certificate{
+			Raw:          big.NewInt(serial).Bytes(),
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "device"},
+			Issuer:       pkix.Name{CommonName: "Tenant CA"},
+			NotAfter:     notAfter,
+		}
+	}
+
+	tracker := NewCertTracker(3)
+	tracker.Observe(cert(1, now.Add(10*day)), "10.0.0.1:1000", now)
+	tracker.Observe(cert(2, now.Add(-day)), "10.0.0.2:1000", now.Add(time.Minute))
+	tracker.Observe(cert(3, now.Add(100*day)), "10.0.0.3:1000", now.Add(2*time.Minute))
+
+	// seen again - moves to the back of the eviction queue
+	tracker.Observe(cert(1, now.Add(10*day)), "10.0.0.1:2000", now.Add(3*time.Minute))
+
+	expiring := tracker.Expiring(30*day, now)
+	assert.Len(t, expiring, 2)
+	assert.Equal(t, "2", expiring[0].Serial)
+	assert.Equal(t, "1", expiring[1].Serial)
+	assert.Equal(t, "10.0.0.1:2000", expiring[1].RemoteAddr)
+	assert.Equal(t, now.Add(3*time.Minute), expiring[1].LastSeen)
+	assert.Equal(t, "CN=device", expiring[1].Subject)
+	assert.Equal(t, "CN=Tenant CA", expiring[1].Issuer)
+	assert.Equal(t, CertFingerprint(cert(1, now)), expiring[1].Fingerprint)
+
+	// full - evicts the least recently seen (2)
+	tracker.Observe(cert(4, now.Add(5*day)), "10.0.0.4:1000", now.Add(4*time.Minute))
+
+	expiring = tracker.Expiring(365*day, now)
+	assert.Len(t, expiring, 3)
+	for _, tc := range expiring {
+		assert.NotEqual(t, "2", tc.Serial)
+	}
+	assert.Equal(t, "4", expiring[0].Serial)
+}
@@ -34,6 +34,29 @@ func (_m *App) Preauth(ctx context.Context, req *mender.AuthReq) error {
 	return r0
 }
 
+// RenewCert provides a mock function with given fields: ctx, certs, idData, csr
+func (_m *App) RenewCert(ctx context.Context, certs []*x509.Certificate, idData string, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	ret := _m.Called(ctx, certs, idData, csr)
+
+	var r0 *x509.Certificate
+	if rf, ok := ret.Get(0).(func(context.Context, []*x509.Certificate, string, *x509.CertificateRequest) *x509.Certificate); ok {
+		r0 = rf(ctx, certs, idData, csr)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*x509.Certificate)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []*x509.Certificate, string, *x509.CertificateRequest) error); ok {
+		r1 = rf(ctx, certs, idData, csr)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // VerifyClientCert provides a mock function with given fields: ctx, certs, req, bodyRaw, bodySignature
 func (_m *App) VerifyClientCert(ctx context.Context, certs []*x509.Certificate, req *mender.AuthReq, bodyRaw []byte, bodySignature string) error {
 	ret := _m.Called(ctx, certs, req, bodyRaw, bodySignature)
@@ -0,0 +1,124 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"go.opentelemetry.io/otel"
+
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+var (
+	ErrRenewalDisabled = errors.New("certificate renewal is not configured")
+	ErrInvalidCSR      = errors.New("invalid CSR signature")
+	ErrRenewIdentity   = errors.New("CSR subject or SANs differ from the current certificate")
+	ErrRenewSameKey    = errors.New("CSR must have a new key")
+)
+
+// RenewCert issues a new cert for an enrolled device, for a CSR with
+// the current cert's subject and SANs and a new key, and preauthorizes the new key
+// with Mender under the device's identity data - so that the device can
+// switch to the new cert and key right away
+func (app *app) RenewCert(ctx context.Context,
+	certs []*x509.Certificate,
+	idData string,
+	csr *x509.CertificateRequest) (cert *x509.Certificate, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "app.RenewCert")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if app.issuer == nil {
+		return nil, ErrRenewalDisabled
+	}
+
+	if len(certs) == 0 {
+		return nil, ErrCertNum
+	}
+	current := certs[0]
+
+	if app.certPolicy != nil {
+		if err := app.certPolicy.Check(current, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, ErrInvalidCSR
+	}
+
+	if !SameIdentity(csr, current) {
+		return nil, ErrRenewIdentity
+	}
+
+	curKey, err := utils.SerializePubKey(current.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := utils.SerializePubKey(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if curKey == newKey {
+		return nil, ErrRenewSameKey
+	}
+
+	cert, err = app.issuer.Issue(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := log.FromContext(ctx)
+	l.Infof("renewed certificate of %q: %s, valid until %s",
+		cert.Subject, cert.SerialNumber, cert.NotAfter.UTC())
+
+	err = app.Preauth(ctx, &mender.AuthReq{
+		IdData: idData,
+		PubKey: newKey,
+	})
+	if err == ErrPreauthConflict {
+		l.Infof("preauthorizing the renewed key of %q: conflict, proceeding", cert.Subject)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// SameIdentity tells whether the CSR asks for the subject and SANs of the cert,
+// so that a renewed cert can't claim another identity
+func SameIdentity(csr *x509.CertificateRequest, cert *x509.Certificate) bool {
+	return csr.Subject.String() == cert.Subject.String() &&
+		reflect.DeepEqual(csr.DNSNames, cert.DNSNames) &&
+		reflect.DeepEqual(csr.EmailAddresses, cert.EmailAddresses) &&
+		reflect.DeepEqual(ipStrings(csr.IPAddresses), ipStrings(cert.IPAddresses)) &&
+		reflect.DeepEqual(uriStrings(csr.URIs), uriStrings(cert.URIs))
+}
+
+func ipStrings(ips []net.IP) []string {
+	var ret []string
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	return ret
+}
+
+func uriStrings(uris []*url.URL) []string {
+	var ret []string
+	for _, u := range uris {
+		ret = append(ret, u.String())
+	}
+	return ret
+}
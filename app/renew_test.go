@@ -0,0 +1,176 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	mapp "github.com/mendersoftware/mtls-ambassador/app/mocks"
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	mmender "github.com/mendersoftware/mtls-ambassador/client/mender/mocks"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+	missuer "github.com/mendersoftware/mtls-ambassador/issuer/mocks"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+func TestAppRenewCert(t *testing.T) {
+	t.Parallel()
+
+	curKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device-1"},
+		URIs:         []*url.URL{{Scheme: "urn", Opaque: "device:1"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &curKey.PublicKey, curKey)
+	assert.NoError(t, err)
+	current, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	csr := func(cn, uri string, key *ecdsa.PrivateKey) *x509.CertificateRequest {
+		u, err := url.Parse(uri)
+		assert.NoError(t, err)
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: cn},
+			URIs:    []*url.URL{u},
+		}, key)
+		assert.NoError(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		assert.NoError(t, err)
+		return csr
+	}
+
+	newPub, err := utils.SerializePubKey(&newKey.PublicKey)
+	assert.NoError(t, err)
+	renewed := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device-1"},
+	}
+
+	cases := []struct {
+		name string
+
+		noIssuer bool
+		certs    []*x509.Certificate
+		csr      *x509.CertificateRequest
+
+		issueErr   error
+		preauthErr error
+
+		outErr error
+	}{
+		{
+			name:  "ok",
+			certs: []*x509.Certificate{current},
+			csr:   csr("device-1", "urn:device:1", newKey),
+		},
+		{
+			name:       "ok, preauth conflict",
+			certs:      []*x509.Certificate{current},
+			csr:        csr("device-1", "urn:device:1", newKey),
+			preauthErr: mender.ErrPreauthConflict,
+		},
+		{
+			name:     "error, renewal disabled",
+			noIssuer: true,
+			certs:    []*x509.Certificate{current},
+			csr:      csr("device-1", "urn:device:1", newKey),
+			outErr:   ErrRenewalDisabled,
+		},
+		{
+			name:   "error, no cert",
+			csr:    csr("device-1", "urn:device:1", newKey),
+			outErr: ErrCertNum,
+		},
+		{
+			name:   "error, other subject",
+			certs:  []*x509.Certificate{current},
+			csr:    csr("device-2", "urn:device:1", newKey),
+			outErr: ErrRenewIdentity,
+		},
+		{
+			name:   "error, other SAN",
+			certs:  []*x509.Certificate{current},
+			csr:    csr("device-1", "urn:device:2", newKey),
+			outErr: ErrRenewIdentity,
+		},
+		{
+			name:   "error, same key",
+			certs:  []*x509.Certificate{current},
+			csr:    csr("device-1", "urn:device:1", curKey),
+			outErr: ErrRenewSameKey,
+		},
+		{
+			name:     "error, issuer",
+			certs:    []*x509.Certificate{current},
+			csr:      csr("device-1", "urn:device:1", newKey),
+			issueErr: errors.New("issuer down"),
+			outErr:   errors.New("issuer down"),
+		},
+		{
+			name:       "error, preauth",
+			certs:      []*x509.Certificate{current},
+			csr:        csr("device-1", "urn:device:1", newKey),
+			preauthErr: errors.New("mender down"),
+			outErr:     errors.New("mender down"),
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			authProvider := &mapp.AuthProvider{}
+			authProvider.On("GetToken").Return("token", nil)
+
+			client := &mmender.Client{}
+			// the contexts carry app.RenewCert's span
+			client.On("Preauth", mock.Anything, `{"sn": "0001"}`, newPub, "token").
+				Return(tc.preauthErr)
+
+			iss := &missuer.Issuer{}
+			iss.On("Issue", mock.Anything, mock.AnythingOfType("*x509.CertificateRequest")).
+				Return(renewed, tc.issueErr)
+
+			var ci issuer.Issuer = iss
+			if tc.noIssuer {
+				ci = nil
+			}
+			app := NewApp(client, authProvider, nil, ci, nil)
+
+			cert, err := app.RenewCert(ctx, tc.certs, `{"sn": "0001"}`, tc.csr)
+			if tc.outErr != nil {
+				assert.EqualError(t, err, tc.outErr.Error())
+				assert.Nil(t, cert)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, renewed, cert)
+			iss.AssertExpectations(t)
+			client.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+)
+
+// replay protection modes
+const (
+	// ReplayOff ignores nonces and timestamps
+	ReplayOff = "off"
+	// ReplayOptional checks auth requests which carry a nonce and timestamp,
+	// and lets legacy ones without them through
+	ReplayOptional = "optional"
+	// ReplayRequire rejects auth requests without a nonce and timestamp
+	ReplayRequire = "require"
+)
+
+// replay protection failures, as reported in ReplayError
+const (
+	ReplayReasonMissing   = "missing"
+	ReplayReasonTimestamp = "timestamp"
+	ReplayReasonStale     = "stale"
+	ReplayReasonReplayed  = "replayed"
+	ReplayReasonFull      = "full"
+)
+
+var (
+	authReplayRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_auth_replay_rejected_total",
+		Help: "Auth requests rejected by the replay protection, by reason.",
+	}, []string{"reason"})
+)
+
+// ReplayError is returned by VerifyClientCert when a correctly signed
+// auth request fails the replay protection
+type ReplayError struct {
+	Reason string
+	Detail string
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("auth request replay protection: %s: %s", e.Reason, e.Detail)
+}
+
+// ReplayGuard enforces the freshness of auth requests which opted in
+// by carrying a nonce and a timestamp. Both are in the signed body,
+// so neither can be changed without invalidating the signature.
+type ReplayGuard struct {
+	Mode string
+	// Window is the max difference of the timestamp from the current time
+	Window time.Duration
+	Nonces *NonceStore
+}
+
+// Check verifies the auth request's timestamp is within the window
+// and its nonce wasn't seen for the same key before
+func (g *ReplayGuard) Check(req *mender.AuthReq, now time.Time) error {
+	err := g.check(req, now)
+	if e, ok := err.(*ReplayError); ok {
+		authReplayRejected.WithLabelValues(e.Reason).Inc()
+	}
+	return err
+}
+
+func (g *ReplayGuard) check(req *mender.AuthReq, now time.Time) error {
+	if g.Mode == ReplayOff {
+		return nil
+	}
+
+	if req.Nonce == "" && req.Timestamp == "" {
+		if g.Mode == ReplayRequire {
+			return &ReplayError{ReplayReasonMissing, "no nonce and timestamp"}
+		}
+		return nil
+	}
+	if req.Nonce == "" || req.Timestamp == "" {
+		return &ReplayError{ReplayReasonMissing, "need both nonce and timestamp"}
+	}
+
+	ts, err := time.Parse(time.RFC3339, req.Timestamp)
+	if err != nil {
+		return &ReplayError{ReplayReasonTimestamp,
+			fmt.Sprintf("invalid timestamp %q", req.Timestamp)}
+	}
+	if d := now.Sub(ts); d > g.Window || d < -g.Window {
+		return &ReplayError{ReplayReasonStale,
+			fmt.Sprintf("timestamp %s more than %s from now", ts.UTC(), g.Window)}
+	}
+
+	// the nonce is only unique per key; it must be kept as long as its
+	// timestamp passes the window check, i.e. at most 2 windows from now
+	switch g.Nonces.Add(nonceKey(req.PubKey, req.Nonce), now.Add(2*g.Window), now) {
+	case ErrNonceSeen:
+		return &ReplayError{ReplayReasonReplayed,
+			fmt.Sprintf("nonce %q already seen", req.Nonce)}
+	case ErrNonceStoreFull:
+		return &ReplayError{ReplayReasonFull,
+			fmt.Sprintf("%d unexpired nonces already recorded", g.Nonces.max)}
+	}
+
+	return nil
+}
+
+func nonceKey(pubKey, nonce string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(pubKey + "\n" + nonce))
+}
+
+var (
+	ErrNonceSeen      = errors.New("nonce already seen")
+	ErrNonceStoreFull = errors.New("nonce store full")
+)
+
+// NonceStore is a bounded set of seen nonces; when it's full of
+// unexpired ones, new nonces are refused rather than forgetting
+// any which could still be replayed
+type NonceStore struct {
+	max int
+
+	mu sync.Mutex
+	// seen holds the nonces' elements in order, oldest first
+	seen  map[[sha256.Size]byte]*list.Element
+	order *list.List
+}
+
+type nonceEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+func NewNonceStore(max int) *NonceStore {
+	return &NonceStore{
+		max:   max,
+		seen:  map[[sha256.Size]byte]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// Add records the nonce until it expires; it returns ErrNonceSeen
+// if the nonce was already recorded and is not expired yet, and
+// ErrNonceStoreFull if there's no room for it
+func (s *NonceStore) Add(key [sha256.Size]byte, expires, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// expirations are added in order - prune from the front
+	for e := s.order.Front(); e != nil; e = s.order.Front() {
+		entry := e.Value.(*nonceEntry)
+		if entry.expires.After(now) {
+			break
+		}
+		s.remove(e)
+	}
+
+	if _, ok := s.seen[key]; ok {
+		return ErrNonceSeen
+	}
+	if s.order.Len() >= s.max {
+		return ErrNonceStoreFull
+	}
+	s.seen[key] = s.order.PushBack(&nonceEntry{key: key, expires: expires})
+
+	return nil
+}
+
+// Len is the number of nonces recorded
+func (s *NonceStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *NonceStore) remove(e *list.Element) {
+	delete(s.seen, e.Value.(*nonceEntry).key)
+	s.order.Remove(e)
+}
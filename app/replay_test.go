@@ -0,0 +1,206 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+)
+
+func TestReplayGuardCheck(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	ts := now.Format(time.RFC3339)
+
+	cases := []struct {
+		name string
+		mode string
+		// seen are the nonces of key "key-1" already seen
+		seen []string
+		req  *mender.AuthReq
+
+		outReason string
+	}{
+		{
+			name: "ok, off",
+			mode: ReplayOff,
+			seen: []string{"n1"},
+			req:  &mender.AuthReq{PubKey: "key-1", Nonce: "n1", Timestamp: "bogus"},
+		},
+		{
+			name: "ok, optional, legacy",
+			mode: ReplayOptional,
+			req:  &mender.AuthReq{PubKey: "key-1"},
+		},
+		{
+			name: "ok, optional",
+			mode: ReplayOptional,
+			seen: []string{"n1"},
+			req:  &mender.AuthReq{PubKey: "key-1", Nonce: "n2", Timestamp: ts},
+		},
+		{
+			name: "ok, require, within window",
+			mode: ReplayRequire,
+			req: &mender.AuthReq{PubKey: "key-1", Nonce: "n1",
+				Timestamp: now.Add(-4 * time.Minute).Format(time.RFC3339)},
+		},
+		{
+			name: "ok, same nonce, other key",
+			mode: ReplayRequire,
+			seen: []string{"n1"},
+			req:  &mender.AuthReq{PubKey: "key-2", Nonce: "n1", Timestamp: ts},
+		},
+		{
+			name: "error, require, legacy",
+			mode: ReplayRequire,
+			req:  &mender.AuthReq{PubKey: "key-1"},
+
+			outReason: ReplayReasonMissing,
+		},
+		{
+			name: "error, optional, no nonce",
+			mode: ReplayOptional,
+			req:  &mender.AuthReq{PubKey: "key-1", Timestamp: ts},
+
+			outReason: ReplayReasonMissing,
+		},
+		{
+			name: "error, timestamp",
+			mode: ReplayOptional,
+			req:  &mender.AuthReq{PubKey: "key-1", Nonce: "n1", Timestamp: "1591012800"},
+
+			outReason: ReplayReasonTimestamp,
+		},
+		{
+			name: "error, too old",
+			mode: ReplayOptional,
+			req: &mender.AuthReq{PubKey: "key-1", Nonce: "n1",
+				Timestamp: now.Add(-6 * time.Minute).Format(time.RFC3339)},
+
+			outReason: ReplayReasonStale,
+		},
+		{
+			name: "error, in the future",
+			mode: ReplayOptional,
+			req: &mender.AuthReq{PubKey: "key-1", Nonce: "n1",
+				Timestamp: now.Add(6 * time.Minute).Format(time.RFC3339)},
+
+			outReason: ReplayReasonStale,
+		},
+		{
+			name: "error, replayed",
+			mode: ReplayOptional,
+			seen: []string{"n0", "n1"},
+			req:  &mender.AuthReq{PubKey: "key-1", Nonce: "n1", Timestamp: ts},
+
+			outReason: ReplayReasonReplayed,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			g := &ReplayGuard{
+				Mode:   tc.mode,
+				Window: 5 * time.Minute,
+				Nonces: NewNonceStore(10),
+			}
+			for _, n := range tc.seen {
+				assert.NoError(t, g.Nonces.Add(nonceKey("key-1", n), now.Add(time.Hour), now))
+			}
+
+			err := g.Check(tc.req, now)
+			if tc.outReason == "" {
+				assert.NoError(t, err)
+			} else {
+				e, ok := err.(*ReplayError)
+				assert.True(t, ok, err)
+				if ok {
+					assert.Equal(t, tc.outReason, e.Reason)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayGuardCheckTwice(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	g := &ReplayGuard{Mode: ReplayOptional, Window: time.Minute, Nonces: NewNonceStore(10)}
+	req := &mender.AuthReq{PubKey: "key", Nonce: "n", Timestamp: now.Format(time.RFC3339)}
+
+	before := testutil.ToFloat64(authReplayRejected.WithLabelValues(ReplayReasonReplayed))
+
+	assert.NoError(t, g.Check(req, now))
+	assert.EqualError(t, g.Check(req, now.Add(30*time.Second)),
+		`auth request replay protection: replayed: nonce "n" already seen`)
+	assert.Equal(t, before+1, testutil.ToFloat64(authReplayRejected.WithLabelValues(ReplayReasonReplayed)))
+}
+
+func TestReplayGuardFull(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	g := &ReplayGuard{Mode: ReplayOptional, Window: time.Minute, Nonces: NewNonceStore(2)}
+	req := func(n string) *mender.AuthReq {
+		return &mender.AuthReq{PubKey: "key", Nonce: n, Timestamp: now.Format(time.RFC3339)}
+	}
+
+	before := testutil.ToFloat64(authReplayRejected.WithLabelValues(ReplayReasonFull))
+
+	assert.NoError(t, g.Check(req("a"), now))
+	assert.NoError(t, g.Check(req("b"), now))
+	assert.EqualError(t, g.Check(req("c"), now),
+		`auth request replay protection: full: 2 unexpired nonces already recorded`)
+	assert.Equal(t, before+1, testutil.ToFloat64(authReplayRejected.WithLabelValues(ReplayReasonFull)))
+
+	// still not replayable
+	assert.EqualError(t, g.Check(req("a"), now),
+		`auth request replay protection: replayed: nonce "a" already seen`)
+
+	// room again once they expire
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, g.Check(req("c"), now))
+}
+
+func TestNonceStore(t *testing.T) {
+	t.Parallel()
+
+	s := NewNonceStore(3)
+	now := time.Now()
+	key := func(n string) [32]byte {
+		return nonceKey("key", n)
+	}
+
+	assert.NoError(t, s.Add(key("a"), now.Add(time.Minute), now))
+	assert.NoError(t, s.Add(key("b"), now.Add(2*time.Minute), now))
+	assert.Equal(t, ErrNonceSeen, s.Add(key("a"), now.Add(2*time.Minute), now))
+	assert.Equal(t, 2, s.Len())
+
+	// a expired
+	now = now.Add(time.Minute)
+	assert.NoError(t, s.Add(key("a"), now.Add(2*time.Minute), now))
+	assert.Equal(t, 2, s.Len())
+
+	// bounded - full of unexpired nonces, new ones are refused
+	assert.NoError(t, s.Add(key("c"), now.Add(2*time.Minute), now))
+	assert.Equal(t, ErrNonceStoreFull, s.Add(key("d"), now.Add(2*time.Minute), now))
+	assert.Equal(t, ErrNonceSeen, s.Add(key("b"), now.Add(2*time.Minute), now))
+	assert.Equal(t, 3, s.Len())
+
+	// b expired, making room
+	now = now.Add(time.Minute)
+	assert.NoError(t, s.Add(key("d"), now.Add(2*time.Minute), now))
+	assert.Equal(t, 3, s.Len())
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	"github.com/mendersoftware/mtls-ambassador/artifacts"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+var (
+	// artifactCache is shared by the virtual hosts and kept across
+	// reloads - its settings take effect after a restart
+	artifactCache     *artifacts.Cache
+	artifactCacheInit bool
+	artifactCacheMu   sync.Mutex
+
+	// downloadSecret signs the rewritten download links without a configured
+	// secret; it's kept across reloads, so that the links stay valid
+	downloadSecret   []byte
+	downloadSecretMu sync.Mutex
+)
+
+// NewArtifactCache opens the artifact download cache, on first use;
+// nil means the cache is off
+func NewArtifactCache(c config.Reader) (*artifacts.Cache, error) {
+	artifactCacheMu.Lock()
+	defer artifactCacheMu.Unlock()
+
+	if artifactCacheInit {
+		return artifactCache, nil
+	}
+
+	cache, err := newArtifactCache(c)
+	if err != nil {
+		return nil, err
+	}
+	artifactCache, artifactCacheInit = cache, true
+	return cache, nil
+}
+
+func newArtifactCache(c config.Reader) (*artifacts.Cache, error) {
+	dir := c.GetString(aconfig.SettingArtifactCacheDir)
+	if dir == "" {
+		return nil, nil
+	}
+
+	maxSize, err := cast.ToInt64E(c.Get(aconfig.SettingArtifactCacheMaxSize))
+	if err != nil || maxSize <= 0 {
+		return nil, errors.Errorf("%s must be a positive number of bytes",
+			aconfig.SettingArtifactCacheMaxSize)
+	}
+	maxArtifactSize, err := cast.ToInt64E(c.Get(aconfig.SettingArtifactCacheMaxArtifactSize))
+	if err != nil || maxArtifactSize < 0 {
+		return nil, errors.Errorf("%s must not be negative",
+			aconfig.SettingArtifactCacheMaxArtifactSize)
+	}
+
+	cache, err := artifacts.NewCache(dir, maxSize, maxArtifactSize)
+	return cache, errors.Wrap(err, aconfig.SettingArtifactCacheDir)
+}
+
+// NewArtifactDownloads parses the settings of rewritten artifact download
+// links; nil means the links are not rewritten
+func NewArtifactDownloads(c config.Reader, cache *artifacts.Cache) (*api.ArtifactDownloads, error) {
+	if !c.GetBool(aconfig.SettingArtifactDownloadRewrite) {
+		return nil, nil
+	}
+
+	ttl := c.GetDuration(aconfig.SettingArtifactDownloadTTL)
+	if ttl <= 0 {
+		return nil, errors.Errorf("%s must be positive", aconfig.SettingArtifactDownloadTTL)
+	}
+
+	secret := []byte(c.GetString(aconfig.SettingArtifactDownloadSecret))
+	if len(secret) == 0 {
+		var err error
+		if secret, err = randomDownloadSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: c.GetBool(aconfig.SettingInsecureSkipVerify),
+		},
+	}
+
+	return api.NewArtifactDownloads(api.ArtifactDownloadConfig{
+		Secret: secret,
+		TTL:    ttl,
+		Client: &http.Client{Transport: otelhttp.NewTransport(tr)},
+		Cache:  cache,
+	})
+}
+
+func randomDownloadSecret() ([]byte, error) {
+	downloadSecretMu.Lock()
+	defer downloadSecretMu.Unlock()
+
+	if downloadSecret == nil {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errors.Wrap(err, "failed to generate download link secret")
+		}
+		downloadSecret = secret
+	}
+	return downloadSecret, nil
+}
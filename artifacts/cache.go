@@ -0,0 +1,393 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package artifacts caches artifact downloads on disk, so that
+// the devices of a site fetch each artifact from its origin once.
+package artifacts
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// results of cached downloads
+	ResultHit    = "hit"
+	ResultShared = "shared"
+	ResultMiss   = "miss"
+	ResultBypass = "bypass"
+
+	// fillIdleTimeout fails fills without data from the origin for this long
+	fillIdleTimeout = time.Minute
+
+	fileExt = ".artifact"
+	tmpExt  = ".tmp"
+)
+
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_artifact_cache_requests_total",
+		Help: "Artifact downloads by cache result: hit, shared (joined a fill), miss or bypass (not cacheable).",
+	}, []string{"result"})
+	cacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mtls_artifact_cache_size_bytes",
+		Help: "Artifacts cached on disk, including the ones being filled.",
+	})
+	cacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mtls_artifact_cache_evictions_total",
+		Help: "Artifacts evicted from the cache to make room for others.",
+	})
+
+	errNotCached = errors.New("not cached")
+
+	l = log.NewEmpty()
+)
+
+// Fetch gets an artifact, whole, from its origin
+type Fetch func() (*http.Response, error)
+
+// Cache keeps artifacts in a directory up to a total size, evicting
+// the least recently used; concurrent downloads of an artifact
+// not cached yet share one fetch, streamed while it's filled in
+type Cache struct {
+	dir             string
+	maxSize         int64
+	maxArtifactSize int64
+
+	mu sync.Mutex
+	// size is of the cached artifacts and the ones being filled
+	size int64
+	// entries are the cached artifacts by name, in lru - most recent first
+	entries map[string]*list.Element
+	lru     *list.List
+	fills   map[string]*fill
+}
+
+type entry struct {
+	name        string
+	size        int64
+	contentType string
+	modTime     time.Time
+}
+
+// NewCache opens the cache in dir, keeping the artifacts cached there before;
+// artifacts larger than maxArtifactSize are not cached, 0 means maxSize
+func NewCache(dir string, maxSize, maxArtifactSize int64) (*Cache, error) {
+	if maxSize <= 0 {
+		return nil, errors.New("max size must be positive")
+	}
+	if maxArtifactSize <= 0 || maxArtifactSize > maxSize {
+		maxArtifactSize = maxSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create cache dir")
+	}
+
+	c := &Cache{
+		dir:             dir,
+		maxSize:         maxSize,
+		maxArtifactSize: maxArtifactSize,
+		entries:         map[string]*list.Element{},
+		lru:             list.New(),
+		fills:           map[string]*fill{},
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes the artifacts in the dir by modification time, the time
+// of their last use, and drops the unfinished fills of an earlier run
+func (c *Cache) load() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read cache dir")
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	for _, fi := range files {
+		switch {
+		case strings.HasSuffix(fi.Name(), tmpExt):
+			_ = os.Remove(filepath.Join(c.dir, fi.Name()))
+		case strings.HasSuffix(fi.Name(), fileExt) && fi.Mode().IsRegular():
+			e := &entry{
+				name:        strings.TrimSuffix(fi.Name(), fileExt),
+				size:        fi.Size(),
+				contentType: "application/octet-stream",
+				modTime:     fi.ModTime(),
+			}
+			c.entries[e.name] = c.lru.PushBack(e)
+			c.size += e.size
+		}
+	}
+
+	c.mu.Lock()
+	c.evict(0)
+	c.mu.Unlock()
+	cacheSize.Set(float64(c.size))
+
+	l.Infof("artifact cache %s: %d artifacts, %d bytes", c.dir, len(c.entries), c.size)
+	return nil
+}
+
+// Serve serves the artifact - from the cache, the running fill, or a new
+// one; Range requests are supported. The key identifies the artifact,
+// e.g. its ID, fetch gets it on a miss.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, key string, fetch Fetch) {
+	lg := log.FromContext(r.Context())
+	name := c.name(key)
+	// artifacts never change, their key is a strong validator, e.g. for If-Range
+	w.Header().Set("ETag", `"`+name[:32]+`"`)
+
+	c.mu.Lock()
+	if el, ok := c.entries[name]; ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*entry)
+		c.mu.Unlock()
+
+		f, err := os.Open(c.path(name, fileExt))
+		if err == nil {
+			defer f.Close()
+			now := time.Now()
+			_ = os.Chtimes(f.Name(), now, now)
+
+			cacheRequests.WithLabelValues(ResultHit).Inc()
+			lg.Debugf("artifact %s: cache hit", key)
+			w.Header().Set("Content-Type", e.contentType)
+			http.ServeContent(w, r, "", e.modTime, f)
+			return
+		}
+		lg.Warnf("artifact %s: dropping unreadable cached file: %s", key, err)
+		c.mu.Lock()
+		c.remove(el)
+	}
+
+	fl, filling := c.fills[name]
+	if !filling {
+		fl = newFill(c.path(name, tmpExt))
+		c.fills[name] = fl
+	}
+	c.mu.Unlock()
+
+	result := ResultShared
+	if !filling {
+		rsp, err := c.startFill(name, fl, fetch)
+		if err != nil {
+			c.mu.Lock()
+			delete(c.fills, name)
+			c.mu.Unlock()
+			fl.finish(err)
+
+			cacheRequests.WithLabelValues(ResultBypass).Inc()
+			lg.Debugf("artifact %s: not cached: %s", key, err)
+			passThrough(w, rsp)
+			return
+		}
+		go c.fill(name, key, fl, rsp)
+		result = ResultMiss
+	}
+
+	rd, err := fl.reader()
+	if err != nil {
+		// the fill this joined was not cacheable, try on our own
+		if err == errNotCached {
+			cacheRequests.WithLabelValues(ResultBypass).Inc()
+			rsp, _ := fetch()
+			passThrough(w, rsp)
+			return
+		}
+		lg.Errorf("artifact %s: cache fill failed: %s", key, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer rd.Close()
+
+	cacheRequests.WithLabelValues(result).Inc()
+	lg.Debugf("artifact %s: serving while filling the cache", key)
+	w.Header().Set("Content-Type", fl.contentType)
+	http.ServeContent(w, r, "", time.Time{}, rd)
+}
+
+// startFill fetches the artifact and, if it can be cached, starts the
+// fill's writes; the response is returned either way, if any
+func (c *Cache) startFill(name string, fl *fill, fetch Fetch) (*http.Response, error) {
+	rsp, err := fetch()
+	if err != nil {
+		fl.start(nil, 0, "", errNotCached)
+		return nil, err
+	}
+
+	// only whole, sized artifacts which fit are cached
+	if rsp.StatusCode != http.StatusOK || rsp.ContentLength < 0 ||
+		rsp.ContentLength > c.maxArtifactSize || !c.reserve(rsp.ContentLength) {
+		fl.start(nil, 0, "", errNotCached)
+		return rsp, errNotCached
+	}
+
+	tmp, err := os.OpenFile(fl.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		c.release(rsp.ContentLength)
+		fl.start(nil, 0, "", errNotCached)
+		return rsp, errors.Wrap(err, "failed to create cache file")
+	}
+
+	contentType := rsp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	fl.start(tmp, rsp.ContentLength, contentType, nil)
+	return rsp, nil
+}
+
+// fill writes the origin's response into the cache
+func (c *Cache) fill(name, key string, fl *fill, rsp *http.Response) {
+	err := c.write(name, fl, rsp)
+
+	c.mu.Lock()
+	delete(c.fills, name)
+	if err == nil {
+		e := &entry{
+			name:        name,
+			size:        fl.size,
+			contentType: fl.contentType,
+			modTime:     time.Now(),
+		}
+		c.entries[name] = c.lru.PushFront(e)
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		l.Errorf("artifact %s: cache fill failed: %s", key, err)
+	}
+	fl.finish(err)
+}
+
+func (c *Cache) write(name string, fl *fill, rsp *http.Response) error {
+	defer rsp.Body.Close()
+
+	// a stalled origin must not hold the fill's readers forever
+	idle := time.AfterFunc(fillIdleTimeout, func() { rsp.Body.Close() })
+	defer idle.Stop()
+
+	n, err := io.Copy(fl, &idleReader{r: rsp.Body, t: idle})
+	if err == nil && n != rsp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if cerr := fl.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fl.commit(c.path(name, fileExt))
+	}
+	if err != nil {
+		_ = os.Remove(fl.file.Name())
+		c.release(rsp.ContentLength)
+		return err
+	}
+	return nil
+}
+
+// reserve makes room for an artifact, evicting others if needed
+func (c *Cache) reserve(size int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.evict(size) {
+		return false
+	}
+	c.size += size
+	cacheSize.Set(float64(c.size))
+	return true
+}
+
+func (c *Cache) release(size int64) {
+	c.mu.Lock()
+	c.size -= size
+	cacheSize.Set(float64(c.size))
+	c.mu.Unlock()
+}
+
+// evict removes the least recently used artifacts until there's
+// room for size more bytes; called with mu held
+func (c *Cache) evict(size int64) bool {
+	for c.size+size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			// the rest is being filled
+			return false
+		}
+		l.Infof("artifact cache: evicting %s", el.Value.(*entry).name)
+		c.remove(el)
+		cacheEvictions.Inc()
+	}
+	return true
+}
+
+// remove drops a cached artifact; readers keep their open file; called with mu held
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.name)
+	c.size -= e.size
+	cacheSize.Set(float64(c.size))
+	_ = os.Remove(c.path(e.name, fileExt))
+}
+
+// name is the key's file name; keys may be anything
+func (c *Cache) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) path(name, ext string) string {
+	return filepath.Join(c.dir, name+ext)
+}
+
+// passThrough copies the origin's response, uncached; none is a 502
+func passThrough(w http.ResponseWriter, rsp *http.Response) {
+	if rsp == nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer rsp.Body.Close()
+
+	w.Header().Del("ETag")
+	for _, h := range []string{"Content-Type", "Content-Length", "Last-Modified"} {
+		if v := rsp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(rsp.StatusCode)
+	_, _ = io.Copy(w, rsp.Body)
+}
+
+// idleReader restarts the idle timer on every read
+type idleReader struct {
+	r io.Reader
+	t *time.Timer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Reset(fillIdleTimeout)
+	return n, err
+}
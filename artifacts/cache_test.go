@@ -0,0 +1,240 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package artifacts
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// origin serves artifacts by path, counting the fetches; a gate
+// holds the second half of each body until released
+type origin struct {
+	artifacts map[string][]byte
+	fetches   int32
+	gate      chan struct{}
+}
+
+func (o *origin) fetch(key string) Fetch {
+	return func() (*http.Response, error) {
+		atomic.AddInt32(&o.fetches, 1)
+		data, ok := o.artifacts[key]
+		if !ok {
+			return &http.Response{
+				StatusCode: http.StatusForbidden,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte("expired"))),
+			}, nil
+		}
+		rsp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/vnd.mender-artifact"}},
+			ContentLength: int64(len(data)),
+			Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		}
+		if o.gate != nil {
+			half := len(data) / 2
+			gate := o.gate
+			rsp.Body = ioutil.NopCloser(io.MultiReader(
+				bytes.NewReader(data[:half]),
+				&gatedReader{gate: gate, r: bytes.NewReader(data[half:])}))
+		}
+		return rsp, nil
+	}
+}
+
+type gatedReader struct {
+	gate chan struct{}
+	r    *bytes.Reader
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	<-g.gate
+	return g.r.Read(p)
+}
+
+func get(c *Cache, key string, fetch Fetch, hdr http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/artifact", nil)
+	for k, v := range hdr {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	c.Serve(w, r, key, fetch)
+	return w
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func artifact(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func TestCacheServe(t *testing.T) {
+	t.Parallel()
+
+	o := &origin{artifacts: map[string][]byte{
+		"a": artifact(1000, 'a'),
+		"b": artifact(5000, 'b'),
+	}}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	c, err := NewCache(dir, 10000, 2000)
+	assert.NoError(t, err)
+
+	t.Run("ok, miss then hit", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			w := get(c, "a", o.fetch("a"), nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, o.artifacts["a"], w.Body.Bytes())
+			assert.Equal(t, "application/vnd.mender-artifact", w.Header().Get("Content-Type"))
+			assert.NotEmpty(t, w.Header().Get("ETag"))
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&o.fetches))
+	})
+
+	t.Run("ok, range", func(t *testing.T) {
+		w := get(c, "a", o.fetch("a"), http.Header{"Range": {"bytes=100-199"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "bytes 100-199/1000", w.Header().Get("Content-Range"))
+		assert.Equal(t, o.artifacts["a"][100:200], w.Body.Bytes())
+	})
+
+	t.Run("ok, too large passed through", func(t *testing.T) {
+		fetches := atomic.LoadInt32(&o.fetches)
+		for i := 0; i < 2; i++ {
+			w := get(c, "b", o.fetch("b"), nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, o.artifacts["b"], w.Body.Bytes())
+			assert.Empty(t, w.Header().Get("ETag"))
+		}
+		assert.Equal(t, fetches+2, atomic.LoadInt32(&o.fetches))
+	})
+
+	t.Run("ok, origin error passed through", func(t *testing.T) {
+		w := get(c, "gone", o.fetch("gone"), nil)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "expired", w.Body.String())
+	})
+}
+
+func TestCacheConcurrentFill(t *testing.T) {
+	t.Parallel()
+
+	o := &origin{
+		artifacts: map[string][]byte{"a": artifact(100000, 'a')},
+		gate:      make(chan struct{}),
+	}
+	for i := range o.artifacts["a"] {
+		o.artifacts["a"][i] = byte(i)
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	c, err := NewCache(dir, 1000000, 0)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	rsps := make([]*httptest.ResponseRecorder, 8)
+	for i := range rsps {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var hdr http.Header
+			if i%2 == 1 {
+				hdr = http.Header{"Range": {"bytes=" + strconv.Itoa(i*1000) + "-"}}
+			}
+			rsps[i] = get(c, "a", o.fetch("a"), hdr)
+		}()
+	}
+
+	// all downloads wait on the one fill
+	time.Sleep(100 * time.Millisecond)
+	close(o.gate)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&o.fetches))
+	for i, w := range rsps {
+		if i%2 == 1 {
+			assert.Equal(t, http.StatusPartialContent, w.Code)
+			assert.Equal(t, o.artifacts["a"][i*1000:], w.Body.Bytes())
+		} else {
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, o.artifacts["a"], w.Body.Bytes())
+		}
+	}
+
+	// cached now
+	w := get(c, "a", o.fetch("a"), nil)
+	assert.Equal(t, o.artifacts["a"], w.Body.Bytes())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&o.fetches))
+}
+
+func TestCacheEviction(t *testing.T) {
+	t.Parallel()
+
+	o := &origin{artifacts: map[string][]byte{
+		"a": artifact(400, 'a'),
+		"b": artifact(400, 'b'),
+		"c": artifact(400, 'c'),
+	}}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	c, err := NewCache(dir, 1000, 0)
+	assert.NoError(t, err)
+
+	fetches := func(keys ...string) int32 {
+		before := atomic.LoadInt32(&o.fetches)
+		for _, k := range keys {
+			w := get(c, k, o.fetch(k), nil)
+			assert.Equal(t, o.artifacts[k], w.Body.Bytes())
+		}
+		return atomic.LoadInt32(&o.fetches) - before
+	}
+
+	assert.Equal(t, int32(2), fetches("a", "b"))
+	// a is used more recently than b, which makes room for c
+	assert.Equal(t, int32(0), fetches("a"))
+	assert.Equal(t, int32(1), fetches("c"))
+	assert.Equal(t, int32(0), fetches("a", "c"))
+	assert.Equal(t, int32(1), fetches("b"))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+fileExt))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// kept across restarts, unfinished fills dropped
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "x"+tmpExt), []byte("x"), 0600))
+	c, err = NewCache(dir, 1000, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), fetches("b", "c"))
+	_, err = os.Stat(filepath.Join(dir, "x"+tmpExt))
+	assert.True(t, os.IsNotExist(err))
+
+	// shrunk on restart
+	c, err = NewCache(dir, 500, 0)
+	assert.NoError(t, err)
+	assert.Len(t, c.entries, 1)
+}
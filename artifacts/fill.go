@@ -0,0 +1,161 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package artifacts
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// fill is an artifact being written to the cache; its readers
+// follow the writes, so that downloads needn't wait for the whole
+type fill struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// path is the file's, renamed into place once complete
+	path string
+	file *os.File
+
+	started     bool
+	size        int64
+	contentType string
+	written     int64
+	done        bool
+	err         error
+}
+
+func newFill(path string) *fill {
+	f := &fill{path: path}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// start begins the writes of size bytes, or fails the fill before any
+func (f *fill) start(file *os.File, size int64, contentType string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.started = true
+	f.file = file
+	f.size = size
+	f.contentType = contentType
+	if err != nil {
+		f.err = err
+		f.done = true
+	}
+	f.cond.Broadcast()
+}
+
+func (f *fill) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+
+	f.mu.Lock()
+	f.written += int64(n)
+	f.cond.Broadcast()
+	f.mu.Unlock()
+
+	return n, err
+}
+
+// commit moves the complete file into place
+func (f *fill) commit(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := os.Rename(f.path, path); err != nil {
+		return err
+	}
+	f.path = path
+	return nil
+}
+
+func (f *fill) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.done = true
+	if f.err == nil {
+		f.err = err
+	}
+	f.cond.Broadcast()
+}
+
+// reader opens a reader of the artifact, once the fill started
+func (f *fill) reader() (*fillReader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for !f.started {
+		f.cond.Wait()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open cache file")
+	}
+	return &fillReader{f: f, file: file}, nil
+}
+
+// fillReader reads an artifact being filled, waiting for the writes
+type fillReader struct {
+	f    *fill
+	file *os.File
+	off  int64
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	f := r.f
+
+	f.mu.Lock()
+	for r.off >= f.written && !f.done {
+		f.cond.Wait()
+	}
+	written, err := f.written, f.err
+	f.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if r.off >= written {
+		return 0, io.EOF
+	}
+	if avail := written - r.off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek works within the artifact's full size, as known from the start
+func (r *fillReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.f.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *fillReader) Close() error {
+	return r.file.Close()
+}
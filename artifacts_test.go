@@ -0,0 +1,157 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func TestNewArtifactCache(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "artifacts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		outCache bool
+		outErr   string
+	}{
+		{
+			name: "ok, defaults: off",
+		},
+		{
+			name: "ok",
+
+			settings: map[string]interface{}{
+				aconfig.SettingArtifactCacheDir:             dir,
+				aconfig.SettingArtifactCacheMaxSize:         "1073741824",
+				aconfig.SettingArtifactCacheMaxArtifactSize: 512 * 1024 * 1024,
+			},
+
+			outCache: true,
+		},
+		{
+			name: "error, max size",
+
+			settings: map[string]interface{}{
+				aconfig.SettingArtifactCacheDir:     dir,
+				aconfig.SettingArtifactCacheMaxSize: "10G",
+			},
+
+			outErr: "artifact_cache_max_size must be a positive number of bytes",
+		},
+		{
+			name: "error, max artifact size",
+
+			settings: map[string]interface{}{
+				aconfig.SettingArtifactCacheDir:             dir,
+				aconfig.SettingArtifactCacheMaxArtifactSize: -1,
+			},
+
+			outErr: "artifact_cache_max_artifact_size must not be negative",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			cache, err := newArtifactCache(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.outCache, cache != nil)
+		})
+	}
+}
+
+func TestNewArtifactDownloads(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		outDownloads bool
+		outErr       string
+	}{
+		{
+			name: "ok, defaults: off",
+		},
+		{
+			name: "ok",
+
+			settings: map[string]interface{}{
+				aconfig.SettingArtifactDownloadRewrite: true,
+				aconfig.SettingArtifactDownloadSecret:  "secret",
+			},
+
+			outDownloads: true,
+		},
+		{
+			name: "ok, generated secret",
+
+			settings: map[string]interface{}{
+				aconfig.SettingArtifactDownloadRewrite: true,
+			},
+
+			outDownloads: true,
+		},
+		{
+			name: "error, ttl",
+
+			settings: map[string]interface{}{
+				aconfig.SettingArtifactDownloadRewrite: true,
+				aconfig.SettingArtifactDownloadTTL:     "0s",
+			},
+
+			outErr: "artifact_download_ttl must be positive",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			downloads, err := NewArtifactDownloads(c, nil)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.outDownloads, downloads != nil)
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+)
+
+// newCA loads the internal CA with its profile and store;
+// it's nil if the CA is not configured
+func newCA(c config.Reader) (*ca.CA, error) {
+	if c.GetString(aconfig.SettingCACert) == "" {
+		return nil, nil
+	}
+
+	l.Infof("loading internal CA %s", c.GetString(aconfig.SettingCACert))
+
+	issuer, err := ca.Load(
+		c.GetString(aconfig.SettingCACert),
+		c.GetString(aconfig.SettingCAKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load internal CA")
+	}
+
+	issuer.Profile, err = newCAProfile(c)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer.Store, err = ca.OpenStore(c.GetString(aconfig.SettingCAStore))
+	if err != nil {
+		return nil, err
+	}
+
+	l.Info("loading internal CA: ok")
+	return issuer, nil
+}
+
+// newIssuer creates the issuer of device certs selected by the issuer setting;
+// it's nil (no EST, renewal or admin signing) if the internal CA is selected
+// but not configured
+func newIssuer(c config.Reader) (issuer.Issuer, error) {
+	switch typ := c.GetString(aconfig.SettingIssuer); typ {
+	case issuer.TypeLocal:
+		localCA, err := newCA(c)
+		if err != nil || localCA == nil {
+			// no typed nil in the interface
+			return nil, err
+		}
+		return localCA, nil
+	case issuer.TypeVault:
+		return newVaultIssuer(c)
+	default:
+		return nil, errors.Errorf("%s: unknown issuer %q", aconfig.SettingIssuer, typ)
+	}
+}
+
+// newVaultIssuer creates the Vault PKI issuer
+func newVaultIssuer(c config.Reader) (issuer.Issuer, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if pem := c.GetString(aconfig.SettingIssuerCAPem); pem != "" {
+		roots, err := certPool(pem)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load issuer CA")
+		}
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}
+	}
+
+	v, err := issuer.NewVault(issuer.VaultConfig{
+		URL:    c.GetString(aconfig.SettingIssuerURL),
+		Mount:  c.GetString(aconfig.SettingIssuerVaultMount),
+		Role:   c.GetString(aconfig.SettingIssuerVaultRole),
+		Token:  c.GetString(aconfig.SettingIssuerToken),
+		TTL:    c.GetDuration(aconfig.SettingCACertValidity),
+		Client: client,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Vault issuer")
+	}
+
+	l.Infof("issuing device certificates with Vault %s", c.GetString(aconfig.SettingIssuerURL))
+	return v, nil
+}
+
+// caStore is the internal CA's issued certs store, if there's a CA
+func caStore(localCA *ca.CA) *ca.Store {
+	if localCA == nil {
+		return nil
+	}
+	return localCA.Store
+}
+
+// newCAProfile parses and validates the internal CA's profile settings
+func newCAProfile(c config.Reader) (*ca.Profile, error) {
+	p := &ca.Profile{
+		Validity:       c.GetDuration(aconfig.SettingCACertValidity),
+		DNSNames:       c.GetStringSlice(aconfig.SettingCASANDNS),
+		URIs:           c.GetStringSlice(aconfig.SettingCASANURI),
+		EmailAddresses: c.GetStringSlice(aconfig.SettingCASANEmail),
+	}
+
+	var err error
+	p.KeyUsage, err = app.ParseKeyUsage(c.GetStringSlice(aconfig.SettingCAKeyUsage))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingCAKeyUsage)
+	}
+
+	p.ExtKeyUsage, err = app.ParseExtKeyUsage(c.GetStringSlice(aconfig.SettingCAExtKeyUsage))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingCAExtKeyUsage)
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid CA profile")
+	}
+
+	return p, nil
+}
+
+// caCommand manages the internal CA from the command line
+var caCommand = cli.Command{
+	Name:  "ca",
+	Usage: "Manage the internal CA (ca_* settings).",
+	Subcommands: []cli.Command{
+		{
+			Name:   "sign",
+			Usage:  "Issue a certificate for a PEM encoded CSR.",
+			Action: cmdCASign,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "csr",
+					Usage: "CSR `FILE` (PEM).",
+				},
+				&cli.StringFlag{
+					Name:  "out",
+					Usage: "Certificate `FILE` (PEM); stdout if not set.",
+				},
+			},
+		},
+		{
+			Name:   "revoke",
+			Usage:  "Revoke an issued certificate.",
+			Action: cmdCARevoke,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "serial",
+					Usage: "Decimal serial `NUMBER` of the certificate.",
+				},
+			},
+		},
+		{
+			Name:   "list",
+			Usage:  "List the issued certificates (JSON).",
+			Action: cmdCAList,
+		},
+	},
+}
+
+func cmdCASign(args *cli.Context) error {
+	issuer, err := requireCA()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(args.String("csr"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("failed to read CSR: %s", err), 1)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return cli.NewExitError("expected a PEM encoded CERTIFICATE REQUEST", 1)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("failed to parse CSR: %s", err), 1)
+	}
+
+	cert, err := issuer.Sign(csr)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	l.Infof("issued certificate %s for %q, valid until %s",
+		cert.SerialNumber, cert.Subject, cert.NotAfter.UTC())
+
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if path := args.String("out"); path != "" {
+		err = ioutil.WriteFile(path, out, 0644)
+	} else {
+		_, err = os.Stdout.Write(out)
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("failed to write certificate: %s", err), 1)
+	}
+	return nil
+}
+
+func cmdCARevoke(args *cli.Context) error {
+	issuer, err := requireCA()
+	if err != nil {
+		return err
+	}
+
+	serial := args.String("serial")
+	if err := issuer.Store.Revoke(serial, time.Now()); err != nil {
+		return cli.NewExitError(fmt.Sprintf("failed to revoke %s: %s", serial, err), 1)
+	}
+	l.Infof("revoked certificate %s", serial)
+	return nil
+}
+
+func cmdCAList(args *cli.Context) error {
+	issuer, err := requireCA()
+	if err != nil {
+		return err
+	}
+
+	certs, err := issuer.Store.List()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(certs)
+}
+
+func requireCA() (*ca.CA, error) {
+	issuer, err := newCA(config.Config)
+	if err != nil {
+		return nil, cli.NewExitError(err.Error(), 1)
+	}
+	if issuer == nil {
+		return nil, cli.NewExitError(
+			fmt.Sprintf("the internal CA is not configured (%s)", aconfig.SettingCACert), 1)
+	}
+	return issuer, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package ca issues device client certs from a local CA key.
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// backdate issued certs a bit, for devices with clocks running late
+	notBeforeSkew = 5 * time.Minute
+)
+
+var (
+	l = log.NewEmpty()
+
+	ErrNoPEM            = errors.New("no PEM data found")
+	ErrUnsupportedKey   = errors.New("unsupported private key type")
+	ErrKeyMismatch      = errors.New("CA key does not match the CA cert")
+	ErrNotCA            = errors.New("certificate is not a CA")
+	ErrInvalidCSR       = errors.New("invalid CSR signature")
+	ErrValidityTooShort = errors.New("validity must be positive")
+	serialNumberLimit   = new(big.Int).Lsh(big.NewInt(1), 128)
+)
+
+// CA is an issuing (typically intermediate) CA: its cert and signing key,
+// the profile of the certs it issues and the record of them
+type CA struct {
+	Cert   *x509.Certificate
+	Signer crypto.Signer
+
+	Profile *Profile
+	// Store, if set, records the issued certs and their revocation
+	Store *Store
+}
+
+// Load reads the CA cert and its private key from PEM files
+func Load(certFile, keyFile string) (*CA, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CA cert")
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CA key")
+	}
+
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA cert")
+	}
+	signer, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA key")
+	}
+
+	return New(cert, signer)
+}
+
+// New creates a CA from its cert and a signer holding the matching private key;
+// set its Profile (and Store) before signing
+func New(cert *x509.Certificate, signer crypto.Signer) (*CA, error) {
+	if !cert.IsCA {
+		return nil, ErrNotCA
+	}
+
+	certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	if string(certPub) != string(keyPub) {
+		return nil, ErrKeyMismatch
+	}
+
+	return &CA{
+		Cert:   cert,
+		Signer: signer,
+	}, nil
+}
+
+// Sign issues a cert for the CSR's subject and public key, shaped by the profile
+// and valid for the profile's validity (but not beyond the CA cert)
+func (ca *CA) Sign(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, ErrInvalidCSR
+	}
+	if ca.Profile == nil || ca.Profile.Validity <= 0 {
+		return nil, ErrValidityTooShort
+	}
+
+	serial, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	now := time.Now()
+	notAfter := now.Add(ca.Profile.Validity)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             now.Add(-notBeforeSkew),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+	}
+	if err := ca.Profile.apply(tmpl, csr); err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, csr.PublicKey, ca.Signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign certificate")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if ca.Store != nil {
+		if err := ca.Store.Add(cert, now); err != nil {
+			return nil, errors.Wrap(err, "failed to record certificate")
+		}
+	}
+
+	return cert, nil
+}
+
+// Issue signs the CSR, as the local issuer.Issuer
+func (ca *CA) Issue(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return ca.Sign(csr)
+}
+
+// CACerts returns the CA's own cert, as the local issuer.Issuer
+func (ca *CA) CACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	return []*x509.Certificate{ca.Cert}, nil
+}
+
+// IsRevoked tells whether the cert was issued by this CA and revoked since
+func (ca *CA) IsRevoked(cert *x509.Certificate) bool {
+	if ca.Store == nil || !bytes.Equal(cert.RawIssuer, ca.Cert.RawSubject) {
+		return false
+	}
+	return ca.Store.IsRevoked(cert.SerialNumber.String())
+}
+
+// ParseCertificate parses the first cert of a PEM bundle
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoPEM
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS#1, SEC 1 or PKCS#8 private key
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoPEM
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, ErrUnsupportedKey
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCA(t *testing.T, notAfter time.Time) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Issuing CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return cert, key
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ca")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := newTestCA(t, time.Now().Add(time.Hour))
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	otherKeyFile := filepath.Join(dir, "other.key")
+	assert.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	assert.NoError(t, ioutil.WriteFile(otherKeyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)}), 0600))
+
+	ca, err := Load(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, ca.Cert.Raw)
+
+	_, err = Load(certFile, otherKeyFile)
+	assert.EqualError(t, err, ErrKeyMismatch.Error())
+
+	_, err = Load(certFile, certFile)
+	assert.Error(t, err)
+}
+
+func TestSign(t *testing.T) {
+	t.Parallel()
+
+	caNotAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	caCert, caKey := newTestCA(t, caNotAfter)
+	ca, err := New(caCert, caKey)
+	assert.NoError(t, err)
+
+	devKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device-1"},
+		DNSNames: []string{"device-1.example.com"},
+	}, devKey)
+	assert.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	assert.NoError(t, err)
+
+	ca.Profile = &Profile{Validity: time.Hour}
+	cert, err := ca.Sign(csr)
+	assert.NoError(t, err)
+	assert.Equal(t, "device-1", cert.Subject.CommonName)
+	assert.Equal(t, []string{"device-1.example.com"}, cert.DNSNames)
+	assert.Equal(t, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment, cert.KeyUsage)
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.ExtKeyUsage)
+	assert.NoError(t, cert.CheckSignatureFrom(caCert))
+
+	// capped at the CA's expiry
+	ca.Profile.Validity = 365 * 24 * time.Hour
+	cert, err = ca.Sign(csr)
+	assert.NoError(t, err)
+	assert.True(t, caNotAfter.Equal(cert.NotAfter))
+
+	ca.Profile.Validity = 0
+	_, err = ca.Sign(csr)
+	assert.EqualError(t, err, ErrValidityTooShort.Error())
+
+	csr.Signature[0] ^= 0xff
+	_, err = ca.Sign(csr)
+	assert.EqualError(t, err, ErrInvalidCSR.Error())
+}
+
+func TestSignProfile(t *testing.T) {
+	t.Parallel()
+
+	caCert, caKey := newTestCA(t, time.Now().Add(48*time.Hour))
+	ca, err := New(caCert, caKey)
+	assert.NoError(t, err)
+
+	devKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   "device-1",
+			SerialNumber: "SN123",
+			Organization: []string{"Tenant Foo"},
+		},
+		DNSNames:       []string{"device-1.example.com"},
+		EmailAddresses: []string{"device-1@example.com"},
+	}, devKey)
+	assert.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+
+		profile *Profile
+
+		outKeyUsage x509.KeyUsage
+		outEKU      []x509.ExtKeyUsage
+		outDNS      []string
+		outEmails   []string
+		outURIs     []string
+		outErr      string
+	}{
+		{
+			name:        "ok, defaults copy the CSR's SANs",
+			profile:     &Profile{Validity: time.Hour},
+			outKeyUsage: x509.KeyUsageDigitalSignature,
+			outEKU:      []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			outDNS:      []string{"device-1.example.com"},
+			outEmails:   []string{"device-1@example.com"},
+		},
+		{
+			name: "ok, usages and templates",
+			profile: &Profile{
+				Validity:    time.Hour,
+				KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+				DNSNames:    []string{"{{.CommonName}}.devices.example.com", "{{.OrganizationalUnit}}"},
+				URIs:        []string{"urn:{{.Organization}}:{{.SerialNumber}}"},
+			},
+			outKeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+			outEKU:      []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+			outDNS:      []string{"device-1.devices.example.com"},
+			outEmails:   []string{"device-1@example.com"},
+			outURIs:     []string{"urn:Tenant Foo:SN123"},
+		},
+		{
+			name: "error, unknown field",
+			profile: &Profile{
+				Validity: time.Hour,
+				DNSNames: []string{"{{.Hostname}}"},
+			},
+			outErr: "failed to render SAN template",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ca := *ca
+			ca.Profile = tc.profile
+
+			cert, err := ca.Sign(csr)
+			if tc.outErr != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), tc.outErr)
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.outKeyUsage, cert.KeyUsage)
+			assert.Equal(t, tc.outEKU, cert.ExtKeyUsage)
+			assert.Equal(t, tc.outDNS, cert.DNSNames)
+			assert.Equal(t, tc.outEmails, cert.EmailAddresses)
+			var uris []string
+			for _, u := range cert.URIs {
+				uris = append(uris, u.String())
+			}
+			assert.Equal(t, tc.outURIs, uris)
+		})
+	}
+}
+
+func TestStoreRevocation(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ca")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "issued.json")
+
+	caCert, caKey := newTestCA(t, time.Now().Add(48*time.Hour))
+	ca, err := New(caCert, caKey)
+	assert.NoError(t, err)
+	ca.Profile = &Profile{Validity: time.Hour}
+	ca.Store, err = OpenStore(path)
+	assert.NoError(t, err)
+
+	devKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device-1"},
+	}, devKey)
+	assert.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	assert.NoError(t, err)
+
+	cert, err := ca.Sign(csr)
+	assert.NoError(t, err)
+	assert.False(t, ca.IsRevoked(cert))
+
+	issued, err := ca.Store.List()
+	assert.NoError(t, err)
+	assert.Len(t, issued, 1)
+	assert.Equal(t, cert.SerialNumber.String(), issued[0].Serial)
+	assert.Equal(t, "CN=device-1", issued[0].Subject)
+
+	// revoked by another process, e.g. the CLI
+	other, err := OpenStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, other.Revoke(cert.SerialNumber.String(), time.Now()))
+	assert.EqualError(t, other.Revoke(cert.SerialNumber.String(), time.Now()), ErrAlreadyRevoked.Error())
+	assert.EqualError(t, other.Revoke("1", time.Now()), ErrCertNotFound.Error())
+
+	assert.True(t, ca.IsRevoked(cert))
+
+	// same serial, different issuer
+	foreign := *cert
+	foreign.RawIssuer = []byte("someone else")
+	assert.False(t, ca.IsRevoked(&foreign))
+}
+
+func TestStoreConcurrentWriters(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ca")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "issued.json")
+
+	// e.g. the server and the 'ca' CLI
+	a, err := OpenStore(path)
+	assert.NoError(t, err)
+	b, err := OpenStore(path)
+	assert.NoError(t, err)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i, s := range []*Store{a, b} {
+		wg.Add(1)
+		go func(i int, s *Store) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				assert.NoError(t, s.Add(&x509.Certificate{
+					SerialNumber: big.NewInt(int64(i*n + j + 1)),
+					Subject:      pkix.Name{CommonName: "device"},
+				}, time.Now()))
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	issued, err := a.List()
+	assert.NoError(t, err)
+	assert.Len(t, issued, 2*n)
+
+	assert.NoError(t, b.Revoke("1", time.Now()))
+	assert.NoError(t, a.Revoke(strconv.Itoa(2*n), time.Now()))
+	assert.True(t, a.IsRevoked("1"))
+	assert.True(t, b.IsRevoked(strconv.Itoa(2*n)))
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package ca
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Profile shapes the certs issued from CSRs
+type Profile struct {
+	Validity time.Duration
+
+	// KeyUsage defaults to digital_signature (plus key_encipherment for RSA keys)
+	KeyUsage x509.KeyUsage
+	// ExtKeyUsage defaults to client_auth
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// SAN templates, rendered with the CSR's fields (see csrFields), e.g.
+	// "urn:dev:{{.CommonName}}"; if none are set for a SAN type,
+	// the CSR's SANs of that type are copied as is
+	DNSNames       []string
+	URIs           []string
+	EmailAddresses []string
+}
+
+// csrFields are the CSR fields available to SAN templates
+type csrFields struct {
+	CommonName         string
+	SerialNumber       string
+	Organization       string
+	OrganizationalUnit string
+	DNSNames           []string
+	EmailAddresses     []string
+	URIs               []string
+}
+
+// Validate checks the validity and parses the SAN templates
+func (p *Profile) Validate() error {
+	if p.Validity <= 0 {
+		return ErrValidityTooShort
+	}
+	for _, tmpls := range [][]string{p.DNSNames, p.URIs, p.EmailAddresses} {
+		for _, t := range tmpls {
+			if _, err := template.New("san").Option("missingkey=error").Parse(t); err != nil {
+				return errors.Wrapf(err, "invalid SAN template %q", t)
+			}
+		}
+	}
+	return nil
+}
+
+// apply fills in the cert template's usages and SANs for the CSR
+func (p *Profile) apply(tmpl *x509.Certificate, csr *x509.CertificateRequest) error {
+	tmpl.KeyUsage = p.KeyUsage
+	if tmpl.KeyUsage == 0 {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+			tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+
+	tmpl.ExtKeyUsage = p.ExtKeyUsage
+	if len(tmpl.ExtKeyUsage) == 0 {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	fields := newCSRFields(csr)
+
+	tmpl.DNSNames = csr.DNSNames
+	if len(p.DNSNames) > 0 {
+		names, err := render(p.DNSNames, fields)
+		if err != nil {
+			return err
+		}
+		tmpl.DNSNames = names
+	}
+
+	tmpl.EmailAddresses = csr.EmailAddresses
+	if len(p.EmailAddresses) > 0 {
+		emails, err := render(p.EmailAddresses, fields)
+		if err != nil {
+			return err
+		}
+		tmpl.EmailAddresses = emails
+	}
+
+	tmpl.URIs = csr.URIs
+	if len(p.URIs) > 0 {
+		uris, err := render(p.URIs, fields)
+		if err != nil {
+			return err
+		}
+		tmpl.URIs = nil
+		for _, s := range uris {
+			u, err := url.Parse(s)
+			if err != nil {
+				return errors.Wrapf(err, "invalid URI SAN %q", s)
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		}
+	}
+
+	return nil
+}
+
+func newCSRFields(csr *x509.CertificateRequest) *csrFields {
+	f := &csrFields{
+		CommonName:     csr.Subject.CommonName,
+		SerialNumber:   csr.Subject.SerialNumber,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+	}
+	if len(csr.Subject.Organization) > 0 {
+		f.Organization = csr.Subject.Organization[0]
+	}
+	if len(csr.Subject.OrganizationalUnit) > 0 {
+		f.OrganizationalUnit = csr.Subject.OrganizationalUnit[0]
+	}
+	for _, u := range csr.URIs {
+		f.URIs = append(f.URIs, u.String())
+	}
+	return f
+}
+
+// render executes the templates; empty results are dropped
+func render(tmpls []string, fields *csrFields) ([]string, error) {
+	var ret []string
+	for _, t := range tmpls {
+		tt, err := template.New("san").Option("missingkey=error").Parse(t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid SAN template %q", t)
+		}
+
+		var buf bytes.Buffer
+		if err := tt.Execute(&buf, fields); err != nil {
+			return nil, errors.Wrapf(err, "failed to render SAN template %q", t)
+		}
+		if buf.Len() > 0 {
+			ret = append(ret, buf.String())
+		}
+	}
+	return ret, nil
+}
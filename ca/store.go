@@ -0,0 +1,242 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrCertNotFound   = errors.New("certificate not found")
+	ErrAlreadyRevoked = errors.New("certificate already revoked")
+)
+
+// IssuedCert is the record of a cert issued by the CA
+type IssuedCert struct {
+	Serial    string     `json:"serial"`
+	Subject   string     `json:"subject"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Store records the issued certs and their revocation in a JSON file.
+// Changes made by other processes (e.g. the 'ca' CLI) are picked up
+// on the next lookup; updates hold an exclusive lock on a '.lock'
+// file next to it, so concurrent writers don't lose each other's records.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	certs   map[string]*IssuedCert
+	modTime time.Time
+	size    int64
+}
+
+// OpenStore loads the store from path; a missing file is an empty store
+func OpenStore(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		certs: map[string]*IssuedCert{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add records a newly issued cert
+func (s *Store) Add(cert *x509.Certificate, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.load(true); err != nil {
+		return err
+	}
+
+	s.certs[cert.SerialNumber.String()] = &IssuedCert{
+		Serial:    cert.SerialNumber.String(),
+		Subject:   cert.Subject.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		IssuedAt:  now,
+	}
+
+	return s.save()
+}
+
+// Revoke marks the cert with the (decimal) serial number as revoked
+func (s *Store) Revoke(serial string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.load(true); err != nil {
+		return err
+	}
+
+	c, ok := s.certs[serial]
+	if !ok {
+		return ErrCertNotFound
+	}
+	if c.RevokedAt != nil {
+		return ErrAlreadyRevoked
+	}
+	c.RevokedAt = &now
+
+	return s.save()
+}
+
+// IsRevoked tells whether the serial number was revoked; on errors
+// reading the file it keeps answering from the last good state
+func (s *Store) IsRevoked(serial string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(false); err != nil {
+		l.Errorf("failed to refresh CA store %s: %s", s.path, err)
+	}
+
+	c, ok := s.certs[serial]
+	return ok && c.RevokedAt != nil
+}
+
+// List returns the issued certs, oldest first
+func (s *Store) List() ([]IssuedCert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(false); err != nil {
+		return nil, err
+	}
+
+	ret := make([]IssuedCert, 0, len(s.certs))
+	for _, c := range s.certs {
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].IssuedAt.Before(ret[j].IssuedAt)
+	})
+	return ret, nil
+}
+
+// lock takes the exclusive lock on the store's lock file;
+// the returned func releases it
+func (s *Store) lock() (func(), error) {
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock CA store")
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to lock CA store")
+	}
+	return func() { f.Close() }, nil
+}
+
+// load re-reads the file if it changed since the last load, or always
+// with force, e.g. under the lock, where a stale read would lose records
+func (s *Store) load(force bool) error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read CA store")
+	}
+	// mtime granularity may hide quick successive writes,
+	// so files changed within the last second are always re-read
+	if !force && fi.ModTime().Equal(s.modTime) && fi.Size() == s.size &&
+		time.Since(fi.ModTime()) > time.Second {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read CA store")
+	}
+
+	var list []*IssuedCert
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.Wrap(err, "failed to parse CA store")
+	}
+
+	certs := make(map[string]*IssuedCert, len(list))
+	for _, c := range list {
+		certs[c.Serial] = c
+	}
+	s.certs = certs
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+
+	return nil
+}
+
+// save atomically replaces the file with the current state
+func (s *Store) save() error {
+	list := make([]*IssuedCert, 0, len(s.certs))
+	for _, c := range s.certs {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IssuedAt.Before(list[j].IssuedAt)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".ca-store")
+	if err != nil {
+		return errors.Wrap(err, "failed to write CA store")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write CA store")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write CA store")
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return errors.Wrap(err, "failed to write CA store")
+	}
+
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return errors.Wrap(err, "failed to write CA store")
+	}
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+
+	return nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+// NewCertHeaders parses the names of the headers passing the client
+// cert's identity to Mender
+func NewCertHeaders(c config.Reader) (api.CertHeaders, error) {
+	h := api.CertHeaders{
+		Fingerprint: c.GetString(aconfig.SettingCertHeaderFingerprint),
+		Subject:     c.GetString(aconfig.SettingCertHeaderSubject),
+		Issuer:      c.GetString(aconfig.SettingCertHeaderIssuer),
+		Serial:      c.GetString(aconfig.SettingCertHeaderSerial),
+		SANURIs:     c.GetString(aconfig.SettingCertHeaderSANURIs),
+		XFCC:        c.GetString(aconfig.SettingCertHeaderXFCC),
+	}
+	if err := h.Validate(); err != nil {
+		return api.CertHeaders{}, errors.Wrap(err, "cert headers")
+	}
+	return h, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+// NewCertPolicy parses and validates the client cert policy settings
+func NewCertPolicy(c config.Reader) (*app.CertPolicy, error) {
+	p := &app.CertPolicy{
+		MaxValidity:    c.GetDuration(aconfig.SettingCertMaxValidity),
+		NotBeforeGrace: c.GetDuration(aconfig.SettingCertNotBeforeGrace),
+		MinRSAKeyBits:  c.GetInt(aconfig.SettingCertMinRSAKeyBits),
+		MinECKeyBits:   c.GetInt(aconfig.SettingCertMinECKeyBits),
+	}
+
+	if p.MaxValidity < 0 {
+		return nil, errors.Errorf("%s must not be negative", aconfig.SettingCertMaxValidity)
+	}
+	if p.NotBeforeGrace < 0 {
+		return nil, errors.Errorf("%s must not be negative", aconfig.SettingCertNotBeforeGrace)
+	}
+
+	var err error
+	p.SignatureAlgorithms, err = app.ParseSignatureAlgorithms(
+		c.GetStringSlice(aconfig.SettingCertSignatureAlgorithms))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingCertSignatureAlgorithms)
+	}
+
+	p.KeyUsage, err = app.ParseKeyUsage(
+		c.GetStringSlice(aconfig.SettingCertKeyUsage))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingCertKeyUsage)
+	}
+
+	p.ExtKeyUsage, err = app.ParseExtKeyUsage(
+		c.GetStringSlice(aconfig.SettingCertExtKeyUsage))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingCertExtKeyUsage)
+	}
+
+	p.Policies, err = app.ParsePolicies(
+		c.GetStringSlice(aconfig.SettingCertPolicies))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingCertPolicies)
+	}
+
+	return p, nil
+}
@@ -17,6 +17,10 @@ import (
 	"time"
 
 	"github.com/mendersoftware/go-lib-micro/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/mendersoftware/mtls-ambassador/requestid"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
 )
 
 const (
@@ -58,21 +62,27 @@ func NewClient(baseUrl string, insecureSkipVerify bool) *client {
 	return &client{
 		c: &http.Client{
 			Timeout:   DefaultTimeoutSec * time.Second,
-			Transport: tr,
+			Transport: otelhttp.NewTransport(tr),
 		},
 		baseUrl: baseUrl,
 	}
 }
 
+// SetUpstreams balances the requests over the pool's backends
+func (client *client) SetUpstreams(pool *upstream.Pool) {
+	client.c.Transport = upstream.NewTransport(pool, client.c.Transport)
+}
+
 func (client *client) Login(ctx context.Context, user, pwd string) (string, error) {
 	url := join(client.baseUrl, LoginUrl)
 
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return "", err
 	}
 
 	req.SetBasicAuth(user, pwd)
+	requestid.SetHeader(ctx, req.Header)
 	resp, err := client.c.Do(req)
 
 	if err != nil {
@@ -117,13 +127,15 @@ func (client *client) Preauth(ctx context.Context, idData, pubKey, userToken str
 
 	rd := bytes.NewReader(preauthBody)
 
-	req, err := http.NewRequest(http.MethodPost, url, rd)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, rd)
 	if err != nil {
 		return err
 	}
 
 	req.Header.Add("Authorization", "Bearer "+userToken)
 	req.Header.Set("Content-Type", "application/json")
+	// the device request's ID, to join our logs with Mender's
+	requestid.SetHeader(ctx, req.Header)
 
 	resp, err := client.c.Do(req)
 	if err != nil {
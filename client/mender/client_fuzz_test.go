@@ -0,0 +1,43 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// +build go1.18
+
+package mender
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// FuzzPreauth feeds attacker controlled identity data (from auth requests)
+// to the preauth request; the seed corpus in testdata/fuzz holds
+// Mender client identities
+func FuzzPreauth(f *testing.F) {
+	f.Add(`{}`)
+	f.Add(`null`)
+	f.Add(`{"mac":{"nested":[1,2,3]}}`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req PreauthReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, false)
+
+	f.Fuzz(func(t *testing.T, idData string) {
+		err := c.Preauth(context.Background(), idData, "key", "token")
+		if err == nil && !json.Valid([]byte(idData)) {
+			t.Fatalf("preauthorized invalid identity data %q", idData)
+		}
+	})
+}
@@ -14,6 +14,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/requestid"
 )
 
 func TestNewClient(t *testing.T) {
@@ -234,3 +236,19 @@ func mockPreauth(t *testing.T, iddata map[string]interface{}, key, token string,
 		}
 	}
 }
+
+func TestClientPreauthRequestID(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	s := mockServer(PreauthUrl, false, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(requestid.RequestIDHeader)
+		w.WriteHeader(http.StatusCreated)
+	})
+	defer s.Close()
+
+	c := NewClient(s.URL, false)
+	ctx := requestid.WithContext(context.Background(), "device-request-1")
+	assert.NoError(t, c.Preauth(ctx, `{"mac": "00:01:02:03"}`, "key", "token"))
+	assert.Equal(t, "device-request-1", got)
+}
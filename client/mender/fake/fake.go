@@ -0,0 +1,626 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package fake is an in-process, stateful fake of the Mender endpoints
+// the Ambassador and its devices use: login, devauth preauth, devices and
+// auth sets, auth requests, inventory, and deployments basics.
+//
+// It keeps Mender's semantics - e.g. a duplicate preauth is a 409, and a
+// device whose auth request matches a preauthorized auth set is accepted -
+// so that end-to-end tests run with `go test` and no containers.
+package fake
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+const (
+	UrlDevauthDevices   = "/api/management/v2/devauth/devices"
+	UrlDevauthDevice    = "/api/management/v2/devauth/devices/:id"
+	UrlAuthSetStatus    = "/api/management/v2/devauth/devices/:id/auth/:aid/status"
+	UrlAuthRequests     = "/api/devices/v1/authentication/auth_requests"
+	UrlInventory        = "/api/devices/v1/inventory/device/attributes"
+	UrlDeploymentsNext  = "/api/devices/v1/deployments/device/deployments/next"
+	UrlDeploymentStatus = "/api/devices/v1/deployments/device/deployments/:id/status"
+
+	HdrSignature = "X-MEN-Signature"
+
+	// device and auth set statuses
+	StatusPending       = "pending"
+	StatusPreauthorized = "preauthorized"
+	StatusAccepted      = "accepted"
+	StatusRejected      = "rejected"
+)
+
+// AuthSet is an identity data and public key pair of a device
+type AuthSet struct {
+	ID     string `json:"id"`
+	PubKey string `json:"pubkey"`
+	Status string `json:"status"`
+}
+
+// Device is a device known to devauth
+type Device struct {
+	ID       string                 `json:"id"`
+	IdData   map[string]interface{} `json:"identity_data"`
+	Status   string                 `json:"status"`
+	AuthSets []AuthSet              `json:"auth_sets"`
+}
+
+// Deployment is a deployment of an artifact to a device
+type Deployment struct {
+	ID           string
+	ArtifactName string
+	URI          string
+	// Statuses are the statuses reported by the device, in order
+	Statuses []string
+}
+
+// Request is a request the fake received
+type Request struct {
+	Method string
+	Path   string
+	// Traceparent is the request's trace context header, if any
+	Traceparent string
+}
+
+// Mender is the fake Mender server; it is an http.Handler,
+// to be served e.g. by httptest.NewServer
+type Mender struct {
+	http.Handler
+
+	user        string
+	pass        string
+	tenantToken string
+
+	mu          sync.Mutex
+	userTokens  map[string]bool
+	devices     []*Device
+	tokens      map[string]*Device
+	inventory   map[string]map[string]interface{}
+	deployments map[string][]*Deployment
+	requests    []Request
+}
+
+// New creates a fake Mender with a single user; tenantToken,
+// if not empty, is the only tenant token accepted in auth requests
+func New(user, pass, tenantToken string) *Mender {
+	m := &Mender{
+		user:        user,
+		pass:        pass,
+		tenantToken: tenantToken,
+		userTokens:  map[string]bool{},
+		tokens:      map[string]*Device{},
+		inventory:   map[string]map[string]interface{}{},
+		deployments: map[string][]*Deployment{},
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery(), m.record)
+
+	router.POST(mender.LoginUrl, m.login)
+
+	mgmt := router.Group("", m.userAuth)
+	mgmt.POST(UrlDevauthDevices, m.preauth)
+	mgmt.GET(UrlDevauthDevices, m.listDevices)
+	mgmt.GET(UrlDevauthDevice, m.getDevice)
+	mgmt.PUT(UrlAuthSetStatus, m.setAuthSetStatus)
+
+	router.POST(UrlAuthRequests, m.authRequest)
+
+	dev := router.Group("", m.deviceAuth)
+	dev.PATCH(UrlInventory, m.patchInventory)
+	dev.GET(UrlDeploymentsNext, m.nextDeployment)
+	dev.PUT(UrlDeploymentStatus, m.setDeploymentStatus)
+
+	m.Handler = router
+	return m
+}
+
+// Requests returns the requests received so far
+func (m *Mender) Requests() []Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Request(nil), m.requests...)
+}
+
+// Devices returns copies of the known devices
+func (m *Mender) Devices() []Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devs := make([]Device, len(m.devices))
+	for i, d := range m.devices {
+		devs[i] = copyDevice(d)
+	}
+	return devs
+}
+
+// Device finds a device by its identity data (JSON)
+func (m *Mender) Device(idData string) (Device, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.findDevice(idData)
+	if d == nil {
+		return Device{}, false
+	}
+	return copyDevice(d), true
+}
+
+// Inventory returns a device's inventory attributes
+func (m *Mender) Inventory(deviceID string) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attrs := map[string]interface{}{}
+	for k, v := range m.inventory[deviceID] {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// Deploy queues a deployment of an artifact, downloadable at uri, to a device
+func (m *Mender) Deploy(deviceID, artifactName, uri string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dep := &Deployment{
+		ID:           newID(),
+		ArtifactName: artifactName,
+		URI:          uri,
+	}
+	m.deployments[deviceID] = append(m.deployments[deviceID], dep)
+	return dep.ID
+}
+
+// Deployments returns copies of a device's deployments
+func (m *Mender) Deployments(deviceID string) []Deployment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deps := make([]Deployment, len(m.deployments[deviceID]))
+	for i, dep := range m.deployments[deviceID] {
+		deps[i] = *dep
+		deps[i].Statuses = append([]string(nil), dep.Statuses...)
+	}
+	return deps
+}
+
+func (m *Mender) record(c *gin.Context) {
+	m.mu.Lock()
+	m.requests = append(m.requests, Request{
+		Method:      c.Request.Method,
+		Path:        c.Request.URL.Path,
+		Traceparent: c.GetHeader("traceparent"),
+	})
+	m.mu.Unlock()
+	c.Next()
+}
+
+func (m *Mender) login(c *gin.Context) {
+	user, pass, ok := c.Request.BasicAuth()
+	if !ok || user != m.user || pass != m.pass {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	token := newID()
+	m.mu.Lock()
+	m.userTokens[token] = true
+	m.mu.Unlock()
+
+	c.String(http.StatusOK, token)
+}
+
+func (m *Mender) userAuth(c *gin.Context) {
+	token := bearer(c.Request)
+
+	m.mu.Lock()
+	ok := m.userTokens[token]
+	m.mu.Unlock()
+
+	if !ok {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+func (m *Mender) deviceAuth(c *gin.Context) {
+	token := bearer(c.Request)
+
+	m.mu.Lock()
+	d, ok := m.tokens[token]
+	accepted := ok && d.Status == StatusAccepted
+	m.mu.Unlock()
+
+	if !accepted {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Set("device", d.ID)
+}
+
+func (m *Mender) preauth(c *gin.Context) {
+	var req mender.PreauthReq
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.IdData) == 0 || req.PubKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid preauth request"})
+		return
+	}
+	pubKey, err := normalizeKey(req.PubKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idData := normalizeIdData(req.IdData)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.findDevice(idData)
+	if d != nil && d.authSet(pubKey) != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "device already exists"})
+		return
+	}
+	if d == nil {
+		d = m.newDevice(req.IdData)
+	}
+	d.AuthSets = append(d.AuthSets, AuthSet{
+		ID:     newID(),
+		PubKey: pubKey,
+		Status: StatusPreauthorized,
+	})
+	if d.Status != StatusAccepted {
+		d.Status = StatusPreauthorized
+	}
+
+	c.Header("Location", UrlDevauthDevices+"/"+d.ID)
+	c.Status(http.StatusCreated)
+}
+
+func (m *Mender) listDevices(c *gin.Context) {
+	c.JSON(http.StatusOK, m.Devices())
+}
+
+func (m *Mender) getDevice(c *gin.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.devices {
+		if d.ID == c.Param("id") {
+			c.JSON(http.StatusOK, copyDevice(d))
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+}
+
+func (m *Mender) setAuthSetStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil ||
+		(req.Status != StatusAccepted && req.Status != StatusRejected) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.devices {
+		if d.ID != c.Param("id") {
+			continue
+		}
+		for i := range d.AuthSets {
+			if d.AuthSets[i].ID == c.Param("aid") {
+				m.setStatus(d, i, req.Status)
+				c.Status(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "auth set not found"})
+}
+
+// authRequest accepts a device if its auth set is preauthorized or accepted,
+// and otherwise records a pending auth set
+func (m *Mender) authRequest(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	var req mender.AuthReq
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid auth request"})
+		return
+	}
+	var idAttrs map[string]interface{}
+	if err := json.Unmarshal([]byte(req.IdData), &idAttrs); err != nil || len(idAttrs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid identity data"})
+		return
+	}
+
+	key, err := parseKey(req.PubKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := utils.VerifyAuthReqSign(c.GetHeader(HdrSignature), key, body); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "signature verification failed"})
+		return
+	}
+
+	if m.tenantToken != "" && req.TenantToken != m.tenantToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid tenant token"})
+		return
+	}
+
+	pubKey, err := utils.SerializePubKey(key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.findDevice(normalizeIdData(idAttrs))
+	if d == nil {
+		d = m.newDevice(idAttrs)
+		d.Status = StatusPending
+	}
+
+	i := d.authSet(pubKey)
+	if i == nil {
+		d.AuthSets = append(d.AuthSets, AuthSet{
+			ID:     newID(),
+			PubKey: pubKey,
+			Status: StatusPending,
+		})
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	switch d.AuthSets[*i].Status {
+	case StatusPreauthorized:
+		m.setStatus(d, *i, StatusAccepted)
+	case StatusAccepted:
+	default:
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	token := newID()
+	m.tokens[token] = d
+	c.String(http.StatusOK, token)
+}
+
+func (m *Mender) patchInventory(c *gin.Context) {
+	var attrs []struct {
+		Name  string      `json:"name"`
+		Value interface{} `json:"value"`
+	}
+	if err := c.ShouldBindJSON(&attrs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid attributes"})
+		return
+	}
+
+	id := c.GetString("device")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.inventory[id]
+	if !ok {
+		inv = map[string]interface{}{}
+		m.inventory[id] = inv
+	}
+	for _, a := range attrs {
+		inv[a.Name] = a.Value
+	}
+	c.Status(http.StatusOK)
+}
+
+// nextDeployment returns the device's first unfinished deployment,
+// unless the device already runs its artifact
+func (m *Mender) nextDeployment(c *gin.Context) {
+	if c.Query("artifact_name") == "" || c.Query("device_type") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "need artifact_name and device_type"})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, dep := range m.deployments[c.GetString("device")] {
+		if dep.finished() || dep.ArtifactName == c.Query("artifact_name") {
+			continue
+		}
+
+		var ret struct {
+			ID       string `json:"id"`
+			Artifact struct {
+				Name   string `json:"artifact_name"`
+				Source struct {
+					URI    string    `json:"uri"`
+					Expire time.Time `json:"expire"`
+				} `json:"source"`
+				DeviceTypes []string `json:"device_types_compatible"`
+			} `json:"artifact"`
+		}
+		ret.ID = dep.ID
+		ret.Artifact.Name = dep.ArtifactName
+		ret.Artifact.Source.URI = dep.URI
+		ret.Artifact.Source.Expire = time.Now().Add(24 * time.Hour).UTC()
+		ret.Artifact.DeviceTypes = []string{c.Query("device_type")}
+
+		c.JSON(http.StatusOK, ret)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (m *Mender) setDeploymentStatus(c *gin.Context) {
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Status == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, dep := range m.deployments[c.GetString("device")] {
+		if dep.ID != c.Param("id") {
+			continue
+		}
+		if dep.finished() {
+			c.JSON(http.StatusConflict, gin.H{"error": "deployment already finished"})
+			return
+		}
+		dep.Statuses = append(dep.Statuses, req.Status)
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "deployment not found"})
+}
+
+// setStatus sets an auth set's status; accepting one
+// rejects the device's other accepted auth sets, like devauth
+func (m *Mender) setStatus(d *Device, i int, status string) {
+	if status == StatusAccepted {
+		for j := range d.AuthSets {
+			if j != i && d.AuthSets[j].Status == StatusAccepted {
+				d.AuthSets[j].Status = StatusRejected
+			}
+		}
+	}
+	d.AuthSets[i].Status = status
+
+	d.Status = StatusPending
+	for _, as := range d.AuthSets {
+		if as.Status == StatusAccepted {
+			d.Status = StatusAccepted
+			break
+		}
+		if as.Status == StatusPreauthorized {
+			d.Status = StatusPreauthorized
+		}
+	}
+
+	// tokens of a no longer accepted device are void
+	if d.Status != StatusAccepted {
+		for t, td := range m.tokens {
+			if td == d {
+				delete(m.tokens, t)
+			}
+		}
+	}
+}
+
+func (m *Mender) findDevice(idData string) *Device {
+	var attrs map[string]interface{}
+	if err := json.Unmarshal([]byte(idData), &attrs); err != nil {
+		return nil
+	}
+	idData = normalizeIdData(attrs)
+
+	for _, d := range m.devices {
+		if normalizeIdData(d.IdData) == idData {
+			return d
+		}
+	}
+	return nil
+}
+
+func (m *Mender) newDevice(idData map[string]interface{}) *Device {
+	d := &Device{
+		ID:     newID(),
+		IdData: idData,
+	}
+	m.devices = append(m.devices, d)
+	return d
+}
+
+func (d *Device) authSet(pubKey string) *int {
+	for i := range d.AuthSets {
+		if d.AuthSets[i].PubKey == pubKey {
+			return &i
+		}
+	}
+	return nil
+}
+
+func (dep *Deployment) finished() bool {
+	n := len(dep.Statuses)
+	return n > 0 && (dep.Statuses[n-1] == "success" ||
+		dep.Statuses[n-1] == "failure" ||
+		dep.Statuses[n-1] == "already-installed")
+}
+
+func copyDevice(d *Device) Device {
+	c := *d
+	c.AuthSets = append([]AuthSet(nil), d.AuthSets...)
+	return c
+}
+
+// normalizeIdData serializes identity data with sorted keys
+func normalizeIdData(attrs map[string]interface{}) string {
+	data, _ := json.Marshal(attrs)
+	return string(data)
+}
+
+func parseKey(pemKey string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+	return key, nil
+}
+
+// normalizeKey re-serializes a PEM public key, so that keys compare equal
+// regardless of formatting
+func normalizeKey(pemKey string) (string, error) {
+	key, err := parseKey(pemKey)
+	if err != nil {
+		return "", err
+	}
+	return utils.SerializePubKey(key)
+}
+
+func bearer(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
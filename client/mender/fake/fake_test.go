@@ -0,0 +1,269 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package fake
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/simulator"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+func newDevice(t *testing.T, url, keyType, mac string) (*simulator.Device, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	issuer, err := ca.New(caCert, caKey)
+	assert.NoError(t, err)
+	issuer.Profile = &ca.Profile{Validity: time.Hour}
+
+	key, err := simulator.GenerateKey(keyType, 2048)
+	assert.NoError(t, err)
+	cert, err := simulator.NewDeviceCert(issuer, key, mac)
+	assert.NoError(t, err)
+	pubKey, err := utils.SerializePubKey(key.Public())
+	assert.NoError(t, err)
+
+	d, err := simulator.NewDevice(`{"mac":"`+mac+`"}`, cert, simulator.DeviceConfig{
+		ServerURL:    url,
+		TenantToken:  "tenant",
+		DeviceType:   "sim",
+		ArtifactName: "release-1",
+		TLS:          &tls.Config{},
+	})
+	assert.NoError(t, err)
+	return d, pubKey
+}
+
+func TestMenderLoginPreauth(t *testing.T) {
+	t.Parallel()
+
+	m := New("user", "pass", "")
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	client := mender.NewClient(srv.URL, false)
+
+	_, err := client.Login(context.Background(), "user", "wrong")
+	assert.Equal(t, mender.ErrUnauthorized, err)
+
+	token, err := client.Login(context.Background(), "user", "pass")
+	assert.NoError(t, err)
+
+	_, pubKey := newDevice(t, srv.URL, simulator.KeyTypeECDSA, "02:00:00:00:00:01")
+
+	err = client.Preauth(context.Background(), `{"mac":"02:00:00:00:00:01"}`, pubKey, "bogus")
+	assert.EqualError(t, err, "unexpected response from preauth: HTTP 401\n")
+
+	err = client.Preauth(context.Background(), `{"mac":"02:00:00:00:00:01"}`, pubKey, token)
+	assert.NoError(t, err)
+
+	// same identity data and key, also with other key order and formatting
+	err = client.Preauth(context.Background(), `{ "mac": "02:00:00:00:00:01" }`, pubKey, token)
+	assert.Equal(t, mender.ErrPreauthConflict, err)
+
+	devs := m.Devices()
+	assert.Len(t, devs, 1)
+	assert.Equal(t, StatusPreauthorized, devs[0].Status)
+	assert.Len(t, devs[0].AuthSets, 1)
+	assert.Equal(t, pubKey, devs[0].AuthSets[0].PubKey)
+
+	// another key of the same device is another auth set
+	_, pubKey2 := newDevice(t, srv.URL, simulator.KeyTypeRSA, "02:00:00:00:00:01")
+	err = client.Preauth(context.Background(), `{"mac":"02:00:00:00:00:01"}`, pubKey2, token)
+	assert.NoError(t, err)
+	dev, ok := m.Device(`{"mac":"02:00:00:00:00:01"}`)
+	assert.True(t, ok)
+	assert.Len(t, dev.AuthSets, 2)
+
+	assert.Equal(t, []Request{
+		{Method: http.MethodPost, Path: mender.LoginUrl},
+		{Method: http.MethodPost, Path: mender.LoginUrl},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+	}, m.Requests())
+}
+
+func TestMenderDevice(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		keyType string
+	}{
+		{name: "rsa", keyType: simulator.KeyTypeRSA},
+		{name: "ecdsa", keyType: simulator.KeyTypeECDSA},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := New("user", "pass", "tenant")
+			srv := httptest.NewServer(m)
+			defer srv.Close()
+
+			ctx := context.Background()
+			idData := `{"mac":"02:00:00:00:00:01"}`
+			d, pubKey := newDevice(t, srv.URL, tc.keyType, "02:00:00:00:00:01")
+
+			// unknown: pending
+			body, sig, err := d.NewAuthReq()
+			assert.NoError(t, err)
+			_, err = d.AuthRequest(ctx, body, sig)
+			assert.Equal(t, simulator.ErrUnauthorized, err)
+
+			dev, ok := m.Device(idData)
+			assert.True(t, ok)
+			assert.Equal(t, StatusPending, dev.Status)
+
+			// a bad signature is rejected before anything else
+			_, err = d.AuthRequest(ctx, body, "AAAA")
+			assert.Equal(t, simulator.ErrUnauthorized, err)
+
+			// no device token yet
+			assert.Equal(t, simulator.ErrUnauthorized, d.SendInventory(ctx))
+
+			// preauthorized: accepted on the next auth request
+			client := mender.NewClient(srv.URL, false)
+			token, err := client.Login(ctx, "user", "pass")
+			assert.NoError(t, err)
+			assert.Equal(t, mender.ErrPreauthConflict,
+				client.Preauth(ctx, idData, pubKey, token))
+
+			req, err := http.NewRequest(http.MethodPut,
+				srv.URL+UrlDevauthDevices+"/"+dev.ID+"/auth/"+dev.AuthSets[0].ID+"/status",
+				bytes.NewReader([]byte(`{"status":"accepted"}`)))
+			assert.NoError(t, err)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rsp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			rsp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+
+			_, err = d.AuthRequest(ctx, body, sig)
+			assert.NoError(t, err)
+			dev, _ = m.Device(idData)
+			assert.Equal(t, StatusAccepted, dev.Status)
+
+			// inventory and a deployment
+			assert.NoError(t, d.SendInventory(ctx))
+			assert.Equal(t, "release-1", m.Inventory(dev.ID)["artifact_name"])
+			assert.Equal(t, "sim", m.Inventory(dev.ID)["device_type"])
+
+			dep, err := d.NextDeployment(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, dep)
+
+			artifact := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte("artifact"))
+				}))
+			defer artifact.Close()
+
+			id := m.Deploy(dev.ID, "release-2", artifact.URL)
+			dep, err = d.NextDeployment(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, id, dep.ID)
+			assert.Equal(t, "release-2", dep.Artifact.Name)
+			assert.Equal(t, artifact.URL, dep.Artifact.Source.URI)
+
+			assert.NoError(t, d.Deploy(ctx, dep))
+			assert.Equal(t, []string{
+				simulator.StatusDownloading,
+				simulator.StatusInstalling,
+				simulator.StatusRebooting,
+				simulator.StatusSuccess,
+			}, m.Deployments(dev.ID)[0].Statuses)
+			assert.Equal(t, "release-2", m.Inventory(dev.ID)["artifact_name"])
+
+			dep, err = d.NextDeployment(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, dep)
+
+			var stErr *simulator.StatusError
+			err = d.SetDeploymentStatus(ctx, id, simulator.StatusSuccess)
+			assert.True(t, errors.As(err, &stErr))
+			assert.Equal(t, http.StatusConflict, stErr.Code)
+		})
+	}
+}
+
+func TestMenderAuthRequestPreauthorized(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		tenantToken string
+		err         error
+	}{
+		{name: "ok", tenantToken: "tenant"},
+		{name: "wrong tenant", tenantToken: "other", err: simulator.ErrUnauthorized},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			m := New("user", "pass", tc.tenantToken)
+			srv := httptest.NewServer(m)
+			defer srv.Close()
+
+			ctx := context.Background()
+			d, pubKey := newDevice(t, srv.URL, simulator.KeyTypeRSA, "02:00:00:00:00:02")
+
+			client := mender.NewClient(srv.URL, false)
+			token, err := client.Login(ctx, "user", "pass")
+			assert.NoError(t, err)
+			assert.NoError(t, client.Preauth(ctx, d.IdData, pubKey, token))
+
+			body, sig, err := d.NewAuthReq()
+			assert.NoError(t, err)
+			_, err = d.AuthRequest(ctx, body, sig)
+			assert.Equal(t, tc.err, err)
+
+			dev, _ := m.Device(d.IdData)
+			if tc.err == nil {
+				assert.Equal(t, StatusAccepted, dev.Status)
+				assert.Equal(t, StatusAccepted, dev.AuthSets[0].Status)
+			} else {
+				assert.Equal(t, StatusPreauthorized, dev.Status)
+			}
+		})
+	}
+}
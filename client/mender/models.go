@@ -8,6 +8,11 @@ type AuthReq struct {
 	IdData      string `json:"id_data"`
 	TenantToken string `json:"tenant_token"`
 	PubKey      string `json:"pubkey"`
+
+	// Nonce and Timestamp (RFC 3339) opt the request into replay protection;
+	// being part of the signed body, they can't be altered by a replayer
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
 }
 
 type PreauthReq struct {
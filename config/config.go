@@ -13,10 +13,39 @@ const (
 	SettingListen        = "listen"
 	SettingListenDefault = "8080"
 
-	// SettingMenderBackend is the config key for the Mender base url (scheme + host:port)
+	// SettingMenderBackend is the config key for the Mender base url (scheme + host:port);
+	// several, comma separated, are balanced by mender_backend_policy
 	SettingMenderBackend        = "mender_backend"
 	SettingMenderBackendDefault = ""
 
+	// SettingMenderBackendPolicy balances requests over several backends:
+	// round_robin, least_requests or consistent_hash (by device)
+	SettingMenderBackendPolicy        = "mender_backend_policy"
+	SettingMenderBackendPolicyDefault = "round_robin"
+
+	// SettingMenderBackendHealthPath is the path of the backends' active health check,
+	// healthy on a status below 500; empty checks that they accept TCP connections
+	SettingMenderBackendHealthPath        = "mender_backend_health_path"
+	SettingMenderBackendHealthPathDefault = ""
+
+	// SettingMenderBackendHealthInterval is the time between health checks of a backend
+	// while in use; 0 disables them
+	SettingMenderBackendHealthInterval        = "mender_backend_health_interval"
+	SettingMenderBackendHealthIntervalDefault = "10s"
+
+	// SettingMenderBackendHealthTimeout bounds a health check
+	SettingMenderBackendHealthTimeout        = "mender_backend_health_timeout"
+	SettingMenderBackendHealthTimeoutDefault = "2s"
+
+	// SettingMenderBackendMaxFails ejects a backend after this many failed requests
+	// (connection errors, 502, 503, 504) in a row; 0 disables ejection
+	SettingMenderBackendMaxFails        = "mender_backend_max_fails"
+	SettingMenderBackendMaxFailsDefault = 3
+
+	// SettingMenderBackendEjectTime is how long an ejected backend gets no requests
+	SettingMenderBackendEjectTime        = "mender_backend_eject_time"
+	SettingMenderBackendEjectTimeDefault = "30s"
+
 	// SettingMenderUser is the Ambassador's Mender login
 	SettingMenderUser        = "mender_user"
 	SettingMenderUserDefault = ""
@@ -29,7 +58,8 @@ const (
 	SettingServerCert        = "server_cert"
 	SettingServerCertDefault = "/etc/mtls/certs/server/server.crt"
 
-	// SettingServerKey is the Ambassador's https server key
+	// SettingServerKey is the Ambassador's https server key: a PEM file, or a PKCS#11 URI
+	// of a key in an HSM (needs the 'pkcs11' build tag)
 	SettingServerKey        = "server_key"
 	SettingServerKeyDefault = "/etc/mtls/certs/server/server.key"
 
@@ -44,6 +74,313 @@ const (
 	// SettingSkipVerify controls the TLS cert verification of the Mender backend
 	SettingInsecureSkipVerify        = "insecure_skip_verify"
 	SettingInsecureSkipVerifyDefault = false
+
+	// SettingTLSMinVersion is the lowest TLS version accepted from devices ("1.0" - "1.3")
+	SettingTLSMinVersion        = "tls_min_version"
+	SettingTLSMinVersionDefault = "1.2"
+
+	// SettingTLSMaxVersion is the highest TLS version accepted from devices ("1.0" - "1.3")
+	SettingTLSMaxVersion        = "tls_max_version"
+	SettingTLSMaxVersionDefault = "1.3"
+
+	// SettingTLSCipherSuites lists the TLS 1.0-1.2 cipher suites by their IANA names, e.g.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; empty means Go defaults
+	SettingTLSCipherSuites = "tls_cipher_suites"
+
+	// SettingTLSCurvePreferences lists the key exchange curves in preference order
+	// (X25519, P256, P384, P521); empty means Go defaults
+	SettingTLSCurvePreferences = "tls_curve_preferences"
+
+	// SettingTLSSessionTickets enables TLS session resumption via tickets
+	SettingTLSSessionTickets        = "tls_session_tickets"
+	SettingTLSSessionTicketsDefault = true
+
+	// SettingTLSSessionTicketKeyRotation is how often the session ticket key is replaced;
+	// 0 leaves key management to Go
+	SettingTLSSessionTicketKeyRotation        = "tls_session_ticket_key_rotation"
+	SettingTLSSessionTicketKeyRotationDefault = "0"
+
+	// SettingTLSClientAuth is the default client cert mode: "require" or "verify_if_given"
+	SettingTLSClientAuth        = "tls_client_auth"
+	SettingTLSClientAuthDefault = "require"
+
+	// SettingTLSClientAuthPaths overrides the client cert mode per URL path prefix,
+	// e.g. {"/status": "verify_if_given"}
+	SettingTLSClientAuthPaths = "tls_client_auth_paths"
+
+	// SettingBodyLimit is the largest request body, in bytes, accepted on the device
+	// listener; larger ones get a 413. 0 means no limit
+	SettingBodyLimit        = "body_limit"
+	SettingBodyLimitDefault = 10 * 1024 * 1024
+
+	// SettingBodyLimitAuthRequests is the body limit of auth requests
+	SettingBodyLimitAuthRequests        = "body_limit_auth_requests"
+	SettingBodyLimitAuthRequestsDefault = 64 * 1024
+
+	// SettingBodyLimitPaths overrides the body limit per URL path prefix,
+	// e.g. {"/api/devices/v1/deployments/device/deployments": 1048576}
+	SettingBodyLimitPaths = "body_limit_paths"
+
+	// SettingReadHeaderTimeout is how long a device may take to send the request headers
+	SettingReadHeaderTimeout        = "read_header_timeout"
+	SettingReadHeaderTimeoutDefault = "10s"
+
+	// SettingReadTimeout is how long a device may take to send a whole request;
+	// a body still incomplete by then gets a 408. 0 means no limit
+	SettingReadTimeout        = "read_timeout"
+	SettingReadTimeoutDefault = "60s"
+
+	// SettingIdleTimeout is how long an idle keep-alive connection is kept open
+	SettingIdleTimeout        = "idle_timeout"
+	SettingIdleTimeoutDefault = "120s"
+
+	// SettingMaxHeaderBytes is the largest size of request headers; larger ones get a 431
+	SettingMaxHeaderBytes        = "max_header_bytes"
+	SettingMaxHeaderBytesDefault = 64 * 1024
+
+	// SettingMaxConnsPerIP is the max number of concurrent connections from one source IP;
+	// connections beyond it are closed right away. 0 means no limit
+	SettingMaxConnsPerIP        = "max_conns_per_ip"
+	SettingMaxConnsPerIPDefault = 0
+
+	// SettingRateLimitAuthPerCert, SettingRateLimitAuthPerIP and SettingRateLimitAuthGlobal
+	// limit auth requests per client cert, per source IP and in total, as "<requests>/<period>",
+	// e.g. "10/m"; empty means no limit. The other device API routes have their own limits.
+	SettingRateLimitAuthPerCert        = "rate_limit_auth_per_cert"
+	SettingRateLimitAuthPerCertDefault = "10/m"
+	SettingRateLimitAuthPerIP          = "rate_limit_auth_per_ip"
+	SettingRateLimitAuthGlobal         = "rate_limit_auth_global"
+	SettingRateLimitPerCert            = "rate_limit_per_cert"
+	SettingRateLimitPerIP              = "rate_limit_per_ip"
+	SettingRateLimitGlobal             = "rate_limit_global"
+
+	// SettingRateLimitMaxKeys is the max number of certs or IPs tracked per rate limit
+	SettingRateLimitMaxKeys        = "rate_limit_max_keys"
+	SettingRateLimitMaxKeysDefault = 100000
+
+	// SettingAuthReplayProtection is the replay protection of auth requests carrying
+	// a nonce and timestamp: "off", "optional" (check them when present) or "require";
+	// can be set per virtual host
+	SettingAuthReplayProtection        = "auth_replay_protection"
+	SettingAuthReplayProtectionDefault = "optional"
+
+	// SettingAuthReplayWindow is the max difference of an auth request's timestamp
+	// from the current time; can be set per virtual host
+	SettingAuthReplayWindow        = "auth_replay_window"
+	SettingAuthReplayWindowDefault = "5m"
+
+	// SettingAuthReplayMaxNonces is the max number of nonces remembered per virtual host;
+	// beyond it, auth requests with new nonces are refused until some expire
+	SettingAuthReplayMaxNonces        = "auth_replay_max_nonces"
+	SettingAuthReplayMaxNoncesDefault = 100000
+
+	// SettingWebSocketIdleTimeout closes proxied WebSocket (HTTP upgrade) connections, e.g.
+	// deviceconnect's, without data from the device for this long; 0 means no timeout
+	SettingWebSocketIdleTimeout        = "websocket_idle_timeout"
+	SettingWebSocketIdleTimeoutDefault = "2m"
+
+	// SettingWebSocketPingInterval is how long a WebSocket device may be quiet before
+	// the Ambassador pings it; 0 disables pings
+	SettingWebSocketPingInterval        = "websocket_ping_interval"
+	SettingWebSocketPingIntervalDefault = "30s"
+
+	// SettingArtifactCacheDir enables the disk cache of artifact downloads proxied to devices,
+	// in this directory; empty means off
+	SettingArtifactCacheDir        = "artifact_cache_dir"
+	SettingArtifactCacheDirDefault = ""
+
+	// SettingArtifactCacheMaxSize is the cache's size, in bytes; the least recently used
+	// artifacts are evicted to stay within it
+	SettingArtifactCacheMaxSize        = "artifact_cache_max_size"
+	SettingArtifactCacheMaxSizeDefault = int64(10 * 1024 * 1024 * 1024)
+
+	// SettingArtifactCacheMaxArtifactSize is the largest artifact cached, in bytes;
+	// 0 means artifact_cache_max_size
+	SettingArtifactCacheMaxArtifactSize        = "artifact_cache_max_artifact_size"
+	SettingArtifactCacheMaxArtifactSizeDefault = 0
+
+	// SettingArtifactDownloadRewrite rewrites the artifact download links of deployments' next
+	// responses to the Ambassador, which streams the artifacts from the original links, so that
+	// devices with a client cert needn't reach the artifact storage
+	SettingArtifactDownloadRewrite        = "artifact_download_rewrite"
+	SettingArtifactDownloadRewriteDefault = false
+
+	// SettingArtifactDownloadTTL bounds the lifetime of rewritten links, on top of the original's
+	SettingArtifactDownloadTTL        = "artifact_download_ttl"
+	SettingArtifactDownloadTTLDefault = "24h"
+
+	// SettingArtifactDownloadSecret signs the rewritten links; empty means a random one per process,
+	// Ambassadors behind one load balancer need the same
+	SettingArtifactDownloadSecret        = "artifact_download_secret"
+	SettingArtifactDownloadSecretDefault = ""
+
+	// SettingCertMaxValidity is the longest remaining validity accepted on a client cert; 0 means no limit
+	SettingCertMaxValidity        = "cert_max_validity"
+	SettingCertMaxValidityDefault = "0"
+
+	// SettingCertNotBeforeGrace accepts client certs which are not yet valid by up to this much,
+	// for devices with bad clocks
+	SettingCertNotBeforeGrace        = "cert_not_before_grace"
+	SettingCertNotBeforeGraceDefault = "0"
+
+	// SettingCertMinRSAKeyBits is the minimum RSA client key size
+	SettingCertMinRSAKeyBits        = "cert_min_rsa_key_bits"
+	SettingCertMinRSAKeyBitsDefault = 0
+
+	// SettingCertMinECKeyBits is the minimum EC client key size (curve bits)
+	SettingCertMinECKeyBits        = "cert_min_ec_key_bits"
+	SettingCertMinECKeyBitsDefault = 0
+
+	// SettingCertSignatureAlgorithms lists the client cert signature algorithms allowed,
+	// e.g. SHA256-RSA, ECDSA-SHA256; empty allows all
+	SettingCertSignatureAlgorithms = "cert_signature_algorithms"
+
+	// SettingCertKeyUsage lists the key usages a client cert must have, e.g. digital_signature
+	SettingCertKeyUsage = "cert_key_usage"
+
+	// SettingCertExtKeyUsage lists the extended key usages a client cert must have, e.g. client_auth
+	SettingCertExtKeyUsage = "cert_ext_key_usage"
+
+	// SettingCertPolicies lists the policy OIDs a client cert must have
+	SettingCertPolicies = "cert_policies"
+
+	// SettingVirtualHosts is a list of device facing hostnames served by SNI, each with
+	// a "hostname" and optionally its own mender_backend, mender_user, mender_pass,
+	// server_cert, server_key and tenant_ca_pem (inherited from the top level if unset);
+	// when set, handshakes for other names are rejected
+	SettingVirtualHosts = "vhosts"
+
+	// VirtualHostName is the vhosts entry key for the hostname
+	VirtualHostName = "hostname"
+
+	// SettingCertExpiryWarning is how close to expiry a client cert is reported as expiring
+	SettingCertExpiryWarning        = "cert_expiry_warning"
+	SettingCertExpiryWarningDefault = "720h"
+
+	// SettingCertExpiryHeader adds X-MEN-Client-Cert-Expires to proxied responses
+	// for client certs expiring within cert_expiry_warning
+	SettingCertExpiryHeader        = "cert_expiry_header"
+	SettingCertExpiryHeaderDefault = false
+
+	// SettingCertHeaderX name the headers passing the client cert's identity to Mender
+	// on proxied requests; empty (default) means not sent. Same-named headers sent by
+	// the device are always dropped.
+	SettingCertHeaderFingerprint        = "cert_header_fingerprint"
+	SettingCertHeaderFingerprintDefault = ""
+	SettingCertHeaderSubject            = "cert_header_subject"
+	SettingCertHeaderSubjectDefault     = ""
+	SettingCertHeaderIssuer             = "cert_header_issuer"
+	SettingCertHeaderIssuerDefault      = ""
+	SettingCertHeaderSerial             = "cert_header_serial"
+	SettingCertHeaderSerialDefault      = ""
+	SettingCertHeaderSANURIs            = "cert_header_san_uris"
+	SettingCertHeaderSANURIsDefault     = ""
+	// SettingCertHeaderXFCC names the header with an Envoy style X-Forwarded-Client-Cert
+	// summary of the above, e.g. "X-Forwarded-Client-Cert"
+	SettingCertHeaderXFCC        = "cert_header_xfcc"
+	SettingCertHeaderXFCCDefault = ""
+
+	// SettingCertTrackerMax is the number of distinct client certs remembered for the admin API
+	SettingCertTrackerMax        = "cert_tracker_max"
+	SettingCertTrackerMaxDefault = 100000
+
+	// SettingAdminListen is the plain HTTP address of the admin API (e.g. "127.0.0.1:8081");
+	// empty disables it
+	SettingAdminListen        = "admin_listen"
+	SettingAdminListenDefault = ""
+
+	// SettingAdminToken is the bearer token required by the admin API; empty means none
+	SettingAdminToken        = "admin_token"
+	SettingAdminTokenDefault = ""
+
+	// SettingESTListen is the port of the EST (RFC 7030) enrollment listener, issuing certs
+	// from the configured issuer; empty disables it
+	SettingESTListen        = "est_listen"
+	SettingESTListenDefault = ""
+
+	// SettingESTBootstrapCAPem is the CA of the factory certs devices enroll with
+	SettingESTBootstrapCAPem        = "est_bootstrap_ca_pem"
+	SettingESTBootstrapCAPemDefault = "/etc/mtls/certs/est/bootstrap.ca.pem"
+
+	// SettingCACert is the internal CA's (typically intermediate) cert; empty disables
+	// the CA. Devices' certs chain to it, so it must be trusted by tenant_ca_pem.
+	SettingCACert        = "ca_cert"
+	SettingCACertDefault = ""
+
+	// SettingCAKey is the internal CA's private key
+	SettingCAKey        = "ca_key"
+	SettingCAKeyDefault = ""
+
+	// SettingCAStore is the file recording the certs issued by the internal CA
+	// and their revocation
+	SettingCAStore        = "ca_store"
+	SettingCAStoreDefault = "/var/lib/mtls/ca/issued.json"
+
+	// SettingCACertValidity is the validity of the certs issued by the internal CA
+	SettingCACertValidity        = "ca_cert_validity"
+	SettingCACertValidityDefault = "8760h"
+
+	// SettingCAKeyUsage lists the key usages of issued certs, e.g. digital_signature;
+	// empty means digital_signature (plus key_encipherment for RSA keys)
+	SettingCAKeyUsage = "ca_key_usage"
+
+	// SettingCAExtKeyUsage lists the extended key usages of issued certs; empty means client_auth
+	SettingCAExtKeyUsage = "ca_ext_key_usage"
+
+	// SettingCASANDNS, SettingCASANURI and SettingCASANEmail are Go templates of the issued
+	// certs' SANs, rendered with the CSR's CommonName, SerialNumber, Organization and
+	// OrganizationalUnit, e.g. "urn:dev:{{.CommonName}}"; empty copies the CSR's SANs
+	SettingCASANDNS   = "ca_san_dns"
+	SettingCASANURI   = "ca_san_uri"
+	SettingCASANEmail = "ca_san_email"
+
+	// SettingIssuer selects who signs device certs for EST, renewal and the admin API:
+	// "local" (the internal CA, ca_* settings) or "vault" (Vault's PKI secrets engine)
+	SettingIssuer        = "issuer"
+	SettingIssuerDefault = "local"
+
+	// SettingIssuerURL is the external issuer's base url, e.g. https://vault:8200
+	SettingIssuerURL        = "issuer_url"
+	SettingIssuerURLDefault = ""
+
+	// SettingIssuerToken is the external issuer's API token
+	SettingIssuerToken        = "issuer_token"
+	SettingIssuerTokenDefault = ""
+
+	// SettingIssuerCAPem is the CA cert verifying the external issuer's https server;
+	// empty means the system roots
+	SettingIssuerCAPem        = "issuer_ca_pem"
+	SettingIssuerCAPemDefault = ""
+
+	// SettingIssuerVaultMount is the mount path of Vault's PKI secrets engine
+	SettingIssuerVaultMount        = "issuer_vault_mount"
+	SettingIssuerVaultMountDefault = "pki"
+
+	// SettingIssuerVaultRole is the Vault PKI role device certs are signed with;
+	// the requested TTL is ca_cert_validity
+	SettingIssuerVaultRole        = "issuer_vault_role"
+	SettingIssuerVaultRoleDefault = ""
+
+	// SettingTracingExporter is where request traces are sent: "otlp" (an OpenTelemetry
+	// collector, tracing_otlp_endpoint) or "stdout" (JSON, for local use); empty disables tracing
+	SettingTracingExporter        = "tracing_exporter"
+	SettingTracingExporterDefault = ""
+
+	// SettingTracingOTLPEndpoint is the collector's OTLP/HTTP traces url
+	SettingTracingOTLPEndpoint        = "tracing_otlp_endpoint"
+	SettingTracingOTLPEndpointDefault = "http://localhost:4318/v1/traces"
+
+	// SettingTracingOTLPHeaders maps extra headers sent to the collector, e.g. authorization
+	SettingTracingOTLPHeaders = "tracing_otlp_headers"
+
+	// SettingTracingServiceName is the service name traces are reported under
+	SettingTracingServiceName        = "tracing_service_name"
+	SettingTracingServiceNameDefault = "mtls-ambassador"
+
+	// SettingTracingSampleRatio is the share (0 to 1) of new traces recorded; traces started
+	// by the caller (traceparent header) follow the caller's decision
+	SettingTracingSampleRatio        = "tracing_sample_ratio"
+	SettingTracingSampleRatioDefault = 1.0
 )
 
 var (
@@ -51,6 +388,12 @@ var (
 	Defaults = []config.Default{
 		{Key: SettingListen, Value: SettingListenDefault},
 		{Key: SettingMenderBackend, Value: SettingMenderBackendDefault},
+		{Key: SettingMenderBackendPolicy, Value: SettingMenderBackendPolicyDefault},
+		{Key: SettingMenderBackendHealthPath, Value: SettingMenderBackendHealthPathDefault},
+		{Key: SettingMenderBackendHealthInterval, Value: SettingMenderBackendHealthIntervalDefault},
+		{Key: SettingMenderBackendHealthTimeout, Value: SettingMenderBackendHealthTimeoutDefault},
+		{Key: SettingMenderBackendMaxFails, Value: SettingMenderBackendMaxFailsDefault},
+		{Key: SettingMenderBackendEjectTime, Value: SettingMenderBackendEjectTimeDefault},
 		{Key: SettingMenderUser, Value: SettingMenderUserDefault},
 		{Key: SettingMenderPass, Value: SettingMenderPassDefault},
 		{Key: SettingServerCert, Value: SettingServerCertDefault},
@@ -58,5 +401,81 @@ var (
 		{Key: SettingTenantCAPem, Value: SettingTenantCAPemDefault},
 		{Key: SettingDebugLog, Value: SettingDebugLogDefault},
 		{Key: SettingInsecureSkipVerify, Value: SettingInsecureSkipVerifyDefault},
+		{Key: SettingTLSMinVersion, Value: SettingTLSMinVersionDefault},
+		{Key: SettingTLSMaxVersion, Value: SettingTLSMaxVersionDefault},
+		{Key: SettingTLSCipherSuites, Value: []string{}},
+		{Key: SettingTLSCurvePreferences, Value: []string{}},
+		{Key: SettingTLSSessionTickets, Value: SettingTLSSessionTicketsDefault},
+		{Key: SettingTLSSessionTicketKeyRotation, Value: SettingTLSSessionTicketKeyRotationDefault},
+		{Key: SettingTLSClientAuth, Value: SettingTLSClientAuthDefault},
+		{Key: SettingTLSClientAuthPaths, Value: map[string]string{}},
+		{Key: SettingBodyLimit, Value: SettingBodyLimitDefault},
+		{Key: SettingBodyLimitAuthRequests, Value: SettingBodyLimitAuthRequestsDefault},
+		{Key: SettingBodyLimitPaths, Value: map[string]int64{}},
+		{Key: SettingReadHeaderTimeout, Value: SettingReadHeaderTimeoutDefault},
+		{Key: SettingReadTimeout, Value: SettingReadTimeoutDefault},
+		{Key: SettingIdleTimeout, Value: SettingIdleTimeoutDefault},
+		{Key: SettingMaxHeaderBytes, Value: SettingMaxHeaderBytesDefault},
+		{Key: SettingMaxConnsPerIP, Value: SettingMaxConnsPerIPDefault},
+		{Key: SettingRateLimitAuthPerCert, Value: SettingRateLimitAuthPerCertDefault},
+		{Key: SettingRateLimitAuthPerIP, Value: ""},
+		{Key: SettingRateLimitAuthGlobal, Value: ""},
+		{Key: SettingRateLimitPerCert, Value: ""},
+		{Key: SettingRateLimitPerIP, Value: ""},
+		{Key: SettingRateLimitGlobal, Value: ""},
+		{Key: SettingRateLimitMaxKeys, Value: SettingRateLimitMaxKeysDefault},
+		{Key: SettingAuthReplayProtection, Value: SettingAuthReplayProtectionDefault},
+		{Key: SettingAuthReplayWindow, Value: SettingAuthReplayWindowDefault},
+		{Key: SettingAuthReplayMaxNonces, Value: SettingAuthReplayMaxNoncesDefault},
+		{Key: SettingWebSocketIdleTimeout, Value: SettingWebSocketIdleTimeoutDefault},
+		{Key: SettingWebSocketPingInterval, Value: SettingWebSocketPingIntervalDefault},
+		{Key: SettingArtifactCacheDir, Value: SettingArtifactCacheDirDefault},
+		{Key: SettingArtifactCacheMaxSize, Value: SettingArtifactCacheMaxSizeDefault},
+		{Key: SettingArtifactCacheMaxArtifactSize, Value: SettingArtifactCacheMaxArtifactSizeDefault},
+		{Key: SettingArtifactDownloadRewrite, Value: SettingArtifactDownloadRewriteDefault},
+		{Key: SettingArtifactDownloadTTL, Value: SettingArtifactDownloadTTLDefault},
+		{Key: SettingArtifactDownloadSecret, Value: SettingArtifactDownloadSecretDefault},
+		{Key: SettingCertMaxValidity, Value: SettingCertMaxValidityDefault},
+		{Key: SettingCertNotBeforeGrace, Value: SettingCertNotBeforeGraceDefault},
+		{Key: SettingCertMinRSAKeyBits, Value: SettingCertMinRSAKeyBitsDefault},
+		{Key: SettingCertMinECKeyBits, Value: SettingCertMinECKeyBitsDefault},
+		{Key: SettingCertSignatureAlgorithms, Value: []string{}},
+		{Key: SettingCertKeyUsage, Value: []string{}},
+		{Key: SettingCertExtKeyUsage, Value: []string{}},
+		{Key: SettingCertPolicies, Value: []string{}},
+		{Key: SettingVirtualHosts, Value: []interface{}{}},
+		{Key: SettingCertExpiryWarning, Value: SettingCertExpiryWarningDefault},
+		{Key: SettingCertExpiryHeader, Value: SettingCertExpiryHeaderDefault},
+		{Key: SettingCertHeaderFingerprint, Value: SettingCertHeaderFingerprintDefault},
+		{Key: SettingCertHeaderSubject, Value: SettingCertHeaderSubjectDefault},
+		{Key: SettingCertHeaderIssuer, Value: SettingCertHeaderIssuerDefault},
+		{Key: SettingCertHeaderSerial, Value: SettingCertHeaderSerialDefault},
+		{Key: SettingCertHeaderSANURIs, Value: SettingCertHeaderSANURIsDefault},
+		{Key: SettingCertHeaderXFCC, Value: SettingCertHeaderXFCCDefault},
+		{Key: SettingCertTrackerMax, Value: SettingCertTrackerMaxDefault},
+		{Key: SettingAdminListen, Value: SettingAdminListenDefault},
+		{Key: SettingAdminToken, Value: SettingAdminTokenDefault},
+		{Key: SettingESTListen, Value: SettingESTListenDefault},
+		{Key: SettingESTBootstrapCAPem, Value: SettingESTBootstrapCAPemDefault},
+		{Key: SettingCACert, Value: SettingCACertDefault},
+		{Key: SettingCAKey, Value: SettingCAKeyDefault},
+		{Key: SettingCAStore, Value: SettingCAStoreDefault},
+		{Key: SettingCACertValidity, Value: SettingCACertValidityDefault},
+		{Key: SettingCAKeyUsage, Value: []string{}},
+		{Key: SettingCAExtKeyUsage, Value: []string{}},
+		{Key: SettingCASANDNS, Value: []string{}},
+		{Key: SettingCASANURI, Value: []string{}},
+		{Key: SettingCASANEmail, Value: []string{}},
+		{Key: SettingIssuer, Value: SettingIssuerDefault},
+		{Key: SettingIssuerURL, Value: SettingIssuerURLDefault},
+		{Key: SettingIssuerToken, Value: SettingIssuerTokenDefault},
+		{Key: SettingIssuerCAPem, Value: SettingIssuerCAPemDefault},
+		{Key: SettingIssuerVaultMount, Value: SettingIssuerVaultMountDefault},
+		{Key: SettingIssuerVaultRole, Value: SettingIssuerVaultRoleDefault},
+		{Key: SettingTracingExporter, Value: SettingTracingExporterDefault},
+		{Key: SettingTracingOTLPEndpoint, Value: SettingTracingOTLPEndpointDefault},
+		{Key: SettingTracingOTLPHeaders, Value: map[string]string{}},
+		{Key: SettingTracingServiceName, Value: SettingTracingServiceNameDefault},
+		{Key: SettingTracingSampleRatio, Value: SettingTracingSampleRatioDefault},
 	}
 )
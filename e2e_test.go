@@ -0,0 +1,470 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/client/mender/fake"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/simulator"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+// e2e is an Ambassador, as built by cmdServer, in front of a fake Mender
+type e2e struct {
+	t *testing.T
+
+	mender *fake.Mender
+	url    string
+	// tenantCA issues valid device certs, otherCA ones of an unknown CA
+	tenantCA *ca.CA
+	otherCA  *ca.CA
+	// serverCAs verify the Ambassador's cert
+	serverCAs *x509.CertPool
+	// replayProtection makes devices add a nonce and timestamp to auth requests
+	replayProtection bool
+}
+
+// newE2E starts the Ambassador with the default config, overridden by settings,
+// tracing requests with tp if set
+func newE2E(t *testing.T, settings map[string]interface{}, tp trace.TracerProvider) *e2e {
+	dir, err := ioutil.TempDir("", "e2e")
+	assert.NoError(t, err)
+
+	e := &e2e{
+		t:        t,
+		mender:   fake.New("user", "pass", "tenant"),
+		tenantCA: newE2ECA(t, "Tenant CA"),
+		otherCA:  newE2ECA(t, "Other CA"),
+	}
+
+	backend := httptest.NewServer(e.mender)
+
+	// the Ambassador's cert, by a CA of its own
+	serverCA := newE2ECA(t, "Server CA")
+	e.serverCAs = x509.NewCertPool()
+	e.serverCAs.AddCert(serverCA.Cert)
+
+	srvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	srvCert := signE2ECert(t, serverCA, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &srvKey.PublicKey)
+	srvKeyDER, err := x509.MarshalECPrivateKey(srvKey)
+	assert.NoError(t, err)
+
+	writePEM(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", srvCert.Raw)
+	writePEM(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", srvKeyDER)
+	writePEM(t, filepath.Join(dir, "tenant-ca.crt"), "CERTIFICATE", e.tenantCA.Cert.Raw)
+
+	c := viper.New()
+	config.SetDefaults(c, aconfig.Defaults)
+	c.Set(aconfig.SettingMenderBackend, backend.URL)
+	c.Set(aconfig.SettingMenderUser, "user")
+	c.Set(aconfig.SettingMenderPass, "pass")
+	c.Set(aconfig.SettingServerCert, filepath.Join(dir, "server.crt"))
+	c.Set(aconfig.SettingServerKey, filepath.Join(dir, "server.key"))
+	c.Set(aconfig.SettingTenantCAPem, filepath.Join(dir, "tenant-ca.crt"))
+	for k, v := range settings {
+		c.Set(k, v)
+	}
+	assert.NoError(t, validateConfig(c))
+
+	vhosts, err := newVirtualHosts(c, nil)
+	assert.NoError(t, err)
+	policy, err := NewTLSPolicy(c)
+	assert.NoError(t, err)
+	s, err := NewServer(vhosts, "0", policy)
+	assert.NoError(t, err)
+	limits, err := NewLimits(c)
+	assert.NoError(t, err)
+	s.SetLimits(limits)
+	rateLimits, err := NewRateLimits(c)
+	assert.NoError(t, err)
+	s.SetRateLimits(rateLimits)
+	if tp != nil {
+		s.SetTracerProvider(tp)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = s.Serve(ln)
+	}()
+	e.url = "https://" + ln.Addr().String()
+
+	t.Cleanup(func() {
+		s.Close()
+		backend.Close()
+		os.RemoveAll(dir)
+	})
+
+	return e
+}
+
+func newE2ECA(t *testing.T, name string) *ca.CA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	c, err := ca.New(cert, key)
+	assert.NoError(t, err)
+	c.Profile = &ca.Profile{Validity: time.Hour}
+	return c
+}
+
+// signE2ECert issues a cert from the template as is, bypassing the CA's profile
+func signE2ECert(t *testing.T, issuer *ca.CA, tmpl *x509.Certificate, pub crypto.PublicKey) *x509.Certificate {
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer.Cert, pub, issuer.Signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	assert.NoError(t, ioutil.WriteFile(path,
+		pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+}
+
+// device creates a simulated device with an RSA key and a cert by the given CA;
+// expired backdates the cert
+func (e *e2e) device(issuer *ca.CA, mac string, expired bool) (*simulator.Device, crypto.Signer) {
+	key, err := simulator.GenerateKey(simulator.KeyTypeRSA, 2048)
+	assert.NoError(e.t, err)
+
+	cert, err := simulator.NewDeviceCert(issuer, key, mac)
+	assert.NoError(e.t, err)
+
+	if expired {
+		leaf := signE2ECert(e.t, issuer, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: mac},
+			NotBefore:    time.Now().Add(-2 * time.Hour),
+			NotAfter:     time.Now().Add(-time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, key.Public())
+		cert.Certificate = [][]byte{leaf.Raw}
+		cert.Leaf = leaf
+	}
+
+	d, err := simulator.NewDevice(`{"mac":"`+mac+`"}`, cert, simulator.DeviceConfig{
+		ServerURL:    e.url,
+		TenantToken:  "tenant",
+		DeviceType:   "e2e",
+		ArtifactName: "release-1",
+		TLS:          &tls.Config{RootCAs: e.serverCAs},
+
+		ReplayProtection: e.replayProtection,
+	})
+	assert.NoError(e.t, err)
+	return d, key
+}
+
+// authReq is an auth request with the given public key, signed by signer
+func authReq(t *testing.T, idData string, pubKey crypto.PublicKey, signer crypto.Signer) ([]byte, string) {
+	key, err := utils.SerializePubKey(pubKey)
+	assert.NoError(t, err)
+	body, err := json.Marshal(mender.AuthReq{
+		IdData:      idData,
+		TenantToken: "tenant",
+		PubKey:      key,
+	})
+	assert.NoError(t, err)
+	sig, err := simulator.SignAuthReq(signer, body)
+	assert.NoError(t, err)
+	return body, sig
+}
+
+func statusCode(err error) int {
+	var e *simulator.StatusError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if err == simulator.ErrUnauthorized {
+		return http.StatusUnauthorized
+	}
+	return 0
+}
+
+func TestE2EEnrollment(t *testing.T) {
+	e := newE2E(t, nil, nil)
+	ctx := context.Background()
+
+	// startup: the Ambassador logs in
+	assert.Equal(t, []fake.Request{
+		{Method: http.MethodPost, Path: mender.LoginUrl},
+	}, e.mender.Requests())
+
+	d, _ := e.device(e.tenantCA, "02:00:00:00:00:01", false)
+
+	body, sig, err := d.NewAuthReq()
+	assert.NoError(t, err)
+	_, err = d.AuthRequest(ctx, body, sig)
+	assert.NoError(t, err)
+
+	dev, ok := e.mender.Device(d.IdData)
+	assert.True(t, ok)
+	assert.Equal(t, fake.StatusAccepted, dev.Status)
+
+	// proxied device API calls
+	assert.NoError(t, d.SendInventory(ctx))
+	assert.Equal(t, "e2e", e.mender.Inventory(dev.ID)["device_type"])
+
+	dep, err := d.NextDeployment(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, dep)
+
+	// a repeated auth request is a preauth conflict the Ambassador ignores
+	_, err = d.AuthRequest(ctx, body, sig)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []fake.Request{
+		{Method: http.MethodPost, Path: mender.LoginUrl},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: fake.UrlAuthRequests},
+		{Method: http.MethodPatch, Path: fake.UrlInventory},
+		{Method: http.MethodGet, Path: fake.UrlDeploymentsNext},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: fake.UrlAuthRequests},
+	}, e.mender.Requests())
+	assert.Len(t, e.mender.Devices(), 1)
+}
+
+func TestE2ERejectedDevices(t *testing.T) {
+	e := newE2E(t, nil, nil)
+	ctx := context.Background()
+
+	otherKey, err := simulator.GenerateKey(simulator.KeyTypeRSA, 2048)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+		run  func() error
+		code int
+	}{
+		{
+			name: "wrong CA",
+			run: func() error {
+				d, _ := e.device(e.otherCA, "02:00:00:00:00:02", false)
+				body, sig, err := d.NewAuthReq()
+				assert.NoError(t, err)
+				_, err = d.AuthRequest(ctx, body, sig)
+				return err
+			},
+		},
+		{
+			name: "expired cert",
+			run: func() error {
+				d, _ := e.device(e.tenantCA, "02:00:00:00:00:03", true)
+				body, sig, err := d.NewAuthReq()
+				assert.NoError(t, err)
+				_, err = d.AuthRequest(ctx, body, sig)
+				return err
+			},
+		},
+		{
+			name: "mismatched key",
+			run: func() error {
+				d, _ := e.device(e.tenantCA, "02:00:00:00:00:04", false)
+				body, sig := authReq(t, d.IdData, otherKey.Public(), otherKey)
+				_, err := d.AuthRequest(ctx, body, sig)
+				return err
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "bad signature",
+			run: func() error {
+				d, key := e.device(e.tenantCA, "02:00:00:00:00:05", false)
+				body, _ := authReq(t, d.IdData, key.Public(), key)
+				_, sig := authReq(t, `{"mac":"02:00:00:00:00:06"}`, key.Public(), key)
+				_, err := d.AuthRequest(ctx, body, sig)
+				return err
+			},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "signed by another key",
+			run: func() error {
+				d, key := e.device(e.tenantCA, "02:00:00:00:00:07", false)
+				body, sig := authReq(t, d.IdData, key.Public(), otherKey)
+				_, err := d.AuthRequest(ctx, body, sig)
+				return err
+			},
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.run()
+		assert.Error(t, err, tc.name)
+		// rejected in the handshake - or by the Ambassador, with a status
+		assert.Equal(t, tc.code, statusCode(err), tc.name)
+	}
+
+	// nothing got past the Ambassador
+	assert.Empty(t, e.mender.Devices())
+	assert.Equal(t, []fake.Request{
+		{Method: http.MethodPost, Path: mender.LoginUrl},
+	}, e.mender.Requests())
+}
+
+func TestE2EReplayProtection(t *testing.T) {
+	e := newE2E(t, map[string]interface{}{
+		aconfig.SettingAuthReplayProtection: app.ReplayRequire,
+	}, nil)
+	ctx := context.Background()
+
+	e.replayProtection = true
+	d, key := e.device(e.tenantCA, "02:00:00:00:00:10", false)
+
+	// fresh requests pass, also repeatedly
+	body, sig, err := d.NewAuthReq()
+	assert.NoError(t, err)
+	_, err = d.AuthRequest(ctx, body, sig)
+	assert.NoError(t, err)
+	assert.NoError(t, d.Authorize(ctx))
+
+	// a replayed one doesn't, nor a legacy one
+	_, err = d.AuthRequest(ctx, body, sig)
+	assert.Equal(t, http.StatusBadRequest, statusCode(err))
+
+	body, sig = authReq(t, d.IdData, key.Public(), key)
+	_, err = d.AuthRequest(ctx, body, sig)
+	assert.Equal(t, http.StatusBadRequest, statusCode(err))
+
+	// neither reached Mender
+	assert.Equal(t, []fake.Request{
+		{Method: http.MethodPost, Path: mender.LoginUrl},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: fake.UrlAuthRequests},
+		{Method: http.MethodPost, Path: mender.PreauthUrl},
+		{Method: http.MethodPost, Path: fake.UrlAuthRequests},
+	}, e.mender.Requests())
+}
+
+// findSpan returns the first span of the name, with the parent if given
+func findSpan(spans []*sdktrace.SpanSnapshot, name string, parent *sdktrace.SpanSnapshot) *sdktrace.SpanSnapshot {
+	for _, s := range spans {
+		if s.Name == name && (parent == nil || s.Parent.SpanID() == parent.SpanContext.SpanID()) {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestE2ETracing(t *testing.T) {
+	// not parallel, the tracer provider and propagator are global
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	installTracing(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+		_ = tp.Shutdown(context.Background())
+	})
+
+	e := newE2E(t, nil, tp)
+	ctx := context.Background()
+
+	d, _ := e.device(e.tenantCA, "02:00:00:00:00:20", false)
+	assert.NoError(t, d.Authorize(ctx))
+
+	// the device's request, covering the handshake, verification,
+	// preauth and proxying; it ends after the response is sent
+	var req *sdktrace.SpanSnapshot
+	assert.Eventually(t, func() bool {
+		req = findSpan(exp.GetSpans(), http.MethodPost+" "+api.ApiUrlProxy, nil)
+		return req != nil
+	}, time.Second, 10*time.Millisecond)
+	if req == nil {
+		return
+	}
+	spans := exp.GetSpans()
+	assert.Equal(t, trace.SpanKindServer, req.SpanKind)
+	assert.Contains(t, req.Attributes, semconv.HTTPStatusCodeKey.Int(http.StatusOK))
+	assert.Contains(t, req.Attributes, semconv.HTTPTargetKey.String(fake.UrlAuthRequests))
+
+	handshake := findSpan(spans, "TLS handshake", req)
+	if assert.NotNil(t, handshake) {
+		assert.Equal(t, req.StartTime, handshake.StartTime)
+		assert.Contains(t, handshake.Attributes, attribute.Bool("tls.resumed", false))
+	}
+	assert.NotNil(t, findSpan(spans, "app.VerifyClientCert", req))
+
+	preauth := findSpan(spans, "app.Preauth", req)
+	if !assert.NotNil(t, preauth) {
+		return
+	}
+	preauthCall := findSpan(spans, http.MethodPost, preauth)
+	proxyCall := findSpan(spans, http.MethodPost, req)
+	if !assert.NotNil(t, preauthCall) || !assert.NotNil(t, proxyCall) {
+		return
+	}
+	assert.Equal(t, trace.SpanKindClient, proxyCall.SpanKind)
+
+	// the trace continues at Mender
+	traceparent := func(s *sdktrace.SpanSnapshot) string {
+		return "00-" + s.SpanContext.TraceID().String() + "-" + s.SpanContext.SpanID().String() + "-01"
+	}
+	assert.Equal(t, []fake.Request{
+		{Method: http.MethodPost, Path: mender.PreauthUrl, Traceparent: traceparent(preauthCall)},
+		{Method: http.MethodPost, Path: fake.UrlAuthRequests, Traceparent: traceparent(proxyCall)},
+	}, e.mender.Requests()[1:])
+}
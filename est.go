@@ -0,0 +1,72 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+)
+
+// newESTServer creates the EST enrollment listener, issuing from the configured issuer.
+// It shares the server cert and TLS policy with the device listener, but only
+// requests client certs in the handshake - each endpoint verifies them against its own CA.
+// rc is optional and rejects re-enrollment with revoked certs; lim, if set, applies
+// the device listener's timeouts and header limit.
+func newESTServer(c config.Reader, iss issuer.Issuer, policy *TLSPolicy,
+	rc RevocationChecker, lim *Limits) (*http.Server, error) {
+	l.Info("creating EST server")
+
+	if iss == nil {
+		return nil, errors.Errorf("%s needs an issuer (%s or %s)",
+			aconfig.SettingESTListen, aconfig.SettingCACert, aconfig.SettingIssuer)
+	}
+
+	bootstrap, err := certPool(c.GetString(aconfig.SettingESTBootstrapCAPem))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load EST bootstrap CA")
+	}
+
+	controller := api.NewESTController(iss, bootstrap)
+	if rc != nil {
+		controller.CheckRevocation(rc)
+	}
+	router, err := api.NewESTRouter(controller)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := loadKeyPair(
+		c.GetString(aconfig.SettingServerCert),
+		c.GetString(aconfig.SettingServerKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server cert")
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	policy.apply(tlsConfig)
+	tlsConfig.ClientAuth = tls.RequestClientCert
+	tlsConfig.VerifyPeerCertificate = nil
+
+	l.Info("creating EST server: ok")
+
+	srv := &http.Server{
+		Addr:      ":" + c.GetString(aconfig.SettingESTListen),
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+	if lim != nil {
+		lim.apply(srv)
+	}
+	return srv, nil
+}
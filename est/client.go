@@ -0,0 +1,95 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package est
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Client talks to an EST server; authenticate it with a client cert
+// in the HTTP client's TLS config - the factory cert for enrollment,
+// the current cert for re-enrollment
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient creates a client of the EST server at url (scheme + host:port)
+func NewClient(url string, client *http.Client) *Client {
+	return &Client{
+		url:  strings.TrimRight(url, "/"),
+		http: client,
+	}
+}
+
+// CACerts fetches the issuing CA certs, which devices should trust
+func (c *Client) CACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url+UrlCACerts, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, req)
+}
+
+// SimpleEnroll requests a first cert for the DER encoded CSR
+func (c *Client) SimpleEnroll(ctx context.Context, csr []byte) (*x509.Certificate, error) {
+	return c.enroll(ctx, UrlSimpleEnroll, csr)
+}
+
+// SimpleReenroll requests a new cert for the DER encoded CSR,
+// which must have the same subject as the current cert
+func (c *Client) SimpleReenroll(ctx context.Context, csr []byte) (*x509.Certificate, error) {
+	return c.enroll(ctx, UrlSimpleReenroll, csr)
+}
+
+func (c *Client) enroll(ctx context.Context, url string, csr []byte) (*x509.Certificate, error) {
+	req, err := http.NewRequest(http.MethodPost, c.url+url, bytes.NewReader(EncodeBody(csr)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentTypePKCS10)
+	req.Header.Set(HdrContentTransferEncoding, "base64")
+
+	certs, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate in EST response")
+	}
+	return certs[0], nil
+}
+
+func (c *Client) do(ctx context.Context, req *http.Request) ([]*x509.Certificate, error) {
+	rsp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "EST request failed")
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read EST response")
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("EST request failed with status %d: %s",
+			rsp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	der, err := DecodeBody(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode EST response")
+	}
+
+	return DecodeCertsOnly(der)
+}
@@ -0,0 +1,41 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package est holds the wire format of Enrollment over Secure Transport
+// (RFC 7030) and a client for it.
+package est
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+const (
+	UrlCACerts        = "/.well-known/est/cacerts"
+	UrlSimpleEnroll   = "/.well-known/est/simpleenroll"
+	UrlSimpleReenroll = "/.well-known/est/simplereenroll"
+
+	ContentTypePKCS10    = "application/pkcs10"
+	ContentTypeCertsOnly = "application/pkcs7-mime; smime-type=certs-only"
+
+	HdrContentTransferEncoding = "Content-Transfer-Encoding"
+)
+
+// EncodeBody base64 encodes a DER message body, as EST transfers them
+func EncodeBody(der []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(der))
+}
+
+// DecodeBody decodes a base64 message body; line breaks are allowed
+func DecodeBody(body []byte) ([]byte, error) {
+	s := strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n', ' ', '\t':
+			return -1
+		}
+		return r
+	}, string(body))
+
+	return base64.StdEncoding.DecodeString(s)
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package est
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	oidData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	ErrNotCertsOnly = errors.New("not a PKCS#7 certs-only message")
+)
+
+// contentInfo is the RFC 2315 envelope of the degenerate, certs-only
+// SignedData which EST uses to carry certs
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// Content is [0] EXPLICIT - asn1 can't round trip that on a RawValue
+	Content asn1.RawValue
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      dataContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue `asn1:"optional"`
+}
+
+type dataContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+// EncodeCertsOnly wraps the certs into a DER PKCS#7 certs-only message
+func EncodeCertsOnly(certs []*x509.Certificate) ([]byte, error) {
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      dataContentInfo{oidData},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      raw,
+		},
+		SignerInfos: emptySet,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      sd,
+		},
+	})
+}
+
+// DecodeCertsOnly extracts the certs from a DER PKCS#7 certs-only message
+func DecodeCertsOnly(der []byte) ([]*x509.Certificate, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, errors.Wrap(err, "failed to parse PKCS#7")
+	}
+	if !ci.ContentType.Equal(oidSignedData) ||
+		ci.Content.Class != asn1.ClassContextSpecific || ci.Content.Tag != 0 {
+		return nil, ErrNotCertsOnly
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, errors.Wrap(err, "failed to parse PKCS#7 signed data")
+	}
+	if sd.Certificates.Class != asn1.ClassContextSpecific || sd.Certificates.Tag != 0 {
+		return nil, ErrNotCertsOnly
+	}
+
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
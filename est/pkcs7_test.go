@@ -0,0 +1,61 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package est
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertsOnly(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	var certs []*x509.Certificate
+	for i := int64(1); i <= 2; i++ {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(i),
+			Subject:      pkix.Name{CommonName: "cert"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		assert.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+		certs = append(certs, cert)
+	}
+
+	der, err := EncodeCertsOnly(certs)
+	assert.NoError(t, err)
+
+	body := EncodeBody(der)
+	// EST servers commonly wrap base64 at 64 chars
+	wrapped := append(append([]byte{}, body[:64]...), '\r', '\n')
+	wrapped = append(wrapped, body[64:]...)
+
+	decoded, err := DecodeBody(wrapped)
+	assert.NoError(t, err)
+
+	out, err := DecodeCertsOnly(decoded)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	for i := range certs {
+		assert.Equal(t, certs[i].Raw, out[i].Raw)
+	}
+
+	_, err = DecodeCertsOnly(certs[0].Raw)
+	assert.Error(t, err)
+}
@@ -0,0 +1,390 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// +build pkcs11,cgo
+
+package hsm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
+)
+
+var (
+	modulesMu sync.Mutex
+	modules   = map[string]*pkcs11.Ctx{}
+
+	signersMu sync.Mutex
+	signers   = map[string]*signer{}
+
+	// retireDelay is how long a replaced signer stays open, so that
+	// handshakes in flight with the previous TLS config can finish
+	retireDelay = 2 * time.Minute
+
+	// rsaHashPrefixes are the DER DigestInfo prefixes of PKCS #1 v1.5 signatures
+	rsaHashPrefixes = map[crypto.Hash][]byte{
+		crypto.MD5SHA1: {},
+		crypto.SHA1:    {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+		crypto.SHA224:  {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+		crypto.SHA256:  {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+		crypto.SHA384:  {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+		crypto.SHA512:  {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+	}
+
+	// pssHashes are the PKCS#11 hash and MGF mechanisms of RSA-PSS signatures
+	pssHashes = map[crypto.Hash][2]uint{
+		crypto.SHA1:   {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1},
+		crypto.SHA224: {pkcs11.CKM_SHA224, pkcs11.CKG_MGF1_SHA224},
+		crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+		crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+		crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+	}
+)
+
+// signer signs with a private key in a PKCS#11 token. A PKCS#11 session
+// runs one operation at a time, so signatures are serialized.
+type signer struct {
+	mu      sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     crypto.PublicKey
+	// closed signers fail, rather than use a session handle the token may reuse
+	closed bool
+}
+
+// NewSigner opens the private key at the URI, whose public key is pub
+// (i.e. taken from the cert). Signers are kept per URI, so reloading
+// the config doesn't open new sessions.
+func NewSigner(u *URI, pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	if u.ModulePath == "" {
+		return nil, ErrNoModule
+	}
+
+	cacheKey := u.cacheKey()
+
+	signersMu.Lock()
+	defer signersMu.Unlock()
+
+	prev, ok := signers[cacheKey]
+	if ok && samePublicKey(prev.pub, pub) {
+		return prev, nil
+	}
+
+	s, err := openSigner(u, pub)
+	if err != nil {
+		return nil, err
+	}
+
+	// catch a key which doesn't belong to the cert now, not in handshakes
+	digest := sha256.Sum256([]byte("mtls-ambassador"))
+	sig, err := s.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err == nil {
+		err = verify(pub, digest[:], sig)
+	}
+	if err != nil {
+		s.close()
+		return nil, errors.Wrap(err, "PKCS#11 key doesn't match the certificate")
+	}
+
+	// the cert changed, the key may have too; the previous
+	// TLS config may still be handshaking with the previous signer
+	if prev != nil {
+		prev.retire()
+	}
+	signers[cacheKey] = s
+	return s, nil
+}
+
+func openSigner(u *URI, pub crypto.PublicKey) (*signer, error) {
+	pin, err := u.Pin()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := loadModule(u.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slot, err := findSlot(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open PKCS#11 session")
+	}
+
+	s := &signer{
+		ctx:     ctx,
+		session: session,
+		pub:     pub,
+	}
+
+	if pin != "" {
+		err := ctx.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil && !isError(err, pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			s.close()
+			return nil, errors.Wrap(err, "PKCS#11 login failed")
+		}
+	}
+
+	s.key, err = findKey(ctx, session, u)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadModule loads and initializes a PKCS#11 module once per process
+func loadModule(path string) (*pkcs11.Ctx, error) {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+
+	if ctx, ok := modules[path]; ok {
+		return ctx, nil
+	}
+
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, errors.Errorf("failed to load PKCS#11 module %s", path)
+	}
+	err := ctx.Initialize()
+	if err != nil && !isError(err, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, errors.Wrapf(err, "failed to initialize PKCS#11 module %s", path)
+	}
+
+	modules[path] = ctx
+	return ctx, nil
+}
+
+func findSlot(ctx *pkcs11.Ctx, u *URI) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list PKCS#11 slots")
+	}
+
+	var found []uint
+	for _, slot := range slots {
+		if u.SlotID != nil && slot != *u.SlotID {
+			continue
+		}
+		if u.Token != "" || u.Serial != "" {
+			info, err := ctx.GetTokenInfo(slot)
+			if err != nil {
+				return 0, errors.Wrap(err, "failed to get PKCS#11 token info")
+			}
+			// labels and serials are blank padded
+			if u.Token != "" && strings.TrimRight(info.Label, " ") != u.Token {
+				continue
+			}
+			if u.Serial != "" && strings.TrimRight(info.SerialNumber, " ") != u.Serial {
+				continue
+			}
+		}
+		found = append(found, slot)
+	}
+
+	switch len(found) {
+	case 0:
+		return 0, errors.New("PKCS#11 token not found")
+	case 1:
+		return found[0], nil
+	default:
+		return 0, errors.New("PKCS#11 URI matches more than one token")
+	}
+}
+
+func findKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, u *URI) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if u.Object != "" {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object))
+	}
+	if u.ID != nil {
+		tmpl = append(tmpl, pkcs11.NewAttribute(pkcs11.CKA_ID, u.ID))
+	}
+
+	if err := ctx.FindObjectsInit(session, tmpl); err != nil {
+		return 0, errors.Wrap(err, "failed to search PKCS#11 keys")
+	}
+	objs, _, err := ctx.FindObjects(session, 2)
+	_ = ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to search PKCS#11 keys")
+	}
+
+	switch len(objs) {
+	case 0:
+		return 0, errors.New("PKCS#11 private key not found")
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, errors.New("PKCS#11 URI matches more than one private key")
+	}
+}
+
+func (s *signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mech *pkcs11.Mechanism
+	data := digest
+
+	switch s.pub.(type) {
+	case *ecdsa.PublicKey:
+		mech = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			params, err := pssParams(pss)
+			if err != nil {
+				return nil, err
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params)
+		} else {
+			prefix, ok := rsaHashPrefixes[opts.HashFunc()]
+			if !ok {
+				return nil, errors.Errorf("unsupported hash %v", opts.HashFunc())
+			}
+			mech = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+			data = append(append([]byte{}, prefix...), digest...)
+		}
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errors.New("PKCS#11 session closed")
+	}
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mech}, s.key)
+	var sig []byte
+	if err == nil {
+		sig, err = s.ctx.Sign(s.session, data)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "PKCS#11 signing failed")
+	}
+
+	if _, ok := s.pub.(*ecdsa.PublicKey); ok {
+		return ecdsaDER(sig)
+	}
+	return sig, nil
+}
+
+// retire closes the signer after retireDelay
+func (s *signer) retire() {
+	time.AfterFunc(retireDelay, s.close)
+}
+
+func (s *signer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	_ = s.ctx.CloseSession(s.session)
+}
+
+func (u *URI) cacheKey() string {
+	slot := ""
+	if u.SlotID != nil {
+		slot = strconv.FormatUint(uint64(*u.SlotID), 10)
+	}
+	return strings.Join([]string{u.ModulePath, u.Token, u.Serial, slot, u.Object, string(u.ID)}, "\x00")
+}
+
+func pssParams(opts *rsa.PSSOptions) ([]byte, error) {
+	h, ok := pssHashes[opts.Hash]
+	if !ok {
+		return nil, errors.Errorf("unsupported hash %v", opts.Hash)
+	}
+
+	salt := opts.SaltLength
+	if salt == rsa.PSSSaltLengthEqualsHash || salt == rsa.PSSSaltLengthAuto {
+		salt = opts.Hash.Size()
+	}
+
+	return pkcs11.NewPSSParams(h[0], h[1], uint(salt)), nil
+}
+
+// ecdsaDER converts a PKCS#11 ECDSA signature (r || s) to ASN.1
+func ecdsaDER(sig []byte) ([]byte, error) {
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, errors.New("invalid PKCS#11 ECDSA signature")
+	}
+	n := len(sig) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		new(big.Int).SetBytes(sig[:n]),
+		new(big.Int).SetBytes(sig[n:]),
+	})
+}
+
+func verify(pub crypto.PublicKey, digest, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	case *ecdsa.PublicKey:
+		var es struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return err
+		}
+		if !ecdsa.Verify(pub, digest, es.R, es.S) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	}
+	return ErrUnsupportedKey
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	da, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	db, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(da, db)
+}
+
+func isError(err error, code uint) bool {
+	e, ok := err.(pkcs11.Error)
+	return ok && uint(e) == code
+}
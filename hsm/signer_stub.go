@@ -0,0 +1,16 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// +build !pkcs11 !cgo
+
+package hsm
+
+import (
+	"crypto"
+)
+
+// NewSigner is not available without the 'pkcs11' build tag
+func NewSigner(u *URI, pub crypto.PublicKey) (crypto.Signer, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// +build pkcs11,cgo
+
+package hsm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testToken = "mtls-test"
+	testPin   = "1234"
+)
+
+// softHSMModule finds SoftHSM v2, or SOFTHSM2_MODULE if set
+func softHSMModule() string {
+	paths := []string{
+		os.Getenv("SOFTHSM2_MODULE"),
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+	}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// initSoftHSM creates a token in a fresh SoftHSM store and imports the keys
+func initSoftHSM(t *testing.T, module, dir string, keys map[string]crypto.Signer) {
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(
+		"directories.tokendir = %s\nobjectstore.backend = file\n", dir)), 0600)
+	assert.NoError(t, err)
+	os.Setenv("SOFTHSM2_CONF", conf)
+
+	ctx := pkcs11.New(module)
+	assert.NotNil(t, ctx)
+	assert.NoError(t, ctx.Initialize())
+	defer func() {
+		assert.NoError(t, ctx.Finalize())
+		ctx.Destroy()
+	}()
+
+	slots, err := ctx.GetSlotList(false)
+	assert.NoError(t, err)
+	assert.NoError(t, ctx.InitToken(slots[0], "so-pin", testToken))
+
+	// SoftHSM moves an initialized token to a new slot
+	slots, err = ctx.GetSlotList(true)
+	assert.NoError(t, err)
+	var slot uint
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		assert.NoError(t, err)
+		if strings.TrimRight(info.Label, " ") == testToken {
+			slot = s
+		}
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	assert.NoError(t, err)
+	defer ctx.CloseSession(session)
+
+	assert.NoError(t, ctx.Login(session, pkcs11.CKU_SO, "so-pin"))
+	assert.NoError(t, ctx.InitPIN(session, testPin))
+	assert.NoError(t, ctx.Logout(session))
+	assert.NoError(t, ctx.Login(session, pkcs11.CKU_USER, testPin))
+
+	for label, key := range keys {
+		attrs := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			params, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+			assert.NoError(t, err)
+			d := key.D.Bytes()
+			d = append(make([]byte, 32-len(d)), d...)
+			attrs = append(attrs,
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+				pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+				pkcs11.NewAttribute(pkcs11.CKA_VALUE, d))
+		case *rsa.PrivateKey:
+			attrs = append(attrs,
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(key.E)).Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, key.D.Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, key.Primes[0].Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, key.Primes[1].Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, key.Precomputed.Dp.Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, key.Precomputed.Dq.Bytes()),
+				pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, key.Precomputed.Qinv.Bytes()))
+		}
+		_, err := ctx.CreateObject(session, attrs)
+		assert.NoError(t, err)
+	}
+}
+
+func writeCert(t *testing.T, dir, name string, key crypto.Signer) string {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, name+".crt")
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.NoError(t, err)
+	return path
+}
+
+func TestSoftHSM(t *testing.T) {
+	module := softHSMModule()
+	if module == "" {
+		t.Skip("SoftHSM v2 not found, set SOFTHSM2_MODULE")
+	}
+
+	dir, err := ioutil.TempDir("", "hsm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	initSoftHSM(t, module, dir, map[string]crypto.Signer{
+		"server-ec":  ecKey,
+		"server-rsa": rsaKey,
+	})
+
+	uri := func(object string) string {
+		return fmt.Sprintf("pkcs11:token=%s;object=%s?module-path=%s&pin-value=%s",
+			testToken, object, module, testPin)
+	}
+
+	cases := []struct {
+		name string
+
+		key    crypto.Signer
+		object string
+
+		outErr string
+	}{
+		{
+			name: "ok, ECDSA",
+
+			key:    ecKey,
+			object: "server-ec",
+		},
+		{
+			name: "ok, RSA",
+
+			key:    rsaKey,
+			object: "server-rsa",
+		},
+		{
+			name: "error, key not found",
+
+			key:    ecKey,
+			object: "nope",
+
+			outErr: "PKCS#11 private key not found",
+		},
+		{
+			name: "error, key doesn't match cert",
+
+			key:    otherKey,
+			object: "server-ec",
+
+			outErr: "PKCS#11 key doesn't match the certificate",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			certFile := writeCert(t, dir, tc.object, tc.key)
+
+			cert, err := LoadX509KeyPair(certFile, uri(tc.object))
+			if tc.outErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.outErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			// the same key is reused on reload
+			again, err := LoadX509KeyPair(certFile, uri(tc.object))
+			assert.NoError(t, err)
+			assert.Equal(t, cert.PrivateKey, again.PrivateKey)
+
+			digest := sha256.Sum256([]byte("hello"))
+			sig, err := cert.PrivateKey.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+			assert.NoError(t, err)
+			assert.NoError(t, verify(tc.key.Public(), digest[:], sig))
+
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			srv.StartTLS()
+			defer srv.Close()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(cert.Leaf)
+
+			// TLS 1.2 signs with PKCS #1 v1.5 (RSA), 1.3 with PSS
+			for _, v := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+				client := &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{
+							RootCAs:    roots,
+							ServerName: "localhost",
+							MinVersion: v,
+							MaxVersion: v,
+						},
+					},
+				}
+				res, err := client.Get(srv.URL)
+				assert.NoError(t, err)
+				if err == nil {
+					assert.Equal(t, http.StatusOK, res.StatusCode)
+					res.Body.Close()
+				}
+			}
+
+			// a failed replacement keeps the signer
+			_, err = LoadX509KeyPair(writeCert(t, dir, tc.object+"-other", otherKey), uri(tc.object))
+			assert.Error(t, err)
+			again, err = LoadX509KeyPair(certFile, uri(tc.object))
+			assert.NoError(t, err)
+			assert.Equal(t, cert.PrivateKey, again.PrivateKey)
+
+			// a replaced signer keeps signing for a while, for the
+			// handshakes of the previous TLS config
+			retireDelay = 100 * time.Millisecond
+			defer func() { retireDelay = 2 * time.Minute }()
+
+			s := cert.PrivateKey.(*signer)
+			s.retire()
+			_, err = s.Sign(rand.Reader, digest[:], crypto.SHA256)
+			assert.NoError(t, err)
+			time.Sleep(200 * time.Millisecond)
+			_, err = s.Sign(rand.Reader, digest[:], crypto.SHA256)
+			assert.EqualError(t, err, "PKCS#11 session closed")
+
+			u, err := ParseURI(uri(tc.object))
+			assert.NoError(t, err)
+			signersMu.Lock()
+			delete(signers, u.cacheKey())
+			signersMu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package hsm keeps the server's private key in an HSM, via a PKCS#11 module.
+// Keys are referenced by PKCS#11 URIs (RFC 7512), e.g.
+//
+//	pkcs11:token=mtls;object=server?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=/etc/mtls/pin
+//
+// PKCS#11 needs cgo; it is only built in with the 'pkcs11' build tag.
+package hsm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	URIScheme = "pkcs11:"
+)
+
+var (
+	ErrNotSupported   = errors.New("built without PKCS#11 support (build tag 'pkcs11')")
+	ErrNoModule       = errors.New("PKCS#11 URI needs a module-path")
+	ErrUnsupportedKey = errors.New("unsupported key type, need RSA or ECDSA")
+)
+
+// URI is a parsed PKCS#11 URI, selecting a private key
+type URI struct {
+	// Token is the token label
+	Token string
+	// Serial is the token serial number
+	Serial string
+	// SlotID selects the slot, if non-nil
+	SlotID *uint
+	// Object is the key label (CKA_LABEL)
+	Object string
+	// ID is the key id (CKA_ID)
+	ID []byte
+
+	// ModulePath is the PKCS#11 module (shared library)
+	ModulePath string
+	// PinValue is the user PIN
+	PinValue string
+	// PinSource is a file holding the user PIN
+	PinSource string
+}
+
+// IsURI tells whether a key setting is a PKCS#11 URI rather than a file
+func IsURI(s string) bool {
+	return strings.HasPrefix(s, URIScheme)
+}
+
+// ParseURI parses a PKCS#11 URI of a private key
+func ParseURI(s string) (*URI, error) {
+	if !IsURI(s) {
+		return nil, errors.Errorf("not a PKCS#11 URI: missing %q", URIScheme)
+	}
+	s = strings.TrimPrefix(s, URIScheme)
+
+	var path, query string
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		path, query = s[:i], s[i+1:]
+	} else {
+		path = s
+	}
+
+	u := &URI{}
+	err := parseAttrs(path, ";", func(k, v string) error {
+		switch k {
+		case "token":
+			u.Token = v
+		case "serial":
+			u.Serial = v
+		case "slot-id":
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return errors.Errorf("invalid slot-id %q", v)
+			}
+			slot := uint(id)
+			u.SlotID = &slot
+		case "object":
+			u.Object = v
+		case "id":
+			u.ID = []byte(v)
+		case "type":
+			if v != "private" {
+				return errors.Errorf("object type must be 'private', not %q", v)
+			}
+		case "manufacturer", "model",
+			"library-description", "library-manufacturer", "library-version",
+			"slot-description", "slot-manufacturer":
+			// informational, as output by p11tool and friends
+		default:
+			return errors.Errorf("unknown attribute %q", k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid PKCS#11 URI")
+	}
+
+	err = parseAttrs(query, "&", func(k, v string) error {
+		switch k {
+		case "module-path":
+			u.ModulePath = v
+		case "pin-value":
+			u.PinValue = v
+		case "pin-source":
+			u.PinSource = v
+		default:
+			return errors.Errorf("unknown query attribute %q", k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid PKCS#11 URI")
+	}
+
+	if u.Object == "" && u.ID == nil {
+		return nil, errors.New("invalid PKCS#11 URI: need an object or id")
+	}
+
+	return u, nil
+}
+
+func parseAttrs(s, sep string, set func(k, v string) error) error {
+	if s == "" {
+		return nil
+	}
+	for _, attr := range strings.Split(s, sep) {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("invalid attribute %q", attr)
+		}
+		v, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return errors.Errorf("invalid value of %q", kv[0])
+		}
+		if err := set(kv[0], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pin returns the user PIN, from pin-value or pin-source ("file:" URI or path);
+// empty means no login
+func (u *URI) Pin() (string, error) {
+	if u.PinValue != "" || u.PinSource == "" {
+		return u.PinValue, nil
+	}
+
+	data, err := ioutil.ReadFile(strings.TrimPrefix(u.PinSource, "file:"))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read PIN")
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Redact hides the PIN of a PKCS#11 URI, for logging;
+// other strings (key file paths) are returned as is
+func Redact(s string) string {
+	if !IsURI(s) {
+		return s
+	}
+	i := strings.IndexByte(s, '?')
+	if i < 0 {
+		return s
+	}
+
+	attrs := strings.Split(s[i+1:], "&")
+	for j, attr := range attrs {
+		if strings.HasPrefix(attr, "pin-value=") {
+			attrs[j] = "pin-value=***"
+		}
+	}
+	return s[:i+1] + strings.Join(attrs, "&")
+}
+
+// LoadX509KeyPair loads a PEM cert chain, with the private key of
+// its leaf in the HSM at the given PKCS#11 URI
+func LoadX509KeyPair(certFile, keyURI string) (tls.Certificate, error) {
+	var cert tls.Certificate
+
+	u, err := ParseURI(keyURI)
+	if err != nil {
+		return cert, err
+	}
+
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return cert, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, errors.Errorf("no certificate in %s", certFile)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, err
+	}
+
+	cert.PrivateKey, err = NewSigner(u, cert.Leaf.PublicKey)
+	if err != nil {
+		return cert, err
+	}
+
+	return cert, nil
+}
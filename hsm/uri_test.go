@@ -0,0 +1,160 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package hsm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseURI(t *testing.T) {
+	t.Parallel()
+
+	slot := uint(3)
+
+	cases := []struct {
+		name string
+
+		uri string
+
+		out    *URI
+		outErr string
+	}{
+		{
+			name: "ok, label",
+
+			uri: "pkcs11:token=mtls;object=server?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234",
+
+			out: &URI{
+				Token:      "mtls",
+				Object:     "server",
+				ModulePath: "/usr/lib/softhsm/libsofthsm2.so",
+				PinValue:   "1234",
+			},
+		},
+		{
+			name: "ok, id, slot, pct-encoding",
+
+			uri: "pkcs11:model=SoftHSM%20v2;serial=a1b2;slot-id=3;id=%01%02;type=private" +
+				"?module-path=/opt/my%20hsm/p11.so&pin-source=file:/etc/mtls/pin",
+
+			out: &URI{
+				Serial:     "a1b2",
+				SlotID:     &slot,
+				ID:         []byte{1, 2},
+				ModulePath: "/opt/my hsm/p11.so",
+				PinSource:  "file:/etc/mtls/pin",
+			},
+		},
+		{
+			name: "error, scheme",
+
+			uri: "/etc/mtls/server.key",
+
+			outErr: `not a PKCS#11 URI: missing "pkcs11:"`,
+		},
+		{
+			name: "error, no key",
+
+			uri: "pkcs11:token=mtls",
+
+			outErr: "invalid PKCS#11 URI: need an object or id",
+		},
+		{
+			name: "error, type",
+
+			uri: "pkcs11:object=server;type=cert",
+
+			outErr: `invalid PKCS#11 URI: object type must be 'private', not "cert"`,
+		},
+		{
+			name: "error, unknown attribute",
+
+			uri: "pkcs11:object=server;label=server",
+
+			outErr: `invalid PKCS#11 URI: unknown attribute "label"`,
+		},
+		{
+			name: "error, unknown query attribute",
+
+			uri: "pkcs11:object=server?pin=1234",
+
+			outErr: `invalid PKCS#11 URI: unknown query attribute "pin"`,
+		},
+		{
+			name: "error, slot",
+
+			uri: "pkcs11:object=server;slot-id=first",
+
+			outErr: `invalid PKCS#11 URI: invalid slot-id "first"`,
+		},
+		{
+			name: "error, encoding",
+
+			uri: "pkcs11:object=server%zz",
+
+			outErr: `invalid PKCS#11 URI: invalid value of "object"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := ParseURI(tc.uri)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.out, u)
+			}
+		})
+	}
+}
+
+func TestURIPin(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "hsm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pin")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("4321\n"), 0600))
+
+	pin, err := (&URI{PinValue: "1234", PinSource: path}).Pin()
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", pin)
+
+	pin, err = (&URI{PinSource: path}).Pin()
+	assert.NoError(t, err)
+	assert.Equal(t, "4321", pin)
+
+	pin, err = (&URI{PinSource: "file:" + path}).Pin()
+	assert.NoError(t, err)
+	assert.Equal(t, "4321", pin)
+
+	pin, err = (&URI{}).Pin()
+	assert.NoError(t, err)
+	assert.Equal(t, "", pin)
+
+	_, err = (&URI{PinSource: filepath.Join(dir, "nope")}).Pin()
+	assert.Error(t, err)
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "/etc/mtls/server.key", Redact("/etc/mtls/server.key"))
+	assert.Equal(t, "pkcs11:object=server", Redact("pkcs11:object=server"))
+	assert.Equal(t,
+		"pkcs11:object=server?module-path=/p11.so&pin-value=***",
+		Redact("pkcs11:object=server?module-path=/p11.so&pin-value=1234"))
+}
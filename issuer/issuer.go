@@ -0,0 +1,51 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package issuer defines how device certs get issued, so that the signing key
+// can live in the Ambassador (see package ca) or in an external PKI.
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TypeLocal is the internal CA, with the key in a local file (ca_* settings)
+	TypeLocal = "local"
+	// TypeVault is HashiCorp Vault's PKI secrets engine
+	TypeVault = "vault"
+)
+
+var (
+	ErrKeyMismatch = errors.New("issued certificate doesn't match the CSR's key")
+)
+
+// Issuer issues device certs from CSRs
+type Issuer interface {
+	// Issue signs a cert for the CSR's subject and public key
+	Issue(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error)
+
+	// CACerts returns the issuing CA cert (first) and its chain
+	CACerts(ctx context.Context) ([]*x509.Certificate, error)
+}
+
+// checkKey verifies that the cert was issued for the CSR's key
+func checkKey(cert *x509.Certificate, csr *x509.CertificateRequest) error {
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	csrKey, err := x509.MarshalPKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(certKey, csrKey) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
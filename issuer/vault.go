@@ -0,0 +1,208 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HdrVaultToken = "X-Vault-Token"
+
+	vaultDefaultMount = "pki"
+)
+
+// VaultConfig configures the Vault PKI issuer
+type VaultConfig struct {
+	// URL is Vault's address, e.g. https://vault:8200
+	URL string
+	// Mount is the PKI secrets engine's mount path, "pki" if empty
+	Mount string
+	// Role is the PKI role certs are signed with
+	Role string
+	// Token authenticates to Vault; it needs the 'update' capability
+	// on <mount>/sign/<role>
+	Token string
+	// TTL is the requested validity; empty means the role's default
+	TTL time.Duration
+
+	// Client is the HTTP client talking to Vault, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// Vault issues certs via Vault's PKI secrets engine sign API
+// (POST /v1/<mount>/sign/<role>)
+type Vault struct {
+	config VaultConfig
+	url    string
+}
+
+type vaultSignReq struct {
+	CSR        string `json:"csr"`
+	CommonName string `json:"common_name,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	Format     string `json:"format"`
+}
+
+type vaultSignRsp struct {
+	Data struct {
+		Certificate  string   `json:"certificate"`
+		IssuingCA    string   `json:"issuing_ca"`
+		CAChain      []string `json:"ca_chain"`
+		SerialNumber string   `json:"serial_number"`
+	} `json:"data"`
+}
+
+type vaultErrRsp struct {
+	Errors []string `json:"errors"`
+}
+
+func NewVault(config VaultConfig) (*Vault, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.Errorf("invalid Vault URL %q", config.URL)
+	}
+	if config.Role == "" {
+		return nil, errors.New("need a Vault PKI role")
+	}
+	if config.Token == "" {
+		return nil, errors.New("need a Vault token")
+	}
+	if config.Mount == "" {
+		config.Mount = vaultDefaultMount
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	return &Vault{
+		config: config,
+		url:    strings.TrimRight(config.URL, "/") + "/v1/" + strings.Trim(config.Mount, "/"),
+	}, nil
+}
+
+func (v *Vault) Issue(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	req := vaultSignReq{
+		CSR: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE REQUEST",
+			Bytes: csr.Raw,
+		})),
+		CommonName: csr.Subject.CommonName,
+		Format:     "pem",
+	}
+	if v.config.TTL > 0 {
+		req.TTL = fmt.Sprintf("%ds", int64(v.config.TTL.Seconds()))
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp vaultSignRsp
+	err = v.do(ctx, http.MethodPost, "/sign/"+v.config.Role, body, &rsp)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(rsp.Data.Certificate))
+	if block == nil {
+		return nil, errors.New("no certificate in Vault response")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate from Vault")
+	}
+
+	if err := checkKey(cert, csr); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// CACerts returns the PKI mount's CA cert (GET /v1/<mount>/ca/pem)
+func (v *Vault) CACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	req, err := http.NewRequest(http.MethodGet, v.url+"/ca/pem", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := v.config.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "Vault request failed")
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read Vault response")
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Vault request failed with status %d", rsp.StatusCode)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse CA certificate from Vault")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no CA certificate in Vault response")
+	}
+
+	return certs, nil
+}
+
+func (v *Vault) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, v.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HdrVaultToken, v.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := v.config.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "Vault request failed")
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read Vault response")
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		var e vaultErrRsp
+		if json.Unmarshal(data, &e) == nil && len(e.Errors) > 0 {
+			return errors.Errorf("Vault request failed with status %d: %s",
+				rsp.StatusCode, strings.Join(e.Errors, "; "))
+		}
+		return errors.Errorf("Vault request failed with status %d", rsp.StatusCode)
+	}
+
+	return errors.Wrap(json.Unmarshal(data, out), "failed to parse Vault response")
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package issuer
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault is a stand-in for Vault's PKI secrets engine at mount "pki"
+type fakeVault struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+
+	// signKey, if set, is put in issued certs instead of the CSR's key
+	signKey crypto.PublicKey
+
+	lastTTL string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Vault CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &fakeVault{ca: ca, caKey: key}
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/pki/ca/pem":
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})
+		return
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/pki/sign/devices":
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+
+	if r.Header.Get(HdrVaultToken) != "s.token" {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+
+	var req vaultSignReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.lastTTL = req.TTL
+
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"errors":["no data found in PEM block"]}`))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pub := csr.PublicKey
+	if f.signKey != nil {
+		pub = f.signKey
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: req.CommonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca, pub, f.caKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var rsp vaultSignRsp
+	rsp.Data.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	rsp.Data.IssuingCA = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw}))
+	_ = json.NewEncoder(w).Encode(rsp)
+}
+
+func newTestCSR(t *testing.T, cn string) *x509.CertificateRequest {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	assert.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	assert.NoError(t, err)
+	return csr
+}
+
+func TestNewVault(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		config VaultConfig
+
+		outURL string
+		outErr string
+	}{
+		{
+			name: "ok, default mount",
+
+			config: VaultConfig{URL: "https://vault:8200/", Role: "devices", Token: "s.token"},
+
+			outURL: "https://vault:8200/v1/pki",
+		},
+		{
+			name: "ok, mount",
+
+			config: VaultConfig{
+				URL:   "https://vault:8200",
+				Mount: "/pki_int/",
+				Role:  "devices",
+				Token: "s.token",
+			},
+
+			outURL: "https://vault:8200/v1/pki_int",
+		},
+		{
+			name: "error, url",
+
+			config: VaultConfig{URL: "vault", Role: "devices", Token: "s.token"},
+
+			outErr: `invalid Vault URL "vault"`,
+		},
+		{
+			name: "error, role",
+
+			config: VaultConfig{URL: "https://vault:8200", Token: "s.token"},
+
+			outErr: "need a Vault PKI role",
+		},
+		{
+			name: "error, token",
+
+			config: VaultConfig{URL: "https://vault:8200", Role: "devices"},
+
+			outErr: "need a Vault token",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			v, err := NewVault(tc.config)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.outURL, v.url)
+			}
+		})
+	}
+}
+
+func TestVault(t *testing.T) {
+	t.Parallel()
+
+	fake := newFakeVault(t)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	v, err := NewVault(VaultConfig{
+		URL:   srv.URL,
+		Role:  "devices",
+		Token: "s.token",
+		TTL:   48 * time.Hour,
+	})
+	assert.NoError(t, err)
+
+	var _ Issuer = v
+
+	ctx := context.Background()
+
+	cas, err := v.CACerts(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{fake.ca}, cas)
+
+	csr := newTestCSR(t, "dev-1")
+	cert, err := v.Issue(ctx, csr)
+	assert.NoError(t, err)
+	assert.Equal(t, "dev-1", cert.Subject.CommonName)
+	assert.NoError(t, cert.CheckSignatureFrom(fake.ca))
+	assert.Equal(t, "172800s", fake.lastTTL)
+
+	// the PKI must not swap the device's key
+	fake.signKey = newTestCSR(t, "other").PublicKey
+	_, err = v.Issue(ctx, csr)
+	assert.Equal(t, ErrKeyMismatch, err)
+
+	// Vault's errors are passed on
+	v, err = NewVault(VaultConfig{URL: srv.URL, Role: "devices", Token: "bad"})
+	assert.NoError(t, err)
+	_, err = v.Issue(ctx, csr)
+	assert.EqualError(t, err, "Vault request failed with status 403: permission denied")
+
+	v, err = NewVault(VaultConfig{URL: srv.URL, Mount: "nope", Role: "devices", Token: "s.token"})
+	assert.NoError(t, err)
+	_, err = v.CACerts(ctx)
+	assert.EqualError(t, err, "Vault request failed with status 404")
+}
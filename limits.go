@@ -0,0 +1,352 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+const (
+	LimitBodySize    = "body_size"
+	LimitReadTimeout = "read_timeout"
+	LimitConnsPerIP  = "conns_per_ip"
+)
+
+var (
+	ErrBodyTooLarge = errors.New("request body too large")
+
+	limitViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_limit_violations_total",
+		Help: "Requests and connections rejected by the device listener's limits.",
+	}, []string{"limit"})
+)
+
+// Limits are the request size limits and slow client protection
+// of the device listener
+type Limits struct {
+	// BodyLimit is the default body limit, BodyLimitPaths
+	// override it per URL path prefix (longest prefix wins); 0 is no limit
+	BodyLimit      int64
+	BodyLimitPaths map[string]int64
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	MaxConnsPerIP int
+}
+
+// NewLimits parses and validates the limits settings
+func NewLimits(c config.Reader) (*Limits, error) {
+	lim := &Limits{
+		BodyLimit:         int64(c.GetInt(aconfig.SettingBodyLimit)),
+		BodyLimitPaths:    map[string]int64{},
+		ReadHeaderTimeout: c.GetDuration(aconfig.SettingReadHeaderTimeout),
+		ReadTimeout:       c.GetDuration(aconfig.SettingReadTimeout),
+		IdleTimeout:       c.GetDuration(aconfig.SettingIdleTimeout),
+		MaxHeaderBytes:    c.GetInt(aconfig.SettingMaxHeaderBytes),
+		MaxConnsPerIP:     c.GetInt(aconfig.SettingMaxConnsPerIP),
+	}
+
+	for path, v := range c.GetStringMap(aconfig.SettingBodyLimitPaths) {
+		n, ok := toInt64(v)
+		if !ok || n < 0 {
+			return nil, errors.Errorf("%s: invalid limit %v of %s",
+				aconfig.SettingBodyLimitPaths, v, path)
+		}
+		lim.BodyLimitPaths[path] = n
+	}
+	// the auth requests' own setting, unless overridden by the path map
+	if _, ok := lim.BodyLimitPaths[api.UrlDevauthAuthReq]; !ok {
+		lim.BodyLimitPaths[api.UrlDevauthAuthReq] = int64(c.GetInt(aconfig.SettingBodyLimitAuthRequests))
+	}
+
+	for _, s := range []struct {
+		name  string
+		value int64
+	}{
+		{aconfig.SettingBodyLimit, lim.BodyLimit},
+		{aconfig.SettingBodyLimitAuthRequests, lim.BodyLimitPaths[api.UrlDevauthAuthReq]},
+		{aconfig.SettingReadHeaderTimeout, int64(lim.ReadHeaderTimeout)},
+		{aconfig.SettingReadTimeout, int64(lim.ReadTimeout)},
+		{aconfig.SettingIdleTimeout, int64(lim.IdleTimeout)},
+		{aconfig.SettingMaxHeaderBytes, int64(lim.MaxHeaderBytes)},
+		{aconfig.SettingMaxConnsPerIP, int64(lim.MaxConnsPerIP)},
+	} {
+		if s.value < 0 {
+			return nil, errors.Errorf("%s must not be negative", s.name)
+		}
+	}
+
+	return lim, nil
+}
+
+// toInt64 converts a number from a config map, which depending
+// on the source (yaml, json, env) may be of any numeric type
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), float64(int64(n)) == n
+	}
+	return 0, false
+}
+
+// bodyLimitFor returns the body limit of the URL path
+func (lim *Limits) bodyLimitFor(path string) int64 {
+	limit, longest := lim.BodyLimit, -1
+	for prefix, l := range lim.BodyLimitPaths {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			limit, longest = l, len(prefix)
+		}
+	}
+	return limit
+}
+
+// apply sets the timeouts and the header limit on the server
+func (lim *Limits) apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = lim.ReadHeaderTimeout
+	srv.ReadTimeout = lim.ReadTimeout
+	srv.IdleTimeout = lim.IdleTimeout
+	srv.MaxHeaderBytes = lim.MaxHeaderBytes
+}
+
+// limitBody rejects request bodies over the path's limit with a 413,
+// and bodies not fully sent within the read timeout with a 408.
+// Whatever the handler (e.g. the proxy) responds once a body read failed
+// this way is replaced with the proper status.
+func (lim *Limits) limitBody(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	limit := lim.bodyLimitFor(r.URL.Path)
+	if limit > 0 && r.ContentLength > limit {
+		limitViolations.WithLabelValues(LimitBodySize).Inc()
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body := &limitedBody{ReadCloser: r.Body, remaining: limit}
+	if limit == 0 {
+		body.remaining = -1
+	}
+	r.Body = body
+
+	next.ServeHTTP(newLimitWriter(w, body), r)
+}
+
+// limitedBody fails reads past the limit with ErrBodyTooLarge
+// and remembers why reading it failed
+type limitedBody struct {
+	io.ReadCloser
+	// remaining is the number of bytes still allowed, -1 is no limit
+	remaining int64
+
+	tooLarge int32
+	timedOut int32
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		// over the limit only if there's something left to read
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n > 0 {
+			return 0, b.exceeded()
+		}
+		return 0, b.check(err)
+	}
+
+	if b.remaining > 0 && int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+	}
+	return n, b.check(err)
+}
+
+func (b *limitedBody) exceeded() error {
+	if atomic.CompareAndSwapInt32(&b.tooLarge, 0, 1) {
+		limitViolations.WithLabelValues(LimitBodySize).Inc()
+	}
+	return ErrBodyTooLarge
+}
+
+func (b *limitedBody) check(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if atomic.CompareAndSwapInt32(&b.timedOut, 0, 1) {
+			limitViolations.WithLabelValues(LimitReadTimeout).Inc()
+		}
+	}
+	return err
+}
+
+// status is the status forced by a failed body read, if any
+func (b *limitedBody) status() int {
+	switch {
+	case atomic.LoadInt32(&b.tooLarge) == 1:
+		return http.StatusRequestEntityTooLarge
+	case atomic.LoadInt32(&b.timedOut) == 1:
+		return http.StatusRequestTimeout
+	}
+	return 0
+}
+
+// limitWriter replaces the response with the status forced by the body,
+// if its reading failed before the response was started
+type limitWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+
+	wroteHeader bool
+	// discard drops the handler's response body in favour of the forced status
+	discard bool
+}
+
+func newLimitWriter(w http.ResponseWriter, body *limitedBody) http.ResponseWriter {
+	return &limitWriter{ResponseWriter: w, body: body}
+}
+
+func (w *limitWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if forced := w.body.status(); forced != 0 {
+		h := w.Header()
+		for k := range h {
+			delete(h, k)
+		}
+		h.Set("Connection", "close")
+		code, w.discard = forced, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *limitWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify is passed through for gin, whose writer asserts it unchecked
+func (w *limitWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
+
+// limitListener closes connections from source IPs which already
+// have max open connections, before the TLS handshake
+type limitListener struct {
+	net.Listener
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newLimitListener(ln net.Listener, max int) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		max:      max,
+		conns:    map[string]int{},
+	}
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		if !ln.acquire(ip) {
+			// counted only: a log line per connection would turn a flood into a log flood
+			limitViolations.WithLabelValues(LimitConnsPerIP).Inc()
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, release: func() { ln.release(ip) }}, nil
+	}
+}
+
+func (ln *limitListener) acquire(ip string) bool {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if ln.conns[ip] >= ln.max {
+		return false
+	}
+	ln.conns[ip]++
+	return true
+}
+
+func (ln *limitListener) release(ip string) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	ln.conns[ip]--
+	if ln.conns[ip] <= 0 {
+		delete(ln.conns, ip)
+	}
+}
+
+// limitConn releases its slot on the first Close
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,370 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func TestNewLimits(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		out    *Limits
+		outErr string
+	}{
+		{
+			name: "ok, defaults",
+
+			out: &Limits{
+				BodyLimit: 10 * 1024 * 1024,
+				BodyLimitPaths: map[string]int64{
+					api.UrlDevauthAuthReq: 64 * 1024,
+				},
+				ReadHeaderTimeout: 10 * time.Second,
+				ReadTimeout:       time.Minute,
+				IdleTimeout:       2 * time.Minute,
+				MaxHeaderBytes:    64 * 1024,
+			},
+		},
+		{
+			name: "ok, all set",
+
+			settings: map[string]interface{}{
+				aconfig.SettingBodyLimit:             0,
+				aconfig.SettingBodyLimitAuthRequests: 4096,
+				aconfig.SettingBodyLimitPaths: map[string]interface{}{
+					"/api/devices/v1/deployments": 1024,
+					"/api/devices/v1/inventory":   float64(2048),
+				},
+				aconfig.SettingReadHeaderTimeout: "1s",
+				aconfig.SettingReadTimeout:       "0",
+				aconfig.SettingIdleTimeout:       "5s",
+				aconfig.SettingMaxHeaderBytes:    8192,
+				aconfig.SettingMaxConnsPerIP:     4,
+			},
+
+			out: &Limits{
+				BodyLimitPaths: map[string]int64{
+					api.UrlDevauthAuthReq:         4096,
+					"/api/devices/v1/deployments": 1024,
+					"/api/devices/v1/inventory":   2048,
+				},
+				ReadHeaderTimeout: time.Second,
+				IdleTimeout:       5 * time.Second,
+				MaxHeaderBytes:    8192,
+				MaxConnsPerIP:     4,
+			},
+		},
+		{
+			name: "ok, auth requests in path map",
+
+			settings: map[string]interface{}{
+				aconfig.SettingBodyLimitPaths: map[string]interface{}{
+					api.UrlDevauthAuthReq: 100,
+				},
+			},
+
+			out: &Limits{
+				BodyLimit: 10 * 1024 * 1024,
+				BodyLimitPaths: map[string]int64{
+					api.UrlDevauthAuthReq: 100,
+				},
+				ReadHeaderTimeout: 10 * time.Second,
+				ReadTimeout:       time.Minute,
+				IdleTimeout:       2 * time.Minute,
+				MaxHeaderBytes:    64 * 1024,
+			},
+		},
+		{
+			name: "error, path limit",
+
+			settings: map[string]interface{}{
+				aconfig.SettingBodyLimitPaths: map[string]interface{}{
+					"/api": "big",
+				},
+			},
+
+			outErr: "body_limit_paths: invalid limit big of /api",
+		},
+		{
+			name: "error, negative",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMaxConnsPerIP: -1,
+			},
+
+			outErr: "max_conns_per_ip must not be negative",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			lim, err := NewLimits(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.out, lim)
+			}
+		})
+	}
+}
+
+func TestLimitsBody(t *testing.T) {
+	t.Parallel()
+
+	lim := &Limits{
+		BodyLimit: 10,
+		BodyLimitPaths: map[string]int64{
+			"/small":      4,
+			"/small/big":  0,
+			"/small/tiny": 1,
+		},
+	}
+
+	// reads the whole body, like the proxy, and fails like it on errors
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("upstream error"))
+			return
+		}
+		_, _ = w.Write(data)
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lim.limitBody(w, r, h)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		path    string
+		body    string
+		chunked bool
+
+		outStatus int
+		outBody   string
+	}{
+		{
+			name: "ok, default limit",
+			path: "/foo",
+			body: "0123456789",
+
+			outStatus: http.StatusOK,
+			outBody:   "0123456789",
+		},
+		{
+			name: "ok, default limit, chunked",
+			path: "/foo",
+			body: "0123456789",
+
+			chunked:   true,
+			outStatus: http.StatusOK,
+			outBody:   "0123456789",
+		},
+		{
+			name: "ok, no limit",
+			path: "/small/big",
+			body: strings.Repeat("x", 100),
+
+			outStatus: http.StatusOK,
+			outBody:   strings.Repeat("x", 100),
+		},
+		{
+			name: "error, content length",
+			path: "/foo",
+			body: "0123456789a",
+
+			outStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "error, chunked",
+			path: "/foo",
+			body: "0123456789a",
+
+			chunked:   true,
+			outStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "error, path limit",
+			path: "/small/x",
+			body: "01234",
+
+			outStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "error, longest prefix wins",
+			path: "/small/tiny",
+			body: "01",
+
+			chunked:   true,
+			outStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tc.body)
+			if tc.chunked {
+				// hide the length
+				body = io.MultiReader(body)
+			}
+			req, err := http.NewRequest(http.MethodPost, srv.URL+tc.path, body)
+			assert.NoError(t, err)
+
+			rsp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			data, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+
+			assert.Equal(t, tc.outStatus, rsp.StatusCode)
+			assert.Equal(t, tc.outBody, string(data))
+		})
+	}
+}
+
+func TestLimitsReadTimeout(t *testing.T) {
+	t.Parallel()
+
+	lim := &Limits{ReadTimeout: 200 * time.Millisecond}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lim.limitBody(w, r, h)
+	}))
+	lim.apply(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	before := testutil.ToFloat64(limitViolations.WithLabelValues(LimitReadTimeout))
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// a device sending only a part of the body
+	_, err = conn.Write([]byte("POST /foo HTTP/1.1\r\nHost: foo\r\nContent-Length: 10\r\n\r\n01"))
+	assert.NoError(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestTimeout, rsp.StatusCode)
+	assert.Equal(t, before+1, testutil.ToFloat64(limitViolations.WithLabelValues(LimitReadTimeout)))
+}
+
+func TestLimitListener(t *testing.T) {
+	t.Parallel()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ln := newLimitListener(tcp, 1)
+	defer ln.Close()
+
+	// echoes a line back on every accepted connection
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err == nil {
+					_, _ = conn.Write(line)
+				}
+			}()
+		}
+	}()
+
+	echo := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("hello\n")); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(line, []byte("hello\n")) {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+
+	before := testutil.ToFloat64(limitViolations.WithLabelValues(LimitConnsPerIP))
+
+	first, err := net.Dial("tcp", tcp.Addr().String())
+	assert.NoError(t, err)
+
+	// wait for the first one to be accepted
+	assert.Eventually(t, func() bool {
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		return ln.conns["127.0.0.1"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	second, err := net.Dial("tcp", tcp.Addr().String())
+	assert.NoError(t, err)
+	assert.Error(t, echo(second))
+	second.Close()
+	assert.Equal(t, before+1, testutil.ToFloat64(limitViolations.WithLabelValues(LimitConnsPerIP)))
+
+	// the slot is released once the first one is closed
+	assert.NoError(t, echo(first))
+	first.Close()
+	assert.Eventually(t, func() bool {
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		return len(ln.conns) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	third, err := net.Dial("tcp", tcp.Addr().String())
+	assert.NoError(t, err)
+	assert.NoError(t, echo(third))
+	third.Close()
+}
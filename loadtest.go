@@ -0,0 +1,158 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/simulator"
+)
+
+// loadtestCommand benchmarks an Ambassador's enrollment throughput
+var loadtestCommand = cli.Command{
+	Name:  "loadtest",
+	Usage: "Benchmark enrollment: many mTLS clients doing auth and proxied requests.",
+	Description: "Every client gets a fresh key and client cert from a test CA (--ca-cert, --ca-key),\n" +
+		"   then repeatedly sends an auth request and a deployments poll, each on a new\n" +
+		"   connection. Reports handshake/auth/proxy latency percentiles and errors.",
+	Action: cmdLoadtest,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "server",
+			Usage: "Ambassador `URL`, e.g. https://localhost:8080.",
+		},
+		&cli.IntFlag{
+			Name:  "clients",
+			Usage: "Number of concurrent clients.",
+			Value: 100,
+		},
+		&cli.DurationFlag{
+			Name:  "ramp",
+			Usage: "Time over which clients are started.",
+			Value: 10 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "Time all clients keep running after the ramp.",
+			Value: time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "think-time",
+			Usage: "Each client's pause between rounds.",
+		},
+		&cli.StringSliceFlag{
+			Name:  "key-types",
+			Usage: "Client key `TYPE`s, assigned round robin: rsa, ecdsa (repeatable).",
+		},
+		&cli.IntFlag{
+			Name:  "rsa-bits",
+			Usage: "RSA client key size.",
+			Value: simulator.DefaultRSABits,
+		},
+		&cli.BoolTFlag{
+			Name:  "resumption",
+			Usage: "Resume TLS sessions; --resumption=false makes every handshake a full one.",
+		},
+		&cli.StringFlag{
+			Name:  "ca-cert",
+			Usage: "Test CA cert `FILE` (PEM) issuing the client certs.",
+		},
+		&cli.StringFlag{
+			Name:  "ca-key",
+			Usage: "Test CA key `FILE` (PEM).",
+		},
+		&cli.StringFlag{
+			Name:  "tenant-token",
+			Usage: "Tenant `TOKEN` sent in auth requests.",
+		},
+		&cli.StringFlag{
+			Name:  "device-type",
+			Usage: "Device `TYPE` reported to Mender.",
+			Value: "loadtest",
+		},
+		&cli.StringFlag{
+			Name:  "server-ca",
+			Usage: "CA cert `FILE` (PEM) verifying the Ambassador; system roots if not set.",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "Skip verifying the Ambassador's cert.",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the report as JSON.",
+		},
+	},
+}
+
+func cmdLoadtest(args *cli.Context) error {
+	if args.String("server") == "" {
+		return cli.NewExitError("need --server", 1)
+	}
+	if args.String("ca-cert") == "" || args.String("ca-key") == "" {
+		return cli.NewExitError("need --ca-cert and --ca-key", 1)
+	}
+
+	issuer, err := ca.Load(args.String("ca-cert"), args.String("ca-key"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("failed to load test CA: %s", err), 1)
+	}
+	issuer.Profile = &ca.Profile{Validity: 24 * time.Hour}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: args.Bool("insecure"),
+	}
+	if path := args.String("server-ca"); path != "" {
+		roots, err := certPool(path)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	keyTypes := args.StringSlice("key-types")
+	for _, kt := range keyTypes {
+		if kt != simulator.KeyTypeRSA && kt != simulator.KeyTypeECDSA {
+			return cli.NewExitError(fmt.Sprintf("unsupported key type %q", kt), 1)
+		}
+	}
+
+	ctx, cancel := simulationContext(0)
+	defer cancel()
+
+	rep, err := simulator.RunLoadTest(ctx, simulator.LoadTestConfig{
+		Device: simulator.DeviceConfig{
+			ServerURL:         args.String("server"),
+			TenantToken:       args.String("tenant-token"),
+			DeviceType:        args.String("device-type"),
+			TLS:               tlsConfig,
+			SessionResumption: args.BoolT("resumption"),
+		},
+		Issuer:    issuer,
+		Clients:   args.Int("clients"),
+		Ramp:      args.Duration("ramp"),
+		Duration:  args.Duration("duration"),
+		ThinkTime: args.Duration("think-time"),
+		KeyTypes:  keyTypes,
+		RSABits:   args.Int("rsa-bits"),
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if args.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	}
+	return rep.Print(os.Stdout)
+}
@@ -5,19 +5,30 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/go-lib-micro/config"
 	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
 	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
 
 	api "github.com/mendersoftware/mtls-ambassador/api/http"
 	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/ca"
 	"github.com/mendersoftware/mtls-ambassador/client/mender"
 	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/hsm"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
 )
 
 var (
@@ -44,20 +55,22 @@ func doMain(args []string) {
 			},
 		},
 		Action: cmdServer,
+		Commands: []cli.Command{
+			caCommand,
+			simulateCommand,
+			loadtestCommand,
+		},
 	}
 
 	app.Before = func(args *cli.Context) error {
 		l.Infof("loading config %s", configPath)
-		err := config.FromConfigFile(configPath, aconfig.Defaults)
+		c, err := readConfig(configPath)
 		if err != nil {
 			return cli.NewExitError(
 				fmt.Sprintf("error loading configuration: %s", err),
 				1)
 		}
-
-		config.Config.SetEnvPrefix("MTLS")
-		config.Config.AutomaticEnv()
-		config.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+		config.Config = c
 
 		l.Info("loading config: ok")
 		dumpConfig()
@@ -78,62 +91,273 @@ func cmdServer(args *cli.Context) error {
 		l.Fatal(err)
 	}
 
-	backend := config.Config.GetString(
-		aconfig.SettingMenderBackend,
+	tp, err := NewTracerProvider(config.Config)
+	if err != nil {
+		l.Fatal(err)
+	}
+	if tp != nil {
+		installTracing(tp)
+		defer func() {
+			_ = tp.Shutdown(context.Background())
+		}()
+	}
+
+	iss, err := newIssuer(config.Config)
+	if err != nil {
+		l.Fatal(err)
+	}
+	localCA, _ := iss.(*ca.CA)
+
+	vhosts, err := newVirtualHosts(config.Config, iss)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	port := config.Config.GetString(
+		aconfig.SettingListen,
 	)
 
-	insecure := config.Config.GetBool(
+	policy, err := NewTLSPolicy(config.Config)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	s, err := NewServer(vhosts,
+		port,
+		policy)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	limits, err := NewLimits(config.Config)
+	if err != nil {
+		l.Fatal(err)
+	}
+	s.SetLimits(limits)
+
+	rateLimits, err := NewRateLimits(config.Config)
+	if err != nil {
+		l.Fatal(err)
+	}
+	s.SetRateLimits(rateLimits)
+	if tp != nil {
+		s.SetTracerProvider(tp)
+	}
+
+	tracker := newCertTracker(config.Config)
+	s.TrackClientCerts(tracker)
+
+	if localCA != nil {
+		s.CheckRevocation(localCA)
+	}
+
+	if addr := config.Config.GetString(aconfig.SettingAdminListen); addr != "" {
+		admin, err := api.NewAdminRouter(tracker, api.AdminConfig{
+			Token:             config.Config.GetString(aconfig.SettingAdminToken),
+			CertExpiryWarning: config.Config.GetDuration(aconfig.SettingCertExpiryWarning),
+			Issuer:            iss,
+			CAStore:           caStore(localCA),
+		})
+		if err != nil {
+			l.Fatal(errors.Wrap(err, aconfig.SettingAdminToken))
+		}
+		go func() {
+			l.Infof("serving admin API on %s", addr)
+			l.Fatal(http.ListenAndServe(addr, admin))
+		}()
+	}
+
+	if config.Config.GetString(aconfig.SettingESTListen) != "" {
+		var rc RevocationChecker
+		if localCA != nil {
+			rc = localCA
+		}
+		estServer, err := newESTServer(config.Config, iss, policy, rc, limits)
+		if err != nil {
+			l.Fatal(err)
+		}
+		go func() {
+			l.Infof("serving EST on %s", estServer.Addr)
+			l.Fatal(estServer.ListenAndServeTLS("", ""))
+		}()
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, unix.SIGHUP)
+	go reloadOnSignal(sighup, args.String("config"), s, iss)
+
+	return s.Run()
+}
+
+// newCertTracker creates the client cert tracker and exports the number
+// of soon-to-expire certs it knows of
+func newCertTracker(c config.Reader) *app.CertTracker {
+	tracker := app.NewCertTracker(c.GetInt(aconfig.SettingCertTrackerMax))
+	warning := c.GetDuration(aconfig.SettingCertExpiryWarning)
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mtls_client_certs_expiring",
+		Help: "Tracked client certs expiring within cert_expiry_warning.",
+	}, func() float64 {
+		return float64(len(tracker.Expiring(warning, time.Now())))
+	})
+
+	return tracker
+}
+
+// readConfig reads the config file into a fresh config instance,
+// so that a broken file never clobbers the active configuration
+func readConfig(configPath string) (*viper.Viper, error) {
+	c := viper.New()
+	config.SetDefaults(c, aconfig.Defaults)
+
+	if configPath != "" {
+		c.SetConfigFile(configPath)
+		if err := c.ReadInConfig(); err != nil {
+			return nil, errors.Wrap(err, "failed to read configuration")
+		}
+	}
+
+	c.SetEnvPrefix("MTLS")
+	c.AutomaticEnv()
+	c.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+
+	return c, nil
+}
+
+// newHandler wires the Mender client, auth provider, app and proxy
+// into the device API router, based on the given config;
+// iss is optional and enables cert renewal
+func newHandler(c *hostConfig, iss issuer.Issuer) (http.Handler, error) {
+	// with several backends, the first is the base url - the
+	// pool sends each request to the one it picks
+	backends := menderBackends(c)
+	if len(backends) == 0 {
+		return nil, errors.Errorf("need setting %s", aconfig.SettingMenderBackend)
+	}
+	backend := backends[0]
+
+	insecure := c.GetBool(
 		aconfig.SettingInsecureSkipVerify,
 	)
 
+	pool, err := NewUpstreamPool(c)
+	if err != nil {
+		return nil, err
+	}
+
 	proxy, err := api.NewProxy(backend, insecure)
 	if err != nil {
-		l.Fatal(err)
+		return nil, err
+	}
+	tunnels, err := newTunnelConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	proxy.SetTunnels(tunnels)
+
+	cache, err := NewArtifactCache(c)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		proxy.SetArtifactCache(cache)
+	}
+	downloads, err := NewArtifactDownloads(c, cache)
+	if err != nil {
+		return nil, err
+	}
+	if downloads != nil {
+		proxy.SetArtifactDownloads(downloads)
 	}
 
 	client := mender.NewClient(backend, insecure)
 
-	user := config.Config.GetString(
+	if pool != nil {
+		proxy.SetUpstreams(pool)
+		client.SetUpstreams(pool)
+	}
+
+	user := c.GetString(
 		aconfig.SettingMenderUser,
 	)
-	pass := config.Config.GetString(
+	pass := c.GetString(
 		aconfig.SettingMenderPass,
 	)
 
 	authProvider, err := app.NewAuthProvider(client, user, pass)
 	if err != nil {
-		l.Fatal(err)
+		return nil, err
 	}
 
-	app := app.NewApp(client, authProvider)
-	r, err := api.NewRouter(app, proxy)
+	certPolicy, err := NewCertPolicy(c)
 	if err != nil {
-		l.Fatal(err)
+		return nil, err
 	}
 
-	srvCertFile := config.Config.GetString(
-		aconfig.SettingServerCert,
-	)
-	srvKeyFile := config.Config.GetString(
-		aconfig.SettingServerKey,
-	)
-	tenantCACertFile := config.Config.GetString(
-		aconfig.SettingTenantCAPem,
-	)
-	port := config.Config.GetString(
-		aconfig.SettingListen,
-	)
+	replay, err := NewReplayGuard(c, c.hostname)
+	if err != nil {
+		return nil, err
+	}
 
-	s, err := NewServer(r,
-		srvCertFile,
-		srvKeyFile,
-		tenantCACertFile,
-		port)
+	certHeaders, err := NewCertHeaders(c)
 	if err != nil {
-		l.Fatal(err)
+		return nil, err
 	}
 
-	return s.Run()
+	app := app.NewApp(client, authProvider, certPolicy, iss, replay)
+	return api.NewRouter(app, proxy, &api.RouterConfig{
+		CertExpiryHeader:  c.GetBool(aconfig.SettingCertExpiryHeader),
+		CertExpiryWarning: c.GetDuration(aconfig.SettingCertExpiryWarning),
+		CertHeaders:       certHeaders,
+		ArtifactDownloads: downloads,
+	})
+}
+
+// newTunnelConfig parses the limits of proxied WebSocket connections
+func newTunnelConfig(c config.Reader) (api.TunnelConfig, error) {
+	cfg := api.TunnelConfig{
+		IdleTimeout:  c.GetDuration(aconfig.SettingWebSocketIdleTimeout),
+		PingInterval: c.GetDuration(aconfig.SettingWebSocketPingInterval),
+	}
+	if cfg.IdleTimeout < 0 {
+		return cfg, errors.Errorf("%s must not be negative", aconfig.SettingWebSocketIdleTimeout)
+	}
+	if cfg.PingInterval < 0 {
+		return cfg, errors.Errorf("%s must not be negative", aconfig.SettingWebSocketPingInterval)
+	}
+	// a live device must get to answer a ping before it counts as idle
+	if cfg.IdleTimeout > 0 && cfg.PingInterval >= cfg.IdleTimeout {
+		return cfg, errors.Errorf("%s must be shorter than %s",
+			aconfig.SettingWebSocketPingInterval, aconfig.SettingWebSocketIdleTimeout)
+	}
+	return cfg, nil
+}
+
+// newVirtualHosts builds the handler chain for every virtual host
+func newVirtualHosts(c config.Reader, iss issuer.Issuer) ([]VirtualHost, error) {
+	hosts, err := hostConfigs(c)
+	if err != nil {
+		return nil, err
+	}
+
+	vhosts := make([]VirtualHost, 0, len(hosts))
+	for _, hc := range hosts {
+		h, err := newHandler(hc, iss)
+		if err != nil {
+			return nil, err
+		}
+
+		vhosts = append(vhosts, VirtualHost{
+			Hostname:    hc.hostname,
+			Handler:     h,
+			ServerCert:  hc.GetString(aconfig.SettingServerCert),
+			ServerKey:   hc.GetString(aconfig.SettingServerKey),
+			TenantCAPem: hc.GetString(aconfig.SettingTenantCAPem),
+		})
+	}
+
+	return vhosts, nil
 }
 
 func validateConfig(c config.Reader) error {
@@ -144,9 +368,16 @@ func validateConfig(c config.Reader) error {
 		aconfig.SettingMenderPass,
 	}
 
-	for _, c := range required {
-		if config.Config.GetString(c) == "" {
-			return errors.New(fmt.Sprintf("validating config failed: need setting %s\n", c))
+	hosts, err := hostConfigs(c)
+	if err != nil {
+		return errors.Wrap(err, "validating config failed")
+	}
+
+	for _, hc := range hosts {
+		for _, setting := range required {
+			if hc.GetString(setting) == "" {
+				return errors.New(fmt.Sprintf("validating config failed: need setting %s\n", setting))
+			}
 		}
 	}
 
@@ -185,9 +416,9 @@ func dumpConfig() {
 
 	l.Infof(" %s: %s",
 		aconfig.SettingServerKey,
-		config.Config.GetString(
+		hsm.Redact(config.Config.GetString(
 			aconfig.SettingServerKey,
-		))
+		)))
 
 	l.Infof(" %s: %s",
 		aconfig.SettingServerKey,
@@ -212,4 +443,14 @@ func dumpConfig() {
 		config.Config.GetBool(
 			aconfig.SettingInsecureSkipVerify,
 		))
+
+	hosts, _ := hostConfigs(config.Config)
+	for _, hc := range hosts {
+		if hc.hostname != "" {
+			l.Infof(" %s: %s -> %s",
+				aconfig.SettingVirtualHosts,
+				hc.hostname,
+				hc.GetString(aconfig.SettingMenderBackend))
+		}
+	}
 }
@@ -48,7 +48,7 @@ func TestRunMain(t *testing.T) {
 
 	go doMain(cliArgs)
 
-	stopChan := make(chan os.Signal)
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, unix.SIGINT, unix.SIGTERM)
 
 	<-stopChan
@@ -0,0 +1,278 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	"github.com/mendersoftware/mtls-ambassador/app"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+const (
+	RateLimitRouteAuth   = "auth"
+	RateLimitRouteDevice = "device"
+
+	RateLimitKeyCert   = "cert"
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyGlobal = "global"
+)
+
+var (
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_rate_limited_total",
+		Help: "Device requests rejected with a 429, by route and limit key.",
+	}, []string{"route", "key"})
+	rateLimitKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtls_rate_limit_keys",
+		Help: "Certs and IPs currently tracked by the rate limiters.",
+	}, []string{"route", "key"})
+	rateLimitGlobalTokens = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtls_rate_limit_global_tokens",
+		Help: "Tokens left in the global rate limit buckets, as of the last request.",
+	}, []string{"route"})
+)
+
+// RateLimits are the token bucket limits of device requests, per client cert,
+// per source IP and global - separately for auth requests and the other routes
+type RateLimits struct {
+	routes map[string][]*rateLimiter
+}
+
+// NewRateLimits parses the rate limit settings; limits are given
+// as "<requests>/<period>", e.g. "10/m" - a bucket of 10 requests
+// refilled over a minute. Empty means no limit.
+func NewRateLimits(c config.Reader) (*RateLimits, error) {
+	maxKeys := c.GetInt(aconfig.SettingRateLimitMaxKeys)
+	if maxKeys <= 0 {
+		return nil, errors.Errorf("%s must be positive", aconfig.SettingRateLimitMaxKeys)
+	}
+
+	rl := &RateLimits{routes: map[string][]*rateLimiter{}}
+
+	for _, s := range []struct {
+		setting string
+		route   string
+		key     string
+	}{
+		{aconfig.SettingRateLimitAuthPerCert, RateLimitRouteAuth, RateLimitKeyCert},
+		{aconfig.SettingRateLimitAuthPerIP, RateLimitRouteAuth, RateLimitKeyIP},
+		{aconfig.SettingRateLimitAuthGlobal, RateLimitRouteAuth, RateLimitKeyGlobal},
+		{aconfig.SettingRateLimitPerCert, RateLimitRouteDevice, RateLimitKeyCert},
+		{aconfig.SettingRateLimitPerIP, RateLimitRouteDevice, RateLimitKeyIP},
+		{aconfig.SettingRateLimitGlobal, RateLimitRouteDevice, RateLimitKeyGlobal},
+	} {
+		spec := c.GetString(s.setting)
+		if spec == "" {
+			continue
+		}
+		burst, period, err := parseRate(spec)
+		if err != nil {
+			return nil, errors.Wrap(err, s.setting)
+		}
+		rl.routes[s.route] = append(rl.routes[s.route],
+			newRateLimiter(s.route, s.key, burst, period, maxKeys))
+	}
+
+	return rl, nil
+}
+
+// parseRate parses "<requests>/<period>", where the period
+// is s, m, h or a duration like 30s
+func parseRate(spec string) (int, time.Duration, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid rate %q, expected <requests>/<period>", spec)
+	}
+
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return 0, 0, errors.Errorf("invalid number of requests in rate %q", spec)
+	}
+
+	var period time.Duration
+	switch parts[1] {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		period, err = time.ParseDuration(parts[1])
+		if err != nil || period <= 0 {
+			return 0, 0, errors.Errorf("invalid period in rate %q", spec)
+		}
+	}
+
+	return n, period, nil
+}
+
+// allow takes a token from each bucket of the request, and if one
+// is empty responds with a 429 and Retry-After. Requests stop at
+// the first empty bucket, and the tokens already taken are put back,
+// so e.g. a device looping on its own cert's limit doesn't drain
+// the global bucket, nor an IP's bucket those of its certs.
+func (rl *RateLimits) allow(w http.ResponseWriter, r *http.Request) bool {
+	route := RateLimitRouteDevice
+	if r.URL.Path == api.UrlDevauthAuthReq {
+		route = RateLimitRouteAuth
+	}
+
+	type taken struct {
+		lim *rateLimiter
+		key string
+	}
+	var took []taken
+
+	now := time.Now()
+	for _, lim := range rl.routes[route] {
+		key, ok := rateLimitKey(lim.key, r)
+		if !ok {
+			continue
+		}
+
+		if wait := lim.take(key, now); wait > 0 {
+			for _, t := range took {
+				t.lim.refund(t.key)
+			}
+			rateLimited.WithLabelValues(route, lim.key).Inc()
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return false
+		}
+		took = append(took, taken{lim, key})
+	}
+
+	return true
+}
+
+// rateLimitKey is the request's bucket key of the limiter's kind;
+// requests without a client cert are not limited per cert
+func rateLimitKey(kind string, r *http.Request) (string, bool) {
+	switch kind {
+	case RateLimitKeyCert:
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			return "", false
+		}
+		return app.CertFingerprint(r.TLS.PeerCertificates[0]), true
+	case RateLimitKeyIP:
+		return remoteIP(r), true
+	}
+	return "", true
+}
+
+// rateLimiter is a set of token buckets of one kind of key
+type rateLimiter struct {
+	route string
+	key   string
+
+	burst float64
+	// rate is the refill, in tokens per second
+	rate    float64
+	maxKeys int
+
+	mu sync.Mutex
+	// buckets are the buckets by key, in lru - most recently used first
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(route, key string, burst int, period time.Duration, maxKeys int) *rateLimiter {
+	return &rateLimiter{
+		route:   route,
+		key:     key,
+		burst:   float64(burst),
+		rate:    float64(burst) / period.Seconds(),
+		maxKeys: maxKeys,
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// take takes a token from the key's bucket; if it's empty
+// nothing is taken and the wait for the next token is returned
+func (rl *rateLimiter) take(key string, now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var b *bucket
+	if el, ok := rl.buckets[key]; ok {
+		rl.lru.MoveToFront(el)
+		b = el.Value.(*bucket)
+	} else {
+		if len(rl.buckets) >= rl.maxKeys {
+			rl.evict()
+		}
+		b = &bucket{key: key, tokens: rl.burst, last: now}
+		rl.buckets[key] = rl.lru.PushFront(b)
+		rateLimitKeys.WithLabelValues(rl.route, rl.key).Set(float64(len(rl.buckets)))
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	var wait time.Duration
+	if b.tokens >= 1 {
+		b.tokens--
+	} else {
+		wait = time.Duration((1 - b.tokens) / rl.rate * float64(time.Second)).Round(time.Millisecond)
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		}
+	}
+
+	if rl.key == RateLimitKeyGlobal {
+		rateLimitGlobalTokens.WithLabelValues(rl.route).Set(b.tokens)
+	}
+	return wait
+}
+
+// refund puts back a token taken from the key's bucket
+func (rl *rateLimiter) refund(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	el, ok := rl.buckets[key]
+	if !ok {
+		return
+	}
+	b := el.Value.(*bucket)
+	b.tokens = math.Min(rl.burst, b.tokens+1)
+
+	if rl.key == RateLimitKeyGlobal {
+		rateLimitGlobalTokens.WithLabelValues(rl.route).Set(b.tokens)
+	}
+}
+
+// evict drops the least recently used bucket - the likeliest to have
+// refilled, i.e. to be the same as a new one
+func (rl *rateLimiter) evict() {
+	el := rl.lru.Back()
+	if el == nil {
+		return
+	}
+	rl.lru.Remove(el)
+	delete(rl.buckets, el.Value.(*bucket).key)
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	api "github.com/mendersoftware/mtls-ambassador/api/http"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func TestNewRateLimits(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		outAuth   []*rateLimiter
+		outDevice []*rateLimiter
+		outErr    string
+	}{
+		{
+			name: "ok, defaults",
+
+			outAuth: []*rateLimiter{
+				newRateLimiter(RateLimitRouteAuth, RateLimitKeyCert, 10, time.Minute, 100000),
+			},
+		},
+		{
+			name: "ok, all set",
+
+			settings: map[string]interface{}{
+				aconfig.SettingRateLimitAuthPerCert: "",
+				aconfig.SettingRateLimitAuthPerIP:   "100/h",
+				aconfig.SettingRateLimitAuthGlobal:  "50/s",
+				aconfig.SettingRateLimitPerCert:     "6/30s",
+				aconfig.SettingRateLimitPerIP:       "60/m",
+				aconfig.SettingRateLimitGlobal:      "1000/s",
+				aconfig.SettingRateLimitMaxKeys:     10,
+			},
+
+			outAuth: []*rateLimiter{
+				newRateLimiter(RateLimitRouteAuth, RateLimitKeyIP, 100, time.Hour, 10),
+				newRateLimiter(RateLimitRouteAuth, RateLimitKeyGlobal, 50, time.Second, 10),
+			},
+			outDevice: []*rateLimiter{
+				newRateLimiter(RateLimitRouteDevice, RateLimitKeyCert, 6, 30*time.Second, 10),
+				newRateLimiter(RateLimitRouteDevice, RateLimitKeyIP, 60, time.Minute, 10),
+				newRateLimiter(RateLimitRouteDevice, RateLimitKeyGlobal, 1000, time.Second, 10),
+			},
+		},
+		{
+			name: "error, no period",
+
+			settings: map[string]interface{}{
+				aconfig.SettingRateLimitPerIP: "10",
+			},
+
+			outErr: `rate_limit_per_ip: invalid rate "10", expected <requests>/<period>`,
+		},
+		{
+			name: "error, requests",
+
+			settings: map[string]interface{}{
+				aconfig.SettingRateLimitAuthGlobal: "0/s",
+			},
+
+			outErr: `rate_limit_auth_global: invalid number of requests in rate "0/s"`,
+		},
+		{
+			name: "error, period",
+
+			settings: map[string]interface{}{
+				aconfig.SettingRateLimitAuthPerCert: "10/day",
+			},
+
+			outErr: `rate_limit_auth_per_cert: invalid period in rate "10/day"`,
+		},
+		{
+			name: "error, max keys",
+
+			settings: map[string]interface{}{
+				aconfig.SettingRateLimitMaxKeys: 0,
+			},
+
+			outErr: "rate_limit_max_keys must be positive",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			rl, err := NewRateLimits(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.outAuth, rl.routes[RateLimitRouteAuth])
+				assert.Equal(t, tc.outDevice, rl.routes[RateLimitRouteDevice])
+			}
+		})
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(RateLimitRouteAuth, RateLimitKeyCert, 2, 10*time.Second, 100)
+	now := time.Now()
+
+	// a full bucket, then empty
+	assert.Zero(t, rl.take("a", now))
+	assert.Zero(t, rl.take("a", now))
+	assert.Equal(t, 5*time.Second, rl.take("a", now))
+	assert.Equal(t, 3*time.Second, rl.take("a", now.Add(2*time.Second)))
+
+	// other keys have their own buckets
+	assert.Zero(t, rl.take("b", now))
+
+	// refilled by one token
+	assert.Zero(t, rl.take("a", now.Add(5*time.Second)))
+	assert.Equal(t, 5*time.Second, rl.take("a", now.Add(5*time.Second)))
+
+	// never more than the burst
+	later := now.Add(time.Hour)
+	assert.Zero(t, rl.take("a", later))
+	assert.Zero(t, rl.take("a", later))
+	assert.Equal(t, 5*time.Second, rl.take("a", later))
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(RateLimitRouteDevice, RateLimitKeyCert, 2, 10*time.Second, 100)
+	now := time.Now()
+
+	assert.Zero(t, rl.take("a", now))
+	assert.Zero(t, rl.take("a", now))
+	rl.refund("a")
+	assert.Zero(t, rl.take("a", now))
+	assert.Equal(t, 5*time.Second, rl.take("a", now))
+
+	// not beyond the burst, nor for unknown keys
+	rl.refund("a")
+	rl.refund("a")
+	rl.refund("a")
+	rl.refund("b")
+	assert.Zero(t, rl.take("a", now))
+	assert.Zero(t, rl.take("a", now))
+	assert.NotZero(t, rl.take("a", now))
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	t.Parallel()
+
+	rl := newRateLimiter(RateLimitRouteDevice, RateLimitKeyIP, 1, time.Minute, 2)
+	now := time.Now()
+
+	assert.Zero(t, rl.take("a", now))
+	assert.Zero(t, rl.take("b", now.Add(30*time.Second)))
+
+	// a is the least recently used - a goes
+	assert.Zero(t, rl.take("c", now.Add(time.Minute)))
+	assert.Len(t, rl.buckets, 2)
+	assert.Contains(t, rl.buckets, "b")
+	assert.Contains(t, rl.buckets, "c")
+	assert.Equal(t, float64(2), testutil.ToFloat64(rateLimitKeys.WithLabelValues(RateLimitRouteDevice, RateLimitKeyIP)))
+
+	// b was used since - c goes
+	assert.NotZero(t, rl.take("b", now.Add(time.Minute)))
+	assert.Zero(t, rl.take("d", now.Add(time.Minute)))
+	assert.Len(t, rl.buckets, 2)
+	assert.Contains(t, rl.buckets, "b")
+	assert.Contains(t, rl.buckets, "d")
+	assert.Equal(t, 2, rl.lru.Len())
+}
+
+func TestRateLimitsAllow(t *testing.T) {
+	t.Parallel()
+
+	rl := &RateLimits{routes: map[string][]*rateLimiter{
+		RateLimitRouteAuth: {
+			newRateLimiter(RateLimitRouteAuth, RateLimitKeyCert, 1, time.Hour, 100),
+			newRateLimiter(RateLimitRouteAuth, RateLimitKeyIP, 2, time.Hour, 100),
+		},
+		RateLimitRouteDevice: {
+			newRateLimiter(RateLimitRouteDevice, RateLimitKeyGlobal, 1, time.Minute, 100),
+		},
+	}}
+
+	newReq := func(path, ip string, raw string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		r.RemoteAddr = ip + ":1234"
+		if raw != "" {
+			r.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Raw: []byte(raw)}},
+			}
+		}
+		return r
+	}
+
+	cases := []struct {
+		name string
+		req  *http.Request
+
+		outStatus     int
+		outRetryAfter string
+	}{
+		{
+			name: "ok, auth",
+			req:  newReq(api.UrlDevauthAuthReq, "10.0.0.1", "cert-1"),
+
+			outStatus: http.StatusOK,
+		},
+		{
+			name: "error, auth, same cert",
+			req:  newReq(api.UrlDevauthAuthReq, "10.0.0.2", "cert-1"),
+
+			outStatus:     http.StatusTooManyRequests,
+			outRetryAfter: "3600",
+		},
+		{
+			name: "ok, auth, other cert",
+			req:  newReq(api.UrlDevauthAuthReq, "10.0.0.1", "cert-2"),
+
+			outStatus: http.StatusOK,
+		},
+		{
+			name: "error, auth, same IP",
+			req:  newReq(api.UrlDevauthAuthReq, "10.0.0.1", "cert-3"),
+
+			outStatus:     http.StatusTooManyRequests,
+			outRetryAfter: "1800",
+		},
+		{
+			name: "ok, auth, cert of the request limited by IP",
+			req:  newReq(api.UrlDevauthAuthReq, "10.0.0.5", "cert-3"),
+
+			outStatus: http.StatusOK,
+		},
+		{
+			name: "ok, auth, no cert",
+			req:  newReq(api.UrlDevauthAuthReq, "10.0.0.3", ""),
+
+			outStatus: http.StatusOK,
+		},
+		{
+			name: "ok, device",
+			req:  newReq("/api/devices/v1/inventory/device/attributes", "10.0.0.1", "cert-1"),
+
+			outStatus: http.StatusOK,
+		},
+		{
+			name: "error, device, global",
+			req:  newReq("/api/devices/v1/deployments/device/deployments/next", "10.0.0.4", "cert-4"),
+
+			outStatus:     http.StatusTooManyRequests,
+			outRetryAfter: "60",
+		},
+	}
+
+	// in order, the cases share the buckets
+	for _, tc := range cases {
+		before := testutil.ToFloat64(rateLimited.WithLabelValues(RateLimitRouteDevice, RateLimitKeyGlobal)) +
+			testutil.ToFloat64(rateLimited.WithLabelValues(RateLimitRouteAuth, RateLimitKeyCert)) +
+			testutil.ToFloat64(rateLimited.WithLabelValues(RateLimitRouteAuth, RateLimitKeyIP))
+
+		w := httptest.NewRecorder()
+		if rl.allow(w, tc.req) {
+			w.WriteHeader(http.StatusOK)
+		}
+
+		after := testutil.ToFloat64(rateLimited.WithLabelValues(RateLimitRouteDevice, RateLimitKeyGlobal)) +
+			testutil.ToFloat64(rateLimited.WithLabelValues(RateLimitRouteAuth, RateLimitKeyCert)) +
+			testutil.ToFloat64(rateLimited.WithLabelValues(RateLimitRouteAuth, RateLimitKeyIP))
+
+		assert.Equal(t, tc.outStatus, w.Code, tc.name)
+		assert.Equal(t, tc.outRetryAfter, w.Header().Get("Retry-After"), tc.name)
+		if tc.outStatus == http.StatusTooManyRequests {
+			assert.Equal(t, before+1, after, tc.name)
+		} else {
+			assert.Equal(t, before, after, tc.name)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/sirupsen/logrus"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/issuer"
+)
+
+// restartSettings are the settings which a reload does not apply
+var restartSettings = []string{
+	aconfig.SettingListen,
+	aconfig.SettingAdminListen,
+	aconfig.SettingAdminToken,
+	aconfig.SettingCertTrackerMax,
+	aconfig.SettingBodyLimit,
+	aconfig.SettingBodyLimitAuthRequests,
+	aconfig.SettingBodyLimitPaths,
+	aconfig.SettingReadHeaderTimeout,
+	aconfig.SettingReadTimeout,
+	aconfig.SettingIdleTimeout,
+	aconfig.SettingMaxHeaderBytes,
+	aconfig.SettingMaxConnsPerIP,
+	aconfig.SettingRateLimitAuthPerCert,
+	aconfig.SettingRateLimitAuthPerIP,
+	aconfig.SettingRateLimitAuthGlobal,
+	aconfig.SettingRateLimitPerCert,
+	aconfig.SettingRateLimitPerIP,
+	aconfig.SettingRateLimitGlobal,
+	aconfig.SettingRateLimitMaxKeys,
+	aconfig.SettingAuthReplayMaxNonces,
+	aconfig.SettingESTListen,
+	aconfig.SettingESTBootstrapCAPem,
+	aconfig.SettingCACert,
+	aconfig.SettingCAKey,
+	aconfig.SettingCAStore,
+	aconfig.SettingCACertValidity,
+	aconfig.SettingCAKeyUsage,
+	aconfig.SettingCAExtKeyUsage,
+	aconfig.SettingCASANDNS,
+	aconfig.SettingCASANURI,
+	aconfig.SettingCASANEmail,
+	aconfig.SettingIssuer,
+	aconfig.SettingIssuerURL,
+	aconfig.SettingIssuerToken,
+	aconfig.SettingIssuerCAPem,
+	aconfig.SettingIssuerVaultMount,
+	aconfig.SettingIssuerVaultRole,
+	aconfig.SettingTracingExporter,
+	aconfig.SettingTracingOTLPEndpoint,
+	aconfig.SettingTracingOTLPHeaders,
+	aconfig.SettingTracingServiceName,
+	aconfig.SettingTracingSampleRatio,
+	aconfig.SettingArtifactCacheDir,
+	aconfig.SettingArtifactCacheMaxSize,
+	aconfig.SettingArtifactCacheMaxArtifactSize,
+}
+
+// reloadOnSignal reloads the config every time a signal (SIGHUP) arrives;
+// a failed reload is logged and the old config stays in effect
+func reloadOnSignal(sigs <-chan os.Signal, configPath string, s *Server, iss issuer.Issuer) {
+	for range sigs {
+		if err := reload(configPath, s, iss); err != nil {
+			l.Errorf("reloading config failed, keeping the old one: %s", err)
+		}
+	}
+}
+
+// reload re-reads and validates the config file, rebuilds the virtual hosts'
+// handler chains (proxy target, Mender client, auth provider) and swaps them
+// into the server together with the TLS material and policy, and the log level
+func reload(configPath string, s *Server, iss issuer.Issuer) error {
+	l.Infof("reloading config %s", configPath)
+
+	c, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := validateConfig(c); err != nil {
+		return err
+	}
+
+	for _, key := range restartSettings {
+		if fmt.Sprint(c.Get(key)) != fmt.Sprint(config.Config.Get(key)) {
+			l.Warnf("%s changed, it will take effect after a restart", key)
+		}
+	}
+
+	policy, err := NewTLSPolicy(c)
+	if err != nil {
+		return err
+	}
+
+	vhosts, err := newVirtualHosts(c, iss)
+	if err != nil {
+		return err
+	}
+
+	err = s.Reload(vhosts, policy)
+	if err != nil {
+		return err
+	}
+
+	config.Config = c
+	setLogLevel(c.GetBool(aconfig.SettingDebugLog))
+
+	l.Info("reloading config: ok")
+	dumpConfig()
+
+	return nil
+}
+
+// setLogLevel is like log.Setup, but can also lower the level back to info
+func setLogLevel(debug bool) {
+	if debug {
+		log.Log.SetLevel(logrus.DebugLevel)
+	} else {
+		log.Log.SetLevel(logrus.InfoLevel)
+	}
+}
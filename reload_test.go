@@ -0,0 +1,117 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/stretchr/testify/assert"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+const (
+	testSrvCert  = "certs/server/server.crt"
+	testSrvKey   = "certs/server/server.key"
+	testTenantCA = "certs/tenant-ca/tenant.ca.pem"
+)
+
+func testVirtualHosts(h http.Handler) []VirtualHost {
+	return []VirtualHost{
+		{
+			Handler:     h,
+			ServerCert:  testSrvCert,
+			ServerKey:   testSrvKey,
+			TenantCAPem: testTenantCA,
+		},
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	old := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	policy := defaultTLSPolicy(t)
+	s, err := NewServer(testVirtualHosts(old), "0", policy)
+	assert.NoError(t, err)
+
+	oldTLS, _ := s.getConfigForClient(&tls.ClientHelloInfo{})
+
+	// failed reload keeps both the handler and the TLS material
+	broken := testVirtualHosts(http.NotFoundHandler())
+	broken[0].TenantCAPem = "nonexistent.pem"
+	err = s.Reload(broken, policy)
+	assert.Error(t, err)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+
+	cur, _ := s.getConfigForClient(&tls.ClientHelloInfo{})
+	assert.True(t, oldTLS == cur)
+
+	// successful reload swaps both
+	err = s.Reload(testVirtualHosts(http.NotFoundHandler()), policy)
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	cur, _ = s.getConfigForClient(&tls.ClientHelloInfo{})
+	assert.False(t, oldTLS == cur)
+
+	cert, err := s.getCertificate(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	assert.NotNil(t, cert.PrivateKey)
+}
+
+func TestReload(t *testing.T) {
+	mender := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("token"))
+	}))
+	defer mender.Close()
+
+	dir, err := ioutil.TempDir("", "mtls-reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig := func(user string, debug bool) {
+		cfg := fmt.Sprintf("mender_backend: %s\nmender_user: %q\nmender_pass: pass\n"+
+			"server_cert: %s\nserver_key: %s\ntenant_ca_pem: %s\ndebug_log: %v\n",
+			mender.URL, user, testSrvCert, testSrvKey, testTenantCA, debug)
+		assert.NoError(t, ioutil.WriteFile(configPath, []byte(cfg), 0600))
+	}
+
+	writeConfig("foo@bar.com", false)
+	c, err := readConfig(configPath)
+	assert.NoError(t, err)
+	config.Config = c
+
+	s, err := NewServer(testVirtualHosts(http.NotFoundHandler()), "0", defaultTLSPolicy(t))
+	assert.NoError(t, err)
+
+	// invalid config - old one stays
+	writeConfig("", true)
+	assert.Error(t, reload(configPath, s, nil))
+	assert.Equal(t, "foo@bar.com", config.Config.GetString(aconfig.SettingMenderUser))
+	assert.False(t, config.Config.GetBool(aconfig.SettingDebugLog))
+
+	writeConfig("baz@bar.com", true)
+	assert.NoError(t, reload(configPath, s, nil))
+	assert.Equal(t, "baz@bar.com", config.Config.GetString(aconfig.SettingMenderUser))
+	assert.True(t, config.Config.GetBool(aconfig.SettingDebugLog))
+
+	setLogLevel(false)
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+var (
+	// nonceStores are the seen nonces of each virtual host, kept
+	// across reloads - a fresh store would let recent requests be replayed
+	nonceStores = map[string]*app.NonceStore{}
+	nonceMu     sync.Mutex
+)
+
+// NewReplayGuard parses and validates the replay protection settings
+// of the virtual host; nil means the protection is off
+func NewReplayGuard(c config.Reader, hostname string) (*app.ReplayGuard, error) {
+	mode := c.GetString(aconfig.SettingAuthReplayProtection)
+	switch mode {
+	case app.ReplayOff:
+		return nil, nil
+	case app.ReplayOptional, app.ReplayRequire:
+	default:
+		return nil, errors.Errorf("%s: unknown mode %q", aconfig.SettingAuthReplayProtection, mode)
+	}
+
+	// GetString, as vhosts override settings as strings
+	window, err := time.ParseDuration(c.GetString(aconfig.SettingAuthReplayWindow))
+	if err != nil || window <= 0 {
+		return nil, errors.Errorf("%s must be a positive duration", aconfig.SettingAuthReplayWindow)
+	}
+
+	max := c.GetInt(aconfig.SettingAuthReplayMaxNonces)
+	if max <= 0 {
+		return nil, errors.Errorf("%s must be positive", aconfig.SettingAuthReplayMaxNonces)
+	}
+
+	return &app.ReplayGuard{
+		Mode:   mode,
+		Window: window,
+		Nonces: nonceStore(hostname, max),
+	}, nil
+}
+
+func nonceStore(hostname string, max int) *app.NonceStore {
+	nonceMu.Lock()
+	defer nonceMu.Unlock()
+
+	hostname = strings.ToLower(hostname)
+	s, ok := nonceStores[hostname]
+	if !ok {
+		s = app.NewNonceStore(max)
+		nonceStores[hostname] = s
+	}
+	return s
+}
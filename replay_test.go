@@ -0,0 +1,147 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func TestNewReplayGuard(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		outMode   string
+		outWindow time.Duration
+		outErr    string
+	}{
+		{
+			name: "ok, defaults",
+
+			outMode:   app.ReplayOptional,
+			outWindow: 5 * time.Minute,
+		},
+		{
+			name: "ok, off",
+
+			settings: map[string]interface{}{
+				aconfig.SettingAuthReplayProtection: app.ReplayOff,
+			},
+		},
+		{
+			name: "ok, require",
+
+			settings: map[string]interface{}{
+				aconfig.SettingAuthReplayProtection: app.ReplayRequire,
+				aconfig.SettingAuthReplayWindow:     "30s",
+			},
+
+			outMode:   app.ReplayRequire,
+			outWindow: 30 * time.Second,
+		},
+		{
+			name: "ok, vhosts override",
+
+			settings: map[string]interface{}{
+				aconfig.SettingVirtualHosts: []interface{}{
+					map[string]interface{}{
+						"hostname":                          "eu.devices.example.com",
+						aconfig.SettingAuthReplayProtection: app.ReplayRequire,
+						aconfig.SettingAuthReplayWindow:     "1m",
+					},
+				},
+			},
+
+			outMode:   app.ReplayRequire,
+			outWindow: time.Minute,
+		},
+		{
+			name: "error, mode",
+
+			settings: map[string]interface{}{
+				aconfig.SettingAuthReplayProtection: "on",
+			},
+
+			outErr: `auth_replay_protection: unknown mode "on"`,
+		},
+		{
+			name: "error, window",
+
+			settings: map[string]interface{}{
+				aconfig.SettingAuthReplayWindow: "0s",
+			},
+
+			outErr: "auth_replay_window must be a positive duration",
+		},
+		{
+			name: "error, max nonces",
+
+			settings: map[string]interface{}{
+				aconfig.SettingAuthReplayMaxNonces: 0,
+			},
+
+			outErr: "auth_replay_max_nonces must be positive",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			hosts, err := hostConfigs(c)
+			assert.NoError(t, err)
+
+			g, err := NewReplayGuard(hosts[0], hosts[0].hostname)
+			switch {
+			case tc.outErr != "":
+				assert.EqualError(t, err, tc.outErr)
+			case tc.outMode == "":
+				assert.NoError(t, err)
+				assert.Nil(t, g)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.outMode, g.Mode)
+				assert.Equal(t, tc.outWindow, g.Window)
+				assert.NotNil(t, g.Nonces)
+			}
+		})
+	}
+}
+
+func TestNewReplayGuardKeepsNonces(t *testing.T) {
+	t.Parallel()
+
+	c := viper.New()
+	config.SetDefaults(c, aconfig.Defaults)
+
+	// as on reload
+	g1, err := NewReplayGuard(c, "Keep.Example.com")
+	assert.NoError(t, err)
+	g2, err := NewReplayGuard(c, "keep.example.com")
+	assert.NoError(t, err)
+	assert.True(t, g1.Nonces == g2.Nonces)
+
+	g3, err := NewReplayGuard(c, "other.example.com")
+	assert.NoError(t, err)
+	assert.True(t, g1.Nonces != g3.Nonces)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package requestid carries the request ID which ties together the logs
+// of a request, across the Ambassador and the Mender backend.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// RequestIDHeader is Mender's request ID header
+	RequestIDHeader = "X-MEN-RequestID"
+
+	// MaxLength bounds the request IDs accepted from clients
+	MaxLength = 128
+)
+
+type requestIDKey struct{}
+
+// New generates a request ID, a random (v4) UUID like Mender's
+func New() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Valid tells if a client's request ID can be used - it ends up in logs
+// and upstream requests, so only short IDs of safe characters are
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FromRequest returns the request's ID header if valid, a new ID otherwise
+func FromRequest(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); Valid(id) {
+		return id
+	}
+	return New()
+}
+
+// WithContext returns the context carrying the request ID
+func WithContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// FromContext returns the context's request ID, empty if none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// SetHeader sets the context's request ID, if any, on an upstream request
+func SetHeader(ctx context.Context, h http.Header) {
+	if id := FromContext(ctx); id != "" {
+		h.Set(RequestIDHeader, id)
+	}
+}
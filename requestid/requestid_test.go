@@ -0,0 +1,93 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package requestid
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a, b := New(), New()
+	assert.Regexp(t, uuid, a)
+	assert.Regexp(t, uuid, b)
+	assert.NotEqual(t, a, b)
+	assert.True(t, Valid(a))
+}
+
+func TestFromRequest(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		in   string
+
+		outKept bool
+	}{
+		{
+			name:    "ok, uuid",
+			in:      "0b2e1c2e-5a47-4e4b-9d3e-3b1b0a7c6f11",
+			outKept: true,
+		},
+		{
+			name:    "ok, other format",
+			in:      "device-42_retry.1:a",
+			outKept: true,
+		},
+		{
+			name: "replaced, missing",
+		},
+		{
+			name: "replaced, log injection",
+			in:   "abc\nlevel=error msg=forged",
+		},
+		{
+			name: "replaced, too long",
+			in:   strings.Repeat("a", MaxLength+1),
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tc.in != "" {
+				r.Header.Set(RequestIDHeader, tc.in)
+			}
+
+			id := FromRequest(r)
+			if tc.outKept {
+				assert.Equal(t, tc.in, id)
+			} else {
+				assert.NotEqual(t, tc.in, id)
+				assert.True(t, Valid(id))
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{}
+	SetHeader(context.Background(), h)
+	assert.Empty(t, h.Get(RequestIDHeader))
+	assert.Empty(t, FromContext(context.Background()))
+
+	ctx := WithContext(context.Background(), "id-1")
+	assert.Equal(t, "id-1", FromContext(ctx))
+	SetHeader(ctx, h)
+	assert.Equal(t, "id-1", h.Get(RequestIDHeader))
+}
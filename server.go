@@ -8,50 +8,473 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mendersoftware/go-lib-micro/log"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/hsm"
+	"github.com/mendersoftware/mtls-ambassador/requestid"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
+)
+
+var (
+	ErrUnknownServerName = errors.New("unknown server name")
+	ErrCertRevoked       = errors.New("client certificate revoked")
 )
 
+// RevocationChecker tells whether a client cert was revoked
+type RevocationChecker interface {
+	IsRevoked(cert *x509.Certificate) bool
+}
+
+// VirtualHost is a device facing hostname, with its own server cert,
+// accepted client CA and handler (i.e. upstream Mender backend).
+// An empty Hostname matches any name - it's used when no vhosts are configured.
+type VirtualHost struct {
+	Hostname    string
+	Handler     http.Handler
+	ServerCert  string
+	ServerKey   string
+	TenantCAPem string
+}
+
 type Server struct {
-	server   *http.Server
-	certFile string
-	keyFile  string
+	server *http.Server
+
+	// hosts holds the current hostSet, consulted on every handshake and request
+	hosts atomic.Value
+
+	tickets    ticketKeys
+	ticketStop chan struct{}
+
+	// tracker, if set, records the client cert of every new connection
+	tracker *app.CertTracker
+	// tracked are the connections whose cert was already recorded
+	tracked sync.Map
+
+	// revocation, if set, is consulted on every handshake and request
+	revocation RevocationChecker
+
+	// limits, if set, bound request sizes and connections per IP
+	limits *Limits
+	// rateLimits, if set, bound request rates per cert, IP and globally
+	rateLimits *RateLimits
+
+	// tracer, if set, starts a server span per request
+	tracer trace.Tracer
+	// handshakes are the ClientHello times of connections yet to serve
+	// their first request, by remote address; only kept while tracing
+	handshakes sync.Map
 }
 
-func NewServer(h http.Handler,
-	srvCertFile,
-	srvKeyFile,
-	tenantCACertFile string,
-	port string) (*Server, error) {
-	l.Infof("creating server with cert %s and key %s", srvCertFile, srvKeyFile)
+// hostSet is an immutable snapshot of the virtual hosts, swapped as a whole on reload
+type hostSet map[string]*host
 
-	pool, err := certPool(tenantCACertFile)
+type host struct {
+	tlsConfig *tls.Config
+	handler   http.Handler
+}
+
+func NewServer(vhosts []VirtualHost,
+	port string,
+	policy *TLSPolicy) (*Server, error) {
+	l.Info("creating server")
+
+	s := &Server{}
+
+	hosts, err := s.newHostSet(vhosts, policy)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create server")
 	}
+	s.hosts.Store(hosts)
+	s.restartTicketRotation(policy)
+	policy.Log()
 
-	// custom TLSConfig - enables client cert verification against a custom CA
-	server := http.Server{
-		Addr:    ":" + port,
-		Handler: h,
+	// custom TLSConfig - resolves the server cert and the client CA pool
+	// per handshake, by SNI, so that both can be swapped on reload
+	s.server = &http.Server{
+		Addr:      ":" + port,
+		Handler:   s,
+		ConnState: s.connState,
 		TLSConfig: &tls.Config{
-			ClientCAs:  pool,
-			ClientAuth: tls.RequireAndVerifyClientCert,
+			GetCertificate:     s.getCertificate,
+			GetConfigForClient: s.getConfigForClient,
 		},
 	}
 
 	l.Info("creating server: ok")
-	return &Server{
-		server:   &server,
-		certFile: srvCertFile,
-		keyFile:  srvKeyFile,
-	}, nil
+	return s, nil
+}
+
+// TrackClientCerts records the client certs of new connections in the tracker;
+// call it before Run
+func (s *Server) TrackClientCerts(tracker *app.CertTracker) {
+	s.tracker = tracker
+}
+
+// CheckRevocation rejects handshakes and requests with client certs the checker
+// reports as revoked; call it before Run
+func (s *Server) CheckRevocation(rc RevocationChecker) {
+	s.revocation = rc
+}
+
+// SetLimits applies the request size limits, timeouts
+// and connections per IP limit; call it before Run
+func (s *Server) SetLimits(lim *Limits) {
+	s.limits = lim
+	lim.apply(s.server)
+}
+
+// SetRateLimits applies the request rate limits; call it before Run
+func (s *Server) SetRateLimits(rl *RateLimits) {
+	s.rateLimits = rl
+}
+
+// SetTracerProvider traces requests, and their TLS handshakes,
+// with spans of the provider; call it before Run
+func (s *Server) SetTracerProvider(tp trace.TracerProvider) {
+	s.tracer = tp.Tracer(tracerName)
 }
 
 func (s *Server) Run() error {
-	l.Info("running...")
-	return s.server.ListenAndServeTLS(s.certFile, s.keyFile)
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve is like Run, but accepts connections on the given listener,
+// e.g. one on a random port
+func (s *Server) Serve(ln net.Listener) error {
+	l.Infof("running on %s...", ln.Addr())
+	if s.limits != nil && s.limits.MaxConnsPerIP > 0 {
+		ln = newLimitListener(ln, s.limits.MaxConnsPerIP)
+	}
+	return s.server.ServeTLS(ln, "", "")
+}
+
+// Close closes the listener and all connections
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Reload swaps the virtual hosts, with their handlers and TLS material.
+// Requests and connections already in flight keep the old ones;
+// on error nothing is swapped.
+func (s *Server) Reload(vhosts []VirtualHost,
+	policy *TLSPolicy) error {
+	l.Info("reloading server")
+
+	hosts, err := s.newHostSet(vhosts, policy)
+	if err != nil {
+		return errors.Wrap(err, "failed to reload server")
+	}
+	s.hosts.Store(hosts)
+	s.restartTicketRotation(policy)
+	policy.Log()
+
+	l.Info("reloading server: ok")
+	return nil
+}
+
+// ServeHTTP dispatches the request to the handler of the virtual host
+// selected by SNI - i.e. the one whose CA verified the client cert
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, r, span := s.startSpan(w, r)
+	defer span.End()
+
+	r = withRequestContext(w, r)
+	span.SetAttributes(attribute.String("request_id", requestid.FromContext(r.Context())))
+
+	name := r.Host
+	if r.TLS != nil {
+		name = r.TLS.ServerName
+	} else if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+
+	h, err := s.lookup(name)
+	if err != nil {
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		return
+	}
+
+	if s.revoked(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if s.rateLimits != nil && !s.rateLimits.allow(w, r) {
+		return
+	}
+	if s.limits != nil {
+		s.limits.limitBody(w, r, h.handler)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// connState feeds the tracker with the client cert of each connection,
+// once - when it turns active, i.e. after the handshake; it also drops
+// the handshake times of connections closed before any request
+func (s *Server) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateHijacked || state == http.StateClosed {
+		s.handshakes.Delete(conn.RemoteAddr().String())
+	}
+
+	if s.tracker == nil {
+		return
+	}
+
+	switch state {
+	case http.StateActive:
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			return
+		}
+		if _, seen := s.tracked.LoadOrStore(conn, struct{}{}); seen {
+			return
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			s.tracker.Observe(certs[0], conn.RemoteAddr().String(), time.Now())
+		}
+	case http.StateHijacked, http.StateClosed:
+		s.tracked.Delete(conn)
+	}
+}
+
+// withRequestContext takes the device's request ID, or generates one, and
+// returns the request with the ID, a logger carrying it and the device's
+// upstream balancing key in its context.
+// The ID is echoed to the device and forwarded to Mender.
+func withRequestContext(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestid.FromRequest(r)
+	r.Header.Set(requestid.RequestIDHeader, id)
+	w.Header().Set(requestid.RequestIDHeader, id)
+
+	fields := log.Ctx{
+		"request_id": id,
+		"peer_ip":    remoteIP(r),
+	}
+	// the device's requests are balanced by its cert, else its IP
+	key := remoteIP(r)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		key = app.CertFingerprint(r.TLS.PeerCertificates[0])
+		fields["cert_fingerprint"] = key
+	}
+
+	ctx := requestid.WithContext(r.Context(), id)
+	ctx = log.WithContext(ctx, l.F(fields))
+	ctx = upstream.WithKey(ctx, key)
+	return r.WithContext(ctx)
+}
+
+// remoteIP is the request's client IP, without the port
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func (s *Server) lookup(serverName string) (*host, error) {
+	hosts := s.hosts.Load().(hostSet)
+
+	if h, ok := hosts[strings.ToLower(serverName)]; ok {
+		return h, nil
+	}
+	if h, ok := hosts[""]; ok {
+		return h, nil
+	}
+
+	return nil, ErrUnknownServerName
+}
+
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h, err := s.lookup(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	return &h.tlsConfig.Certificates[0], nil
+}
+
+func (s *Server) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	h, err := s.lookup(hello.ServerName)
+	if err != nil {
+		l.Warnf("rejecting handshake from %s: %s %q",
+			hello.Conn.RemoteAddr(), err, hello.ServerName)
+		return nil, err
+	}
+	s.helloReceived(hello.Conn)
+	return h.tlsConfig, nil
+}
+
+// newHostSet loads the TLS material of every virtual host and wraps
+// their handlers according to the TLS policy
+func (s *Server) newHostSet(vhosts []VirtualHost, policy *TLSPolicy) (hostSet, error) {
+	hosts := hostSet{}
+
+	for _, vh := range vhosts {
+		name := strings.ToLower(vh.Hostname)
+		if _, ok := hosts[name]; ok {
+			return nil, errors.Errorf("duplicate virtual host %q", vh.Hostname)
+		}
+
+		l.Infof("adding virtual host %q with cert %s and key %s",
+			vh.Hostname, vh.ServerCert, hsm.Redact(vh.ServerKey))
+
+		tlsConfig, err := newTLSConfig(vh.ServerCert, vh.ServerKey, vh.TenantCAPem, policy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "virtual host %q", vh.Hostname)
+		}
+
+		s.verifyNotRevoked(tlsConfig)
+
+		hosts[name] = &host{
+			tlsConfig: tlsConfig,
+			handler:   policy.requireClientCert(vh.Handler),
+		}
+	}
+
+	if len(hosts) == 0 {
+		return nil, errors.New("no virtual hosts")
+	}
+
+	if err := s.setTicketKeys(hosts, policy); err != nil {
+		return nil, err
+	}
+
+	return hosts, nil
+}
+
+// verifyNotRevoked chains the revocation check after the config's own verification
+func (s *Server) verifyNotRevoked(cfg *tls.Config) {
+	verify := cfg.VerifyPeerCertificate
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+
+		if s.revocation == nil || len(rawCerts) == 0 {
+			return nil
+		}
+
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if s.revocation.IsRevoked(leaf) {
+			l.Warnf("rejecting revoked client certificate %s of %q", leaf.SerialNumber, leaf.Subject)
+			return ErrCertRevoked
+		}
+		return nil
+	}
+}
+
+// revoked checks the request's client cert again: resumed TLS sessions
+// skip VerifyPeerCertificate, so a cert revoked since the connection's
+// full handshake would keep working until its session ticket expires
+func (s *Server) revoked(r *http.Request) bool {
+	if s.revocation == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	if !s.revocation.IsRevoked(leaf) {
+		return false
+	}
+	log.FromContext(r.Context()).Warnf("rejecting request with revoked client certificate %s of %q",
+		leaf.SerialNumber, leaf.Subject)
+	return true
+}
+
+// setTicketKeys installs the session ticket keys into the hosts' configs
+// if the policy rotates them; the running rotation is left alone, so that
+// the current hosts' keys keep rotating if the new hosts aren't stored
+func (s *Server) setTicketKeys(hosts hostSet, policy *TLSPolicy) error {
+	if !policy.SessionTickets || policy.SessionTicketKeyRotation == 0 {
+		return nil
+	}
+
+	keys := s.tickets.get()
+	if len(keys) == 0 {
+		var err error
+		keys, err = s.tickets.rotate()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate session ticket key")
+		}
+	}
+	for _, h := range hosts {
+		h.tlsConfig.SetSessionTicketKeys(keys)
+	}
+
+	return nil
+}
+
+// restartTicketRotation stops the rotation of the session ticket keys and
+// starts it again if the policy asks for it; call it once the hosts whose
+// keys it rotates are stored
+func (s *Server) restartTicketRotation(policy *TLSPolicy) {
+	if s.ticketStop != nil {
+		close(s.ticketStop)
+		s.ticketStop = nil
+	}
+
+	if !policy.SessionTickets || policy.SessionTicketKeyRotation == 0 {
+		return
+	}
+
+	s.ticketStop = make(chan struct{})
+	go s.tickets.run(policy.SessionTicketKeyRotation, s.ticketStop, func(keys [][32]byte) {
+		for _, h := range s.hosts.Load().(hostSet) {
+			h.tlsConfig.SetSessionTicketKeys(keys)
+		}
+	})
+}
+
+// loadKeyPair loads the server cert and its key, from a PEM file
+// or, for a PKCS#11 URI, from an HSM
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	if hsm.IsURI(keyFile) {
+		return hsm.LoadX509KeyPair(certFile, keyFile)
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// newTLSConfig loads the server's key pair and the tenant's CA
+// into a config which enables client cert verification against a custom CA,
+// and applies the TLS policy on top
+func newTLSConfig(srvCertFile, srvKeyFile, tenantCACertFile string, policy *TLSPolicy) (*tls.Config, error) {
+	cert, err := loadKeyPair(srvCertFile, srvKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server cert")
+	}
+
+	pool, err := certPool(tenantCACertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	policy.apply(cfg)
+
+	return cfg, nil
 }
 
 // certPool prepares a custom cert pool with tenant's CA - to verify client certs against
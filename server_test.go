@@ -0,0 +1,316 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/app"
+	"github.com/mendersoftware/mtls-ambassador/requestid"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
+)
+
+func TestServerTrackClientCerts(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	s, err := NewServer(testVirtualHosts(h), "0", defaultTLSPolicy(t))
+	assert.NoError(t, err)
+
+	tracker := app.NewCertTracker(10)
+	s.TrackClientCerts(tracker)
+
+	// the tracker doesn't care about verification - accept any cert
+	srv := httptest.NewUnstartedServer(s)
+	srv.Config.ConnState = s.server.ConnState
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				Certificates: []tls.Certificate{{
+					Certificate: [][]byte{der},
+					PrivateKey:  key,
+				}},
+			},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(srv.URL + "/status")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+
+	certs := tracker.Expiring(48*time.Hour, time.Now())
+	assert.Len(t, certs, 1)
+	if len(certs) == 1 {
+		assert.Equal(t, "CN=device", certs[0].Subject)
+		assert.Equal(t, "42", certs[0].Serial)
+		assert.True(t, notAfter.Equal(certs[0].NotAfter))
+	}
+	assert.Empty(t, tracker.Expiring(time.Hour, time.Now()))
+}
+
+type revokedSerials struct {
+	mu      sync.Mutex
+	serials map[int64]bool
+}
+
+func (r *revokedSerials) IsRevoked(cert *x509.Certificate) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.serials[cert.SerialNumber.Int64()]
+}
+
+func (r *revokedSerials) revoke(serial int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serials[serial] = true
+}
+
+func TestServerCheckRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Tenant CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+
+	// clients drop sessions with expired server certs instead of resuming
+	// them, so don't use the checked in one
+	srvKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	srvDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(100),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &srvKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	srvKeyDER, err := x509.MarshalECPrivateKey(srvKey)
+	assert.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "server.crt"), "CERTIFICATE", srvDER)
+	writePEM(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", srvKeyDER)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	vhosts := testVirtualHosts(h)
+	vhosts[0].ServerCert = filepath.Join(dir, "server.crt")
+	vhosts[0].ServerKey = filepath.Join(dir, "server.key")
+	vhosts[0].TenantCAPem = caFile
+
+	s, err := NewServer(vhosts, "0", defaultTLSPolicy(t))
+	assert.NoError(t, err)
+	revoked := &revokedSerials{serials: map[int64]bool{2: true}}
+	s.CheckRevocation(revoked)
+
+	srv := httptest.NewUnstartedServer(s)
+	srv.TLS = s.server.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(serial int64) *http.Client {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "device"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		assert.NoError(t, err)
+
+		// a new connection per request, resuming the first one's session
+		return &http.Client{
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates: []tls.Certificate{{
+						Certificate: [][]byte{der},
+						PrivateKey:  key,
+					}},
+					ClientSessionCache: tls.NewLRUClientSessionCache(1),
+				},
+			},
+		}
+	}
+	get := func(client *http.Client) (*http.Response, error) {
+		res, err := client.Get(srv.URL + "/status")
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+
+	_, err = get(newClient(3))
+	assert.NoError(t, err)
+	_, err = get(newClient(2))
+	assert.Error(t, err)
+
+	// revoked after the full handshake: resumed sessions are refused too
+	client := newClient(4)
+	res, err := get(client)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	revoked.revoke(4)
+	res, err = get(client)
+	if assert.NoError(t, err) {
+		assert.True(t, res.TLS.DidResume)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	}
+}
+
+func TestServerRequestContext(t *testing.T) {
+	var (
+		ctxID  string
+		fields map[string]interface{}
+		hdrID  string
+		ctxKey string
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxID = requestid.FromContext(r.Context())
+		fields = log.FromContext(r.Context()).Data
+		hdrID = r.Header.Get(requestid.RequestIDHeader)
+		ctxKey = upstream.KeyFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+	s, err := NewServer(testVirtualHosts(h), "0", defaultTLSPolicy(t))
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+
+		inID   string
+		inCert bool
+
+		outKept bool
+	}{
+		{
+			name: "device's ID",
+
+			inID:   "0b2e1c2e-5a47-4e4b-9d3e-3b1b0a7c6f11",
+			inCert: true,
+
+			outKept: true,
+		},
+		{
+			name: "generated ID",
+		},
+		{
+			name: "invalid ID replaced",
+
+			inID: "forged\nID",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/status", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.TLS = &tls.ConnectionState{}
+			if tc.inCert {
+				r.TLS.PeerCertificates = []*x509.Certificate{cert}
+			}
+			if tc.inID != "" {
+				r.Header.Set(requestid.RequestIDHeader, tc.inID)
+			}
+			w := httptest.NewRecorder()
+
+			s.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			id := w.Header().Get(requestid.RequestIDHeader)
+			if tc.outKept {
+				assert.Equal(t, tc.inID, id)
+			} else {
+				assert.True(t, requestid.Valid(id))
+				assert.NotEqual(t, tc.inID, id)
+			}
+			// forwarded upstream and logged
+			assert.Equal(t, id, ctxID)
+			assert.Equal(t, id, hdrID)
+			assert.Equal(t, id, fields["request_id"])
+			assert.Equal(t, "10.0.0.1", fields["peer_ip"])
+			// balanced upstream by the cert, else the IP
+			if tc.inCert {
+				assert.Equal(t, app.CertFingerprint(cert), fields["cert_fingerprint"])
+				assert.Equal(t, app.CertFingerprint(cert), ctxKey)
+			} else {
+				assert.NotContains(t, fields, "cert_fingerprint")
+				assert.Equal(t, "10.0.0.1", ctxKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/simulator"
+)
+
+// simulateCommand runs simulated Mender devices against an Ambassador
+var simulateCommand = cli.Command{
+	Name:  "simulate",
+	Usage: "Run simulated devices: mTLS auth, inventory and deployments polling.",
+	Description: "Devices get fresh keys and client certs from a test CA (--ca-cert, --ca-key),\n" +
+		"   or a single device uses an existing client cert (--cert, --key).",
+	Action: cmdSimulate,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "server",
+			Usage: "Ambassador `URL`, e.g. https://localhost:8080.",
+		},
+		&cli.IntFlag{
+			Name:  "devices",
+			Usage: "Number of concurrent devices.",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "ca-cert",
+			Usage: "Test CA cert `FILE` (PEM) issuing the device certs.",
+		},
+		&cli.StringFlag{
+			Name:  "ca-key",
+			Usage: "Test CA key `FILE` (PEM).",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "Client cert `FILE` (PEM) of a single device.",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "Client key `FILE` (PEM) of a single device.",
+		},
+		&cli.StringFlag{
+			Name:  "key-type",
+			Usage: "Device key `TYPE`: rsa or ecdsa.",
+			Value: simulator.KeyTypeRSA,
+		},
+		&cli.IntFlag{
+			Name:  "rsa-bits",
+			Usage: "RSA device key size.",
+			Value: simulator.DefaultRSABits,
+		},
+		&cli.StringFlag{
+			Name:  "tenant-token",
+			Usage: "Tenant `TOKEN` sent in auth requests.",
+		},
+		&cli.StringFlag{
+			Name:  "device-type",
+			Usage: "Device `TYPE` reported to Mender.",
+			Value: "simulator",
+		},
+		&cli.StringFlag{
+			Name:  "artifact-name",
+			Usage: "Initial artifact `NAME` reported to Mender.",
+			Value: "release-v1",
+		},
+		&cli.DurationFlag{
+			Name:  "poll-interval",
+			Usage: "Time between deployment polls.",
+			Value: simulator.DefaultPollInterval,
+		},
+		&cli.StringFlag{
+			Name:  "server-ca",
+			Usage: "CA cert `FILE` (PEM) verifying the Ambassador; system roots if not set.",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "Skip verifying the Ambassador's cert.",
+		},
+		&cli.DurationFlag{
+			Name:  "duration",
+			Usage: "Stop after this long; 0 runs until interrupted.",
+		},
+	},
+}
+
+func cmdSimulate(args *cli.Context) error {
+	if args.String("server") == "" {
+		return cli.NewExitError("need --server", 1)
+	}
+	n := args.Int("devices")
+	if n < 1 {
+		return cli.NewExitError("--devices must be at least 1", 1)
+	}
+
+	var issuer *ca.CA
+	var fixed *tls.Certificate
+	switch {
+	case args.String("cert") != "":
+		if n != 1 {
+			return cli.NewExitError("--cert can only be used with a single device", 1)
+		}
+		cert, err := tls.LoadX509KeyPair(args.String("cert"), args.String("key"))
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("failed to load client cert: %s", err), 1)
+		}
+		fixed = &cert
+	case args.String("ca-cert") != "":
+		var err error
+		issuer, err = ca.Load(args.String("ca-cert"), args.String("ca-key"))
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("failed to load test CA: %s", err), 1)
+		}
+		issuer.Profile = &ca.Profile{Validity: 30 * 24 * time.Hour}
+	default:
+		return cli.NewExitError("need --ca-cert and --ca-key, or --cert and --key", 1)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: args.Bool("insecure"),
+	}
+	if path := args.String("server-ca"); path != "" {
+		roots, err := certPool(path)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	config := simulator.DeviceConfig{
+		ServerURL:    args.String("server"),
+		TenantToken:  args.String("tenant-token"),
+		DeviceType:   args.String("device-type"),
+		ArtifactName: args.String("artifact-name"),
+		PollInterval: args.Duration("poll-interval"),
+		TLS:          tlsConfig,
+	}
+
+	ctx, cancel := simulationContext(args.Duration("duration"))
+	defer cancel()
+
+	// MACs are locally administered, unique per run and device
+	run := make([]byte, 2)
+	if _, err := rand.Read(run); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	l.Infof("starting %d simulated devices against %s", n, config.ServerURL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		mac := fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x",
+			run[0], run[1], byte(i>>16), byte(i>>8), byte(i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := simulateDevice(ctx, mac, issuer, fixed, args, config); err != nil {
+				l.Errorf("device %s: %s", mac, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	l.Info("simulation done")
+	return nil
+}
+
+func simulateDevice(ctx context.Context,
+	mac string,
+	issuer *ca.CA,
+	fixed *tls.Certificate,
+	args *cli.Context,
+	config simulator.DeviceConfig) error {
+
+	var cert tls.Certificate
+	if fixed != nil {
+		cert = *fixed
+	} else {
+		key, err := simulator.GenerateKey(args.String("key-type"), args.Int("rsa-bits"))
+		if err != nil {
+			return err
+		}
+		cert, err = simulator.NewDeviceCert(issuer, key, mac)
+		if err != nil {
+			return err
+		}
+	}
+
+	d, err := simulator.NewDevice(fmt.Sprintf(`{"mac":"%s"}`, mac), cert, config)
+	if err != nil {
+		return err
+	}
+	return d.Run(ctx)
+}
+
+// simulationContext is done after the duration (if any) or on SIGINT/SIGTERM
+func simulationContext(duration time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), duration)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, unix.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			l.Info("stopping simulated devices")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+
+	return ctx, cancel
+}
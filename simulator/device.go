@@ -0,0 +1,450 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package simulator simulates Mender devices talking to the Ambassador:
+// mTLS authentication with signed auth requests, inventory and
+// the deployments polling loop.
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+const (
+	UrlAuthRequests     = "/api/devices/v1/authentication/auth_requests"
+	UrlInventory        = "/api/devices/v1/inventory/device/attributes"
+	UrlDeploymentsNext  = "/api/devices/v1/deployments/device/deployments/next"
+	UrlDeploymentStatus = "/api/devices/v1/deployments/device/deployments/%s/status"
+
+	HdrSignature = "X-MEN-Signature"
+
+	StatusDownloading = "downloading"
+	StatusInstalling  = "installing"
+	StatusRebooting   = "rebooting"
+	StatusSuccess     = "success"
+
+	DefaultPollInterval = 5 * time.Second
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+
+	l = log.NewEmpty()
+)
+
+// StatusError is an unexpected response status
+type StatusError struct {
+	Method string
+	Path   string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d", e.Method, e.Path, e.Code)
+}
+
+// DeviceConfig is the setup shared by simulated devices
+type DeviceConfig struct {
+	// ServerURL is the Ambassador's base url (scheme + host:port)
+	ServerURL string
+	// TenantToken is sent in auth requests
+	TenantToken string
+	// DeviceType and ArtifactName are reported in inventory and deployment polls
+	DeviceType   string
+	ArtifactName string
+	// PollInterval is the time between deployment polls and pending auth retries
+	PollInterval time.Duration
+	// TLS is the base client TLS config (server verification);
+	// each device adds its own client cert
+	TLS *tls.Config
+	// SessionResumption gives each device a TLS session cache
+	SessionResumption bool
+	// NewConnections sends every request on a new connection (no keep-alive),
+	// so that each one goes through a TLS handshake
+	NewConnections bool
+	// ReplayProtection adds a nonce and timestamp to every auth request
+	ReplayProtection bool
+}
+
+// Deployment is the next deployment as returned to a device
+type Deployment struct {
+	ID       string `json:"id"`
+	Artifact struct {
+		Name   string `json:"artifact_name"`
+		Source struct {
+			URI string `json:"uri"`
+		} `json:"source"`
+	} `json:"artifact"`
+}
+
+// Device is a simulated Mender device, authenticating with its client cert
+// and signing its auth requests with the cert's key, like the Mender client
+type Device struct {
+	IdData string
+
+	config   DeviceConfig
+	key      crypto.Signer
+	client   *http.Client
+	artifact string
+	token    string
+}
+
+// NewDevice creates a device with the given identity data and client cert,
+// whose private key must be a crypto.Signer
+func NewDevice(idData string, cert tls.Certificate, config DeviceConfig) (*Device, error) {
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("client key is not a crypto.Signer")
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultPollInterval
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.TLS != nil {
+		tlsConfig = config.TLS.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	// never share sessions - they carry the device's identity
+	tlsConfig.ClientSessionCache = nil
+	if config.SessionResumption {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+
+	return &Device{
+		IdData:   idData,
+		config:   config,
+		key:      key,
+		artifact: config.ArtifactName,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				ForceAttemptHTTP2: !config.NewConnections,
+				DisableKeepAlives: config.NewConnections,
+			},
+		},
+	}, nil
+}
+
+// SignAuthReq signs an auth request body like the Mender client:
+// BASE64(SIGN(device_private_key, SHA256(body)))
+func SignAuthReq(key crypto.Signer, body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	sig, err := key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Run authorizes the device, sends its inventory and polls for deployments
+// until the context is done; deployments are "installed" by downloading
+// the artifact and reporting the statuses of a successful update
+func (d *Device) Run(ctx context.Context) error {
+	if err := d.Authorize(ctx); err != nil {
+		return stopped(ctx, err)
+	}
+
+	for {
+		err := d.SendInventory(ctx)
+		if err == nil {
+			break
+		}
+		if err := d.handleError(ctx, "sending inventory", err); err != nil {
+			return stopped(ctx, err)
+		}
+	}
+
+	for {
+		dep, err := d.NextDeployment(ctx)
+		if err == nil && dep != nil {
+			err = d.Deploy(ctx, dep)
+		}
+		if err != nil {
+			if err := d.handleError(ctx, "checking deployments", err); err != nil {
+				return stopped(ctx, err)
+			}
+			continue
+		}
+
+		if err := d.wait(ctx); err != nil {
+			return nil
+		}
+	}
+}
+
+// stopped hides the error of a device stopped by its context
+func stopped(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// handleError re-authorizes on an expired token and waits out other errors;
+// it only fails when the context is done
+func (d *Device) handleError(ctx context.Context, what string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == ErrUnauthorized {
+		l.Infof("device %s: token rejected, re-authorizing", d.IdData)
+		return d.Authorize(ctx)
+	}
+	l.Warnf("device %s: %s failed: %s", d.IdData, what, err)
+	return d.wait(ctx)
+}
+
+func (d *Device) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d.config.PollInterval):
+		return nil
+	}
+}
+
+// NewAuthReq creates the device's auth request body and its signature
+func (d *Device) NewAuthReq() ([]byte, string, error) {
+	pub, err := utils.SerializePubKey(d.key.Public())
+	if err != nil {
+		return nil, "", err
+	}
+
+	req := mender.AuthReq{
+		IdData:      d.IdData,
+		TenantToken: d.config.TenantToken,
+		PubKey:      pub,
+	}
+	if d.config.ReplayProtection {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, "", err
+		}
+		req.Nonce = hex.EncodeToString(nonce)
+		req.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sig, err := SignAuthReq(d.key, body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to sign auth request")
+	}
+
+	return body, sig, nil
+}
+
+// Authorize sends signed auth requests until the device is accepted;
+// each one is created anew, like by the Mender client
+func (d *Device) Authorize(ctx context.Context) error {
+	for {
+		body, sig, err := d.NewAuthReq()
+		if err != nil {
+			return err
+		}
+
+		_, err = d.AuthRequest(ctx, body, sig)
+		if err == nil {
+			l.Infof("device %s: authorized", d.IdData)
+			return nil
+		}
+
+		if err == ErrUnauthorized {
+			l.Infof("device %s: not accepted yet", d.IdData)
+		} else {
+			l.Warnf("device %s: auth request failed: %s", d.IdData, err)
+		}
+		if err := d.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// AuthRequest sends one auth request and, if accepted, returns
+// the device token (also used by the device's further requests)
+func (d *Device) AuthRequest(ctx context.Context, body []byte, signature string) (string, error) {
+	req, err := d.newRequest(ctx, http.MethodPost, UrlAuthRequests, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(HdrSignature, signature)
+
+	token, err := d.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	d.token = string(token)
+	return d.token, nil
+}
+
+// SendInventory reports the device type and current artifact
+func (d *Device) SendInventory(ctx context.Context) error {
+	attrs := []map[string]string{
+		{"name": "device_type", "value": d.config.DeviceType},
+		{"name": "artifact_name", "value": d.artifact},
+		{"name": "client", "value": "mtls-ambassador simulator"},
+	}
+	body, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+
+	req, err := d.newRequest(ctx, http.MethodPatch, UrlInventory, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.do(req, http.StatusOK)
+	return err
+}
+
+// NextDeployment polls for a deployment; nil means there's none
+func (d *Device) NextDeployment(ctx context.Context) (*Deployment, error) {
+	q := url.Values{}
+	q.Set("artifact_name", d.artifact)
+	q.Set("device_type", d.config.DeviceType)
+
+	req, err := d.newRequest(ctx, http.MethodGet, UrlDeploymentsNext+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := d.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+
+	dep := &Deployment{}
+	if err := json.Unmarshal(body, dep); err != nil {
+		return nil, errors.Wrap(err, "failed to parse deployment")
+	}
+	return dep, nil
+}
+
+// Deploy downloads the deployment's artifact and reports a successful update
+func (d *Device) Deploy(ctx context.Context, dep *Deployment) error {
+	l.Infof("device %s: deployment %s of %s", d.IdData, dep.ID, dep.Artifact.Name)
+
+	if err := d.SetDeploymentStatus(ctx, dep.ID, StatusDownloading); err != nil {
+		return err
+	}
+
+	if err := d.download(ctx, dep.Artifact.Source.URI); err != nil {
+		return err
+	}
+
+	for _, status := range []string{StatusInstalling, StatusRebooting, StatusSuccess} {
+		if err := d.SetDeploymentStatus(ctx, dep.ID, status); err != nil {
+			return err
+		}
+	}
+
+	d.artifact = dep.Artifact.Name
+	return d.SendInventory(ctx)
+}
+
+// SetDeploymentStatus reports a deployment's status
+func (d *Device) SetDeploymentStatus(ctx context.Context, id, status string) error {
+	body, err := json.Marshal(map[string]string{"status": status})
+	if err != nil {
+		return err
+	}
+
+	req, err := d.newRequest(ctx, http.MethodPut,
+		fmt.Sprintf(UrlDeploymentStatus, url.PathEscape(id)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.do(req, http.StatusNoContent, http.StatusOK)
+	return err
+}
+
+// download fetches the artifact (typically a presigned storage url) and discards it
+func (d *Device) download(ctx context.Context, uri string) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid artifact uri")
+	}
+
+	rsp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "artifact download failed")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return errors.Errorf("artifact download failed with status %d", rsp.StatusCode)
+	}
+	_, err = io.Copy(ioutil.Discard, rsp.Body)
+	return errors.Wrap(err, "artifact download failed")
+}
+
+func (d *Device) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(d.config.ServerURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if d.token != "" && path != UrlAuthRequests {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do sends the request and returns the response body if the status is one of ok
+func (d *Device) do(req *http.Request, ok ...int) ([]byte, error) {
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range ok {
+		if rsp.StatusCode == status {
+			return body, nil
+		}
+	}
+	if rsp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
+	return nil, &StatusError{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Code:   rsp.StatusCode,
+	}
+}
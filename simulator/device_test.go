@@ -0,0 +1,225 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package simulator
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+	"github.com/mendersoftware/mtls-ambassador/client/mender"
+	"github.com/mendersoftware/mtls-ambassador/utils"
+)
+
+func newTestCA(t *testing.T) *ca.CA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Tenant CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	issuer, err := ca.New(cert, key)
+	assert.NoError(t, err)
+	issuer.Profile = &ca.Profile{Validity: time.Hour}
+	return issuer
+}
+
+func TestSignAuthReq(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`{"id_data":"{\"mac\":\"02:00:00:00:00:01\"}"}`)
+
+	rsaKey, err := GenerateKey(KeyTypeRSA, 2048)
+	assert.NoError(t, err)
+	sig, err := SignAuthReq(rsaKey, body)
+	assert.NoError(t, err)
+	assert.NoError(t, utils.VerifyAuthReqSign(sig, rsaKey.Public(), body))
+
+	ecKey, err := GenerateKey(KeyTypeECDSA, 0)
+	assert.NoError(t, err)
+	sig, err = SignAuthReq(ecKey, body)
+	assert.NoError(t, err)
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	assert.NoError(t, err)
+	var es struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(raw, &es)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(body)
+	assert.True(t, ecdsa.Verify(ecKey.Public().(*ecdsa.PublicKey), sum[:], es.R, es.S))
+
+	_, err = GenerateKey("dsa", 0)
+	assert.EqualError(t, err, `unknown key type "dsa"`)
+}
+
+// fakeBackend plays the Ambassador and Mender for one device:
+// the first auth request is pending, then there's one deployment
+type fakeBackend struct {
+	t *testing.T
+
+	mu        sync.Mutex
+	authReqs  int
+	inventory []string
+	polls     int
+	statuses  []string
+	done      chan struct{}
+}
+
+func (f *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path != UrlAuthRequests && r.URL.Path != "/artifact" &&
+		r.Header.Get("Authorization") != "Bearer token-1" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == UrlAuthRequests:
+		body, _ := ioutil.ReadAll(r.Body)
+		var req mender.AuthReq
+		assert.NoError(f.t, json.Unmarshal(body, &req))
+
+		// the Ambassador's checks
+		certKey, err := utils.SerializePubKey(r.TLS.PeerCertificates[0].PublicKey)
+		assert.NoError(f.t, err)
+		assert.Equal(f.t, certKey, req.PubKey)
+		assert.NoError(f.t, utils.VerifyAuthReqSign(
+			r.Header.Get(HdrSignature), r.TLS.PeerCertificates[0].PublicKey, body))
+		assert.Equal(f.t, "tenant", req.TenantToken)
+
+		f.authReqs++
+		if f.authReqs == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("token-1"))
+
+	case r.URL.Path == UrlInventory && r.Method == http.MethodPatch:
+		var attrs []map[string]string
+		assert.NoError(f.t, json.NewDecoder(r.Body).Decode(&attrs))
+		for _, a := range attrs {
+			if a["name"] == "artifact_name" {
+				f.inventory = append(f.inventory, a["value"])
+			}
+		}
+		if len(f.inventory) == 2 {
+			close(f.done)
+		}
+
+	case r.URL.Path == UrlDeploymentsNext:
+		assert.Equal(f.t, "sim", r.URL.Query().Get("device_type"))
+		f.polls++
+		if f.polls > 1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		dep := Deployment{ID: "dep-1"}
+		dep.Artifact.Name = "release-2"
+		dep.Artifact.Source.URI = "https://" + r.Host + "/artifact"
+		_ = json.NewEncoder(w).Encode(dep)
+
+	case r.URL.Path == "/api/devices/v1/deployments/device/deployments/dep-1/status":
+		var status map[string]string
+		assert.NoError(f.t, json.NewDecoder(r.Body).Decode(&status))
+		f.statuses = append(f.statuses, status["status"])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.URL.Path == "/artifact":
+		_, _ = w.Write([]byte("artifact"))
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestDeviceRun(t *testing.T) {
+	t.Parallel()
+
+	f := &fakeBackend{t: t, done: make(chan struct{})}
+	srv := httptest.NewUnstartedServer(f)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	key, err := GenerateKey(KeyTypeRSA, 2048)
+	assert.NoError(t, err)
+	cert, err := NewDeviceCert(newTestCA(t), key, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "device-1", cert.Leaf.Subject.CommonName)
+
+	d, err := NewDevice(`{"mac":"02:00:00:00:00:01"}`, cert, DeviceConfig{
+		ServerURL:    srv.URL,
+		TenantToken:  "tenant",
+		DeviceType:   "sim",
+		ArtifactName: "release-1",
+		PollInterval: 10 * time.Millisecond,
+		TLS:          &tls.Config{InsecureSkipVerify: true},
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- d.Run(ctx)
+	}()
+
+	select {
+	case <-f.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("device didn't finish the deployment")
+	}
+	cancel()
+	assert.NoError(t, <-errs)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	assert.Equal(t, 2, f.authReqs)
+	assert.Equal(t, []string{"release-1", "release-2"}, f.inventory)
+	assert.Equal(t, []string{
+		StatusDownloading,
+		StatusInstalling,
+		StatusRebooting,
+		StatusSuccess,
+	}, f.statuses)
+}
+
+func TestNewDevice(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewDevice("{}", tls.Certificate{PrivateKey: crypto.PrivateKey("key")}, DeviceConfig{})
+	assert.EqualError(t, err, "client key is not a crypto.Signer")
+}
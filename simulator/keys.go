@@ -0,0 +1,69 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package simulator
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+)
+
+const (
+	KeyTypeRSA   = "rsa"
+	KeyTypeECDSA = "ecdsa"
+
+	DefaultRSABits = 3072
+)
+
+// GenerateKey generates a device key: RSA of the given size,
+// or ECDSA on P-256
+func GenerateKey(keyType string, rsaBits int) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		if rsaBits == 0 {
+			rsaBits = DefaultRSABits
+		}
+		return rsa.GenerateKey(rand.Reader, rsaBits)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, errors.Errorf("unknown key type %q", keyType)
+	}
+}
+
+// NewDeviceCert issues a client cert for the key from the (test) CA,
+// with the CA cert in the chain
+func NewDeviceCert(issuer *ca.CA, key crypto.Signer, commonName string) (tls.Certificate, error) {
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to create CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert, err := issuer.Sign(csr)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "failed to issue device cert")
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw, issuer.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, nil
+}
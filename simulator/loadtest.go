@@ -0,0 +1,261 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package simulator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mtls-ambassador/ca"
+)
+
+const (
+	// OpHandshake is a TLS handshake, OpAuth an auth request (intercepted and
+	// preauthorized by the Ambassador) and OpProxy a proxied deployments poll
+	OpHandshake = "handshake"
+	OpAuth      = "auth"
+	OpProxy     = "proxy"
+)
+
+// LoadTestConfig configures a load test
+type LoadTestConfig struct {
+	// Device is the simulated devices' setup; every request goes on a new connection
+	Device DeviceConfig
+	// Issuer is the test CA issuing the clients' certs
+	Issuer *ca.CA
+
+	// Clients is the number of concurrent clients
+	Clients int
+	// Ramp is the time over which clients are started, at an even pace
+	Ramp time.Duration
+	// Duration is how long all clients keep running after the ramp
+	Duration time.Duration
+	// ThinkTime is each client's pause between auth + proxy rounds
+	ThinkTime time.Duration
+
+	// KeyTypes are the client key types, assigned round robin
+	KeyTypes []string
+	// RSABits is the RSA client key size
+	RSABits int
+}
+
+// RunLoadTest drives the clients against the server: each one repeatedly
+// sends an auth request and a proxied request, each on a new connection
+// (with or without TLS session resumption)
+func RunLoadTest(ctx context.Context, config LoadTestConfig) (*Report, error) {
+	if config.Clients < 1 {
+		return nil, errors.New("need at least one client")
+	}
+	if len(config.KeyTypes) == 0 {
+		config.KeyTypes = []string{KeyTypeRSA}
+	}
+	config.Device.NewConnections = true
+
+	devices, err := newLoadDevices(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := newRecorder()
+
+	ctx, cancel := context.WithTimeout(ctx, config.Ramp+config.Duration)
+	defer cancel()
+
+	l.Infof("load test: starting %d clients over %s, running for %s more",
+		len(devices), config.Ramp, config.Duration)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		delay := config.Ramp * time.Duration(i) / time.Duration(len(devices))
+		wg.Add(1)
+		go func(d *Device) {
+			defer wg.Done()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			runLoadClient(ctx, d, rec, config.ThinkTime)
+		}(d)
+	}
+	wg.Wait()
+
+	return rec.report(time.Since(start), len(devices)), nil
+}
+
+// newLoadDevices generates the clients' keys and certs up front,
+// so that key generation doesn't skew the measurements
+func newLoadDevices(ctx context.Context, config LoadTestConfig) ([]*Device, error) {
+	l.Infof("load test: generating %d client keys and certs", config.Clients)
+
+	devices := make([]*Device, config.Clients)
+	errs := make([]error, config.Clients)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				devices[i], errs[i] = newLoadDevice(i, config)
+			}
+		}()
+	}
+
+	for i := 0; i < config.Clients && ctx.Err() == nil; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return devices, nil
+}
+
+func newLoadDevice(i int, config LoadTestConfig) (*Device, error) {
+	mac := fmt.Sprintf("02:00:00:%02x:%02x:%02x", byte(i>>16), byte(i>>8), byte(i))
+
+	key, err := GenerateKey(config.KeyTypes[i%len(config.KeyTypes)], config.RSABits)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := NewDeviceCert(config.Issuer, key, mac)
+	if err != nil {
+		return nil, err
+	}
+	return NewDevice(fmt.Sprintf(`{"mac":"%s"}`, mac), cert, config.Device)
+}
+
+func runLoadClient(ctx context.Context, d *Device, rec *recorder, think time.Duration) {
+	body, sig, err := d.NewAuthReq()
+	if err != nil {
+		l.Errorf("load test: device %s: %s", d.IdData, err)
+		return
+	}
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		_, err := d.AuthRequest(rec.trace(ctx), body, sig)
+		rec.record(ctx, OpAuth, time.Since(start), err)
+
+		if err == nil {
+			start = time.Now()
+			_, err = d.NextDeployment(rec.trace(ctx))
+			rec.record(ctx, OpProxy, time.Since(start), err)
+		}
+
+		if think > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(think):
+			}
+		}
+	}
+}
+
+// errorKind groups errors for the report
+func errorKind(err error) string {
+	if err == ErrUnauthorized {
+		return "status 401"
+	}
+	if e, ok := errors.Cause(err).(*StatusError); ok {
+		return fmt.Sprintf("status %d", e.Code)
+	}
+
+	if e, ok := errors.Cause(err).(net.Error); ok && e.Timeout() {
+		return "timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "connect"
+	}
+	var recErr tls.RecordHeaderError
+	var authErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var hostErr x509.HostnameError
+	if errors.As(err, &recErr) || errors.As(err, &authErr) ||
+		errors.As(err, &certErr) || errors.As(err, &hostErr) ||
+		(errors.As(err, &opErr) && opErr.Op == "remote error") {
+		return "tls"
+	}
+	return "other"
+}
+
+// recorder collects the load test's latencies and errors
+type recorder struct {
+	mu         sync.Mutex
+	samples    map[string][]time.Duration
+	errors     map[string]map[string]int
+	resumed    int
+	handshakes int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		samples: map[string][]time.Duration{},
+		errors:  map[string]map[string]int{},
+	}
+}
+
+// trace measures the TLS handshakes of a request
+func (r *recorder) trace(ctx context.Context) context.Context {
+	var start time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			start = time.Now()
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			took := time.Since(start)
+			if err == nil {
+				r.mu.Lock()
+				r.handshakes++
+				if cs.DidResume {
+					r.resumed++
+				}
+				r.mu.Unlock()
+			}
+			r.record(ctx, OpHandshake, took, err)
+		},
+	})
+}
+
+// record records an operation, unless it was cut short by the end of the test
+func (r *recorder) record(ctx context.Context, op string, took time.Duration, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		kinds, ok := r.errors[op]
+		if !ok {
+			kinds = map[string]int{}
+			r.errors[op] = kinds
+		}
+		kinds[errorKind(err)]++
+		return
+	}
+	r.samples[op] = append(r.samples[op], took)
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunLoadTest(t *testing.T) {
+	t.Parallel()
+
+	var polls int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case UrlAuthRequests:
+				_, _ = w.Write([]byte("token"))
+			case UrlDeploymentsNext:
+				// every other poll fails upstream
+				if atomic.AddInt32(&polls, 1)%2 == 0 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	rep, err := RunLoadTest(context.Background(), LoadTestConfig{
+		Device: DeviceConfig{
+			ServerURL:         srv.URL,
+			SessionResumption: true,
+			TLS:               &tls.Config{InsecureSkipVerify: true},
+		},
+		Issuer:    newTestCA(t),
+		Clients:   4,
+		Ramp:      50 * time.Millisecond,
+		Duration:  300 * time.Millisecond,
+		ThinkTime: 10 * time.Millisecond,
+		KeyTypes:  []string{KeyTypeECDSA, KeyTypeRSA},
+		RSABits:   2048,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, rep.Clients)
+	for _, op := range []string{OpHandshake, OpAuth, OpProxy} {
+		assert.NotZero(t, rep.Ops[op].Count, op)
+		assert.NotZero(t, rep.Ops[op].P50, op)
+		assert.True(t, rep.Ops[op].P50 <= rep.Ops[op].P99, op)
+		assert.True(t, rep.Ops[op].P99 <= rep.Ops[op].Max, op)
+	}
+	assert.Zero(t, rep.Ops[OpAuth].Errors)
+	assert.NotZero(t, rep.Ops[OpProxy].ErrorKinds["status 502"])
+	assert.Equal(t, rep.Ops[OpProxy].Errors, rep.Ops[OpProxy].ErrorKinds["status 502"])
+
+	// every request is on a new connection; all but the first of a client resume.
+	// A client's last request may be cut short by the end of the test after
+	// its handshake, which is then the only one recorded.
+	requests := rep.Ops[OpAuth].Count + rep.Ops[OpProxy].Count + rep.Ops[OpProxy].Errors
+	assert.True(t, rep.Ops[OpHandshake].Count >= requests, rep.Ops[OpHandshake].Count)
+	assert.True(t, rep.Ops[OpHandshake].Count <= requests+rep.Clients, rep.Ops[OpHandshake].Count)
+	assert.NotZero(t, rep.ResumedHandshakes)
+
+	var out bytes.Buffer
+	assert.NoError(t, rep.Print(&out))
+	assert.Contains(t, out.String(), "proxy errors:\n  status 502:")
+
+	_, err = RunLoadTest(context.Background(), LoadTestConfig{})
+	assert.Error(t, err)
+}
+
+func TestErrorKind(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		err  error
+		kind string
+	}{
+		{name: "unauthorized", err: ErrUnauthorized, kind: "status 401"},
+		{name: "status", err: &StatusError{Code: 503}, kind: "status 503"},
+		{name: "wrapped status", err: errors.Wrap(&StatusError{Code: 500}, "auth"), kind: "status 500"},
+		{
+			name: "connect",
+			err: &url.Error{Op: "Post", URL: "https://localhost",
+				Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			kind: "connect",
+		},
+		{name: "other", err: errors.New("boom"), kind: "other"},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.kind, errorKind(tc.err))
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	t.Parallel()
+
+	samples := make([]time.Duration, 100)
+	for i := range samples {
+		samples[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+	assert.Equal(t, 50*time.Millisecond, percentile(samples, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(samples, 99))
+	assert.Equal(t, 100*time.Millisecond, percentile(samples, 100))
+	assert.Equal(t, 7*time.Millisecond, percentile(samples[6:7], 50))
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package simulator
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Report is the outcome of a load test
+type Report struct {
+	Duration time.Duration `json:"duration"`
+	Clients  int           `json:"clients"`
+
+	// Ops are the stats of OpHandshake, OpAuth and OpProxy
+	Ops map[string]*OpStats `json:"ops"`
+
+	// ResumedHandshakes of all successful ones used TLS session resumption
+	ResumedHandshakes int `json:"resumed_handshakes"`
+}
+
+// OpStats are the latencies (of successful operations) and errors of an operation
+type OpStats struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"`
+	Rate   float64 `json:"rate"`
+
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P95 time.Duration `json:"p95"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+
+	// ErrorKinds breaks errors down, e.g. "status 500", "timeout", "tls"
+	ErrorKinds map[string]int `json:"error_kinds,omitempty"`
+}
+
+func (r *recorder) report(took time.Duration, clients int) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rep := &Report{
+		Duration:          took,
+		Clients:           clients,
+		Ops:               map[string]*OpStats{},
+		ResumedHandshakes: r.resumed,
+	}
+
+	for _, op := range []string{OpHandshake, OpAuth, OpProxy} {
+		samples := r.samples[op]
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i] < samples[j]
+		})
+
+		stats := &OpStats{
+			Count:      len(samples),
+			ErrorKinds: r.errors[op],
+			P50:        percentile(samples, 50),
+			P90:        percentile(samples, 90),
+			P95:        percentile(samples, 95),
+			P99:        percentile(samples, 99),
+			Max:        percentile(samples, 100),
+		}
+		for _, n := range stats.ErrorKinds {
+			stats.Errors += n
+		}
+		if took > 0 {
+			stats.Rate = float64(stats.Count) / took.Seconds()
+		}
+		rep.Ops[op] = stats
+	}
+
+	return rep
+}
+
+// percentile is the nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+// Print writes the report as a table
+func (rep *Report) Print(w io.Writer) error {
+	fmt.Fprintf(w, "clients: %d, duration: %s, TLS handshakes resumed: %d of %d\n\n",
+		rep.Clients, rep.Duration.Round(time.Millisecond),
+		rep.ResumedHandshakes, rep.Ops[OpHandshake].Count)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tok\terrors\trate/s\tp50\tp90\tp95\tp99\tmax\t")
+	for _, op := range []string{OpHandshake, OpAuth, OpProxy} {
+		s := rep.Ops[op]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%s\t\n",
+			op, s.Count, s.Errors, s.Rate,
+			ms(s.P50), ms(s.P90), ms(s.P95), ms(s.P99), ms(s.Max))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, op := range []string{OpHandshake, OpAuth, OpProxy} {
+		kinds := rep.Ops[op].ErrorKinds
+		if len(kinds) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(kinds))
+		for k := range kinds {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(w, "\n%s errors:\n", op)
+		for _, k := range names {
+			fmt.Fprintf(w, "  %s: %d\n", k, kinds[k])
+		}
+	}
+	return nil
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+const (
+	ClientAuthRequire       = "require"
+	ClientAuthVerifyIfGiven = "verify_if_given"
+
+	// ticketKeysKept is the number of session ticket keys kept after rotation,
+	// i.e. tickets stay valid for this many rotation periods
+	ticketKeysKept = 3
+)
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+)
+
+// TLSPolicy is the TLS configuration enforced on the device listener
+type TLSPolicy struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+
+	SessionTickets           bool
+	SessionTicketKeyRotation time.Duration
+
+	// ClientAuth is the default client cert mode, ClientAuthPaths
+	// override it per URL path prefix (longest prefix wins)
+	ClientAuth      string
+	ClientAuthPaths map[string]string
+
+	// NotBeforeGrace accepts client certs in the handshake which
+	// are not yet valid by up to this much
+	NotBeforeGrace time.Duration
+}
+
+// NewTLSPolicy parses and validates the TLS policy settings
+func NewTLSPolicy(c config.Reader) (*TLSPolicy, error) {
+	p := &TLSPolicy{
+		SessionTickets:           c.GetBool(aconfig.SettingTLSSessionTickets),
+		SessionTicketKeyRotation: c.GetDuration(aconfig.SettingTLSSessionTicketKeyRotation),
+		ClientAuthPaths:          map[string]string{},
+		NotBeforeGrace:           c.GetDuration(aconfig.SettingCertNotBeforeGrace),
+	}
+
+	var err error
+	p.MinVersion, err = parseTLSVersion(c.GetString(aconfig.SettingTLSMinVersion))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingTLSMinVersion)
+	}
+	p.MaxVersion, err = parseTLSVersion(c.GetString(aconfig.SettingTLSMaxVersion))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingTLSMaxVersion)
+	}
+	if p.MaxVersion < p.MinVersion {
+		return nil, errors.Errorf("%s is lower than %s",
+			aconfig.SettingTLSMaxVersion, aconfig.SettingTLSMinVersion)
+	}
+
+	suites := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+	for _, name := range c.GetStringSlice(aconfig.SettingTLSCipherSuites) {
+		id, ok := suites[name]
+		if !ok {
+			return nil, errors.Errorf("%s: unknown or insecure cipher suite %s",
+				aconfig.SettingTLSCipherSuites, name)
+		}
+		p.CipherSuites = append(p.CipherSuites, id)
+	}
+
+	for _, name := range c.GetStringSlice(aconfig.SettingTLSCurvePreferences) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, errors.Errorf("%s: unknown curve %s",
+				aconfig.SettingTLSCurvePreferences, name)
+		}
+		p.CurvePreferences = append(p.CurvePreferences, id)
+	}
+
+	if p.SessionTicketKeyRotation < 0 {
+		return nil, errors.Errorf("%s must not be negative", aconfig.SettingTLSSessionTicketKeyRotation)
+	}
+
+	p.ClientAuth, err = parseClientAuth(c.GetString(aconfig.SettingTLSClientAuth))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingTLSClientAuth)
+	}
+	for path, mode := range c.GetStringMapString(aconfig.SettingTLSClientAuthPaths) {
+		p.ClientAuthPaths[path], err = parseClientAuth(mode)
+		if err != nil {
+			return nil, errors.Wrap(err, aconfig.SettingTLSClientAuthPaths)
+		}
+	}
+
+	return p, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	version, ok := tlsVersions[v]
+	if !ok {
+		return 0, errors.Errorf("unknown TLS version %q", v)
+	}
+	return version, nil
+}
+
+func parseClientAuth(mode string) (string, error) {
+	switch mode {
+	case ClientAuthRequire, ClientAuthVerifyIfGiven:
+		return mode, nil
+	default:
+		return "", errors.Errorf("unknown client auth mode %q", mode)
+	}
+}
+
+// apply sets the policy on a server side tls.Config
+func (p *TLSPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.MinVersion
+	cfg.MaxVersion = p.MaxVersion
+	cfg.CipherSuites = p.CipherSuites
+	cfg.CurvePreferences = p.CurvePreferences
+	cfg.SessionTicketsDisabled = !p.SessionTickets
+
+	// the handshake can't see the path yet - if any path accepts
+	// cert-less clients, the requirement is enforced per request instead
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if p.optionalClientCert() {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// Go's verification has no clock skew tolerance - verify on our own
+	if p.NotBeforeGrace > 0 {
+		if cfg.ClientAuth == tls.RequireAndVerifyClientCert {
+			cfg.ClientAuth = tls.RequireAnyClientCert
+		} else {
+			cfg.ClientAuth = tls.RequestClientCert
+		}
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyClientCert(rawCerts, cfg.ClientCAs, p.NotBeforeGrace, time.Now())
+		}
+	}
+}
+
+// verifyClientCert verifies the client's chain like the TLS handshake would,
+// but accepts a leaf which becomes valid within the grace period
+func verifyClientCert(rawCerts [][]byte, roots *x509.CertPool, grace time.Duration, now time.Time) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse client certificate")
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	leaf := certs[0]
+	if now.Before(leaf.NotBefore) && leaf.NotBefore.Sub(now) <= grace {
+		l.Warnf("client certificate %q not valid until %s, within grace period",
+			leaf.Subject, leaf.NotBefore.UTC())
+		opts.CurrentTime = leaf.NotBefore
+	}
+
+	_, err := leaf.Verify(opts)
+	return err
+}
+
+func (p *TLSPolicy) optionalClientCert() bool {
+	if p.ClientAuth == ClientAuthVerifyIfGiven {
+		return true
+	}
+	for _, mode := range p.ClientAuthPaths {
+		if mode == ClientAuthVerifyIfGiven {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAuthFor returns the client cert mode for a URL path
+func (p *TLSPolicy) clientAuthFor(path string) string {
+	mode, longest := p.ClientAuth, -1
+	for prefix, m := range p.ClientAuthPaths {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			mode, longest = m, len(prefix)
+		}
+	}
+	return mode
+}
+
+// requireClientCert wraps h to reject requests without a verified
+// client cert on paths where the policy requires one
+func (p *TLSPolicy) requireClientCert(h http.Handler) http.Handler {
+	if !p.optionalClientCert() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// any cert present has been verified in the handshake
+		if p.clientAuthFor(r.URL.Path) == ClientAuthRequire &&
+			(r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			l.Warnf("client cert required on %s, rejecting %s", r.URL.Path, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Log prints the effective policy
+func (p *TLSPolicy) Log() {
+	l.Info("TLS policy:")
+	l.Infof(" min version: %s", tlsVersionName(p.MinVersion))
+	l.Infof(" max version: %s", tlsVersionName(p.MaxVersion))
+
+	if len(p.CipherSuites) == 0 {
+		l.Info(" cipher suites: Go defaults")
+	} else {
+		names := make([]string, len(p.CipherSuites))
+		for i, id := range p.CipherSuites {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		l.Infof(" cipher suites: %s", strings.Join(names, ", "))
+	}
+
+	if len(p.CurvePreferences) == 0 {
+		l.Info(" curve preferences: Go defaults")
+	} else {
+		names := make([]string, len(p.CurvePreferences))
+		for i, id := range p.CurvePreferences {
+			names[i] = tlsCurveName(id)
+		}
+		l.Infof(" curve preferences: %s", strings.Join(names, ", "))
+	}
+
+	switch {
+	case !p.SessionTickets:
+		l.Info(" session tickets: disabled")
+	case p.SessionTicketKeyRotation == 0:
+		l.Info(" session tickets: enabled, keys managed by Go")
+	default:
+		l.Infof(" session tickets: enabled, key rotation every %s", p.SessionTicketKeyRotation)
+	}
+
+	if p.NotBeforeGrace > 0 {
+		l.Infof(" client cert not-yet-valid grace: %s", p.NotBeforeGrace)
+	}
+
+	l.Infof(" client auth: %s", p.ClientAuth)
+	paths := make([]string, 0, len(p.ClientAuthPaths))
+	for path := range p.ClientAuthPaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		l.Infof(" client auth on %s: %s", path, p.ClientAuthPaths[path])
+	}
+}
+
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func tlsCurveName(id tls.CurveID) string {
+	for name, curve := range tlsCurves {
+		if curve == id {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", uint16(id))
+}
+
+// ticketKeys rotates session ticket keys on a timer, keeping the
+// most recent ones so that tickets survive a rotation
+type ticketKeys struct {
+	mu   sync.Mutex
+	keys [][32]byte
+}
+
+// rotate generates a new key, to be used for encrypting new tickets
+func (tk *ticketKeys) rotate() ([][32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	tk.keys = append([][32]byte{key}, tk.keys...)
+	if len(tk.keys) > ticketKeysKept {
+		tk.keys = tk.keys[:ticketKeysKept]
+	}
+
+	return tk.current(), nil
+}
+
+func (tk *ticketKeys) get() [][32]byte {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	return tk.current()
+}
+
+func (tk *ticketKeys) current() [][32]byte {
+	keys := make([][32]byte, len(tk.keys))
+	copy(keys, tk.keys)
+	return keys
+}
+
+// run calls set with freshly rotated keys every interval, until stopped
+func (tk *ticketKeys) run(interval time.Duration, stop <-chan struct{}, set func([][32]byte)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			keys, err := tk.rotate()
+			if err != nil {
+				l.Errorf("rotating session ticket key failed: %s", err)
+				continue
+			}
+			set(keys)
+			l.Debug("rotated session ticket key")
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func defaultTLSPolicy(t *testing.T) *TLSPolicy {
+	c := viper.New()
+	config.SetDefaults(c, aconfig.Defaults)
+
+	p, err := NewTLSPolicy(c)
+	assert.NoError(t, err)
+
+	return p
+}
+
+func TestNewTLSPolicy(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		out    *TLSPolicy
+		outErr string
+	}{
+		{
+			name: "ok, defaults",
+
+			out: &TLSPolicy{
+				MinVersion:      tls.VersionTLS12,
+				MaxVersion:      tls.VersionTLS13,
+				SessionTickets:  true,
+				ClientAuth:      ClientAuthRequire,
+				ClientAuthPaths: map[string]string{},
+			},
+		},
+		{
+			name: "ok, all set",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTLSMinVersion: "1.3",
+				aconfig.SettingTLSCipherSuites: []string{
+					"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+					"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+				},
+				aconfig.SettingTLSCurvePreferences:         []string{"X25519", "P384"},
+				aconfig.SettingTLSSessionTicketKeyRotation: "12h",
+				aconfig.SettingTLSClientAuth:               ClientAuthVerifyIfGiven,
+				aconfig.SettingTLSClientAuthPaths: map[string]string{
+					"/api/devices": ClientAuthRequire,
+				},
+			},
+
+			out: &TLSPolicy{
+				MinVersion: tls.VersionTLS13,
+				MaxVersion: tls.VersionTLS13,
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+				},
+				CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP384},
+				SessionTickets:           true,
+				SessionTicketKeyRotation: 12 * time.Hour,
+				ClientAuth:               ClientAuthVerifyIfGiven,
+				ClientAuthPaths: map[string]string{
+					"/api/devices": ClientAuthRequire,
+				},
+			},
+		},
+		{
+			name: "error, version",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTLSMaxVersion: "1.4",
+			},
+
+			outErr: `tls_max_version: unknown TLS version "1.4"`,
+		},
+		{
+			name: "error, max lower than min",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTLSMaxVersion: "1.1",
+			},
+
+			outErr: "tls_max_version is lower than tls_min_version",
+		},
+		{
+			name: "error, insecure cipher suite",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+			},
+
+			outErr: "tls_cipher_suites: unknown or insecure cipher suite TLS_RSA_WITH_RC4_128_SHA",
+		},
+		{
+			name: "error, curve",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTLSCurvePreferences: []string{"P224"},
+			},
+
+			outErr: "tls_curve_preferences: unknown curve P224",
+		},
+		{
+			name: "error, client auth path mode",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTLSClientAuthPaths: map[string]string{
+					"/status": "none",
+				},
+			},
+
+			outErr: `tls_client_auth_paths: unknown client auth mode "none"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			p, err := NewTLSPolicy(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.out, p)
+			}
+		})
+	}
+}
+
+func TestTLSPolicyServer(t *testing.T) {
+	policy := defaultTLSPolicy(t)
+	policy.SessionTicketKeyRotation = time.Hour
+	policy.ClientAuthPaths["/status"] = ClientAuthVerifyIfGiven
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	s, err := NewServer(testVirtualHosts(h), "0", policy)
+	assert.NoError(t, err)
+	assert.Len(t, s.tickets.get(), 1)
+
+	srv := httptest.NewUnstartedServer(s.server.Handler)
+	srv.TLS = s.server.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	// TLS 1.1 is below the policy's minimum
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS11,
+			},
+		},
+	}
+	_, err = client.Get(srv.URL + "/status")
+	assert.Error(t, err)
+
+	// no client cert - only accepted where the policy says so
+	client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	res, err := client.Get(srv.URL + "/status")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = client.Get(srv.URL + "/api/devices/v1/inventory/device/attributes")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	// a failed reload keeps rotating the current hosts' keys
+	rotation := s.ticketStop
+	err = s.Reload(nil, policy)
+	assert.Error(t, err)
+	assert.True(t, rotation == s.ticketStop)
+	select {
+	case <-rotation:
+		t.Error("rotation stopped")
+	default:
+	}
+
+	// ticket keys survive a reload, and rotation keeps the previous ones
+	err = s.Reload(testVirtualHosts(h), policy)
+	assert.NoError(t, err)
+	assert.False(t, rotation == s.ticketStop)
+	_, running := <-rotation
+	assert.False(t, running)
+	keys := s.tickets.get()
+	assert.Len(t, keys, 1)
+
+	for i := 0; i < ticketKeysKept+1; i++ {
+		_, err = s.tickets.rotate()
+		assert.NoError(t, err)
+	}
+	rotated := s.tickets.get()
+	assert.Len(t, rotated, ticketKeysKept)
+	assert.NotEqual(t, keys[0], rotated[0])
+
+	close(s.ticketStop)
+}
+
+func TestVerifyClientCertGrace(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Tenant CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    now.Add(5 * time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca, &leafKey.PublicKey, caKey)
+	assert.NoError(t, err)
+
+	assert.Error(t, verifyClientCert([][]byte{leafDER}, roots, 0, now))
+	assert.Error(t, verifyClientCert([][]byte{leafDER}, roots, time.Minute, now))
+	assert.NoError(t, verifyClientCert([][]byte{leafDER}, roots, 10*time.Minute, now))
+
+	// the grace only covers clock skew, not a foreign CA
+	assert.Error(t, verifyClientCert([][]byte{leafDER}, x509.NewCertPool(), 10*time.Minute, now))
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+// tracing exporters
+const (
+	TracingOTLP   = "otlp"
+	TracingStdout = "stdout"
+)
+
+const (
+	// tracerName is the instrumentation name of the server's spans
+	tracerName = "github.com/mendersoftware/mtls-ambassador"
+)
+
+// NewTracerProvider parses and validates the tracing settings
+// and starts the exporter; nil means tracing is off
+func NewTracerProvider(c config.Reader) (*sdktrace.TracerProvider, error) {
+	ratio := c.GetFloat64(aconfig.SettingTracingSampleRatio)
+	if ratio < 0 || ratio > 1 {
+		return nil, errors.Errorf("%s must be between 0 and 1", aconfig.SettingTracingSampleRatio)
+	}
+
+	var exp sdktrace.SpanExporter
+	switch e := c.GetString(aconfig.SettingTracingExporter); e {
+	case "":
+		return nil, nil
+	case TracingStdout:
+		se, err := stdout.NewExporter(stdout.WithWriter(os.Stdout), stdout.WithoutMetricExport())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create the stdout exporter")
+		}
+		exp = se
+	case TracingOTLP:
+		opts, err := otlpOptions(c)
+		if err != nil {
+			return nil, err
+		}
+		oe, err := otlp.NewExporter(context.Background(), otlphttp.NewDriver(opts...))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create the OTLP exporter")
+		}
+		exp = oe
+	default:
+		return nil, errors.Errorf("%s: unknown exporter %q", aconfig.SettingTracingExporter, e)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.ServiceNameKey.String(c.GetString(aconfig.SettingTracingServiceName)))),
+	), nil
+}
+
+// otlpOptions sends the spans over OTLP/HTTP to the traces url
+func otlpOptions(c config.Reader) ([]otlphttp.Option, error) {
+	endpoint := c.GetString(aconfig.SettingTracingOTLPEndpoint)
+	if endpoint == "" {
+		return nil, errors.Errorf("%s must be set", aconfig.SettingTracingOTLPEndpoint)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("%s must be an http(s) url", aconfig.SettingTracingOTLPEndpoint)
+	}
+
+	opts := []otlphttp.Option{
+		otlphttp.WithEndpoint(u.Host),
+		otlphttp.WithHeaders(c.GetStringMapString(aconfig.SettingTracingOTLPHeaders)),
+	}
+	if u.Path != "" {
+		opts = append(opts, otlphttp.WithTracesURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlphttp.WithInsecure())
+	}
+	return opts, nil
+}
+
+// installTracing makes tp the provider of all spans, propagated
+// with W3C trace context; its errors, e.g. failed exports, are logged
+func installTracing(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(tracingErrors{})
+}
+
+type tracingErrors struct{}
+
+// Handle logs the SDK's errors, which may be nil
+func (tracingErrors) Handle(err error) {
+	if err == nil {
+		return
+	}
+	l.Warnf("tracing: %s", err)
+}
+
+// startSpan starts the request's server span, joining the caller's trace
+// if any; the first request of a connection also covers its TLS handshake,
+// which gets a child span of its own
+func (s *Server) startSpan(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, trace.Span) {
+	if s.tracer == nil {
+		return w, r, trace.SpanFromContext(r.Context())
+	}
+
+	start := time.Now()
+	hello, handshake := s.handshakes.Load(r.RemoteAddr)
+	if handshake {
+		s.handshakes.Delete(r.RemoteAddr)
+		start = hello.(time.Time)
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer.Start(ctx, "HTTP "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+			semconv.NetPeerIPKey.String(remoteIP(r))))
+	if !span.IsRecording() {
+		return w, r.WithContext(ctx), span
+	}
+
+	if r.TLS != nil {
+		span.SetAttributes(attribute.String("tls.server_name", r.TLS.ServerName))
+		if handshake {
+			_, hs := s.tracer.Start(ctx, "TLS handshake",
+				trace.WithTimestamp(start),
+				trace.WithAttributes(
+					attribute.String("tls.version", tlsVersionName(r.TLS.Version)),
+					attribute.String("tls.cipher", tls.CipherSuiteName(r.TLS.CipherSuite)),
+					attribute.Bool("tls.resumed", r.TLS.DidResume),
+					attribute.Int("tls.client_certs", len(r.TLS.PeerCertificates))))
+			hs.End()
+		}
+	}
+
+	return &traceWriter{ResponseWriter: w, span: span}, r.WithContext(ctx), span
+}
+
+// helloReceived notes the start of a connection's handshake, for its first request's span
+func (s *Server) helloReceived(conn net.Conn) {
+	if s.tracer != nil {
+		s.handshakes.Store(conn.RemoteAddr().String(), time.Now())
+	}
+}
+
+// traceWriter records the response status on the request's span
+type traceWriter struct {
+	http.ResponseWriter
+	span trace.Span
+
+	wroteHeader bool
+}
+
+func (w *traceWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.span.SetAttributes(semconv.HTTPStatusCodeKey.Int(code))
+		if code >= http.StatusInternalServerError {
+			w.span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", code))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *traceWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify is passed through for gin, whose writer asserts it unchecked
+func (w *traceWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *traceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func TestNewTracerProvider(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		outTracer bool
+		outErr    string
+	}{
+		{
+			name: "ok, defaults: off",
+		},
+		{
+			name: "ok, stdout",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter: TracingStdout,
+			},
+
+			outTracer: true,
+		},
+		{
+			name: "ok, otlp",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter:     TracingOTLP,
+				aconfig.SettingTracingOTLPHeaders:  map[string]string{"Authorization": "Bearer x"},
+				aconfig.SettingTracingSampleRatio:  0.1,
+				aconfig.SettingTracingOTLPEndpoint: "https://collector:4318/v1/traces",
+			},
+
+			outTracer: true,
+		},
+		{
+			name: "ok, otlp, default path",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter:     TracingOTLP,
+				aconfig.SettingTracingOTLPEndpoint: "http://collector:4318",
+			},
+
+			outTracer: true,
+		},
+		{
+			name: "error, exporter",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter: "jaeger",
+			},
+
+			outErr: `tracing_exporter: unknown exporter "jaeger"`,
+		},
+		{
+			name: "error, endpoint",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter:     TracingOTLP,
+				aconfig.SettingTracingOTLPEndpoint: "",
+			},
+
+			outErr: "tracing_otlp_endpoint must be set",
+		},
+		{
+			name: "error, endpoint url",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter:     TracingOTLP,
+				aconfig.SettingTracingOTLPEndpoint: "collector:4318",
+			},
+
+			outErr: "tracing_otlp_endpoint must be an http(s) url",
+		},
+		{
+			name: "error, sample ratio",
+
+			settings: map[string]interface{}{
+				aconfig.SettingTracingExporter:    TracingStdout,
+				aconfig.SettingTracingSampleRatio: 1.5,
+			},
+
+			outErr: "tracing_sample_ratio must be between 0 and 1",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			tp, err := NewTracerProvider(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.outTracer {
+				assert.NotNil(t, tp)
+				assert.NoError(t, tp.Shutdown(context.Background()))
+			} else {
+				assert.Nil(t, tp)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// Package upstream balances requests over several Mender backends,
+// avoiding those failing health checks or recent requests.
+package upstream
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// load balancing policies
+const (
+	PolicyRoundRobin     = "round_robin"
+	PolicyLeastRequests  = "least_requests"
+	PolicyConsistentHash = "consistent_hash"
+)
+
+var (
+	ErrNoUpstreams = errors.New("no upstreams")
+
+	upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtls_upstream_healthy",
+		Help: "Whether the upstream Mender backend is used (1) or avoided (0).",
+	}, []string{"upstream"})
+	upstreamEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtls_upstream_ejections_total",
+		Help: "Upstream Mender backends ejected after failed requests.",
+	}, []string{"upstream"})
+
+	l = log.NewEmpty()
+)
+
+// Config is the pool's balancing and health checking
+type Config struct {
+	// Policy picks among the available upstreams
+	Policy string
+
+	// HealthPath is the path probed with GET, healthy on a status below 500;
+	// empty probes with a TCP connection
+	HealthPath string
+	// HealthInterval is the time between probes of an upstream
+	// while the pool is in use; 0 disables them
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	// HealthClient sends the probes, e.g. with the upstreams' TLS settings
+	HealthClient *http.Client
+
+	// MaxFails ejects an upstream after this many failed requests in a row;
+	// 0 disables ejection
+	MaxFails  int
+	EjectTime time.Duration
+}
+
+// Endpoint is one upstream
+type Endpoint struct {
+	// inflight and the times are first, for 64-bit alignment of atomic ops
+	inflight int64
+	// ejectedUntil is the end (unix nanos) of the ejection, if any
+	ejectedUntil int64
+	// lastCheck is the time (unix nanos) of the last probe
+	lastCheck int64
+
+	URL *url.URL
+
+	healthy  int32
+	fails    int32
+	checking int32
+}
+
+// Pool is a set of equivalent upstreams
+type Pool struct {
+	next uint64
+
+	endpoints []*Endpoint
+	cfg       Config
+	pick      func(eps []*Endpoint, key string) *Endpoint
+}
+
+// NewPool creates a pool of the upstream urls; they may
+// differ only in scheme and host, requests keep their path
+func NewPool(urls []string, cfg Config) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	p := &Pool{cfg: cfg}
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upstream %q", s)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, errors.Errorf("upstream %q: need scheme and host", s)
+		}
+		if len(p.endpoints) > 0 && u.Path != p.endpoints[0].URL.Path {
+			return nil, errors.Errorf("upstream %q: path differs from %q", s, p.endpoints[0].URL)
+		}
+		p.endpoints = append(p.endpoints, &Endpoint{URL: u, healthy: 1})
+		upstreamHealthy.WithLabelValues(u.Host).Set(1)
+	}
+
+	switch cfg.Policy {
+	case PolicyRoundRobin, "":
+		p.pick = p.roundRobin
+	case PolicyLeastRequests:
+		p.pick = p.leastRequests
+	case PolicyConsistentHash:
+		p.pick = p.consistentHash
+	default:
+		return nil, errors.Errorf("unknown policy %q", cfg.Policy)
+	}
+
+	if p.cfg.HealthClient == nil {
+		p.cfg.HealthClient = &http.Client{}
+	}
+
+	return p, nil
+}
+
+// Endpoints returns the pool's upstreams
+func (p *Pool) Endpoints() []*Endpoint {
+	return p.endpoints
+}
+
+// Pick selects the upstream of a request; the key, e.g. the device's,
+// is used by the consistent hash policy. If no upstream is available,
+// all are considered - better to try one than to fail for sure.
+func (p *Pool) Pick(key string) *Endpoint {
+	now := time.Now()
+
+	available := make([]*Endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		p.maybeCheck(e, now)
+		if e.Available(now) {
+			available = append(available, e)
+		}
+	}
+	if len(available) == 0 {
+		l.Warn("no healthy upstream, trying all")
+		available = p.endpoints
+	}
+
+	return p.pick(available, key)
+}
+
+func (p *Pool) roundRobin(eps []*Endpoint, key string) *Endpoint {
+	return eps[atomic.AddUint64(&p.next, 1)%uint64(len(eps))]
+}
+
+// leastRequests picks the upstream with the fewest requests in flight,
+// the ties in turns
+func (p *Pool) leastRequests(eps []*Endpoint, key string) *Endpoint {
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(len(eps)))
+
+	var best *Endpoint
+	for i := range eps {
+		e := eps[(start+i)%len(eps)]
+		if best == nil || atomic.LoadInt64(&e.inflight) < atomic.LoadInt64(&best.inflight) {
+			best = e
+		}
+	}
+	return best
+}
+
+// consistentHash picks by rendezvous hashing, so that a key keeps its
+// upstream, and only the keys of an unavailable one move elsewhere
+func (p *Pool) consistentHash(eps []*Endpoint, key string) *Endpoint {
+	if key == "" {
+		return p.roundRobin(eps, key)
+	}
+
+	var (
+		best  *Endpoint
+		score uint64
+	)
+	for _, e := range eps {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(e.URL.Host))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		if s := mix(h.Sum64()); best == nil || s > score {
+			best, score = e, s
+		}
+	}
+	return best
+}
+
+// mix is murmur3's finalizer: FNV alone spreads keys
+// differing in their last bytes poorly over the high bits
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// Available tells if the upstream is healthy and not ejected
+func (e *Endpoint) Available(now time.Time) bool {
+	return atomic.LoadInt32(&e.healthy) == 1 &&
+		now.UnixNano() >= atomic.LoadInt64(&e.ejectedUntil)
+}
+
+// Inflight is the number of requests to the upstream in progress
+func (e *Endpoint) Inflight() int64 {
+	return atomic.LoadInt64(&e.inflight)
+}
+
+func (e *Endpoint) begin() {
+	atomic.AddInt64(&e.inflight, 1)
+}
+
+// end records a request's result; too many failures in a row eject the upstream
+func (p *Pool) end(e *Endpoint, ok bool) {
+	atomic.AddInt64(&e.inflight, -1)
+
+	if ok {
+		atomic.StoreInt32(&e.fails, 0)
+		return
+	}
+	if p.cfg.MaxFails <= 0 {
+		return
+	}
+	if atomic.AddInt32(&e.fails, 1) >= int32(p.cfg.MaxFails) {
+		atomic.StoreInt32(&e.fails, 0)
+		atomic.StoreInt64(&e.ejectedUntil, time.Now().Add(p.cfg.EjectTime).UnixNano())
+		upstreamEjections.WithLabelValues(e.URL.Host).Inc()
+		l.Warnf("ejecting upstream %s for %s after %d failed requests",
+			e.URL.Host, p.cfg.EjectTime, p.cfg.MaxFails)
+	}
+}
+
+// maybeCheck probes the upstream in the background, if due
+func (p *Pool) maybeCheck(e *Endpoint, now time.Time) {
+	if p.cfg.HealthInterval <= 0 {
+		return
+	}
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&e.lastCheck))) < p.cfg.HealthInterval {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&e.checking, 0, 1) {
+		return
+	}
+	atomic.StoreInt64(&e.lastCheck, now.UnixNano())
+
+	go func() {
+		defer atomic.StoreInt32(&e.checking, 0)
+		p.setHealth(e, p.Check(e))
+	}()
+}
+
+// Check probes the upstream once
+func (p *Pool) Check(e *Endpoint) error {
+	timeout := p.cfg.HealthTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	if p.cfg.HealthPath == "" {
+		host := e.URL.Host
+		if e.URL.Port() == "" {
+			port := "80"
+			if e.URL.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(e.URL.Hostname(), port)
+		}
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	u := *e.URL
+	u.Path = p.cfg.HealthPath
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := p.cfg.HealthClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("health check: HTTP %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) setHealth(e *Endpoint, err error) {
+	healthy := int32(1)
+	if err != nil {
+		healthy = 0
+	}
+	if atomic.SwapInt32(&e.healthy, healthy) == healthy {
+		return
+	}
+
+	if err != nil {
+		l.Warnf("upstream %s is unhealthy: %s", e.URL.Host, err)
+	} else {
+		l.Infof("upstream %s is healthy again", e.URL.Host)
+	}
+	upstreamHealthy.WithLabelValues(e.URL.Host).Set(float64(healthy))
+}
+
+type keyKey struct{}
+
+// WithKey returns the context with the balancing key of its requests,
+// e.g. the device's cert fingerprint
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyKey{}, key)
+}
+
+// KeyFromContext returns the context's balancing key, empty if none
+func KeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(keyKey{}).(string)
+	return key
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPool(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		urls   []string
+		policy string
+
+		outErr string
+	}{
+		{
+			name: "ok",
+
+			urls:   []string{"https://a.local", "http://b.local:8080"},
+			policy: PolicyLeastRequests,
+		},
+		{
+			name: "ok, same path",
+
+			urls: []string{"https://a.local/mender", "https://b.local/mender"},
+		},
+		{
+			name: "error, none",
+
+			outErr: "no upstreams",
+		},
+		{
+			name: "error, no host",
+
+			urls: []string{"https://a.local", "b.local"},
+
+			outErr: `upstream "b.local": need scheme and host`,
+		},
+		{
+			name: "error, paths differ",
+
+			urls: []string{"https://a.local/mender", "https://b.local"},
+
+			outErr: `upstream "https://b.local": path differs from "https://a.local/mender"`,
+		},
+		{
+			name: "error, policy",
+
+			urls:   []string{"https://a.local"},
+			policy: "random",
+
+			outErr: `unknown policy "random"`,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := NewPool(tc.urls, Config{Policy: tc.policy})
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, p.Endpoints(), len(tc.urls))
+		})
+	}
+}
+
+func TestPoolPick(t *testing.T) {
+	t.Parallel()
+
+	urls := []string{"http://a.local", "http://b.local", "http://c.local"}
+
+	t.Run("round robin", func(t *testing.T) {
+		t.Parallel()
+
+		p, err := NewPool(urls, Config{Policy: PolicyRoundRobin})
+		assert.NoError(t, err)
+
+		picked := map[string]int{}
+		for i := 0; i < 30; i++ {
+			picked[p.Pick("same device").URL.Host]++
+		}
+		assert.Equal(t, map[string]int{"a.local": 10, "b.local": 10, "c.local": 10}, picked)
+	})
+
+	t.Run("least requests", func(t *testing.T) {
+		t.Parallel()
+
+		p, err := NewPool(urls, Config{Policy: PolicyLeastRequests})
+		assert.NoError(t, err)
+
+		eps := p.Endpoints()
+		eps[0].begin()
+		eps[0].begin()
+		eps[2].begin()
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, "b.local", p.Pick("").URL.Host)
+		}
+
+		// ties are shared
+		eps[1].begin()
+		picked := map[string]int{}
+		for i := 0; i < 9; i++ {
+			picked[p.Pick("").URL.Host]++
+		}
+		assert.Equal(t, 0, picked["a.local"])
+		assert.True(t, picked["b.local"] > 0 && picked["c.local"] > 0)
+	})
+
+	t.Run("consistent hash", func(t *testing.T) {
+		t.Parallel()
+
+		p, err := NewPool(urls, Config{Policy: PolicyConsistentHash, MaxFails: 1, EjectTime: time.Hour})
+		assert.NoError(t, err)
+
+		keys := map[string]string{}
+		spread := map[string]int{}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("device-%d", i)
+			keys[key] = p.Pick(key).URL.Host
+			assert.Equal(t, keys[key], p.Pick(key).URL.Host)
+			spread[keys[key]]++
+		}
+		for _, h := range urls {
+			assert.True(t, spread[h[len("http://"):]] > 50)
+		}
+
+		// ejecting an upstream moves only its own keys
+		b := p.Endpoints()[1]
+		b.begin()
+		p.end(b, false)
+		for key, host := range keys {
+			if host == "b.local" {
+				assert.NotEqual(t, "b.local", p.Pick(key).URL.Host)
+			} else {
+				assert.Equal(t, host, p.Pick(key).URL.Host)
+			}
+		}
+	})
+}
+
+func TestPoolEjection(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewPool([]string{"http://a.local", "http://b.local"}, Config{
+		MaxFails:  3,
+		EjectTime: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	a := p.Endpoints()[0]
+
+	fail := func(ok bool) {
+		a.begin()
+		p.end(a, ok)
+	}
+
+	// failures must be in a row
+	fail(false)
+	fail(false)
+	fail(true)
+	fail(false)
+	fail(false)
+	assert.True(t, a.Available(time.Now()))
+	assert.Equal(t, int64(0), a.Inflight())
+
+	fail(false)
+	assert.False(t, a.Available(time.Now()))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "b.local", p.Pick("").URL.Host)
+	}
+
+	// back after the ejection
+	assert.True(t, a.Available(time.Now().Add(100*time.Millisecond)))
+
+	// with all unavailable, all are tried
+	b := p.Endpoints()[1]
+	for i := 0; i < 3; i++ {
+		b.begin()
+		p.end(b, false)
+	}
+	picked := map[string]int{}
+	for i := 0; i < 10; i++ {
+		picked[p.Pick("").URL.Host]++
+	}
+	assert.Equal(t, map[string]int{"a.local": 5, "b.local": 5}, picked)
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	var status int32 = http.StatusOK
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer healthy.Close()
+
+	// a port nobody listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	t.Run("http", func(t *testing.T) {
+		p, err := NewPool([]string{healthy.URL, down}, Config{
+			HealthPath:     "/health",
+			HealthInterval: 20 * time.Millisecond,
+			HealthTimeout:  time.Second,
+		})
+		assert.NoError(t, err)
+		eps := p.Endpoints()
+
+		assert.NoError(t, p.Check(eps[0]))
+		assert.Error(t, p.Check(eps[1]))
+
+		// picks probe in the background
+		assert.Eventually(t, func() bool {
+			p.Pick("")
+			return eps[0].Available(time.Now()) && !eps[1].Available(time.Now())
+		}, time.Second, 10*time.Millisecond)
+
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+		assert.Eventually(t, func() bool {
+			p.Pick("")
+			return !eps[0].Available(time.Now())
+		}, time.Second, 10*time.Millisecond)
+
+		// 4xx is a live server
+		atomic.StoreInt32(&status, http.StatusNotFound)
+		assert.Eventually(t, func() bool {
+			p.Pick("")
+			return eps[0].Available(time.Now())
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		p, err := NewPool([]string{healthy.URL, down}, Config{HealthTimeout: time.Second})
+		assert.NoError(t, err)
+		eps := p.Endpoints()
+
+		assert.NoError(t, p.Check(eps[0]))
+		assert.Error(t, p.Check(eps[1]))
+
+		// no interval, no probes
+		p.Pick("")
+		time.Sleep(50 * time.Millisecond)
+		assert.True(t, eps[1].Available(time.Now()))
+	})
+}
+
+func TestKeyContext(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	assert.Equal(t, "", KeyFromContext(ctx))
+	assert.Equal(t, "device", KeyFromContext(WithKey(ctx, "device")))
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Transport sends each request to an upstream picked from the pool,
+// by the balancing key of its context
+type Transport struct {
+	Pool *Pool
+	Base http.RoundTripper
+}
+
+// NewTransport wraps the base transport; nil means http.DefaultTransport
+func NewTransport(pool *Pool, base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{Pool: pool, Base: base}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := t.Pool.Pick(KeyFromContext(req.Context()))
+
+	// the request must not be modified, only a copy
+	out := req.Clone(req.Context())
+	out.URL.Scheme = e.URL.Scheme
+	out.URL.Host = e.URL.Host
+
+	e.begin()
+	rsp, err := t.Base.RoundTrip(out)
+	if err != nil {
+		t.Pool.end(e, false)
+		return nil, err
+	}
+
+	ok := true
+	switch rsp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		ok = false
+	}
+
+	// the body of an upgrade is the tunnel's connection, which
+	// the reverse proxy needs as is; the request is done here
+	if rsp.StatusCode == http.StatusSwitchingProtocols {
+		t.Pool.end(e, ok)
+		return rsp, nil
+	}
+
+	rsp.Body = &body{ReadCloser: rsp.Body, done: func() { t.Pool.end(e, ok) }}
+	return rsp, nil
+}
+
+// CloseIdleConnections is passed through, e.g. for http.Client's
+func (t *Transport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if ci, ok := t.Base.(closeIdler); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// body ends the request, as in flight, when closed
+type body struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
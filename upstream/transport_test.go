@@ -0,0 +1,102 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package upstream
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	newBackend := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(r.URL.Path))
+		}))
+	}
+	ok := newBackend("ok", http.StatusOK)
+	defer ok.Close()
+	unavailable := newBackend("unavailable", http.StatusServiceUnavailable)
+	defer unavailable.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := "http://" + ln.Addr().String()
+	ln.Close()
+
+	do := func(c *http.Client, url string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		assert.NoError(t, err)
+		return c.Do(req.WithContext(WithKey(req.Context(), "device")))
+	}
+
+	t.Run("ok, balanced and path kept", func(t *testing.T) {
+		p, err := NewPool([]string{ok.URL, unavailable.URL}, Config{})
+		assert.NoError(t, err)
+		c := &http.Client{Transport: NewTransport(p, nil)}
+
+		picked := map[string]int{}
+		for i := 0; i < 4; i++ {
+			rsp, err := do(c, "http://mender.invalid/api/devices/v1/inventory")
+			assert.NoError(t, err)
+			body, _ := ioutil.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			assert.Equal(t, "/api/devices/v1/inventory", string(body))
+			picked[rsp.Header.Get("X-Backend")]++
+		}
+		assert.Equal(t, map[string]int{"ok": 2, "unavailable": 2}, picked)
+	})
+
+	t.Run("ok, in flight until the body is closed", func(t *testing.T) {
+		p, err := NewPool([]string{ok.URL}, Config{})
+		assert.NoError(t, err)
+		c := &http.Client{Transport: NewTransport(p, nil)}
+		e := p.Endpoints()[0]
+
+		rsp, err := do(c, "http://mender.invalid/")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), e.Inflight())
+		rsp.Body.Close()
+		rsp.Body.Close()
+		assert.Equal(t, int64(0), e.Inflight())
+	})
+
+	t.Run("ok, failing upstreams ejected", func(t *testing.T) {
+		p, err := NewPool([]string{ok.URL, unavailable.URL, down}, Config{
+			MaxFails:  2,
+			EjectTime: time.Hour,
+		})
+		assert.NoError(t, err)
+		c := &http.Client{Transport: NewTransport(p, nil)}
+
+		for i := 0; i < 6; i++ {
+			rsp, err := do(c, "http://mender.invalid/")
+			if err == nil {
+				rsp.Body.Close()
+			}
+		}
+
+		eps := p.Endpoints()
+		assert.True(t, eps[0].Available(time.Now()))
+		assert.False(t, eps[1].Available(time.Now()))
+		assert.False(t, eps[2].Available(time.Now()))
+
+		for i := 0; i < 5; i++ {
+			rsp, err := do(c, "http://mender.invalid/")
+			assert.NoError(t, err)
+			rsp.Body.Close()
+			assert.Equal(t, "ok", rsp.Header.Get("X-Backend"))
+		}
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
+)
+
+// menderBackends splits the comma separated mender_backend urls
+func menderBackends(c config.Reader) []string {
+	var urls []string
+	for _, u := range strings.Split(c.GetString(aconfig.SettingMenderBackend), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// NewUpstreamPool creates the pool balancing over several Mender backends,
+// nil if there's only one - which then gets all requests, as always
+func NewUpstreamPool(c config.Reader) (*upstream.Pool, error) {
+	urls := menderBackends(c)
+	if len(urls) < 2 {
+		return nil, nil
+	}
+
+	cfg := upstream.Config{
+		Policy:         c.GetString(aconfig.SettingMenderBackendPolicy),
+		HealthPath:     c.GetString(aconfig.SettingMenderBackendHealthPath),
+		HealthInterval: c.GetDuration(aconfig.SettingMenderBackendHealthInterval),
+		HealthTimeout:  c.GetDuration(aconfig.SettingMenderBackendHealthTimeout),
+		HealthClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: c.GetBool(aconfig.SettingInsecureSkipVerify),
+				},
+			},
+		},
+		MaxFails:  c.GetInt(aconfig.SettingMenderBackendMaxFails),
+		EjectTime: c.GetDuration(aconfig.SettingMenderBackendEjectTime),
+	}
+	if cfg.MaxFails < 0 {
+		return nil, errors.Errorf("%s must not be negative", aconfig.SettingMenderBackendMaxFails)
+	}
+	if cfg.HealthPath != "" && !strings.HasPrefix(cfg.HealthPath, "/") {
+		return nil, errors.Errorf("%s must start with /", aconfig.SettingMenderBackendHealthPath)
+	}
+
+	pool, err := upstream.NewPool(urls, cfg)
+	return pool, errors.Wrap(err, aconfig.SettingMenderBackend)
+}
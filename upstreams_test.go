@@ -0,0 +1,116 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+	"github.com/mendersoftware/mtls-ambassador/upstream"
+)
+
+func TestNewUpstreamPool(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		settings map[string]interface{}
+
+		outUpstreams []string
+		outErr       string
+	}{
+		{
+			name: "ok, single backend: no pool",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMenderBackend: "https://mender.local",
+			},
+		},
+		{
+			name: "ok, several",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMenderBackend:       "https://mender-1.local, https://mender-2.local:8443,",
+				aconfig.SettingMenderBackendPolicy: upstream.PolicyConsistentHash,
+			},
+
+			outUpstreams: []string{"mender-1.local", "mender-2.local:8443"},
+		},
+		{
+			name: "error, policy",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMenderBackend:       "https://mender-1.local,https://mender-2.local",
+				aconfig.SettingMenderBackendPolicy: "random",
+			},
+
+			outErr: `mender_backend: unknown policy "random"`,
+		},
+		{
+			name: "error, paths differ",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMenderBackend: "https://mender-1.local,https://mender-2.local/mender",
+			},
+
+			outErr: `mender_backend: upstream "https://mender-2.local/mender": path differs from "https://mender-1.local"`,
+		},
+		{
+			name: "error, max fails",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMenderBackend:         "https://mender-1.local,https://mender-2.local",
+				aconfig.SettingMenderBackendMaxFails: -1,
+			},
+
+			outErr: "mender_backend_max_fails must not be negative",
+		},
+		{
+			name: "error, health path",
+
+			settings: map[string]interface{}{
+				aconfig.SettingMenderBackend:           "https://mender-1.local,https://mender-2.local",
+				aconfig.SettingMenderBackendHealthPath: "health",
+			},
+
+			outErr: "mender_backend_health_path must start with /",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			for k, v := range tc.settings {
+				c.Set(k, v)
+			}
+
+			pool, err := NewUpstreamPool(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.outUpstreams == nil {
+				assert.Nil(t, pool)
+				return
+			}
+
+			var hosts []string
+			for _, e := range pool.Endpoints() {
+				hosts = append(hosts, e.URL.Host)
+			}
+			assert.Equal(t, tc.outUpstreams, hosts)
+		})
+	}
+}
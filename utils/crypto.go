@@ -12,9 +12,16 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"math/big"
+)
+
+var (
+	ErrUnsupportedKey   = errors.New("unsupported public key type")
+	ErrInvalidSignature = errors.New("invalid signature")
 )
 
 func SerializePubKey(key interface{}) (string, error) {
@@ -55,12 +62,29 @@ func VerifyAuthReqSign(signature string, pubkey interface{}, content []byte) err
 		return err
 	}
 
-	key := pubkey.(*rsa.PublicKey)
-
-	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash.Sum(nil), decodedSig)
-	if err != nil {
-		return err
+	switch key := pubkey.(type) {
+	case *rsa.PublicKey:
+		if key == nil {
+			return ErrUnsupportedKey
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash.Sum(nil), decodedSig)
+	case *ecdsa.PublicKey:
+		if key == nil {
+			return ErrUnsupportedKey
+		}
+		// ASN.1 encoded, like the Mender client's ECDSA signatures
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(decodedSig, &sig)
+		if err != nil || len(rest) > 0 {
+			return ErrInvalidSignature
+		}
+		if !ecdsa.Verify(key, hash.Sum(nil), sig.R, sig.S) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return ErrUnsupportedKey
 	}
-
-	return nil
 }
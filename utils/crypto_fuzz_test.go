@@ -0,0 +1,32 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+// +build go1.18
+
+package utils
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+// FuzzVerifyAuthReqSign feeds attacker controlled auth request keys,
+// signature headers and bodies to the verification; the seed corpus
+// in testdata/fuzz holds Mender client requests
+func FuzzVerifyAuthReqSign(f *testing.F) {
+	f.Add("", "", []byte(nil))
+	f.Add("-----BEGIN PUBLIC KEY-----\n-----END PUBLIC KEY-----\n", "AAAA", []byte("{}"))
+
+	f.Fuzz(func(t *testing.T, pubKeyPEM string, signature string, body []byte) {
+		var key interface{}
+		if block, _ := pem.Decode([]byte(pubKeyPEM)); block != nil {
+			key, _ = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+
+		if err := VerifyAuthReqSign(signature, key, body); err == nil && key == nil {
+			t.Fatal("verified a signature without a key")
+		}
+	})
+}
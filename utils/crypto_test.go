@@ -0,0 +1,127 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyAuthReqSign(t *testing.T) {
+	t.Parallel()
+
+	body := []byte(`{"id_data":"{\"mac\":\"02:00:00:00:00:01\"}","tenant_token":"","pubkey":""}`)
+	sum := sha256.Sum256(body)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	rsaSig, err := rsaKey.Sign(rand.Reader, sum[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecSig, err := ecKey.Sign(rand.Reader, sum[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+		key  interface{}
+		sig  string
+		body []byte
+		err  error
+	}{
+		{
+			name: "ok, rsa",
+			key:  &rsaKey.PublicKey,
+			sig:  base64.StdEncoding.EncodeToString(rsaSig),
+			body: body,
+		},
+		{
+			name: "ok, ecdsa",
+			key:  &ecKey.PublicKey,
+			sig:  base64.StdEncoding.EncodeToString(ecSig),
+			body: body,
+		},
+		{
+			name: "error, rsa, other body",
+			key:  &rsaKey.PublicKey,
+			sig:  base64.StdEncoding.EncodeToString(rsaSig),
+			body: []byte("{}"),
+			err:  rsa.ErrVerification,
+		},
+		{
+			name: "error, ecdsa, other body",
+			key:  &ecKey.PublicKey,
+			sig:  base64.StdEncoding.EncodeToString(ecSig),
+			body: []byte("{}"),
+			err:  ErrInvalidSignature,
+		},
+		{
+			name: "error, ecdsa, garbage signature",
+			key:  &ecKey.PublicKey,
+			sig:  base64.StdEncoding.EncodeToString([]byte("garbage")),
+			body: body,
+			err:  ErrInvalidSignature,
+		},
+		{
+			name: "error, ecdsa, trailing data",
+			key:  &ecKey.PublicKey,
+			sig:  base64.StdEncoding.EncodeToString(append(ecSig, 0)),
+			body: body,
+			err:  ErrInvalidSignature,
+		},
+		{
+			name: "error, unsupported key",
+			key:  edKey,
+			sig:  base64.StdEncoding.EncodeToString(rsaSig),
+			body: body,
+			err:  ErrUnsupportedKey,
+		},
+		{
+			name: "error, nil ecdsa key",
+			key:  (*ecdsa.PublicKey)(nil),
+			sig:  base64.StdEncoding.EncodeToString(ecSig),
+			body: body,
+			err:  ErrUnsupportedKey,
+		},
+		{
+			name: "error, nil rsa key",
+			key:  (*rsa.PublicKey)(nil),
+			sig:  base64.StdEncoding.EncodeToString(rsaSig),
+			body: body,
+			err:  ErrUnsupportedKey,
+		},
+		{
+			name: "error, no key",
+			sig:  base64.StdEncoding.EncodeToString(rsaSig),
+			body: body,
+			err:  ErrUnsupportedKey,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := VerifyAuthReqSign(tc.sig, tc.key, tc.body)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+
+	assert.Error(t, VerifyAuthReqSign("not base64!", &rsaKey.PublicKey, body))
+}
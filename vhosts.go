@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+var (
+	// hostSettings are the settings a vhosts entry can override
+	hostSettings = map[string]bool{
+		aconfig.SettingMenderBackend:       true,
+		aconfig.SettingMenderBackendPolicy: true,
+		aconfig.SettingMenderUser:          true,
+		aconfig.SettingMenderPass:          true,
+		aconfig.SettingServerCert:          true,
+		aconfig.SettingServerKey:           true,
+		aconfig.SettingTenantCAPem:         true,
+
+		aconfig.SettingAuthReplayProtection: true,
+		aconfig.SettingAuthReplayWindow:     true,
+
+		aconfig.SettingCertHeaderFingerprint: true,
+		aconfig.SettingCertHeaderSubject:     true,
+		aconfig.SettingCertHeaderIssuer:      true,
+		aconfig.SettingCertHeaderSerial:      true,
+		aconfig.SettingCertHeaderSANURIs:     true,
+		aconfig.SettingCertHeaderXFCC:        true,
+	}
+)
+
+// hostConfig overlays a virtual host's settings on top of the top level config
+type hostConfig struct {
+	config.Reader
+	hostname string
+	settings map[string]string
+}
+
+func (c *hostConfig) GetString(key string) string {
+	if v, ok := c.settings[key]; ok {
+		return v
+	}
+	return c.Reader.GetString(key)
+}
+
+func (c *hostConfig) IsSet(key string) bool {
+	if _, ok := c.settings[key]; ok {
+		return true
+	}
+	return c.Reader.IsSet(key)
+}
+
+// hostConfigs returns the config of every virtual host;
+// without vhosts, it's just the top level config, matching any hostname
+func hostConfigs(c config.Reader) ([]*hostConfig, error) {
+	entries, err := cast.ToSliceE(c.Get(aconfig.SettingVirtualHosts))
+	if err != nil {
+		return nil, errors.Wrap(err, aconfig.SettingVirtualHosts)
+	}
+
+	if len(entries) == 0 {
+		return []*hostConfig{{Reader: c}}, nil
+	}
+
+	hosts := make([]*hostConfig, 0, len(entries))
+	for i, e := range entries {
+		settings, err := cast.ToStringMapStringE(e)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s[%d]", aconfig.SettingVirtualHosts, i)
+		}
+
+		hc := &hostConfig{
+			Reader:   c,
+			hostname: settings[aconfig.VirtualHostName],
+			settings: map[string]string{},
+		}
+		if hc.hostname == "" {
+			return nil, errors.Errorf("%s[%d]: need setting %s",
+				aconfig.SettingVirtualHosts, i, aconfig.VirtualHostName)
+		}
+
+		for k, v := range settings {
+			if k == aconfig.VirtualHostName {
+				continue
+			}
+			if !hostSettings[k] {
+				return nil, errors.Errorf("%s[%d]: unsupported setting %s",
+					aconfig.SettingVirtualHosts, i, k)
+			}
+			hc.settings[k] = v
+		}
+
+		hosts = append(hosts, hc)
+	}
+
+	return hosts, nil
+}
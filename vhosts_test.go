@@ -0,0 +1,160 @@
+// Copyright 2020 Northern.tech AS
+//
+//    All Rights Reserved
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mendersoftware/go-lib-micro/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	aconfig "github.com/mendersoftware/mtls-ambassador/config"
+)
+
+func TestHostConfigs(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+
+		vhosts interface{}
+
+		outHosts    []string
+		outBackends []string
+		outErr      string
+	}{
+		{
+			name: "ok, no vhosts",
+
+			outHosts:    []string{""},
+			outBackends: []string{"https://default.mender.io"},
+		},
+		{
+			name: "ok, vhosts",
+
+			vhosts: []interface{}{
+				map[interface{}]interface{}{
+					"hostname":       "eu.devices.example.com",
+					"mender_backend": "https://eu.mender.io",
+				},
+				map[string]interface{}{
+					"hostname": "us.devices.example.com",
+				},
+			},
+
+			outHosts:    []string{"eu.devices.example.com", "us.devices.example.com"},
+			outBackends: []string{"https://eu.mender.io", "https://default.mender.io"},
+		},
+		{
+			name: "error, no hostname",
+
+			vhosts: []interface{}{
+				map[string]interface{}{
+					"mender_backend": "https://eu.mender.io",
+				},
+			},
+
+			outErr: "vhosts[0]: need setting hostname",
+		},
+		{
+			name: "error, unsupported setting",
+
+			vhosts: []interface{}{
+				map[string]interface{}{
+					"hostname":  "eu.devices.example.com",
+					"debug_log": "true",
+				},
+			},
+
+			outErr: "vhosts[0]: unsupported setting debug_log",
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			c := viper.New()
+			config.SetDefaults(c, aconfig.Defaults)
+			c.Set(aconfig.SettingMenderBackend, "https://default.mender.io")
+			if tc.vhosts != nil {
+				c.Set(aconfig.SettingVirtualHosts, tc.vhosts)
+			}
+
+			hosts, err := hostConfigs(c)
+			if tc.outErr != "" {
+				assert.EqualError(t, err, tc.outErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, hosts, len(tc.outHosts))
+			for i, hc := range hosts {
+				assert.Equal(t, tc.outHosts[i], hc.hostname)
+				assert.Equal(t, tc.outBackends[i], hc.GetString(aconfig.SettingMenderBackend))
+			}
+		})
+	}
+}
+
+func TestServerVirtualHosts(t *testing.T) {
+	policy := defaultTLSPolicy(t)
+	policy.ClientAuth = ClientAuthVerifyIfGiven
+
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+	}
+
+	vhosts := append(testVirtualHosts(handler("eu")), testVirtualHosts(handler("us"))...)
+	vhosts[0].Hostname = "eu.devices.example.com"
+	vhosts[1].Hostname = "US.devices.example.com"
+
+	s, err := NewServer(vhosts, "0", policy)
+	assert.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(s.server.Handler)
+	srv.TLS = s.server.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(serverName string) (string, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					ServerName:         serverName,
+				},
+			},
+		}
+		res, err := client.Get(srv.URL + "/status")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	body, err := get("eu.devices.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "eu", body)
+
+	body, err = get("us.devices.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "us", body)
+
+	_, err = get("unknown.example.com")
+	assert.Error(t, err)
+
+	// duplicates are refused
+	vhosts[1].Hostname = vhosts[0].Hostname
+	assert.Error(t, s.Reload(vhosts, policy))
+}